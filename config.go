@@ -26,6 +26,7 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -40,6 +41,11 @@ const (
 	ResponseTimeout = 500
 	// DefaultChannelSize sets a default for how large each go channel should be
 	DefaultChannelSize = 10000
+	// DefaultHighWatermark defines how full (as a fraction) a pipeline's queues get before we pause consuming from Kafka
+	DefaultHighWatermark = 0.8
+	// DefaultLowWatermark defines how empty (as a fraction) a pipeline's queues must get before we resume consuming from Kafka
+	// (or less, see defaultLowWatermark)
+	DefaultLowWatermark = 0.5
 	// DefaultOffset defines the basic kafka offset behavior for new consumer groups
 	DefaultOffset = "earliest"
 	// DefaultSendBatch defines the length of our metric array we should send to outputs
@@ -50,6 +56,30 @@ const (
 	DefaultStatsAddress = "127.0.0.1"
 	// DefaultStatsPort defines the listener port for our prometheus stats
 	DefaultStatsPort = "9999"
+	// DefaultShutdownTimeout defines how long (in seconds) we wait on outputs while shutting down
+	DefaultShutdownTimeout = 30
+	// DefaultMaxDecompressedBytes defines how large a single message can get once we decompress it
+	DefaultMaxDecompressedBytes = 64 * 1024 * 1024
+	// DefaultSpoolMaxMB defines how large (in MB) an on-disk spool can grow before we evict the oldest data
+	DefaultSpoolMaxMB = 1024
+	// DefaultSpoolRetryInterval defines how frequently (in seconds) we try to replay a spool
+	DefaultSpoolRetryInterval = 10
+	// DefaultMaxRetries defines how many times we retry a failed write
+	DefaultMaxRetries = 5
+	// DefaultRetryInitialInterval defines how long (in seconds) we wait before the first retry of a failed write
+	DefaultRetryInitialInterval = 0.5
+	// DefaultRetryMaxInterval defines the longest (in seconds) we'll wait between retries of a failed write
+	DefaultRetryMaxInterval = 30
+	// DefaultRetryMaxElapsed defines how long (in seconds) we'll keep retrying a failed write
+	DefaultRetryMaxElapsed = 60
+	// DefaultRetryMultiplier defines how much longer we wait before each retry
+	DefaultRetryMultiplier = 2
+	// DefaultRetryJitter defines how much (as a fraction of the wait) we randomize waits between retries
+	DefaultRetryJitter = 0.2
+	// DefaultBreakerThreshold defines how many consecutive failed writes open a circuit breaker
+	DefaultBreakerThreshold = 5
+	// DefaultBreakerCooldown defines how long (in seconds) a circuit breaker stays open before probing the output
+	DefaultBreakerCooldown = 30
 	// DefaultTSDFlushSegment defines how frequently we should force writes to outputs in seconds
 	DefaultTSDFlushSegment = 5
 	// TimeSegmentDivisor defines how we should segment time-based decisions (currently in seconds (nanosecond * microsecond * millisecond * second))
@@ -77,36 +107,260 @@ type InfluxMetric struct {
 	Tags      map[string]string      `json:"tags"`
 	Name      string                 `json:"name"`
 	Timestamp int64                  `json:"timestamp"`
+	Source    *MessageSource         `json:"-"`
+}
+
+/*
+SchemaMapping describes how a schema registry record becomes a metric.
+Paths are dotted (e.g. "host.name") to reach into nested records and maps.
+*/
+type SchemaMapping struct {
+	Measurement      string   `yaml:"measurement"`
+	MeasurementField string   `yaml:"measurement_field"`
+	TagFields        []string `yaml:"tag_fields"`
+	ValueFields      []string `yaml:"value_fields"`
+	TimestampField   string   `yaml:"timestamp_field"`
+	TimestampUnit    string   `yaml:"timestamp_unit"`
+}
+
+/*
+OutputConfig holds everything about a single output (where it is, and how we batch, retry and dead-letter writes to it).
+A write path's own output settings are the defaults for each of its outputs.
+*/
+type OutputConfig struct {
+	Name        string `yaml:"name"`
+	TSDEndpoint string `yaml:"output_endpoint"`
+	TSDURLPath  string `yaml:"output_path"`
+	TSDPort     string `yaml:"output_port"`
+	TSDDBName   string `yaml:"tsd_database_name"`
+	TSDDBOrg    string `yaml:"tsd_database_org"`
+	OutputType  string `yaml:"output_type"`
+	// dead letters for this output (defaults to the global failed_writes_topic)
+	FailedWritesTopic string `yaml:"failed_writes_topic"`
+
+	// output tuning
+	WriteThreads    int     `yaml:"write_threads"`
+	SendBatch       uint    `yaml:"send_batch"`
+	WriteTimeout    uint    `yaml:"write_timeout"`
+	TSDFlushSegment float64 `yaml:"tsd_flush_time"`
+	// unset (nil) is not the same as 0, which turns retries off
+	MaxRetries *uint `yaml:"max_retries"`
+
+	// retries and circuit breaking
+	RetryInitialInterval float64 `yaml:"retry_initial_interval"`
+	RetryMaxInterval     float64 `yaml:"retry_max_interval"`
+	RetryMaxElapsed      float64 `yaml:"retry_max_elapsed_time"`
+	RetryMultiplier      float64 `yaml:"retry_multiplier"`
+	RetryJitter          float64 `yaml:"retry_jitter"`
+	BreakerThreshold     int     `yaml:"circuit_breaker_threshold"`
+	BreakerCooldown      float64 `yaml:"circuit_breaker_cooldown"`
+
+	// on-disk spool for failed writes
+	SpoolDir           string  `yaml:"spool_directory"`
+	SpoolMaxMB         int64   `yaml:"spool_max_mb"`
+	SpoolRetryInterval float64 `yaml:"spool_retry_interval"`
+
+	// kafka outputs (brokers default to the global brokers)
+	KafkaTopic           string   `yaml:"kafka_topic"`
+	KafkaFormat          string   `yaml:"kafka_format"`
+	KafkaPartitionBy     string   `yaml:"kafka_partition_by"`
+	KafkaIdempotent      bool     `yaml:"kafka_idempotent"`
+	KafkaCompressionType string   `yaml:"kafka_compression_type"`
+	KafkaBrokers         []string `yaml:"kafka_brokers"`
+}
+
+// URL : the full URL of an output (kafka outputs are just their topic)
+func (o OutputConfig) URL() string {
+	if o.OutputType == OutputTypeKafka {
+		return fmt.Sprintf("kafka://%v", o.KafkaTopic)
+	}
+	if o.TSDPort != "" {
+		return fmt.Sprintf("%v:%v%v", o.TSDEndpoint, o.TSDPort, o.TSDURLPath)
+	}
+	return fmt.Sprintf("%v%v", o.TSDEndpoint, o.TSDURLPath)
+}
+
+/*
+inherit fills in any settings an output doesn't set from defaults
+(the write path's own output settings).
+spool_directory isn't inherited, outputs can't share a spool (see spoolDir)
+*/
+func (o *OutputConfig) inherit(defaults OutputConfig) {
+	if o.TSDEndpoint == "" {
+		o.TSDEndpoint = defaults.TSDEndpoint
+		// an output on a different host shouldn't pick up our port
+		if o.TSDPort == "" {
+			o.TSDPort = defaults.TSDPort
+		}
+	}
+	if o.TSDURLPath == "" {
+		o.TSDURLPath = defaults.TSDURLPath
+	}
+	if o.TSDDBName == "" {
+		o.TSDDBName = defaults.TSDDBName
+	}
+	if o.TSDDBOrg == "" {
+		o.TSDDBOrg = defaults.TSDDBOrg
+	}
+	if o.OutputType == "" {
+		o.OutputType = defaults.OutputType
+	}
+	if o.FailedWritesTopic == "" {
+		o.FailedWritesTopic = defaults.FailedWritesTopic
+	}
+	if o.WriteThreads == 0 {
+		o.WriteThreads = defaults.WriteThreads
+	}
+	if o.SendBatch == 0 {
+		o.SendBatch = defaults.SendBatch
+	}
+	if o.WriteTimeout == 0 {
+		o.WriteTimeout = defaults.WriteTimeout
+	}
+	if o.TSDFlushSegment == 0 {
+		o.TSDFlushSegment = defaults.TSDFlushSegment
+	}
+	if o.MaxRetries == nil {
+		o.MaxRetries = defaults.MaxRetries
+	}
+	if o.RetryInitialInterval == 0 {
+		o.RetryInitialInterval = defaults.RetryInitialInterval
+	}
+	if o.RetryMaxInterval == 0 {
+		o.RetryMaxInterval = defaults.RetryMaxInterval
+	}
+	if o.RetryMaxElapsed == 0 {
+		o.RetryMaxElapsed = defaults.RetryMaxElapsed
+	}
+	if o.RetryMultiplier == 0 {
+		o.RetryMultiplier = defaults.RetryMultiplier
+	}
+	if o.RetryJitter == 0 {
+		o.RetryJitter = defaults.RetryJitter
+	}
+	if o.BreakerThreshold == 0 {
+		o.BreakerThreshold = defaults.BreakerThreshold
+	}
+	if o.BreakerCooldown == 0 {
+		o.BreakerCooldown = defaults.BreakerCooldown
+	}
+	if o.SpoolMaxMB == 0 {
+		o.SpoolMaxMB = defaults.SpoolMaxMB
+	}
+	if o.SpoolRetryInterval == 0 {
+		o.SpoolRetryInterval = defaults.SpoolRetryInterval
+	}
+	if o.KafkaTopic == "" {
+		o.KafkaTopic = defaults.KafkaTopic
+	}
+	if o.KafkaFormat == "" {
+		o.KafkaFormat = defaults.KafkaFormat
+	}
+	if o.KafkaPartitionBy == "" {
+		o.KafkaPartitionBy = defaults.KafkaPartitionBy
+	}
+	// there's no telling an unset bool from false, so an idempotent write path makes idempotent outputs
+	if defaults.KafkaIdempotent {
+		o.KafkaIdempotent = true
+	}
+	if o.KafkaCompressionType == "" {
+		o.KafkaCompressionType = defaults.KafkaCompressionType
+	}
+	if len(o.KafkaBrokers) < 1 {
+		o.KafkaBrokers = defaults.KafkaBrokers
+	}
 }
 
 // WritePath holds metadata about an output path
 type WritePath struct {
-	TSDEndpoint      string   `yaml:"output_endpoint"`
-	TSDURLPath       string   `yaml:"output_path"`
-	TSDPort          string   `yaml:"output_port"`
-	TSDDBName        string   `yaml:"tsd_database_name"`
-	TSDDBOrg         string   `yaml:"tsd_database_org"`
+	OutputConfig `yaml:",inline"`
+	// every metric is written to each of these (just OutputConfig above if empty)
+	Outputs []OutputConfig `yaml:"outputs"`
+	// spread series across Outputs (by consistent hash) instead of writing every metric to each of them
+	ShardOutputs      bool `yaml:"shard_outputs"`
+	ReplicationFactor int  `yaml:"replication_factor"`
+
 	PromTopics       []string `yaml:"prometheus_topics"`
 	InfluxJSONTopics []string `yaml:"influx_json_topics"`
 	InfluxLineTopics []string `yaml:"influx_line_topics"`
+	// other input formats
+	PromRemoteWriteTopics []string `yaml:"prometheus_remote_write_topics"`
+	PromTextTopics        []string `yaml:"prometheus_text_topics"`
+	MixedTopics           []string `yaml:"mixed_topics"`
+	OTLPTopics            []string `yaml:"otlp_topics"`
+	// resource/scope attributes that become tags (all of them if empty)
+	OTLPPromoteAttributes []string `yaml:"otlp_promote_attributes"`
+	GraphiteTopics        []string `yaml:"graphite_topics"`
+	GraphiteTemplates     []string `yaml:"graphite_templates"`
+	GraphiteSeparator     string   `yaml:"graphite_separator"`
+	GraphiteProtocol      string   `yaml:"graphite_protocol"`
+	SchemaRegistryTopics  []string `yaml:"schema_registry_topics"`
+	SchemaRegistryURL     string   `yaml:"schema_registry_url"`
+	// how schema registry records become metrics
+	SchemaRegistryMapping SchemaMapping `yaml:"schema_registry_mapping"`
+	StatsdTopics          []string      `yaml:"statsd_topics"`
+	StatsdListenAddress   string        `yaml:"statsd_listen_address"`
+	StatsdFlushInterval   float64       `yaml:"statsd_flush_interval"`
+	StatsdGaugeExpiry     int           `yaml:"statsd_gauge_expiry"`
+	StatsdPercentiles     []float64     `yaml:"statsd_percentiles"`
+	OpenTSDBTopics        []string      `yaml:"opentsdb_topics"`
 
 	// threading settings
 	ChannelSize    int `yaml:"go_channel_size"`
 	ReadThreads    int `yaml:"kafka_reader_threads"`
 	ProcessThreads int `yaml:"processor_threads"`
 	FilterThreads  int `yaml:"filter_threads"`
-	WriteThreads   int `yaml:"write_threads"`
 
-	// output tuning
-	SendBatch       uint    `yaml:"send_batch"`
-	WriteTimeout    uint    `yaml:"write_timeout"`
-	TSDFlushSegment float64 `yaml:"tsd_flush_time"`
-	MaxRetries      uint    `yaml:"max_retries"`
+	// backpressure (unset (nil) is not the same as 0)
+	HighWatermark *float64 `yaml:"queue_high_watermark"`
+	LowWatermark  *float64 `yaml:"queue_low_watermark"`
 
 	// misc
 	FlipSingleFields bool `yaml:"flip_single_fields"`
 }
 
+/*
+defaultLowWatermark : where we resume consuming if only queue_high_watermark is set.
+That's DefaultLowWatermark, unless the high watermark is close to (or under) it,
+then we keep the same ratio the defaults have.
+*/
+func defaultLowWatermark(high float64) float64 {
+	return math.Min(DefaultLowWatermark, high*DefaultLowWatermark/DefaultHighWatermark)
+}
+
+/*
+spoolDir : where an output without its own spool_directory spools.
+A single output uses the write path's spool_directory, several each get
+a subdirectory of it (named after the output).
+*/
+func (wp WritePath) spoolDir(output OutputConfig) string {
+	if wp.SpoolDir == "" || len(wp.Outputs) < 2 {
+		return wp.SpoolDir
+	}
+	return filepath.Join(wp.SpoolDir, replaceChars.ReplaceAllString(output.Name, "_"))
+}
+
+// validOutputType : whether we know how to write to an output_type
+func validOutputType(outputType string) error {
+	switch outputType {
+	case OutputTypeInflux, OutputTypeRemoteWrite, OutputTypeVMImport, OutputTypeKafka:
+		return nil
+	}
+	return fmt.Errorf("unknown output_type %v (should be %v, %v, %v or %v)", outputType,
+		OutputTypeInflux, OutputTypeRemoteWrite, OutputTypeVMImport, OutputTypeKafka)
+}
+
+// kafkaOutput : producer settings for a kafka output
+func (c *Config) kafkaOutput(output OutputConfig) KafkaOutputMeta {
+	brokers := c.BrokerStr
+	if len(output.KafkaBrokers) > 0 {
+		brokers = strings.Join(output.KafkaBrokers, ",")
+	}
+	return KafkaOutputMeta{KafkaProducerMeta: KafkaProducerMeta{Brokers: brokers, Topic: output.KafkaTopic,
+		CompressionType: output.KafkaCompressionType, Idempotent: output.KafkaIdempotent},
+		Format: output.KafkaFormat, PartitionBy: output.KafkaPartitionBy}
+}
+
 // Config holds general config data (and is the "top level" of the config object we load from our config yaml file)
 type Config struct {
 	ConsumerGroup           string   `yaml:"consumer_group"`
@@ -116,8 +370,15 @@ type Config struct {
 	BrokerStr               string
 	FailedWritesTopic       string `yaml:"failed_writes_topic"`
 	FailedWritesCompression string `yaml:"failed_writes_compression_type"`
+	ParseFailuresTopic      string `yaml:"parse_failures_topic"`
 	Offset                  string `yaml:"starting_offset_type"`
 	Normalize               bool   `yaml:"normalize_metrics"`
+	AtLeastOnce             bool   `yaml:"at_least_once"`
+
+	ShutdownTimeout float64 `yaml:"shutdown_timeout"`
+
+	// a negative limit disables decompressing payloads
+	MaxDecompressedBytes int64 `yaml:"max_decompressed_bytes"`
 
 	TLSCA   string `yaml:"tls_ca"`
 	TLSCert string `yaml:"tls_cert"`
@@ -129,6 +390,15 @@ type Config struct {
 	StatsPort    string `yaml:"stats_listen_port"`
 }
 
+// anchorTopics turns plain topic names into regexes that only match that topic
+func anchorTopics(topics []string) {
+	for index, element := range topics {
+		if !strings.ContainsAny(element, "^*$") {
+			topics[index] = fmt.Sprintf("^%v$", element)
+		}
+	}
+}
+
 // LoadConfig actually loads our config file and sets some defaults
 func (c *Config) LoadConfig(ConfigFile string) {
 	log.Info("Loading config...")
@@ -150,28 +420,28 @@ func (c *Config) LoadConfig(ConfigFile string) {
 	/*
 		Set defaults for individual write paths
 	*/
+	spoolDirs := make(map[string]bool)
 	for i := 0; i < len(c.WritePaths); i++ {
-		for index, element := range c.WritePaths[i].PromTopics {
-			if !strings.ContainsAny(element, "^*$") {
-				c.WritePaths[i].PromTopics[index] = fmt.Sprintf("^%v$", element)
-			}
-		}
-		for index, element := range c.WritePaths[i].InfluxJSONTopics {
-			if !strings.ContainsAny(element, "^*$") {
-				c.WritePaths[i].InfluxJSONTopics[index] = fmt.Sprintf("^%v$", element)
-			}
-		}
-		for index, element := range c.WritePaths[i].InfluxLineTopics {
-			if !strings.ContainsAny(element, "^*$") {
-				c.WritePaths[i].InfluxLineTopics[index] = fmt.Sprintf("^%v$", element)
-			}
-		}
+		anchorTopics(c.WritePaths[i].PromTopics)
+		anchorTopics(c.WritePaths[i].InfluxJSONTopics)
+		anchorTopics(c.WritePaths[i].InfluxLineTopics)
+		anchorTopics(c.WritePaths[i].PromRemoteWriteTopics)
+		anchorTopics(c.WritePaths[i].PromTextTopics)
+		anchorTopics(c.WritePaths[i].MixedTopics)
+		anchorTopics(c.WritePaths[i].StatsdTopics)
+		anchorTopics(c.WritePaths[i].OpenTSDBTopics)
+		anchorTopics(c.WritePaths[i].OTLPTopics)
+		anchorTopics(c.WritePaths[i].GraphiteTopics)
+		anchorTopics(c.WritePaths[i].SchemaRegistryTopics)
 		if c.WritePaths[i].TSDEndpoint == "" {
 			c.WritePaths[i].TSDEndpoint = "http://localhost"
 		}
 		if c.WritePaths[i].TSDURLPath == "" {
 			c.WritePaths[i].TSDURLPath = "/"
 		}
+		if c.WritePaths[i].OutputType == "" {
+			c.WritePaths[i].OutputType = OutputTypeInflux
+		}
 		/*
 			Set defaults for threading and channel sizes
 		*/
@@ -190,6 +460,17 @@ func (c *Config) LoadConfig(ConfigFile string) {
 		if c.WritePaths[i].ChannelSize == 0 {
 			c.WritePaths[i].ChannelSize = DefaultChannelSize
 		}
+		if c.WritePaths[i].HighWatermark == nil {
+			high := float64(DefaultHighWatermark)
+			c.WritePaths[i].HighWatermark = &high
+		}
+		if c.WritePaths[i].LowWatermark == nil {
+			low := defaultLowWatermark(*c.WritePaths[i].HighWatermark)
+			c.WritePaths[i].LowWatermark = &low
+		}
+		if *c.WritePaths[i].LowWatermark < 0 || *c.WritePaths[i].LowWatermark >= *c.WritePaths[i].HighWatermark {
+			panic(fmt.Errorf("queue_low_watermark (%v) must be at least 0 and lower than queue_high_watermark (%v)", *c.WritePaths[i].LowWatermark, *c.WritePaths[i].HighWatermark))
+		}
 		/*
 			Set defaults for write configs
 		*/
@@ -202,6 +483,102 @@ func (c *Config) LoadConfig(ConfigFile string) {
 		if c.WritePaths[i].TSDFlushSegment == 0 {
 			c.WritePaths[i].TSDFlushSegment = DefaultTSDFlushSegment
 		}
+		/*
+			Set defaults for retries and circuit breaking
+			(a negative retry_max_elapsed_time disables retries, a negative circuit_breaker_threshold disables the breaker)
+		*/
+		if c.WritePaths[i].MaxRetries == nil {
+			maxRetries := uint(DefaultMaxRetries)
+			c.WritePaths[i].MaxRetries = &maxRetries
+		}
+		if c.WritePaths[i].RetryInitialInterval == 0 {
+			c.WritePaths[i].RetryInitialInterval = DefaultRetryInitialInterval
+		}
+		if c.WritePaths[i].RetryMaxInterval == 0 {
+			c.WritePaths[i].RetryMaxInterval = DefaultRetryMaxInterval
+		}
+		if c.WritePaths[i].RetryMaxElapsed == 0 {
+			c.WritePaths[i].RetryMaxElapsed = DefaultRetryMaxElapsed
+		}
+		if c.WritePaths[i].RetryMultiplier == 0 {
+			c.WritePaths[i].RetryMultiplier = DefaultRetryMultiplier
+		}
+		if c.WritePaths[i].RetryJitter == 0 {
+			c.WritePaths[i].RetryJitter = DefaultRetryJitter
+		}
+		if c.WritePaths[i].BreakerThreshold == 0 {
+			c.WritePaths[i].BreakerThreshold = DefaultBreakerThreshold
+		}
+		if c.WritePaths[i].BreakerCooldown == 0 {
+			c.WritePaths[i].BreakerCooldown = DefaultBreakerCooldown
+		}
+		/*
+			Set defaults for spooling
+		*/
+		if c.WritePaths[i].SpoolMaxMB == 0 {
+			c.WritePaths[i].SpoolMaxMB = DefaultSpoolMaxMB
+		}
+		if c.WritePaths[i].SpoolRetryInterval == 0 {
+			c.WritePaths[i].SpoolRetryInterval = DefaultSpoolRetryInterval
+		}
+		if c.WritePaths[i].FailedWritesTopic == "" {
+			c.WritePaths[i].FailedWritesTopic = c.FailedWritesTopic
+		}
+		/*
+			Set defaults for kafka outputs
+		*/
+		if c.WritePaths[i].KafkaFormat == "" {
+			c.WritePaths[i].KafkaFormat = KafkaFormatInfluxLine
+		}
+		if c.WritePaths[i].KafkaPartitionBy == "" {
+			c.WritePaths[i].KafkaPartitionBy = KafkaPartitionBySeries
+		}
+		if c.WritePaths[i].KafkaCompressionType == "" {
+			c.WritePaths[i].KafkaCompressionType = DefaultKafkaCompressionType
+		}
+		/*
+			Every output gets the write path's settings
+			for anything it doesn't set itself
+		*/
+		if c.WritePaths[i].ReplicationFactor == 0 {
+			c.WritePaths[i].ReplicationFactor = DefaultReplicationFactor
+		}
+		if len(c.WritePaths[i].Outputs) < 1 {
+			c.WritePaths[i].Outputs = []OutputConfig{c.WritePaths[i].OutputConfig}
+		}
+		for j := 0; j < len(c.WritePaths[i].Outputs); j++ {
+			c.WritePaths[i].Outputs[j].inherit(c.WritePaths[i].OutputConfig)
+			// a single output doesn't need a name, several need one to tell their stats/health apart
+			if c.WritePaths[i].Outputs[j].Name == "" && len(c.WritePaths[i].Outputs) > 1 {
+				c.WritePaths[i].Outputs[j].Name = c.WritePaths[i].Outputs[j].URL()
+			}
+			for k := 0; k < j; k++ {
+				if c.WritePaths[i].Outputs[k].Name == c.WritePaths[i].Outputs[j].Name {
+					panic(fmt.Errorf("output name %v is used by more than one output of a writepath", c.WritePaths[i].Outputs[j].Name))
+				}
+			}
+			if err := validOutputType(c.WritePaths[i].Outputs[j].OutputType); err != nil {
+				panic(err)
+			}
+			if c.WritePaths[i].Outputs[j].SpoolDir == "" {
+				c.WritePaths[i].Outputs[j].SpoolDir = c.WritePaths[i].spoolDir(c.WritePaths[i].Outputs[j])
+			}
+			if c.WritePaths[i].Outputs[j].OutputType == OutputTypeKafka {
+				if c.WritePaths[i].Outputs[j].KafkaTopic == "" {
+					panic(fmt.Errorf("kafka outputs need a kafka_topic"))
+				}
+				if err := validKafkaOutput(c.WritePaths[i].Outputs[j].KafkaFormat, c.WritePaths[i].Outputs[j].KafkaPartitionBy); err != nil {
+					panic(err)
+				}
+			}
+			if c.WritePaths[i].Outputs[j].SpoolDir == "" {
+				continue
+			}
+			if spoolDirs[c.WritePaths[i].Outputs[j].SpoolDir] {
+				panic(fmt.Errorf("spool_directory %v is used by more than one output", c.WritePaths[i].Outputs[j].SpoolDir))
+			}
+			spoolDirs[c.WritePaths[i].Outputs[j].SpoolDir] = true
+		}
 	}
 	if c.FailedWritesCompression == "" {
 		c.FailedWritesCompression = "gzip"
@@ -223,6 +600,12 @@ func (c *Config) LoadConfig(ConfigFile string) {
 	if c.Offset == "" {
 		c.Offset = DefaultOffset
 	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	if c.MaxDecompressedBytes == 0 {
+		c.MaxDecompressedBytes = DefaultMaxDecompressedBytes
+	}
 
 	/*
 		Set defaults for stats configs
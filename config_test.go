@@ -0,0 +1,97 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testConfig loads a config file with the given contents
+func testConfig(t *testing.T, contents string) Config {
+	dir, err := ioutil.TempDir("", "sisyphus-config")
+	if err != nil {
+		t.Fatalf("Couldn't create config directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatalf("Couldn't write config: %v", err)
+	}
+	var c Config
+	c.LoadConfig(file)
+	return c
+}
+
+/*
+Things we should check:
+1. max_retries defaults to retrying, and outputs inherit the write path's setting
+2. an output can turn retries off (max_retries: 0) even when its write path retries
+*/
+func TestConfigRetries(t *testing.T) {
+	c := testConfig(t, `
+writepaths:
+  - name: defaults
+    influx_line_topics: [test]
+  - name: outputs
+    influx_line_topics: [test]
+    max_retries: 3
+    outputs:
+      - name: inherited
+      - name: off
+        max_retries: 0
+`)
+	if retries := *c.WritePaths[0].Outputs[0].MaxRetries; retries != DefaultMaxRetries {
+		t.Fatalf("Wrong default max_retries: %v -> should be %v", retries, DefaultMaxRetries)
+	}
+	if retries := *c.WritePaths[1].Outputs[0].MaxRetries; retries != 3 {
+		t.Fatalf("Output didn't inherit max_retries: %v -> should be 3", retries)
+	}
+	if retries := *c.WritePaths[1].Outputs[1].MaxRetries; retries != 0 {
+		t.Fatalf("Output couldn't turn retries off: %v -> should be 0", retries)
+	}
+}
+
+/*
+Things we should check:
+1. the default low watermark stays below a (low) configured high watermark
+2. 0 is a legal low watermark
+*/
+func TestConfigWatermarks(t *testing.T) {
+	c := testConfig(t, `
+writepaths:
+  - name: defaults
+  - name: high
+    queue_high_watermark: 0.4
+  - name: zero
+    queue_low_watermark: 0
+`)
+	for i, expected := range [][2]float64{{DefaultHighWatermark, DefaultLowWatermark}, {0.4, 0.25}, {DefaultHighWatermark, 0}} {
+		if high, low := *c.WritePaths[i].HighWatermark, *c.WritePaths[i].LowWatermark; high != expected[0] || low != expected[1] {
+			t.Fatalf("Wrong watermarks for %v: %v/%v -> should be %v/%v", c.WritePaths[i].Name, high, low, expected[0], expected[1])
+		}
+	}
+}
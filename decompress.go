@@ -0,0 +1,173 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// Payload encodings we can decompress
+const (
+	EncodingGzip     = "gzip"
+	EncodingZstd     = "zstd"
+	EncodingSnappy   = "snappy"
+	EncodingLZ4      = "lz4"
+	EncodingIdentity = "identity"
+	// the Kafka header producers can use to tell us how a payload is compressed
+	contentEncodingHeader = "content-encoding"
+)
+
+var (
+	gzipMagic         = []byte{0x1f, 0x8b}
+	zstdMagic         = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	lz4Magic          = []byte{0x04, 0x22, 0x4d, 0x18}
+	snappyFramedMagic = []byte("\xff\x06\x00\x00sNaPpY")
+	errTooLarge       = errors.New("decompressed payload is larger than max_decompressed_bytes")
+)
+
+/*
+payloadEncoding works out how a payload is compressed.
+A content-encoding header wins, otherwise we look for a compression format's magic bytes.
+Raw (unframed) snappy has no magic bytes, so it's only recognized by the header.
+*/
+func payloadEncoding(value []byte, header string) string {
+	if header != "" {
+		encoding := strings.ToLower(strings.TrimSpace(header))
+		if encoding == "x-gzip" {
+			return EncodingGzip
+		}
+		return encoding
+	}
+	switch {
+	case bytes.HasPrefix(value, gzipMagic):
+		return EncodingGzip
+	case bytes.HasPrefix(value, zstdMagic):
+		return EncodingZstd
+	case bytes.HasPrefix(value, lz4Magic):
+		return EncodingLZ4
+	case bytes.HasPrefix(value, snappyFramedMagic):
+		return EncodingSnappy
+	}
+	return EncodingIdentity
+}
+
+// readLimited reads a decompressed stream, refusing to read more than limit bytes
+func readLimited(reader io.Reader, limit int64) ([]byte, error) {
+	out, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, errTooLarge
+	}
+	return out, nil
+}
+
+// decompressPayload : decompress a payload with the given encoding (at most limit bytes of output)
+func decompressPayload(value []byte, encoding string, limit int64) ([]byte, error) {
+	switch encoding {
+	case EncodingIdentity, "":
+		return value, nil
+	case EncodingGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(value))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return readLimited(reader, limit)
+	case EncodingZstd:
+		reader, err := zstd.NewReader(bytes.NewReader(value), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(limit)))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		out, err := readLimited(reader, limit)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+			return nil, errTooLarge
+		}
+		return out, err
+	case EncodingLZ4:
+		return readLimited(lz4.NewReader(bytes.NewReader(value)), limit)
+	case EncodingSnappy:
+		if bytes.HasPrefix(value, snappyFramedMagic) {
+			return readLimited(snappy.NewReader(bytes.NewReader(value)), limit)
+		}
+		// a raw snappy block tells us how large it'll be before we decode it
+		size, err := snappy.DecodedLen(value)
+		if err != nil {
+			return nil, err
+		}
+		if int64(size) > limit {
+			return nil, errTooLarge
+		}
+		return snappy.Decode(nil, value)
+	}
+	return nil, fmt.Errorf("unknown content-encoding %q", encoding)
+}
+
+// headerValue : the (case insensitive) value of a Kafka header
+func headerValue(headers []kafka.Header, key string) string {
+	for _, header := range headers {
+		if strings.EqualFold(header.Key, key) {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+/*
+decompressMsg returns a Kafka message's decompressed value, and the encoding we undid
+(EncodingIdentity if we left it alone).
+Payloads we can't decompress are passed along untouched.
+A negative limit turns decompression off.
+*/
+func decompressMsg(thread int, msg *kafka.Message, limit int64) ([]byte, string) {
+	if limit < 0 || len(msg.Value) == 0 {
+		return msg.Value, EncodingIdentity
+	}
+	encoding := payloadEncoding(msg.Value, headerValue(msg.Headers, contentEncodingHeader))
+	if encoding == EncodingIdentity {
+		return msg.Value, EncodingIdentity
+	}
+	value, err := decompressPayload(msg.Value, encoding, limit)
+	if err != nil {
+		DecompressFailures.Inc()
+		log.WithFields(log.Fields{"threadNum": thread, "encoding": encoding, "error": err, "section": "kafka reader"}).Error("Couldn't decompress message")
+		return msg.Value, EncodingIdentity
+	}
+	decompressedMsgs(encoding).Inc()
+	return value, encoding
+}
@@ -0,0 +1,87 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+/*
+Things we should check:
+1. gzip, zstd, lz4 and framed snappy payloads are recognized by their magic bytes
+2. raw snappy (no magic bytes) is decompressed when the content-encoding header says so
+3. payloads that decompress past the limit are refused
+4. uncompressed and undecompressable payloads are passed along untouched
+*/
+func TestDecompress(t *testing.T) {
+	payload := []byte(strings.Repeat("cpu,host=a usage=1 1637047250\n", 100))
+	var gz, lz, framed bytes.Buffer
+	gzWriter := gzip.NewWriter(&gz)
+	gzWriter.Write(payload)
+	gzWriter.Close()
+	lzWriter := lz4.NewWriter(&lz)
+	lzWriter.Write(payload)
+	lzWriter.Close()
+	snappyWriter := snappy.NewBufferedWriter(&framed)
+	snappyWriter.Write(payload)
+	snappyWriter.Close()
+	zstdWriter, _ := zstd.NewWriter(nil)
+	zstdPayload := zstdWriter.EncodeAll(payload, nil)
+
+	for name, msg := range map[string]*kafka.Message{
+		"gzip":          {Value: gz.Bytes()},
+		"zstd":          {Value: zstdPayload},
+		"lz4":           {Value: lz.Bytes()},
+		"framed snappy": {Value: framed.Bytes()},
+		"raw snappy":    {Value: snappy.Encode(nil, payload), Headers: []kafka.Header{{Key: "Content-Encoding", Value: []byte("snappy")}}},
+		"uncompressed":  {Value: payload},
+	} {
+		if value, _ := decompressMsg(1, msg, DefaultMaxDecompressedBytes); !bytes.Equal(value, payload) {
+			t.Fatalf("%v payload wasn't decompressed: %q", name, value)
+		}
+	}
+	for name, value := range map[string][]byte{"gzip": gz.Bytes(), "zstd": zstdPayload, "lz4": lz.Bytes(), "snappy": framed.Bytes()} {
+		if _, err := decompressPayload(value, payloadEncoding(value, ""), 100); err != errTooLarge {
+			t.Fatalf("%v payload past the limit wasn't refused: %v", name, err)
+		}
+	}
+	if _, err := decompressPayload(snappy.Encode(nil, payload), EncodingSnappy, 100); err != errTooLarge {
+		t.Fatalf("raw snappy payload past the limit wasn't refused: %v", err)
+	}
+	broken := append([]byte{}, gz.Bytes()[:10]...)
+	if value, encoding := decompressMsg(1, &kafka.Message{Value: broken}, DefaultMaxDecompressedBytes); !bytes.Equal(value, broken) || encoding != EncodingIdentity {
+		t.Fatalf("broken payload wasn't passed along: %q", value)
+	}
+	if value, _ := decompressMsg(1, &kafka.Message{Value: gz.Bytes()}, -1); !bytes.Equal(value, gz.Bytes()) {
+		t.Fatalf("negative limit should disable decompression")
+	}
+}
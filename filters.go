@@ -28,7 +28,6 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
-	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -47,6 +46,7 @@ func filterMsg(thread int, msg InfluxMetric, normalize bool) (InfluxMetric, erro
 	finalMsg := InfluxMetric{
 		Name: "", Fields: make(map[string]interface{}),
 		Tags: make(map[string]string), Timestamp: msg.Timestamp,
+		Source: msg.Source,
 	}
 	var name string
 
@@ -112,7 +112,7 @@ func filterMsg(thread int, msg InfluxMetric, normalize bool) (InfluxMetric, erro
 }
 
 // FilterMessages is our main loop for ensuring incoming messages match our expected format
-func FilterMessages(ctx context.Context, thread int, inChannel chan InfluxMetric, outChannel chan InfluxMetric, wg *sync.WaitGroup, normalize bool) {
+func FilterMessages(ctx context.Context, thread int, inChannel chan InfluxMetric, outChannel chan InfluxMetric, wg *Stage, normalize bool) {
 	log.WithFields(log.Fields{"threadNum": thread, "section": "filter"}).Info("Starting Message Filtering thread...")
 	defer wg.Done()
 
@@ -123,6 +123,9 @@ filterloop:
 			output, err := filterMsg(thread, msg, normalize)
 			if err == nil {
 				outChannel <- output
+			} else {
+				// dropped metrics are as delivered as they'll ever be
+				msg.Source.Done()
 			}
 		case <-ctx.Done():
 			log.WithFields(log.Fields{"threadNum": thread, "section": "filter"}).Info("Closing filter thread...")
@@ -130,6 +133,9 @@ filterloop:
 				output, err := filterMsg(thread, msg, normalize)
 				if err == nil {
 					outChannel <- output
+				} else {
+					// dropped metrics are as delivered as they'll ever be
+					msg.Source.Done()
 				}
 			}
 			break filterloop
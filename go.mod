@@ -5,16 +5,23 @@ go 1.17
 require (
 	github.com/VictoriaMetrics/metrics v1.18.1
 	github.com/confluentinc/confluent-kafka-go v1.7.0
+	github.com/golang/snappy v0.0.4
 	github.com/influxdata/influxdb v1.9.5
 	github.com/influxdata/influxdb-client-go/v2 v2.6.0
+	github.com/jhump/protoreflect v1.14.1
 	github.com/json-iterator/go v1.1.12
+	github.com/klauspost/compress v1.15.15
+	github.com/linkedin/goavro/v2 v2.12.0
+	github.com/pierrec/lz4/v4 v4.1.17
 	github.com/pkg/profile v1.6.0
 	github.com/sirupsen/logrus v1.8.1
-	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
+	google.golang.org/protobuf v1.28.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/deepmap/oapi-codegen v1.8.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/influxdata/line-protocol v0.0.0-20200327222509-2487e7298839 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
@@ -23,5 +30,6 @@ require (
 	github.com/valyala/histogram v1.2.0 // indirect
 	golang.org/x/net v0.0.0-20210119194325-5f4716e94777 // indirect
 	golang.org/x/sys v0.0.0-20210823070655-63515b42dcdf // indirect
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
 	gopkg.in/yaml.v2 v2.3.0 // indirect
 )
@@ -0,0 +1,403 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Graphite protocols we can read
+const (
+	GraphitePlaintext = "plaintext"
+	GraphitePickle    = "pickle"
+	// DefaultGraphiteTemplate : the whole path is the measurement name
+	DefaultGraphiteTemplate = "measurement*"
+	// DefaultGraphiteSeparator : what we join multiple measurement/field/tag parts with
+	DefaultGraphiteSeparator = "."
+)
+
+/*
+graphiteTemplate :
+A Telegraf-style graphite template ("[filter] template [tag=value,...]").
+The template names each part of a dotted path: "measurement", "field", a tag name,
+or "" to skip that part. "measurement*" or "field*" take every remaining part.
+*/
+type graphiteTemplate struct {
+	filter []string
+	parts  []string
+	tags   map[string]string
+}
+
+// graphiteParser : everything we need to turn graphite paths into influx metrics
+type graphiteParser struct {
+	templates []graphiteTemplate
+	fallback  graphiteTemplate
+	separator string
+	protocol  string
+}
+
+func parseGraphiteTemplate(template string) (graphiteTemplate, error) {
+	var t graphiteTemplate
+	pieces := strings.Fields(template)
+	switch {
+	case len(pieces) == 1:
+		t.parts = strings.Split(pieces[0], ".")
+	case len(pieces) == 2 && strings.Contains(pieces[1], "="):
+		t.parts = strings.Split(pieces[0], ".")
+		pieces = append([]string{""}, pieces...)
+	case len(pieces) == 2 || len(pieces) == 3:
+		t.filter = strings.Split(pieces[0], ".")
+		t.parts = strings.Split(pieces[1], ".")
+	default:
+		return t, fmt.Errorf("invalid graphite template %q", template)
+	}
+	if len(pieces) == 3 {
+		t.tags = make(map[string]string)
+		for _, tag := range strings.Split(pieces[2], ",") {
+			kv := strings.SplitN(tag, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return t, fmt.Errorf("invalid default tag %q in graphite template %q", tag, template)
+			}
+			t.tags[kv[0]] = kv[1]
+		}
+	}
+	wildcards := 0
+	for _, part := range t.parts {
+		if part == "measurement*" || part == "field*" {
+			wildcards++
+		}
+	}
+	if wildcards > 1 {
+		return t, fmt.Errorf("graphite template %q can only use one of 'measurement*' or 'field*'", template)
+	}
+	return t, nil
+}
+
+/*
+NewGraphiteParser : build a parser for a write path's graphite templates.
+Templates without a filter replace the default template ("measurement*").
+*/
+func NewGraphiteParser(templates []string, separator string, protocol string) (*graphiteParser, error) {
+	p := &graphiteParser{separator: separator, protocol: protocol}
+	if p.separator == "" {
+		p.separator = DefaultGraphiteSeparator
+	}
+	if p.protocol == "" {
+		p.protocol = GraphitePlaintext
+	}
+	if p.protocol != GraphitePlaintext && p.protocol != GraphitePickle {
+		return nil, fmt.Errorf("unknown graphite protocol %q", protocol)
+	}
+	var err error
+	p.fallback, err = parseGraphiteTemplate(DefaultGraphiteTemplate)
+	if err != nil {
+		return nil, err
+	}
+	for _, template := range templates {
+		t, err := parseGraphiteTemplate(template)
+		if err != nil {
+			return nil, err
+		}
+		if t.filter == nil {
+			p.fallback = t
+			continue
+		}
+		for _, part := range t.filter {
+			if _, err := path.Match(part, ""); err != nil {
+				return nil, fmt.Errorf("invalid filter in graphite template %q: %w", template, err)
+			}
+		}
+		p.templates = append(p.templates, t)
+	}
+	return p, nil
+}
+
+/*
+match : the template for a path.
+A template's filter matches if each of its parts (globs) matches the path's part in the same place.
+The most specific filter wins: the longest one, then the one with the fewest wildcards,
+then whichever was configured first.
+*/
+func (p *graphiteParser) match(parts []string) graphiteTemplate {
+	best, bestLen, bestWild := p.fallback, -1, 0
+	for _, t := range p.templates {
+		if len(t.filter) > len(parts) {
+			continue
+		}
+		wild := 0
+		matched := true
+		for i, part := range t.filter {
+			if ok, _ := path.Match(part, parts[i]); !ok {
+				matched = false
+				break
+			}
+			if strings.ContainsAny(part, "*?[") {
+				wild++
+			}
+		}
+		if matched && (len(t.filter) > bestLen || (len(t.filter) == bestLen && wild < bestWild)) {
+			best, bestLen, bestWild = t, len(t.filter), wild
+		}
+	}
+	return best
+}
+
+// apply : turn a dotted path into a measurement name, tags and a field name
+func (p *graphiteParser) apply(metricPath string) (string, map[string]string, string) {
+	parts := strings.Split(metricPath, ".")
+	t := p.match(parts)
+	var measurement, field []string
+	tagParts := make(map[string][]string)
+	for i, part := range t.parts {
+		if i >= len(parts) {
+			break
+		}
+		switch part {
+		case "measurement":
+			measurement = append(measurement, parts[i])
+		case "field":
+			field = append(field, parts[i])
+		case "measurement*":
+			measurement = append(measurement, parts[i:]...)
+		case "field*":
+			field = append(field, parts[i:]...)
+		case "":
+		default:
+			tagParts[part] = append(tagParts[part], parts[i])
+		}
+		if strings.HasSuffix(part, "*") {
+			break
+		}
+	}
+	tags := make(map[string]string, len(t.tags)+len(tagParts))
+	for key, value := range t.tags {
+		tags[key] = value
+	}
+	for key, values := range tagParts {
+		tags[key] = strings.Join(values, p.separator)
+	}
+	return strings.Join(measurement, p.separator), tags, strings.Join(field, p.separator)
+}
+
+// graphitePoint : a single point from either graphite protocol
+type graphitePoint struct {
+	path      string
+	value     float64
+	timestamp int64
+}
+
+/*
+metric : apply our templates to a point.
+Graphite 1.1 tagged series ("path;tag=value;...") keep their tags (which win over template tags).
+*/
+func (p *graphiteParser) metric(point graphitePoint, flipSingleField bool) (InfluxMetric, error) {
+	pieces := strings.Split(point.path, ";")
+	name, tags, field := p.apply(pieces[0])
+	for _, tag := range pieces[1:] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return InfluxMetric{}, fmt.Errorf("invalid tag %q in graphite path %q", tag, point.path)
+		}
+		tags[kv[0]] = kv[1]
+	}
+	if name == "" {
+		return InfluxMetric{}, fmt.Errorf("graphite path %q has no measurement", point.path)
+	}
+	metric := InfluxMetric{Name: name, Tags: tags, Fields: make(map[string]interface{}), Timestamp: point.timestamp}
+	switch {
+	case field == "":
+		metric.Fields["value"] = point.value
+	case flipSingleField:
+		// like influx metrics, our single field ends up in the name
+		metric.Name += fmt.Sprintf("_%v", field)
+		metric.Fields["value"] = point.value
+	default:
+		metric.Fields[field] = point.value
+	}
+	return metric, nil
+}
+
+// graphiteTimestamp : graphite timestamps are (possibly fractional) seconds, -1 means "now"
+func graphiteTimestamp(ts float64) int64 {
+	if ts < 0 {
+		return time.Now().Unix()
+	}
+	return int64(ts)
+}
+
+// parseGraphitePlaintext : parse "path value [timestamp]" lines
+func parseGraphitePlaintext(msg []byte) ([]graphitePoint, error) {
+	var points []graphitePoint
+	for _, line := range bytes.Split(msg, []byte("\n")) {
+		pieces := strings.Fields(string(line))
+		if len(pieces) == 0 {
+			continue
+		}
+		if len(pieces) < 2 || len(pieces) > 3 {
+			return nil, fmt.Errorf("invalid graphite line %q", line)
+		}
+		value, err := strconv.ParseFloat(pieces[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value in graphite line %q: %w", line, err)
+		}
+		ts := -1.0
+		if len(pieces) == 3 {
+			ts, err = strconv.ParseFloat(pieces[2], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp in graphite line %q: %w", line, err)
+			}
+		}
+		points = append(points, graphitePoint{path: pieces[0], value: value, timestamp: graphiteTimestamp(ts)})
+	}
+	return points, nil
+}
+
+var errBadPickle = errors.New("carbon pickle isn't a list of (path, (timestamp, value)) tuples")
+
+func pickleFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	case string:
+		return strconv.ParseFloat(n, 64)
+	}
+	return 0, errBadPickle
+}
+
+/*
+parseGraphitePickle : parse a carbon pickle ([(path, (timestamp, value)), ...]).
+Carbon's pickle receiver expects a 4 byte length header, which we skip if it's there.
+*/
+func parseGraphitePickle(msg []byte) ([]graphitePoint, error) {
+	if len(msg) > 4 && int(binary.BigEndian.Uint32(msg)) == len(msg)-4 {
+		msg = msg[4:]
+	}
+	decoded, err := unpickle(msg)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := decoded.(*pickleList)
+	if !ok {
+		return nil, errBadPickle
+	}
+	points := make([]graphitePoint, 0, len(list.items))
+	for _, item := range list.items {
+		metric, ok := item.([]interface{})
+		if !ok || len(metric) != 2 {
+			return nil, errBadPickle
+		}
+		name, ok := metric[0].(string)
+		datapoint, tupleOK := metric[1].([]interface{})
+		if !ok || !tupleOK || len(datapoint) != 2 {
+			return nil, errBadPickle
+		}
+		ts, err := pickleFloat(datapoint[0])
+		if err != nil {
+			return nil, errBadPickle
+		}
+		value, err := pickleFloat(datapoint[1])
+		if err != nil {
+			return nil, errBadPickle
+		}
+		points = append(points, graphitePoint{path: name, value: value, timestamp: graphiteTimestamp(ts)})
+	}
+	return points, nil
+}
+
+// format : how parse failures from this parser are labelled
+func (p *graphiteParser) format() string {
+	if p.protocol == GraphitePickle {
+		return FormatGraphitePickle
+	}
+	return FormatGraphite
+}
+
+/*
+deserializeGraphite : turn graphite plaintext lines (or a carbon pickle) into influx metrics
+These still need filtering (graphite paths are joined with '.', which isn't valid in the prometheus data model)
+*/
+func deserializeGraphite(thread int, msg []byte, parser *graphiteParser, flipSingleField bool) ([]InfluxMetric, error) {
+	var outputStats []InfluxMetric
+	ProcTimeStart := time.Now()
+	defer func() { ProcessTime.Add(float64(time.Now().Sub(ProcTimeStart)) / TimeSegmentDivisor) }()
+	ReceivedMsgs.Inc()
+	if msg == nil {
+		log.Warning("Empty message received from Kafka")
+		return nil, nil
+	}
+	var points []graphitePoint
+	var err error
+	if parser.protocol == GraphitePickle {
+		points, err = parseGraphitePickle(msg)
+	} else {
+		points, err = parseGraphitePlaintext(msg)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"threadNum": thread, "error": err, "section": "graphite processing"}).Error("Couldn't process message")
+		return nil, err
+	}
+	for _, point := range points {
+		metric, err := parser.metric(point, flipSingleField)
+		if err != nil {
+			log.WithFields(log.Fields{"threadNum": thread, "error": err, "section": "graphite processing"}).Error("Couldn't process message")
+			return nil, err
+		}
+		outputStats = append(outputStats, metric)
+	}
+	return outputStats, nil
+}
+
+// ProcessGraphiteMsg : parse and forward a graphite message
+func ProcessGraphiteMsg(ctx context.Context, thread int, inChannel chan KafkaMsg, outChannel chan InfluxMetric, parseFailedChan chan ParseFailure, parser *graphiteParser, flipSingleField bool, wg *Stage) {
+	log.WithFields(log.Fields{"threadNum": thread, "section": "graphite processing"}).Info("processing thread starting...")
+	defer wg.Done()
+
+processloop:
+	for {
+		select {
+		case msg := <-inChannel:
+			metrics, err := deserializeGraphite(thread, msg.Value, parser, flipSingleField)
+			handleParsed(msg, parser.format(), metrics, err, outChannel, parseFailedChan)
+		case <-ctx.Done():
+			log.WithFields(log.Fields{"threadNum": thread, "section": "graphite processing"}).Info("Closing processing thread...")
+			for msg := range inChannel {
+				metrics, err := deserializeGraphite(thread, msg.Value, parser, flipSingleField)
+				handleParsed(msg, parser.format(), metrics, err, outChannel, parseFailedChan)
+			}
+			break processloop
+		}
+	}
+}
@@ -0,0 +1,116 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"testing"
+)
+
+/*
+Things we should check:
+1. the default template makes the whole path the measurement
+2. the most specific filter picks the template, and default tags are added
+3. field* / measurement* wildcards and tagged series (;tag=value) work
+4. carbon pickles (protocols 0, 2 and 4, with or without a length header) decode the same way
+5. bad lines/pickles fail to parse
+*/
+func TestGraphite(t *testing.T) {
+	parser, err := NewGraphiteParser([]string{
+		"servers.* .host.measurement.field*",
+		"servers.*.cpu .host.measurement.field region=us-west,env=prod",
+		"stats.* .measurement*",
+	}, "", "")
+	if err != nil {
+		t.Fatalf("Couldn't build graphite parser: %v", err)
+	}
+	msg := "servers.host1.cpu.load 1.5 1637047250\n\nservers.host1.disk.bytes.free 100 1637047250\n" +
+		"stats.app.requests 3 1637047250.5\nother.thing 4 1637047250\nservers.host2.cpu.load;dc=east;region=eu 2 1637047250\n"
+	results, err := deserializeGraphite(1, []byte(msg), parser, false)
+	if err != nil {
+		t.Fatalf("Couldn't deserialize message: %v", err)
+	}
+	if len(results) != 5 {
+		t.Fatalf("metric count is wrong: %v -> should be 5", len(results))
+	}
+	if results[0].Name != "cpu" || results[0].Fields["load"].(float64) != 1.5 || results[0].Timestamp != 1637047250 ||
+		results[0].Tags["host"] != "host1" || results[0].Tags["region"] != "us-west" || results[0].Tags["env"] != "prod" {
+		t.Fatalf("most specific template wasn't used: %+v", results[0])
+	}
+	if results[1].Name != "disk" || results[1].Fields["bytes.free"].(float64) != 100 || len(results[1].Tags) != 1 {
+		t.Fatalf("field* template is wrong: %+v", results[1])
+	}
+	if results[2].Name != "app.requests" || results[2].Fields["value"].(float64) != 3 || results[2].Timestamp != 1637047250 {
+		t.Fatalf("measurement* template is wrong: %+v", results[2])
+	}
+	if results[3].Name != "other.thing" || results[3].Fields["value"].(float64) != 4 {
+		t.Fatalf("default template is wrong: %+v", results[3])
+	}
+	if results[4].Tags["dc"] != "east" || results[4].Tags["region"] != "eu" || results[4].Tags["host"] != "host2" {
+		t.Fatalf("tagged series is wrong: %+v", results[4])
+	}
+	results, err = deserializeGraphite(1, []byte("servers.host1.cpu.load 1.5 1637047250"), parser, true)
+	if err != nil || results[0].Name != "cpu_load" || results[0].Fields["value"].(float64) != 1.5 {
+		t.Fatalf("flipped metric is wrong: %+v (%v)", results, err)
+	}
+	// filtering makes these valid prometheus names
+	filtered, err := filterMsg(1, results[0], false)
+	if err != nil || filtered.Name != "cpu_load" {
+		t.Fatalf("filtered metric is wrong: %+v (%v)", filtered, err)
+	}
+
+	pickleParser, err := NewGraphiteParser(nil, "_", GraphitePickle)
+	if err != nil {
+		t.Fatalf("Couldn't build graphite parser: %v", err)
+	}
+	for _, pickle := range []string{
+		"(lp0\x0a(Vservers.host1.cpu.load\x0ap1\x0a(I1637047250\x0aF1.5\x0atp2\x0atp3\x0aa(Vservers.host2.cpu.load;dc=east\x0ap4\x0a(F1637047250.0\x0aI2\x0atp5\x0atp6\x0aa.",
+		"\x80\x02]q\x00(X\x16\x00\x00\x00servers.host1.cpu.loadq\x01J\xd2[\x93aG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x1e\x00\x00\x00servers.host2.cpu.load;dc=eastq\x04GA\xd8d\xd6\xf4\x80\x00\x00K\x02\x86q\x05\x86q\x06e.",
+		"\x80\x04\x95`\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x16servers.host1.cpu.load\x94J\xd2[\x93aG?\xf8\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x1eservers.host2.cpu.load;dc=east\x94GA\xd8d\xd6\xf4\x80\x00\x00K\x02\x86\x94\x86\x94e.",
+		"\x00\x00\x00o\x80\x02]q\x00(X\x16\x00\x00\x00servers.host1.cpu.loadq\x01J\xd2[\x93aG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x1e\x00\x00\x00servers.host2.cpu.load;dc=eastq\x04GA\xd8d\xd6\xf4\x80\x00\x00K\x02\x86q\x05\x86q\x06e.",
+	} {
+		results, err = deserializeGraphite(1, []byte(pickle), pickleParser, false)
+		if err != nil {
+			t.Fatalf("Couldn't deserialize pickle %q: %v", pickle, err)
+		}
+		if len(results) != 2 || results[0].Name != "servers_host1_cpu_load" || results[0].Fields["value"].(float64) != 1.5 ||
+			results[0].Timestamp != 1637047250 || results[1].Fields["value"].(float64) != 2 || results[1].Tags["dc"] != "east" {
+			t.Fatalf("pickle %q decoded wrong: %+v", pickle, results)
+		}
+	}
+
+	for _, bad := range []string{"servers.host1.cpu.load one 1637047250", "servers.host1.cpu.load", "servers.host1;dc 1 1"} {
+		if _, err = deserializeGraphite(1, []byte(bad), parser, false); err == nil {
+			t.Fatalf("Bad line %q was deserialized", bad)
+		}
+	}
+	// the last one claims a (BINUNICODE8) string long enough to overflow our bounds check
+	for _, bad := range []string{"\x80\x02}q\x00.", "\x8d\xff\xff\xff\xff\xff\xff\xff\x7f"} {
+		if _, err = deserializeGraphite(1, []byte(bad), pickleParser, false); err == nil {
+			t.Fatalf("Bad pickle %q was deserialized", bad)
+		}
+	}
+	if _, err = NewGraphiteParser([]string{"measurement*.field*"}, "", ""); err == nil {
+		t.Fatalf("Template with two wildcards was accepted")
+	}
+}
@@ -0,0 +1,325 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	json "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// how frequently we check on outputs and dead letter producers that haven't otherwise told us how they're doing
+	healthCheckInterval = 10 * time.Second
+	// how long (in ms) we give Kafka to answer a health check
+	healthCheckTimeout = 5000
+)
+
+// errOutputNotReady : our output answered a ping, but said it isn't ready
+var errOutputNotReady = errors.New("output isn't ready")
+
+/*
+Stage :
+A group of goroutines making up one stage of a pipeline.
+Works like a sync.WaitGroup, but also knows how many of its goroutines
+are still running (so we can tell when one has died).
+*/
+type Stage struct {
+	sync.WaitGroup
+	started int32
+	running int32
+}
+
+// Add : start tracking new goroutines
+func (s *Stage) Add(delta int) {
+	atomic.AddInt32(&s.started, int32(delta))
+	atomic.AddInt32(&s.running, int32(delta))
+	s.WaitGroup.Add(delta)
+}
+
+// Done : a goroutine has finished
+func (s *Stage) Done() {
+	atomic.AddInt32(&s.running, -1)
+	s.WaitGroup.Done()
+}
+
+// Running : how many of the stage's goroutines are running, and how many we started
+func (s *Stage) Running() (int, int) {
+	return int(atomic.LoadInt32(&s.running)), int(atomic.LoadInt32(&s.started))
+}
+
+// ComponentStatus : the state of a single part of a pipeline
+type ComponentStatus struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// WritePathStatus : the state of every component of a single pipeline
+type WritePathStatus struct {
+	WritePath  string                     `json:"writepath"`
+	OK         bool                       `json:"ok"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// HealthReport : what our health endpoints return
+type HealthReport struct {
+	OK         bool              `json:"ok"`
+	WritePaths []WritePathStatus `json:"writepaths"`
+}
+
+type checkResult struct {
+	ok     bool
+	detail string
+	at     time.Time
+}
+
+/*
+Health :
+What a pipeline's components last told us about the outside world
+(partitions assigned to our readers, whether each output (by sink name) and dead letter producer is reachable).
+Everything here is updated from the component's own goroutine, so it's all behind a lock.
+*/
+type Health struct {
+	lock         sync.Mutex
+	assignments  map[string]map[int]int
+	outputs      map[string]checkResult
+	producers    map[string]checkResult
+	shuttingDown bool
+}
+
+// Assigned : record how many partitions a reader thread has for its topics
+func (h *Health) Assigned(topics []string, thread int, partitions int) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.assignments == nil {
+		h.assignments = make(map[string]map[int]int)
+	}
+	group := fmt.Sprintf("%v", topics)
+	if h.assignments[group] == nil {
+		h.assignments[group] = make(map[int]int)
+	}
+	h.assignments[group][thread] = partitions
+}
+
+/*
+OutputResult : record the result of a write (or ping) to one of our outputs.
+An output that answered, but rejected our data, is still up.
+*/
+func (h *Health) OutputResult(sink string, err error) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.outputs == nil {
+		h.outputs = make(map[string]checkResult)
+	}
+	class, _ := classifyWriteError(err)
+	result := checkResult{ok: err == nil || class == ErrorClassClient, at: time.Now()}
+	if err != nil {
+		result.detail = err.Error()
+	}
+	h.outputs[sink] = result
+}
+
+// outputCheckedSince : whether we've heard from an output since a given time
+func (h *Health) outputCheckedSince(sink string, since time.Time) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.outputs[sink].at.After(since)
+}
+
+// ProducerResult : record whether a Kafka producer could reach its brokers
+func (h *Health) ProducerResult(name string, err error) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.producers == nil {
+		h.producers = make(map[string]checkResult)
+	}
+	result := checkResult{ok: err == nil, at: time.Now()}
+	if err != nil {
+		result.detail = err.Error()
+	}
+	h.producers[name] = result
+}
+
+// ShuttingDown : we're draining, so we shouldn't be sent any more work
+func (h *Health) ShuttingDown() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.shuttingDown = true
+}
+
+func resultStatus(result checkResult) ComponentStatus {
+	if result.at.IsZero() {
+		return ComponentStatus{OK: false, Detail: "not checked yet"}
+	}
+	if result.detail == "" {
+		return ComponentStatus{OK: result.ok, Detail: fmt.Sprintf("last checked %v", result.at.Format(time.RFC3339))}
+	}
+	return ComponentStatus{OK: result.ok, Detail: fmt.Sprintf("%v (last checked %v)", result.detail, result.at.Format(time.RFC3339))}
+}
+
+// stages : every stage of a pipeline, by name
+func (p *Pipeline) stages() map[string]*Stage {
+	return map[string]*Stage{
+		"kafka_readers":  &p.ReadWG,
+		"processors":     &p.JSONWG,
+		"filters":        &p.FilterWG,
+		"writers":        &p.WriteWG,
+		"failed_writes":  &p.FailedWG,
+		"parse_failures": &p.ParseFailedWG,
+		"spool":          &p.SpoolWG,
+	}
+}
+
+// Liveness : whether every goroutine we started for a pipeline is still running
+func (p *Pipeline) Liveness() WritePathStatus {
+	status := WritePathStatus{WritePath: p.TSDURL, OK: true, Components: make(map[string]ComponentStatus)}
+	p.Health.lock.Lock()
+	shuttingDown := p.Health.shuttingDown
+	p.Health.lock.Unlock()
+	for name, stage := range p.stages() {
+		running, started := stage.Running()
+		if started < 1 {
+			continue
+		}
+		// stages finishing while we shut down is expected
+		ok := running == started || shuttingDown
+		status.Components[name] = ComponentStatus{OK: ok, Detail: fmt.Sprintf("%v/%v running", running, started)}
+		status.OK = status.OK && ok
+	}
+	return status
+}
+
+/*
+Readiness : whether a pipeline can do its job.
+Every reader's topics need partitions assigned, and each of our outputs and
+dead letter producers need to have answered their last write/check.
+*/
+func (p *Pipeline) Readiness() WritePathStatus {
+	status := WritePathStatus{WritePath: p.TSDURL, OK: true, Components: make(map[string]ComponentStatus)}
+	p.Health.lock.Lock()
+	defer p.Health.lock.Unlock()
+	if p.Health.shuttingDown {
+		status.OK = false
+		status.Components["pipeline"] = ComponentStatus{OK: false, Detail: "shutting down"}
+	}
+	for group, threads := range p.Health.assignments {
+		partitions := 0
+		for _, count := range threads {
+			partitions += count
+		}
+		component := ComponentStatus{OK: partitions > 0, Detail: fmt.Sprintf("%v partitions assigned", partitions)}
+		status.Components[fmt.Sprintf("consumer %v", group)] = component
+		status.OK = status.OK && component.OK
+	}
+	if len(p.Health.assignments) < 1 {
+		status.OK = false
+		status.Components["consumers"] = ComponentStatus{OK: false, Detail: "no partitions assigned yet"}
+	}
+	for _, sink := range p.Sinks {
+		name := sinkComponent("output", sink.Name)
+		status.Components[name] = resultStatus(p.Health.outputs[sink.Name])
+		status.OK = status.OK && status.Components[name].OK
+	}
+	for name, result := range p.Health.producers {
+		status.Components[name] = resultStatus(result)
+		status.OK = status.OK && status.Components[name].OK
+	}
+	return status
+}
+
+/*
+MonitorOutput : ping an output whenever we haven't heard from it (through writes) in a while,
+so readiness reflects an idle output too
+*/
+func MonitorOutput(ctx context.Context, cfg OutputMeta, health *Health) {
+	writer := newOutputWriter(cfg)
+	defer writer.Close()
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	lastCheck := time.Time{}
+	for {
+		if !health.outputCheckedSince(cfg.Sink, lastCheck) {
+			ok, err := writer.Ping(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if err == nil && !ok {
+				err = errOutputNotReady
+			}
+			health.OutputResult(cfg.Sink, err)
+		}
+		lastCheck = time.Now()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func healthReport(check func(p *Pipeline) WritePathStatus) HealthReport {
+	report := HealthReport{OK: true, WritePaths: make([]WritePathStatus, 0, len(Endpoints))}
+	for i := 0; i < len(Endpoints); i++ {
+		status := check(&Endpoints[i])
+		report.OK = report.OK && status.OK
+		report.WritePaths = append(report.WritePaths, status)
+	}
+	sort.SliceStable(report.WritePaths, func(i, j int) bool { return report.WritePaths[i].WritePath < report.WritePaths[j].WritePath })
+	return report
+}
+
+// healthHandler serves a health report, failing the request (503) if anything is unhealthy
+func healthHandler(check func(p *Pipeline) WritePathStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		report := healthReport(check)
+		body, err := json.Marshal(report)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "section": "stats"}).Error("Couldn't serialize health report")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !report.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_, _ = w.Write(body)
+	}
+}
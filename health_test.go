@@ -0,0 +1,101 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	influxhttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+	json "github.com/json-iterator/go"
+)
+
+/*
+Things we should check:
+1. a stage that loses a goroutine isn't live (unless we're shutting down)
+2. a pipeline isn't ready until its readers have partitions and its output has answered
+3. an output rejecting our data is still ready, an unreachable output/producer isn't
+4. the endpoints return 503 (and which component failed) when anything isn't ok
+*/
+func TestHealth(t *testing.T) {
+	p := &Pipeline{TSDURL: "http://test", Sinks: []*Sink{{}}}
+	p.ReadWG.Add(2)
+	p.WriteWG.Add(1)
+	if status := p.Liveness(); !status.OK || len(status.Components) != 2 {
+		t.Fatalf("Running pipeline isn't live: %+v", status)
+	}
+	p.ReadWG.Done()
+	if status := p.Liveness(); status.OK || status.Components["kafka_readers"].OK {
+		t.Fatalf("Pipeline with a dead reader is live: %+v", status)
+	}
+
+	if status := p.Readiness(); status.OK {
+		t.Fatalf("Pipeline with no partitions or output checks is ready: %+v", status)
+	}
+	p.Health.Assigned([]string{"test"}, 1, 3)
+	p.Health.Assigned([]string{"test"}, 2, 0)
+	p.Health.OutputResult("", &influxhttp.Error{StatusCode: 400})
+	p.Health.ProducerResult("dead_letter_producer", nil)
+	if status := p.Readiness(); !status.OK {
+		t.Fatalf("Pipeline with partitions and a reachable output isn't ready: %+v", status)
+	}
+	p.Health.OutputResult("", &influxhttp.Error{StatusCode: 503})
+	if status := p.Readiness(); status.OK || status.Components["output"].OK {
+		t.Fatalf("Pipeline with a failing output is ready: %+v", status)
+	}
+	p.Health.OutputResult("", nil)
+	p.Health.Assigned([]string{"test"}, 1, 0)
+	if status := p.Readiness(); status.OK {
+		t.Fatalf("Pipeline with no partitions is ready: %+v", status)
+	}
+	p.Health.Assigned([]string{"test"}, 1, 3)
+
+	Endpoints = []Pipeline{{TSDURL: "http://test", Sinks: []*Sink{{}}}}
+	defer func() { Endpoints = nil }()
+	Endpoints[0].ReadWG.Add(1)
+	recorder := httptest.NewRecorder()
+	healthHandler((*Pipeline).Liveness)(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Live pipeline returned %v -> should be 200", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	healthHandler((*Pipeline).Readiness)(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	var report HealthReport
+	if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Couldn't decode readiness report: %v", err)
+	}
+	if recorder.Code != http.StatusServiceUnavailable || report.OK || len(report.WritePaths) != 1 ||
+		!strings.Contains(report.WritePaths[0].Components["output"].Detail, "not checked") {
+		t.Fatalf("Unready pipeline returned %v: %v", recorder.Code, recorder.Body.String())
+	}
+	Endpoints[0].Health.ShuttingDown()
+	Endpoints[0].ReadWG.Done()
+	recorder = httptest.NewRecorder()
+	healthHandler((*Pipeline).Liveness)(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Pipeline shutting down returned %v -> should still be live", recorder.Code)
+	}
+}
@@ -25,8 +25,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
@@ -46,6 +49,14 @@ type KafkaConsumerMeta struct {
 	ClientID       string
 	SessionTimeout int
 	OffsetReset    string
+	AtLeastOnce    bool
+	Breaker        *CircuitBreaker
+	QueueFill      func() float64
+	HighWatermark  float64
+	LowWatermark   float64
+	Health         *Health
+	// largest a message can be after decompressing it (negative to not decompress)
+	MaxDecompressed int64
 }
 
 // KafkaProducerMeta : meta about Kafka producer objects
@@ -56,6 +67,22 @@ type KafkaProducerMeta struct {
 	WritePath       string
 	TSDOrg          string
 	TSDName         string
+	Sink            string
+	Idempotent      bool
+	Health          *Health
+}
+
+// producerConfig : the settings every one of our producers shares
+func producerConfig(prodMeta KafkaProducerMeta) *kafka.ConfigMap {
+	cfg := &kafka.ConfigMap{
+		"bootstrap.servers":   prodMeta.Brokers,
+		"compression.type":    prodMeta.CompressionType,
+		"go.delivery.reports": true}
+	if prodMeta.Idempotent {
+		// also implies acks=all and bounded in-flight requests, so retries can't duplicate or reorder messages
+		cfg.SetKey("enable.idempotence", true)
+	}
+	return cfg
 }
 
 /*
@@ -68,87 +95,466 @@ type DeadLetterMsg struct {
 	TSDOrg    string
 	TSDName   string
 	Message   string
+	// why the write failed
+	ErrorClass string
+	Error      string
+	HTTPStatus int
+	RetryCount int
+	FailedAt   time.Time
+	// where the metric originally came from (Kafka timestamp is in ms)
+	SourceTopic     string
+	SourcePartition int32
+	SourceOffset    int64
+	SourceTimestamp int64
+	Version         string
+}
+
+// FailedWrite : a metric (in line protocol) that we couldn't write, why, and the message it came from
+type FailedWrite struct {
+	Message    string
+	Source     *MessageSource
+	ErrorClass string
+	Error      string
+	HTTPStatus int
+	Retries    int
+	FailedAt   time.Time
 }
 
-var (
-	deliveryChan chan kafka.Event
+// ParseFailure : a raw Kafka message we couldn't deserialize, and why
+type ParseFailure struct {
+	Value    []byte
+	Source   *MessageSource
+	Format   string
+	Error    string
+	FailedAt time.Time
+}
+
+const (
+	// how frequently we hand offsets of fully delivered messages to librdkafka (in at-least-once mode)
+	offsetStoreInterval = 1 * time.Second
+	// how long (in ms) we keep trying to deliver dead letter/parse failure messages once our shutdown deadline has passed
+	finalFlushTimeout = 10 * 1000
+	// how frequently we check whether we should pause (or resume) consuming (and retry queueing held messages)
+	pauseCheckInterval = 100 * time.Millisecond
+	// how many times we try to deliver a dead letter/parse failure message (librdkafka retries within each attempt too)
+	maxDeliveryAttempts = 3
+	// how long we back off (at first, and at most) while a producer's queue is full
+	produceBackoff    = 10 * time.Millisecond
+	maxProduceBackoff = time.Second
 )
 
+// deliveryAttempt : a dead letter/parse failure message's Opaque, so a failed delivery can be retried
+type deliveryAttempt struct {
+	source   *MessageSource
+	attempts int
+}
+
 /*
 Dead letter queue section
 
 Here we collect messages that didn't write successfully and push them back into Kafka
 */
-func processFailed(msg DeadLetterMsg, topic string, producer *kafka.Producer) {
+func newDeadLetterMsg(failed FailedWrite, prodMeta KafkaProducerMeta) DeadLetterMsg {
+	msg := DeadLetterMsg{Message: failed.Message, WritePath: prodMeta.WritePath,
+		TSDOrg: prodMeta.TSDOrg, TSDName: prodMeta.TSDName,
+		ErrorClass: failed.ErrorClass, Error: failed.Error, HTTPStatus: failed.HTTPStatus,
+		RetryCount: failed.Retries, FailedAt: failed.FailedAt, Version: Version}
+	if failed.Source != nil {
+		msg.SourceTopic = failed.Source.Topic
+		msg.SourcePartition = failed.Source.Partition
+		msg.SourceOffset = failed.Source.Offset
+		msg.SourceTimestamp = failed.Source.Timestamp.UnixNano() / int64(time.Millisecond)
+	}
+	return msg
+}
+
+/*
+deadLetterHeaders duplicates the dead letter envelope's metadata as Kafka headers
+so tooling can triage failures without deserializing every message
+*/
+func deadLetterHeaders(msg DeadLetterMsg) []kafka.Header {
+	headers := []kafka.Header{
+		{Key: "sisyphus-writepath", Value: []byte(msg.WritePath)},
+		{Key: "sisyphus-error-class", Value: []byte(msg.ErrorClass)},
+		{Key: "sisyphus-error", Value: []byte(msg.Error)},
+		{Key: "sisyphus-http-status", Value: []byte(strconv.Itoa(msg.HTTPStatus))},
+		{Key: "sisyphus-retry-count", Value: []byte(strconv.Itoa(msg.RetryCount))},
+		{Key: "sisyphus-failed-at", Value: []byte(msg.FailedAt.Format(time.RFC3339Nano))},
+		{Key: "sisyphus-version", Value: []byte(msg.Version)},
+	}
+	if msg.SourceTopic != "" {
+		headers = append(headers, sourceHeaders(msg.SourceTopic, msg.SourcePartition, msg.SourceOffset, msg.SourceTimestamp)...)
+	}
+	return headers
+}
+
+// sourceHeaders describe the Kafka message a failure came from (timestamp in ms)
+func sourceHeaders(topic string, partition int32, offset int64, timestamp int64) []kafka.Header {
+	return []kafka.Header{
+		{Key: "sisyphus-source-topic", Value: []byte(topic)},
+		{Key: "sisyphus-source-partition", Value: []byte(strconv.FormatInt(int64(partition), 10))},
+		{Key: "sisyphus-source-offset", Value: []byte(strconv.FormatInt(offset, 10))},
+		{Key: "sisyphus-source-timestamp", Value: []byte(strconv.FormatInt(timestamp, 10))},
+	}
+}
+
+func processFailed(failed FailedWrite, prodMeta KafkaProducerMeta, producer *kafka.Producer) {
 	FailedTimeStart := time.Now()
+	msg := newDeadLetterMsg(failed, prodMeta)
 	thisMsg, err := json.Marshal(msg)
 	if err != nil {
 		log.WithFields(log.Fields{"message": msg, "error": err}).Fatal("Failed to deserialize message for dead letter queue")
 	}
-	err = producer.Produce(&kafka.Message{
-		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+	err = produce(producer, &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &prodMeta.Topic, Partition: kafka.PartitionAny},
 		Value:          thisMsg,
-	}, nil)
+		Headers:        deadLetterHeaders(msg),
+		Opaque:         &deliveryAttempt{source: failed.Source, attempts: 1},
+	})
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Fatal("Couldn't write message to dead letter queue")
+		log.WithFields(log.Fields{"error": err, "section": "failedwrites"}).Error("Couldn't write message to dead letter queue, giving up on it")
+		LostMsgs.Inc()
+		failed.Source.Done()
+		return
 	}
 	FailedMsgs.Inc()
 	FailedWriteTime.Add(float64(time.Now().Sub(FailedTimeStart)) / TimeSegmentDivisor)
 }
 
+/*
+Delivery reports tell us when a dead letter/parse failure message has actually landed in Kafka.
+Only then is the message it carries considered handled.
+A failed delivery is produced again (up to maxDeliveryAttempts, and only until ctx is done,
+so nothing is produced while we flush and close the producer). After that we give up on it:
+it's counted as lost and its source released, so its partition's offsets keep moving.
+*/
+func processDeliveryReports(ctx context.Context, producer *kafka.Producer, section string) {
+	for ev := range producer.Events() {
+		switch e := ev.(type) {
+		case *kafka.Message:
+			attempt, _ := e.Opaque.(*deliveryAttempt)
+			if attempt == nil {
+				continue
+			}
+			if e.TopicPartition.Error == nil {
+				attempt.source.Done()
+				continue
+			}
+			logFields := log.Fields{"error": e.TopicPartition.Error, "attempts": attempt.attempts, "section": section}
+			if attempt.attempts < maxDeliveryAttempts && ctx.Err() == nil {
+				attempt.attempts++
+				err := producer.Produce(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: e.TopicPartition.Topic, Partition: kafka.PartitionAny},
+					Value: e.Value, Headers: e.Headers, Opaque: attempt}, nil)
+				if err == nil {
+					log.WithFields(logFields).Warning("Couldn't deliver message, retrying")
+					continue
+				}
+				logFields["error"] = err
+			}
+			log.WithFields(logFields).Error("Couldn't deliver message, giving up on it")
+			LostMsgs.Inc()
+			attempt.source.Done()
+		case kafka.Error:
+			log.WithFields(log.Fields{"error": e, "section": section}).Error("Kafka Error, recovering...")
+		}
+	}
+}
+
+/*
+Parse failures section
+
+Messages we couldn't deserialize are sent (byte for byte) to a separate topic,
+with where they came from and why they failed in the headers, so whoever
+produced them can be tracked down.
+*/
+func parseFailureHeaders(failure ParseFailure, prodMeta KafkaProducerMeta) []kafka.Header {
+	headers := []kafka.Header{
+		{Key: "sisyphus-writepath", Value: []byte(prodMeta.WritePath)},
+		{Key: "sisyphus-format", Value: []byte(failure.Format)},
+		{Key: "sisyphus-error", Value: []byte(failure.Error)},
+		{Key: "sisyphus-failed-at", Value: []byte(failure.FailedAt.Format(time.RFC3339Nano))},
+		{Key: "sisyphus-version", Value: []byte(Version)},
+	}
+	if failure.Source != nil {
+		headers = append(headers, sourceHeaders(failure.Source.Topic, failure.Source.Partition,
+			failure.Source.Offset, failure.Source.Timestamp.UnixNano()/int64(time.Millisecond))...)
+	}
+	return headers
+}
+
+/*
+produce hands a message to a producer, backing off while its queue is full
+(e.g. during a burst of failures) until our delivery reports make room.
+Any other error is returned, the message won't be delivered.
+*/
+func produce(producer *kafka.Producer, msg *kafka.Message) error {
+	backoff := produceBackoff
+	for {
+		err := producer.Produce(msg, nil)
+		var kafkaErr kafka.Error
+		if err == nil || !errors.As(err, &kafkaErr) || kafkaErr.Code() != kafka.ErrQueueFull {
+			return err
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxProduceBackoff {
+			backoff = maxProduceBackoff
+		}
+	}
+}
+
+func processParseFailure(failure ParseFailure, prodMeta KafkaProducerMeta, producer *kafka.Producer) {
+	FailedTimeStart := time.Now()
+	err := produce(producer, &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &prodMeta.Topic, Partition: kafka.PartitionAny},
+		Value:          failure.Value,
+		Headers:        parseFailureHeaders(failure, prodMeta),
+		Opaque:         &deliveryAttempt{source: failure.Source, attempts: 1},
+	})
+	if err != nil {
+		// a message we can't produce must never take the forwarder down with it
+		log.WithFields(log.Fields{"error": err, "section": "parsefailures"}).Error("Couldn't write message to parse failures topic, giving up on it")
+		LostMsgs.Inc()
+		failure.Source.Done()
+	}
+	FailedWriteTime.Add(float64(time.Now().Sub(FailedTimeStart)) / TimeSegmentDivisor)
+}
+
+/*
+flushProducer waits for a producer's outstanding messages to be delivered
+until drainCtx is done (our shutdown deadline), then gives them one last
+finalFlushTimeout. Anything still undelivered is counted (and makes our shutdown unclean).
+*/
+func flushProducer(drainCtx context.Context, producer *kafka.Producer, section string) {
+	remaining := producer.Flush(100)
+	for remaining > 0 && drainCtx.Err() == nil {
+		remaining = producer.Flush(100)
+	}
+	if remaining > 0 {
+		remaining = producer.Flush(finalFlushTimeout)
+	}
+	if remaining > 0 {
+		UndeliveredMsgs.Add(remaining)
+		log.WithFields(log.Fields{"undelivered": remaining, "section": section}).Error("Couldn't deliver all messages before shutting down")
+	}
+}
+
+/*
+monitorProducer periodically checks that a producer can reach its brokers
+(by asking for its topic's metadata), so readiness reflects it.
+Returns a function to stop monitoring, which must be called before the producer is closed.
+*/
+func monitorProducer(producer *kafka.Producer, prodMeta KafkaProducerMeta, component string) func() {
+	if prodMeta.Health == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(healthCheckInterval)
+		defer ticker.Stop()
+		for {
+			_, err := producer.GetMetadata(&prodMeta.Topic, false, healthCheckTimeout)
+			prodMeta.Health.ProducerResult(component, err)
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// SendParseFailuresToKafka : Exposed function for sending messages we couldn't deserialize to the parse failures topic
+func SendParseFailuresToKafka(ctx context.Context, drainCtx context.Context, channel chan ParseFailure, prodMeta KafkaProducerMeta, wg *Stage) {
+	log.WithFields(log.Fields{"section": "parsefailures"}).Info("Starting parse failures thread...")
+	defer wg.Done()
+	producer, err := kafka.NewProducer(producerConfig(prodMeta))
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "section": "parsefailures"}).Fatal("Couldn't build Kafka producer")
+	}
+	defer producer.Close()
+	go processDeliveryReports(ctx, producer, "parsefailures")
+	defer monitorProducer(producer, prodMeta, "parse_failures_producer")()
+
+parseloop:
+	for {
+		select {
+		case failure := <-channel:
+			processParseFailure(failure, prodMeta, producer)
+		case <-ctx.Done():
+			log.WithFields(log.Fields{"section": "parsefailures"}).Info("Closing parse failures thread...")
+			for failure := range channel {
+				processParseFailure(failure, prodMeta, producer)
+			}
+			flushProducer(drainCtx, producer, "parsefailures")
+			break parseloop
+		}
+	}
+}
+
 // SendFailedToKafka : Exposed function for sending failed write attempts to our dead letter queue
-func SendFailedToKafka(ctx context.Context, channel chan string, prodMeta KafkaProducerMeta, wg *sync.WaitGroup) {
+func SendFailedToKafka(ctx context.Context, drainCtx context.Context, channel chan FailedWrite, prodMeta KafkaProducerMeta, wg *Stage) {
 	/*
 		Dead letter messages should contain:
 		1. the endpoint they were being sent to (to handle tenancy)
 		2. the actual metric that failed to write
-		3. the topic they came from
+		3. the topic/partition/offset they came from
+		4. why (and when) the write failed
+		Everything but the metric itself is also sent as Kafka headers
 	*/
 	log.WithFields(log.Fields{"section": "failedwrites"}).Info("Starting failed writes thread...")
 	defer wg.Done()
-	producer, err := kafka.NewProducer(
-		&kafka.ConfigMap{
-			"bootstrap.servers":   prodMeta.Brokers,
-			"compression.type":    prodMeta.CompressionType,
-			"go.delivery.reports": false})
+	producer, err := kafka.NewProducer(producerConfig(prodMeta))
 	if err != nil {
 		log.WithFields(log.Fields{"error": err, "section": "failedwrites"}).Fatal("Couldn't build Kafka producer")
 	}
 	defer producer.Close()
+	go processDeliveryReports(ctx, producer, "failedwrites")
+	defer monitorProducer(producer, prodMeta, sinkComponent("dead_letter_producer", prodMeta.Sink))()
 
 failedloop:
 	for {
 		select {
 		case msg := <-channel:
-			processFailed(DeadLetterMsg{Message: msg, WritePath: prodMeta.WritePath,
-				TSDOrg: prodMeta.TSDOrg, TSDName: prodMeta.TSDName}, prodMeta.Topic, producer)
+			processFailed(msg, prodMeta, producer)
 		case <-ctx.Done():
 			// we want to drain the queue before we completely close (if possible)
 			log.WithFields(log.Fields{"section": "failedwrites"}).Info("Closing failed writes thread...")
 			for msg := range channel {
-				processFailed(DeadLetterMsg{Message: msg, WritePath: prodMeta.WritePath,
-					TSDOrg: prodMeta.TSDOrg, TSDName: prodMeta.TSDName}, prodMeta.Topic, producer)
+				processFailed(msg, prodMeta, producer)
 			}
-			// wait for producer to flush for 10 seconds
-			producer.Flush(10 * 1000)
+			flushProducer(drainCtx, producer, "failedwrites")
 			break failedloop
 		}
 	}
 }
 
-//ReadFromKafka : Allow for reading Influx or Prometheus-style stats through a boolean
-func ReadFromKafka(ctx context.Context, cfg KafkaConsumerMeta, outputChannel chan []byte, wg *sync.WaitGroup) {
+/*
+storeOffsets hands librdkafka the offsets of messages that have been completely delivered.
+librdkafka's auto commit then only ever commits offsets we've stored.
+*/
+func storeOffsets(thread int, consumer *kafka.Consumer, tracker *offsetTracker) {
+	offsets := tracker.committable()
+	if len(offsets) < 1 {
+		return
+	}
+	_, err := consumer.StoreOffsets(offsets)
+	if err != nil {
+		log.WithFields(log.Fields{"threadNum": thread, "error": err, "offsets": offsets, "section": "kafka reader"}).Error("Couldn't store offsets")
+	}
+}
+
+// setPaused pauses (or resumes) every partition assigned to a consumer
+func setPaused(thread int, consumer *kafka.Consumer, pause bool) {
+	partitions, err := consumer.Assignment()
+	if err != nil {
+		log.WithFields(log.Fields{"threadNum": thread, "error": err, "section": "kafka reader"}).Error("Couldn't get assigned partitions")
+		return
+	}
+	if pause {
+		err = consumer.Pause(partitions)
+	} else {
+		err = consumer.Resume(partitions)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"threadNum": thread, "error": err, "pause": pause, "section": "kafka reader"}).Error("Couldn't pause/resume partitions")
+	}
+}
+
+/*
+shouldPause decides whether a reader should stop consuming.
+We pause while the output's circuit breaker is open, while we're holding messages
+we couldn't queue, or once the pipeline's queues pass the high watermark.
+Once paused, we only resume after the queues have drained below the low watermark.
+*/
+func (cfg KafkaConsumerMeta) shouldPause(paused bool, backlogged bool) bool {
+	if backlogged || cfg.Breaker.Open() {
+		return true
+	}
+	if cfg.QueueFill == nil {
+		return false
+	}
+	fill := cfg.QueueFill()
+	if paused {
+		return fill > cfg.LowWatermark
+	}
+	return fill >= cfg.HighWatermark
+}
+
+// flushBacklog queues as many held messages as will fit (without blocking)
+func flushBacklog(backlog []KafkaMsg, outputChannel chan KafkaMsg, tracker *offsetTracker) []KafkaMsg {
+	for len(backlog) > 0 {
+		select {
+		case outputChannel <- backlog[0]:
+			tracker.track(backlog[0].Source)
+			backlog = backlog[1:]
+		default:
+			return backlog
+		}
+	}
+	return backlog
+}
+
+/*
+dropRevoked forgets held messages from partitions we no longer own.
+They were never handed over (or tracked), so whoever picks the partition up re-delivers them.
+*/
+func dropRevoked(backlog []KafkaMsg, partitions []kafka.TopicPartition) []KafkaMsg {
+	revoked := make(map[topicPartition]bool, len(partitions))
+	for _, tp := range partitions {
+		if tp.Topic != nil {
+			revoked[topicPartition{topic: *tp.Topic, partition: tp.Partition}] = true
+		}
+	}
+	kept := backlog[:0]
+	for _, msg := range backlog {
+		if !revoked[topicPartition{topic: msg.Source.Topic, partition: msg.Source.Partition}] {
+			kept = append(kept, msg)
+		}
+	}
+	return kept
+}
+
+/*
+ReadFromKafka : Allow for reading Influx or Prometheus-style stats through a boolean
+
+We turn off librdkafka's automatic offset storage and store offsets ourselves.
+In at-least-once mode, we only store an offset once every metric from that message
+(and all messages before it in the partition) has been written or dead-lettered.
+Otherwise, we store it as soon as the message is handed to the pipeline.
+
+While our output's circuit breaker is open, or our pipeline's queues are too full,
+we pause our partitions. We stay in the consumer group (so there's no rebalancing),
+but stop pulling in data we can't handle yet.
+We never block on a full queue inside the events loop (as that would stall rebalances),
+messages that don't fit are held until there's room again.
+
+Shutting down is two steps: when ctx is done we stop feeding the pipeline (and release wg),
+when commitCtx is done (once the rest of the pipeline has drained) we store and commit
+our final offsets and leave the consumer group.
+Messages we're still holding when we stop are queued until drainCtx is done
+(our shutdown deadline), anything left after that is abandoned (and re-delivered after a restart).
+*/
+func ReadFromKafka(ctx context.Context, drainCtx context.Context, commitCtx context.Context, cfg KafkaConsumerMeta, outputChannel chan KafkaMsg, wg *Stage, commitWG *sync.WaitGroup) {
 	log.WithFields(log.Fields{"threadNum": cfg.ThreadCount, "section": "kafka reader"}).Info("Starting Sisyphus ingest thread...")
-	defer wg.Done()
+	defer commitWG.Done()
+	tracker := newOffsetTracker(cfg.AtLeastOnce)
 	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers":        cfg.Brokers,
-		"client.id":                fmt.Sprintf("%v-%v", cfg.ClientID, cfg.ThreadCount),
-		"group.id":                 cfg.ConsumerGroup,
-		"session.timeout.ms":       cfg.SessionTimeout,
-		"go.events.channel.enable": true,
-		"enable.partition.eof":     true,
-		"enable.auto.commit":       true,
-		"auto.offset.reset":        cfg.OffsetReset})
+		"bootstrap.servers":               cfg.Brokers,
+		"client.id":                       fmt.Sprintf("%v-%v", cfg.ClientID, cfg.ThreadCount),
+		"group.id":                        cfg.ConsumerGroup,
+		"session.timeout.ms":              cfg.SessionTimeout,
+		"go.events.channel.enable":        true,
+		"go.application.rebalance.enable": true,
+		"enable.partition.eof":            true,
+		"enable.auto.commit":              true,
+		"enable.auto.offset.store":        false,
+		"auto.offset.reset":               cfg.OffsetReset})
 	if err != nil {
 		log.WithFields(log.Fields{"threadNum": cfg.ThreadCount, "error": err, "section": "kafka reader"}).Fatal("Couldn't build consumer")
 	}
@@ -158,6 +564,46 @@ func ReadFromKafka(ctx context.Context, cfg KafkaConsumerMeta, outputChannel cha
 		log.WithFields(log.Fields{"threadNum": cfg.ThreadCount, "error": err, "section": "kafka reader"}).Fatal("Couldn't subscribe to topics")
 	}
 	log.WithFields(log.Fields{"threadNum": cfg.ThreadCount, "brokers": cfg.Brokers, "topics": cfg.Topics, "section": "kafka reader"}).Info("Consumer Started")
+	storeTicker := time.NewTicker(offsetStoreInterval)
+	defer storeTicker.Stop()
+	pauseTicker := time.NewTicker(pauseCheckInterval)
+	defer pauseTicker.Stop()
+	paused := false
+	var backlog []KafkaMsg
+	/*
+		Once we're told to stop, we stop handing messages to the pipeline,
+		but keep our consumer (and its place in the group) until the rest of
+		the pipeline has drained, so we can commit the offsets of everything it wrote
+	*/
+	draining := false
+	// once closed, ctx.Done() is always ready, so we stop selecting on it after the first time
+	readDone := ctx.Done()
+	stopReading := func() {
+		if draining {
+			return
+		}
+		log.WithFields(log.Fields{"threadNum": cfg.ThreadCount, "section": "kafka reader"}).Info("Closing ingest thread...")
+		// processing threads are still running, so anything we're holding can still be queued (until our deadline)
+	backlogloop:
+		for i, msg := range backlog {
+			select {
+			case outputChannel <- msg:
+				tracker.track(msg.Source)
+			case <-drainCtx.Done():
+				// never tracked, so their offsets won't be stored
+				AbandonedMsgs.Add(len(backlog) - i)
+				log.WithFields(log.Fields{"threadNum": cfg.ThreadCount, "abandoned": len(backlog) - i, "section": "kafka reader"}).Error("Shutdown deadline reached, abandoning held messages")
+				break backlogloop
+			}
+		}
+		backlog = nil
+		if paused {
+			atomic.AddInt64(&pausedReaders, -1)
+		}
+		setPaused(cfg.ThreadCount, consumer, true)
+		draining = true
+		wg.Done()
+	}
 
 readloop:
 	for {
@@ -171,24 +617,85 @@ readloop:
 				if err != nil {
 					log.WithFields(log.Fields{"threadNum": cfg.ThreadCount, "msg": e, "section": "kafka reader"}).Error("Couldn't assign partitions")
 				}
+				if paused || draining {
+					setPaused(cfg.ThreadCount, consumer, true)
+				}
+				cfg.Health.Assigned(cfg.Topics, cfg.ThreadCount, len(e.Partitions))
 			case kafka.RevokedPartitions:
 				log.WithFields(log.Fields{"threadNum": cfg.ThreadCount, "msg": e, "section": "kafka reader"}).Debug("Revoked partitions...")
+				// last chance to store offsets for partitions we're losing
+				storeOffsets(cfg.ThreadCount, consumer, tracker)
+				tracker.revoke(e.Partitions)
+				backlog = dropRevoked(backlog, e.Partitions)
 				err := consumer.Unassign()
+				cfg.Health.Assigned(cfg.Topics, cfg.ThreadCount, 0)
 				if err != nil {
 					log.WithFields(log.Fields{"threadNum": cfg.ThreadCount, "msg": e, "section": "kafka reader"}).Error("Couldn't unassign partitions")
 				}
 			case kafka.PartitionEOF:
 				log.WithFields(log.Fields{"threadNum": cfg.ThreadCount, "msg": e, "section": "kafka reader"}).Debug("End of partition...")
 			case *kafka.Message:
+				if draining {
+					// fetched before we paused, we never track (or store) it so it'll be re-delivered after we restart
+					continue
+				}
 				IngestMsgs.Inc()
-				outputChannel <- e.Value
+				/*
+					messages are only tracked once they're queued (held ones don't count yet),
+					so a message we never hand to the pipeline is never stored
+				*/
+				msg := KafkaMsg{Source: newMessageSource(e), ContentType: headerValue(e.Headers, contentTypeHeader), Raw: e.Value}
+				msg.Value, msg.Encoding = decompressMsg(cfg.ThreadCount, e, cfg.MaxDecompressed)
+				if len(backlog) < 1 {
+					select {
+					case outputChannel <- msg:
+						tracker.track(msg.Source)
+					default:
+						backlog = append(backlog, msg)
+					}
+				} else {
+					backlog = append(backlog, msg)
+				}
+				if len(backlog) > 0 && !paused {
+					log.WithFields(log.Fields{"threadNum": cfg.ThreadCount, "section": "kafka reader"}).Warning("Queue full, pausing consumption")
+					setPaused(cfg.ThreadCount, consumer, true)
+					paused = true
+					atomic.AddInt64(&pausedReaders, 1)
+				}
 			case kafka.Error:
 				// Errors should generally be considered as informational, the client will try to automatically recover
 				log.WithFields(log.Fields{"threadNum": cfg.ThreadCount, "error": e, "section": "kafka reader"}).Error("Kafka Error, recovering...")
 			}
 			IngestTime.Add(float64(time.Now().Sub(ingestTimeStart)) / TimeSegmentDivisor)
-		case <-ctx.Done():
-			log.WithFields(log.Fields{"threadNum": cfg.ThreadCount, "section": "kafka reader"}).Info("Closing ingest thread...")
+		case <-storeTicker.C:
+			storeOffsets(cfg.ThreadCount, consumer, tracker)
+		case <-pauseTicker.C:
+			if draining {
+				continue
+			}
+			backlog = flushBacklog(backlog, outputChannel, tracker)
+			if pause := cfg.shouldPause(paused, len(backlog) > 0); pause != paused {
+				log.WithFields(log.Fields{"threadNum": cfg.ThreadCount, "paused": pause, "breaker": cfg.Breaker.State(), "held": len(backlog), "section": "kafka reader"}).Warning("Pausing/resuming consumption")
+				setPaused(cfg.ThreadCount, consumer, pause)
+				paused = pause
+				if paused {
+					atomic.AddInt64(&pausedReaders, 1)
+				} else {
+					atomic.AddInt64(&pausedReaders, -1)
+				}
+			}
+		case <-readDone:
+			stopReading()
+			readDone = nil
+		case <-commitCtx.Done():
+			stopReading()
+			// anything still in flight will be re-delivered on our next start
+			storeOffsets(cfg.ThreadCount, consumer, tracker)
+			log.WithFields(log.Fields{"threadNum": cfg.ThreadCount, "pending": tracker.pending(), "section": "kafka reader"}).Info("Stored offsets of delivered messages")
+			_, err := consumer.Commit()
+			if kerr, ok := err.(kafka.Error); err != nil && !(ok && kerr.Code() == kafka.ErrNoOffset) {
+				log.WithFields(log.Fields{"threadNum": cfg.ThreadCount, "error": err, "section": "kafka reader"}).Error("Couldn't commit final offsets")
+			}
 			break readloop
 		}
 	}
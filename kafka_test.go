@@ -0,0 +1,184 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	influxhttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+	json "github.com/json-iterator/go"
+)
+
+/*
+Things we should check:
+1. we pause at the high watermark, and only resume below the low watermark
+2. we always pause while holding messages or while the output's circuit breaker is open
+3. held messages are queued as soon as there's room, in order
+4. held messages only count as handed over (and committable, without at-least-once) once they're queued
+5. held messages from revoked partitions are dropped (and never tracked), the rest are kept in order
+*/
+func TestBackpressure(t *testing.T) {
+	fill := 0.0
+	cfg := KafkaConsumerMeta{QueueFill: func() float64 { return fill }, HighWatermark: 0.8, LowWatermark: 0.5}
+	for _, check := range []struct {
+		fill       float64
+		paused     bool
+		backlogged bool
+		pause      bool
+	}{
+		{0.1, false, false, false},
+		{0.7, false, false, false},
+		{0.8, false, false, true},
+		{0.7, true, false, true},
+		{0.5, true, false, false},
+		{0.1, false, true, true},
+	} {
+		fill = check.fill
+		if pause := cfg.shouldPause(check.paused, check.backlogged); pause != check.pause {
+			t.Fatalf("Wrong pause decision at %v full (paused: %v, holding messages: %v): %v -> should be %v", check.fill, check.paused, check.backlogged, pause, check.pause)
+		}
+	}
+	fill = 0
+	cfg.Breaker = &CircuitBreaker{Threshold: 1}
+	cfg.Breaker.Failure()
+	if !cfg.shouldPause(false, false) {
+		t.Fatalf("Didn't pause with an open circuit breaker")
+	}
+
+	outputChannel := make(chan KafkaMsg, 2)
+	tracker := newOffsetTracker(false)
+	backlog := []KafkaMsg{{Value: []byte("1"), Source: testSource("test", 0, 0)}, {Value: []byte("2"), Source: testSource("test", 0, 1)},
+		{Value: []byte("3"), Source: testSource("test", 0, 2)}}
+	backlog = flushBacklog(backlog, outputChannel, tracker)
+	if len(backlog) != 1 || string(backlog[0].Value) != "3" {
+		t.Fatalf("Wrong messages left after filling our queue: %v -> should be just '3'", backlog)
+	}
+	if offsets := tracker.committable(); len(offsets) != 1 || offsets[0].Offset != 2 {
+		t.Fatalf("Wrong offsets committable while holding a message: %v -> should be 2", offsets)
+	}
+	<-outputChannel
+	backlog = flushBacklog(backlog, outputChannel, tracker)
+	if len(backlog) != 0 || string((<-outputChannel).Value) != "2" || string((<-outputChannel).Value) != "3" {
+		t.Fatalf("Held messages weren't queued in order")
+	}
+
+	topic := "test"
+	backlog = []KafkaMsg{{Value: []byte("1"), Source: testSource("test", 0, 3)}, {Value: []byte("2"), Source: testSource("test", 1, 0)},
+		{Value: []byte("3"), Source: testSource("test", 0, 4)}, {Value: []byte("4"), Source: testSource("test", 2, 0)}}
+	tracker.revoke([]kafka.TopicPartition{{Topic: &topic, Partition: 0}})
+	backlog = dropRevoked(backlog, []kafka.TopicPartition{{Topic: &topic, Partition: 0}})
+	if len(backlog) != 2 || string(backlog[0].Value) != "2" || string(backlog[1].Value) != "4" {
+		t.Fatalf("Wrong messages held after a revoke: %v -> should be '2' and '4'", backlog)
+	}
+	backlog = flushBacklog(backlog, outputChannel, tracker)
+	for _, offset := range tracker.committable() {
+		if offset.Partition == 0 {
+			t.Fatalf("Revoked partition is being tracked again: %v", offset)
+		}
+	}
+}
+
+/*
+Things we should check:
+1. the dead letter envelope has the failed metric, where it was going, why it failed and where it came from
+2. every header matches the envelope (timestamps as RFC3339 and ms)
+3. failures without a source (e.g. from the spool) have no source headers
+*/
+func TestDeadLetter(t *testing.T) {
+	failedAt := time.Date(2021, 11, 16, 7, 20, 50, 123456789, time.UTC)
+	source := &MessageSource{Topic: "metrics", Partition: 3, Offset: 42, Timestamp: time.Unix(1637047250, 5*int64(time.Millisecond))}
+	prodMeta := KafkaProducerMeta{Topic: "failed", WritePath: "influx", TSDOrg: "datto", TSDName: "metrics"}
+	tests := []struct {
+		name     string
+		failed   FailedWrite
+		envelope map[string]interface{}
+		headers  map[string]string
+	}{
+		{
+			name: "server error with source",
+			failed: func() FailedWrite {
+				failed := newFailedWrite("cpu value=1 1637047250", source,
+					&influxhttp.Error{StatusCode: 503, Code: "unavailable", Message: "try later"}, 3)
+				failed.FailedAt = failedAt
+				return failed
+			}(),
+			envelope: map[string]interface{}{"WritePath": "influx", "TSDOrg": "datto", "TSDName": "metrics",
+				"Message": "cpu value=1 1637047250", "ErrorClass": ErrorClassServer, "Error": "unavailable: try later",
+				"HTTPStatus": 503.0, "RetryCount": 3.0, "FailedAt": "2021-11-16T07:20:50.123456789Z",
+				"SourceTopic": "metrics", "SourcePartition": 3.0, "SourceOffset": 42.0, "SourceTimestamp": 1637047250005.0,
+				"Version": Version},
+			headers: map[string]string{"sisyphus-writepath": "influx", "sisyphus-error-class": ErrorClassServer,
+				"sisyphus-error": "unavailable: try later", "sisyphus-http-status": "503", "sisyphus-retry-count": "3",
+				"sisyphus-failed-at": "2021-11-16T07:20:50.123456789Z", "sisyphus-version": Version,
+				"sisyphus-source-topic": "metrics", "sisyphus-source-partition": "3",
+				"sisyphus-source-offset": "42", "sisyphus-source-timestamp": "1637047250005"},
+		},
+		{
+			name: "queue full without source",
+			failed: func() FailedWrite {
+				failed := newFailedWrite("mem free=2 1637047250", nil, errQueueFull, 0)
+				failed.FailedAt = failedAt
+				return failed
+			}(),
+			envelope: map[string]interface{}{"WritePath": "influx", "TSDOrg": "datto", "TSDName": "metrics",
+				"Message": "mem free=2 1637047250", "ErrorClass": ErrorClassQueueFull, "Error": errQueueFull.Error(),
+				"HTTPStatus": 0.0, "RetryCount": 0.0, "FailedAt": "2021-11-16T07:20:50.123456789Z",
+				"SourceTopic": "", "SourcePartition": 0.0, "SourceOffset": 0.0, "SourceTimestamp": 0.0,
+				"Version": Version},
+			headers: map[string]string{"sisyphus-writepath": "influx", "sisyphus-error-class": ErrorClassQueueFull,
+				"sisyphus-error": errQueueFull.Error(), "sisyphus-http-status": "0", "sisyphus-retry-count": "0",
+				"sisyphus-failed-at": "2021-11-16T07:20:50.123456789Z", "sisyphus-version": Version},
+		},
+	}
+	for _, test := range tests {
+		msg := newDeadLetterMsg(test.failed, prodMeta)
+		encoded, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("%v: couldn't encode envelope: %v", test.name, err)
+		}
+		var envelope map[string]interface{}
+		if err := json.Unmarshal(encoded, &envelope); err != nil {
+			t.Fatalf("%v: couldn't decode envelope: %v", test.name, err)
+		}
+		if len(envelope) != len(test.envelope) {
+			t.Fatalf("%v: envelope is wrong: %v -> should be %v", test.name, envelope, test.envelope)
+		}
+		for key, value := range test.envelope {
+			if envelope[key] != value {
+				t.Fatalf("%v: envelope %v is wrong: %v -> should be %v", test.name, key, envelope[key], value)
+			}
+		}
+		headers := deadLetterHeaders(msg)
+		if len(headers) != len(test.headers) {
+			t.Fatalf("%v: headers are wrong: %v -> should be %v", test.name, headers, test.headers)
+		}
+		for _, header := range headers {
+			if value, ok := test.headers[header.Key]; !ok || string(header.Value) != value {
+				t.Fatalf("%v: header %v is wrong: %q -> should be %q", test.name, header.Key, header.Value, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,299 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	influxhttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+	influxapiwrite "github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/influxdata/influxdb/models"
+	json "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultKafkaCompressionType defines how messages to kafka outputs are compressed
+	DefaultKafkaCompressionType = "gzip"
+
+	// KafkaFormatInfluxLine : one line of Influx line protocol (nanosecond timestamps) per message
+	KafkaFormatInfluxLine = "influx_line"
+	// KafkaFormatInfluxJSON : one Influx JSON metric per message
+	KafkaFormatInfluxJSON = "influx_json"
+	// KafkaFormatPromJSON : one Prometheus JSON sample per message (so one per field of a metric)
+	KafkaFormatPromJSON = "prometheus_json"
+
+	// KafkaPartitionBySeries : key messages by series (so a series always lands on the same partition)
+	KafkaPartitionBySeries = "series"
+	// KafkaPartitionByNone : no key (messages are spread across partitions)
+	KafkaPartitionByNone = "none"
+)
+
+// KafkaOutputMeta : settings for a Kafka output
+type KafkaOutputMeta struct {
+	KafkaProducerMeta
+	Format      string
+	PartitionBy string
+}
+
+// kafkaRecord : a single message for a Kafka output
+type kafkaRecord struct {
+	key   []byte
+	value []byte
+}
+
+// validKafkaOutput : whether a kafka output's format and partitioning make sense
+func validKafkaOutput(format string, partitionBy string) error {
+	switch format {
+	case KafkaFormatInfluxLine, KafkaFormatInfluxJSON, KafkaFormatPromJSON:
+	default:
+		return fmt.Errorf("unknown kafka_format %v (should be %v, %v or %v)", format,
+			KafkaFormatInfluxLine, KafkaFormatInfluxJSON, KafkaFormatPromJSON)
+	}
+	switch partitionBy {
+	case KafkaPartitionBySeries, KafkaPartitionByNone:
+	default:
+		return fmt.Errorf("unknown kafka_partition_by %v (should be %v or %v)", partitionBy,
+			KafkaPartitionBySeries, KafkaPartitionByNone)
+	}
+	return nil
+}
+
+/*
+encodeKafkaRecords turns metrics into messages for a Kafka output.
+Prometheus JSON gets one message per sample (named the same way as our
+series outputs name them), everything else one message per metric.
+*/
+func encodeKafkaRecords(metrics []InfluxMetric, format string, partitionBy string) ([]kafkaRecord, error) {
+	records := make([]kafkaRecord, 0, len(metrics))
+	for _, metric := range metrics {
+		var key []byte
+		if partitionBy == KafkaPartitionBySeries {
+			key = []byte(shardKey(metric))
+		}
+		switch format {
+		case KafkaFormatInfluxLine:
+			p := influxdb2.NewPoint(metric.Name, metric.Tags, metric.Fields, time.Unix(metric.Timestamp, 0))
+			line := strings.TrimSuffix(influxapiwrite.PointToLineProtocol(p, time.Nanosecond), "\n")
+			records = append(records, kafkaRecord{key: key, value: []byte(line)})
+		case KafkaFormatInfluxJSON:
+			value, err := json.Marshal(metric)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, kafkaRecord{key: key, value: value})
+		case KafkaFormatPromJSON:
+			batch := newSeriesBatch()
+			batch.add(metric.Name, metric.Tags, metric.Fields, time.Unix(metric.Timestamp, 0))
+			var err error
+			batch.each(func(series *outputSeries) {
+				prom := PromMetric{Labels: make(map[string]string, len(series.labels))}
+				for _, label := range series.labels {
+					prom.Labels[label[0]] = label[1]
+				}
+				prom.Name = prom.Labels["__name__"]
+				for _, sample := range series.samples {
+					prom.Value = strconv.FormatFloat(sample.Value, 'f', -1, 64)
+					prom.Timestamp = time.Unix(0, sample.Timestamp*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+					value, merr := json.Marshal(prom)
+					if merr != nil {
+						err = merr
+						return
+					}
+					records = append(records, kafkaRecord{key: key, value: value})
+				}
+			})
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown kafka_format %v", format)
+		}
+	}
+	return records, nil
+}
+
+/*
+KafkaWriter :
+Blocking writes of (filtered) metrics to a Kafka topic, so other consumers
+get the same cleaned-up stream our other outputs do.
+Like our other writers, a write only returns once every message is
+delivered (or failed), so retries, bisecting, spooling and dead lettering
+work the same as for every other output type.
+*/
+type KafkaWriter struct {
+	producer *kafka.Producer
+	meta     KafkaOutputMeta
+}
+
+// newKafkaWriter : a writer for a kafka output (sharing the dead letter queue's producer setup)
+func newKafkaWriter(meta KafkaOutputMeta) *KafkaWriter {
+	producer, err := kafka.NewProducer(producerConfig(meta.KafkaProducerMeta))
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "topic": meta.Topic, "section": "kafka output"}).Fatal("Couldn't build Kafka producer")
+	}
+	// delivery reports come back per write, anything else here is just an error to log
+	go func() {
+		for ev := range producer.Events() {
+			if e, ok := ev.(kafka.Error); ok {
+				log.WithFields(log.Fields{"error": e, "topic": meta.Topic, "section": "kafka output"}).Error("Kafka Error, recovering...")
+			}
+		}
+	}()
+	return &KafkaWriter{producer: producer, meta: meta}
+}
+
+// WritePoint : write influx points to our topic
+func (w *KafkaWriter) WritePoint(ctx context.Context, point ...*influxapiwrite.Point) error {
+	metrics := make([]InfluxMetric, 0, len(point))
+	for _, p := range point {
+		tags := make(map[string]string, len(p.TagList()))
+		for _, tag := range p.TagList() {
+			tags[tag.Key] = tag.Value
+		}
+		fields := make(map[string]interface{}, len(p.FieldList()))
+		for _, field := range p.FieldList() {
+			fields[field.Key] = field.Value
+		}
+		metrics = append(metrics, InfluxMetric{Name: p.Name(), Tags: tags, Fields: fields, Timestamp: p.Time().Unix()})
+	}
+	return w.write(ctx, metrics)
+}
+
+// WriteRecord : write line protocol (from our spool, at FailedPrecision) to our topic
+func (w *KafkaWriter) WriteRecord(ctx context.Context, line ...string) error {
+	if len(line) < 1 {
+		return nil
+	}
+	points, err := models.ParsePointsWithPrecision([]byte(strings.Join(line, "\n")), time.Now(), "u")
+	if err != nil {
+		return &influxhttp.Error{StatusCode: http.StatusBadRequest, Code: "invalid", Message: err.Error(), Err: err}
+	}
+	metrics := make([]InfluxMetric, 0, len(points))
+	for _, p := range points {
+		fields, err := p.Fields()
+		if err != nil {
+			return &influxhttp.Error{StatusCode: http.StatusBadRequest, Code: "invalid", Message: err.Error(), Err: err}
+		}
+		metrics = append(metrics, InfluxMetric{Name: string(p.Name()), Tags: p.Tags().Map(), Fields: fields, Timestamp: p.Time().Unix()})
+	}
+	return w.write(ctx, metrics)
+}
+
+/*
+write produces every metric and waits for all of their delivery reports.
+Returns the first error (a *kafka.Error for anything the producer reports).
+If ctx is done first, messages already handed to the producer may still be
+delivered, so a retry can duplicate them (like any other timed out write).
+*/
+func (w *KafkaWriter) write(ctx context.Context, metrics []InfluxMetric) error {
+	if len(metrics) < 1 {
+		return nil
+	}
+	records, err := encodeKafkaRecords(metrics, w.meta.Format, w.meta.PartitionBy)
+	if err != nil {
+		return err
+	}
+	// big enough that late reports never block the producer
+	deliveries := make(chan kafka.Event, len(records))
+	produced := 0
+	var firstErr error
+	for _, record := range records {
+		err := w.producer.Produce(&kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &w.meta.Topic, Partition: kafka.PartitionAny},
+			Key:            record.key,
+			Value:          record.value}, deliveries)
+		if err != nil {
+			firstErr = err
+			break
+		}
+		produced++
+	}
+	for ; produced > 0; produced-- {
+		select {
+		case ev := <-deliveries:
+			if msg, ok := ev.(*kafka.Message); ok && msg.TopicPartition.Error != nil && firstErr == nil {
+				firstErr = msg.TopicPartition.Error
+			}
+		case <-ctx.Done():
+			if firstErr == nil {
+				firstErr = ctx.Err()
+			}
+			return firstErr
+		}
+	}
+	return firstErr
+}
+
+// Ping : whether we can get our topic's metadata from the brokers
+func (w *KafkaWriter) Ping(ctx context.Context) (bool, error) {
+	timeout := healthCheckTimeout
+	if deadline, ok := ctx.Deadline(); ok && int(time.Until(deadline)/time.Millisecond) < timeout {
+		timeout = int(time.Until(deadline) / time.Millisecond)
+	}
+	_, err := w.producer.GetMetadata(&w.meta.Topic, false, timeout)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Close : deliver anything still queued and close the producer
+func (w *KafkaWriter) Close() {
+	w.producer.Flush(finalFlushTimeout)
+	w.producer.Close()
+}
+
+/*
+classifyKafkaError puts errors from our Kafka output into our usual
+error classes (and says whether err was a Kafka error at all).
+Anything Kafka won't retry on its own (e.g. a message that's too large,
+or a topic we aren't allowed to write to) is a client error.
+*/
+func classifyKafkaError(err error) (string, bool) {
+	var kafkaErr kafka.Error
+	if !errors.As(err, &kafkaErr) {
+		return "", false
+	}
+	switch kafkaErr.Code() {
+	case kafka.ErrMsgTimedOut, kafka.ErrTimedOut, kafka.ErrTimedOutQueue:
+		return ErrorClassTimeout, true
+	case kafka.ErrTransport, kafka.ErrAllBrokersDown:
+		return ErrorClassConnection, true
+	case kafka.ErrQueueFull:
+		return ErrorClassServer, true
+	}
+	if kafkaErr.IsRetriable() {
+		return ErrorClassServer, true
+	}
+	return ErrorClassClient, true
+}
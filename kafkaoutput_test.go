@@ -0,0 +1,126 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	json "github.com/json-iterator/go"
+)
+
+/*
+Things we should check:
+1. influx line and influx JSON get one message per metric, keyed by series (name and sorted tags)
+2. prometheus JSON gets one message per field, named like our series outputs, with RFC3339 timestamps
+3. no key at all when we aren't partitioning by series
+*/
+func TestEncodeKafkaRecords(t *testing.T) {
+	metrics := []InfluxMetric{
+		{Name: "disk", Tags: map[string]string{"path": "/", "host": "a"}, Fields: map[string]interface{}{"used": int64(10), "free": 2.5}, Timestamp: 1637090544},
+		{Name: "load", Tags: map[string]string{}, Fields: map[string]interface{}{"value": 0.5}, Timestamp: 1637090544},
+	}
+	records, err := encodeKafkaRecords(metrics, KafkaFormatInfluxLine, KafkaPartitionBySeries)
+	if err != nil {
+		t.Fatalf("Couldn't encode line protocol: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Wrong number of line protocol messages: %v -> should be 2", len(records))
+	}
+	if string(records[0].key) != "disk,host=a,path=/" {
+		t.Fatalf("Wrong key: %q -> should be %q", records[0].key, "disk,host=a,path=/")
+	}
+	if string(records[0].value) != "disk,host=a,path=/ free=2.5,used=10i 1637090544000000000" {
+		t.Fatalf("Wrong line protocol: %q", records[0].value)
+	}
+
+	records, err = encodeKafkaRecords(metrics, KafkaFormatInfluxJSON, KafkaPartitionBySeries)
+	if err != nil {
+		t.Fatalf("Couldn't encode influx JSON: %v", err)
+	}
+	var metric InfluxMetric
+	if err := json.Unmarshal(records[1].value, &metric); err != nil {
+		t.Fatalf("Bad influx JSON %q: %v", records[1].value, err)
+	}
+	if metric.Name != "load" || metric.Timestamp != 1637090544 || metric.Fields["value"] != 0.5 {
+		t.Fatalf("Wrong influx JSON: %v", metric)
+	}
+	if string(records[1].key) != "load" {
+		t.Fatalf("Wrong key: %q -> should be %q", records[1].key, "load")
+	}
+
+	records, err = encodeKafkaRecords(metrics, KafkaFormatPromJSON, KafkaPartitionByNone)
+	if err != nil {
+		t.Fatalf("Couldn't encode prometheus JSON: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("Wrong number of prometheus JSON messages: %v -> should be 3", len(records))
+	}
+	found := make(map[string]PromMetric)
+	for _, record := range records {
+		if record.key != nil {
+			t.Fatalf("Message keyed without partitioning by series: %q", record.key)
+		}
+		var prom PromMetric
+		if err := json.Unmarshal(record.value, &prom); err != nil {
+			t.Fatalf("Bad prometheus JSON %q: %v", record.value, err)
+		}
+		found[prom.Name] = prom
+	}
+	used, ok := found["disk_used"]
+	if !ok || used.Value != "10" || used.Labels["path"] != "/" || used.Labels["__name__"] != "disk_used" {
+		t.Fatalf("Wrong prometheus JSON for disk_used: %v", found)
+	}
+	if used.Timestamp != "2021-11-16T19:22:24Z" {
+		t.Fatalf("Wrong prometheus JSON timestamp: %v -> should be 2021-11-16T19:22:24Z", used.Timestamp)
+	}
+	if load, ok := found["load"]; !ok || load.Value != "0.5" {
+		t.Fatalf("Wrong prometheus JSON for load: %v", found)
+	}
+}
+
+/*
+Things we should check:
+1. timeouts, connection problems and retriable errors are retried like any other output's
+2. everything else is a client error (and gets dead-lettered)
+3. errors that aren't from Kafka aren't ours to classify
+*/
+func TestClassifyKafkaError(t *testing.T) {
+	tests := map[kafka.ErrorCode]string{
+		kafka.ErrMsgTimedOut:     ErrorClassTimeout,
+		kafka.ErrAllBrokersDown:  ErrorClassConnection,
+		kafka.ErrQueueFull:       ErrorClassServer,
+		kafka.ErrMsgSizeTooLarge: ErrorClassClient,
+	}
+	for code, expected := range tests {
+		class, _ := classifyWriteError(fmt.Errorf("write: %w", kafka.NewError(code, "", false)))
+		if class != expected {
+			t.Fatalf("Wrong class for %v: %v -> should be %v", code, class, expected)
+		}
+	}
+	if _, ok := classifyKafkaError(fmt.Errorf("nope")); ok {
+		t.Fatalf("Classified a non-Kafka error as a Kafka error")
+	}
+}
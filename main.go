@@ -29,8 +29,10 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/pkg/profile"
 	log "github.com/sirupsen/logrus"
@@ -58,24 +60,152 @@ type Pipeline struct {
 	OutputCancel          context.CancelFunc
 	FailedCTX             context.Context
 	FailedCancel          context.CancelFunc
-	ReadWG                sync.WaitGroup
-	JSONWG                sync.WaitGroup
-	FilterWG              sync.WaitGroup
-	WriteWG               sync.WaitGroup
-	FailedWG              sync.WaitGroup
+	SpoolCTX              context.Context
+	SpoolCancel           context.CancelFunc
+	ParseFailedCTX        context.Context
+	ParseFailedCancel     context.CancelFunc
+	DrainCTX              context.Context
+	DrainCancel           context.CancelFunc
+	CommitCTX             context.Context
+	CommitCancel          context.CancelFunc
+	ReadWG                Stage
+	JSONWG                Stage
+	FilterWG              Stage
+	WriteWG               Stage
+	FailedWG              Stage
+	SpoolWG               Stage
+	ParseFailedWG         Stage
+	CommitWG              sync.WaitGroup
 	/*
 		Actual variables needed for processing
 		data in the pipeline
 	*/
 	TSDURL                string
-	ProcessInfluxJSONChan chan []byte
-	ProcessInfluxLineChan chan []byte
-	ProcessPromJSONChan   chan []byte
+	ProcessInfluxJSONChan chan KafkaMsg
+	ProcessInfluxLineChan chan KafkaMsg
+	ProcessPromJSONChan   chan KafkaMsg
+	ProcessPromRWChan     chan KafkaMsg
+	ProcessPromTextChan   chan KafkaMsg
+	ProcessMixedChan      chan KafkaMsg
+	ProcessStatsdChan     chan KafkaMsg
+	ProcessOpenTSDBChan   chan KafkaMsg
+	ProcessOTLPChan       chan KafkaMsg
+	ProcessGraphiteChan   chan KafkaMsg
+	ProcessSchemaChan     chan KafkaMsg
 	FilterTagChan         chan InfluxMetric
 	OutputTSDBChan        chan InfluxMetric
-	FailedWritesChan      chan string
+	ParseFailedChan       chan ParseFailure
+	Sinks                 []*Sink
+	Statsd                *statsdAggregator
+	Health                Health
 }
 
+/*
+Shutdown : drain a pipeline stage by stage
+
+Because we have wait groups stored for each pipeline object,
+we can just issue cancel/wait commands to the wait groups and move along.
+Our Kafka readers stay in the consumer group until everything else
+has finished, so they can commit the offsets of everything we wrote.
+*/
+func (p *Pipeline) Shutdown(index int, wg *sync.WaitGroup) {
+	defer wg.Done()
+	p.Health.ShuttingDown()
+	log.WithFields(log.Fields{"queue": index}).Info("Closing ingest threads for writepath")
+	p.ReadCancel()
+	p.ReadWG.Wait()
+	log.WithFields(log.Fields{"Influx Proccess Queue": len(p.ProcessInfluxJSONChan), "Influx Line Process Queue": len(p.ProcessInfluxLineChan), "Prometheus Process Queue": len(p.ProcessPromJSONChan), "Prometheus Remote Write Process Queue": len(p.ProcessPromRWChan), "Prometheus Text Process Queue": len(p.ProcessPromTextChan), "Mixed Process Queue": len(p.ProcessMixedChan), "StatsD Process Queue": len(p.ProcessStatsdChan), "OpenTSDB Process Queue": len(p.ProcessOpenTSDBChan), "OTLP Process Queue": len(p.ProcessOTLPChan), "Graphite Process Queue": len(p.ProcessGraphiteChan), "Schema Registry Process Queue": len(p.ProcessSchemaChan), "section": "main"}).Info("Waiting on queues to flush...")
+	close(p.ProcessInfluxJSONChan)
+	close(p.ProcessInfluxLineChan)
+	close(p.ProcessPromJSONChan)
+	close(p.ProcessPromRWChan)
+	close(p.ProcessPromTextChan)
+	close(p.ProcessMixedChan)
+	close(p.ProcessStatsdChan)
+	close(p.ProcessOpenTSDBChan)
+	close(p.ProcessOTLPChan)
+	close(p.ProcessGraphiteChan)
+	close(p.ProcessSchemaChan)
+	p.JSONCancel()
+	p.JSONWG.Wait()
+	if p.Statsd != nil {
+		// everything has been aggregated now, so this is the last flush
+		for _, metric := range p.Statsd.Flush(time.Now()) {
+			p.FilterTagChan <- metric
+		}
+	}
+	if p.ParseFailedChan != nil {
+		log.WithFields(log.Fields{"Parse Failure Queue": len(p.ParseFailedChan), "section": "main"}).Info("Waiting on queues to flush...")
+		close(p.ParseFailedChan)
+		p.ParseFailedCancel()
+		p.ParseFailedWG.Wait()
+	}
+	log.WithFields(log.Fields{"Filter Queue": len(p.FilterTagChan), "section": "main"}).Info("Waiting on queues to flush...")
+	close(p.FilterTagChan)
+	p.FilterCancel()
+	p.FilterWG.Wait()
+	log.WithFields(log.Fields{"Output Queue": len(p.OutputTSDBChan), "section": "main"}).Info("Waiting on queues to flush...")
+	close(p.OutputTSDBChan)
+	p.OutputCancel()
+	p.WriteWG.Wait()
+	spooled, failed := 0, 0
+	for _, sink := range p.Sinks {
+		spooled += sink.Spool.Len()
+		failed += len(sink.FailedWritesChan)
+	}
+	log.WithFields(log.Fields{"Spooled Batches": spooled, "section": "main"}).Info("Stopping spool replay...")
+	p.SpoolCancel()
+	p.SpoolWG.Wait()
+	log.WithFields(log.Fields{"Failed Write Queue": failed, "section": "main"}).Info("Waiting on queues to flush...")
+	for _, sink := range p.Sinks {
+		close(sink.FailedWritesChan)
+	}
+	p.FailedCancel()
+	p.FailedWG.Wait()
+	log.WithFields(log.Fields{"queue": index, "section": "main"}).Info("Committing final offsets...")
+	p.CommitCancel()
+	p.CommitWG.Wait()
+}
+
+// QueueFill : how full (from 0 to 1) the fullest of a pipeline's queues is
+func (p *Pipeline) QueueFill() float64 {
+	fill := 0.0
+	queues := []struct{ len, cap int }{
+		{len(p.ProcessInfluxJSONChan), cap(p.ProcessInfluxJSONChan)},
+		{len(p.ProcessInfluxLineChan), cap(p.ProcessInfluxLineChan)},
+		{len(p.ProcessPromJSONChan), cap(p.ProcessPromJSONChan)},
+		{len(p.ProcessPromRWChan), cap(p.ProcessPromRWChan)},
+		{len(p.ProcessPromTextChan), cap(p.ProcessPromTextChan)},
+		{len(p.ProcessMixedChan), cap(p.ProcessMixedChan)},
+		{len(p.ProcessStatsdChan), cap(p.ProcessStatsdChan)},
+		{len(p.ProcessOpenTSDBChan), cap(p.ProcessOpenTSDBChan)},
+		{len(p.ProcessOTLPChan), cap(p.ProcessOTLPChan)},
+		{len(p.ProcessGraphiteChan), cap(p.ProcessGraphiteChan)},
+		{len(p.ProcessSchemaChan), cap(p.ProcessSchemaChan)},
+		{len(p.FilterTagChan), cap(p.FilterTagChan)},
+		{len(p.OutputTSDBChan), cap(p.OutputTSDBChan)},
+		{len(p.ParseFailedChan), cap(p.ParseFailedChan)},
+	}
+	/*
+		A sink's own queue only matters when it's the pipeline's (a single sink),
+		several sinks never hold each other up (see FanOut)
+	*/
+	for _, sink := range p.Sinks {
+		queues = append(queues, struct{ len, cap int }{len(sink.FailedWritesChan), cap(sink.FailedWritesChan)})
+	}
+	for _, queue := range queues {
+		if queue.cap > 0 && float64(queue.len)/float64(queue.cap) > fill {
+			fill = float64(queue.len) / float64(queue.cap)
+		}
+	}
+	return fill
+}
+
+const (
+	// ExitUncleanShutdown : our exit status when we couldn't drain everything before our shutdown deadline
+	ExitUncleanShutdown = 1
+)
+
 var (
 	//Endpoints is our meta object to track each pipeline
 	Endpoints []Pipeline
@@ -91,6 +221,13 @@ func main() {
 	var err error
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetOutput(os.Stdout)
+	/*
+		Subcommands get their own flags,
+		so check for them before parsing ours
+	*/
+	if len(os.Args) > 1 && os.Args[1] == "replay-dlq" {
+		os.Exit(ReplayDLQ(os.Args[2:]))
+	}
 	var cfgfile = flag.String("config", "config.yml", "Full path to config file")
 	var memprofile = flag.Bool("memprofile", false, "Enable memory profiling")
 	var cpuprofile = flag.Bool("cpuprofile", false, "Enable CPU profiling")
@@ -127,20 +264,9 @@ func main() {
 	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
 	log.WithFields(log.Fields{"Configs": c.WritePaths, "Length": len(c.WritePaths)}).Debug("Creating endpoint structs")
-	Endpoints := make([]Pipeline, len(c.WritePaths))
-	go StatsListener(c.StatsAddress, c.StatsPort)
+	Endpoints = make([]Pipeline, len(c.WritePaths))
 
 	for i := 0; i < len(c.WritePaths); i++ {
-		/*
-			Properly format write endpoint
-		*/
-		if c.WritePaths[i].TSDPort != "" {
-			Endpoints[i].TSDURL = fmt.Sprintf("%v:%v", c.WritePaths[i].TSDEndpoint, c.WritePaths[i].TSDPort)
-		} else {
-			Endpoints[i].TSDURL = fmt.Sprintf("%v", c.WritePaths[i].TSDEndpoint)
-		}
-		Endpoints[i].TSDURL = fmt.Sprintf("%v%v", Endpoints[i].TSDURL, c.WritePaths[i].TSDURLPath)
-		log.WithFields(log.Fields{"TSDURL": Endpoints[i].TSDURL, "section": "main"}).Info("Output URL")
 		/*
 			Build meta objects
 			(contexts and wait groups)
@@ -151,6 +277,10 @@ func main() {
 		Endpoints[i].FilterCTX, Endpoints[i].FilterCancel = context.WithCancel(Endpoints[i].Ctx)
 		Endpoints[i].OutputCTX, Endpoints[i].OutputCancel = context.WithCancel(Endpoints[i].Ctx)
 		Endpoints[i].FailedCTX, Endpoints[i].FailedCancel = context.WithCancel(Endpoints[i].Ctx)
+		Endpoints[i].SpoolCTX, Endpoints[i].SpoolCancel = context.WithCancel(Endpoints[i].Ctx)
+		Endpoints[i].ParseFailedCTX, Endpoints[i].ParseFailedCancel = context.WithCancel(Endpoints[i].Ctx)
+		Endpoints[i].DrainCTX, Endpoints[i].DrainCancel = context.WithCancel(Endpoints[i].Ctx)
+		Endpoints[i].CommitCTX, Endpoints[i].CommitCancel = context.WithCancel(Endpoints[i].Ctx)
 
 		/*
 			Channels
@@ -158,43 +288,137 @@ func main() {
 			Actually create all the channels with the defined
 			buffer size
 		*/
-		Endpoints[i].ProcessInfluxJSONChan = make(chan []byte, c.WritePaths[i].ChannelSize)
-		Endpoints[i].ProcessInfluxLineChan = make(chan []byte, c.WritePaths[i].ChannelSize)
-		Endpoints[i].ProcessPromJSONChan = make(chan []byte, c.WritePaths[i].ChannelSize)
+		Endpoints[i].ProcessInfluxJSONChan = make(chan KafkaMsg, c.WritePaths[i].ChannelSize)
+		Endpoints[i].ProcessInfluxLineChan = make(chan KafkaMsg, c.WritePaths[i].ChannelSize)
+		Endpoints[i].ProcessPromJSONChan = make(chan KafkaMsg, c.WritePaths[i].ChannelSize)
+		Endpoints[i].ProcessPromRWChan = make(chan KafkaMsg, c.WritePaths[i].ChannelSize)
+		Endpoints[i].ProcessPromTextChan = make(chan KafkaMsg, c.WritePaths[i].ChannelSize)
+		Endpoints[i].ProcessMixedChan = make(chan KafkaMsg, c.WritePaths[i].ChannelSize)
+		Endpoints[i].ProcessStatsdChan = make(chan KafkaMsg, c.WritePaths[i].ChannelSize)
+		Endpoints[i].ProcessOpenTSDBChan = make(chan KafkaMsg, c.WritePaths[i].ChannelSize)
+		Endpoints[i].ProcessOTLPChan = make(chan KafkaMsg, c.WritePaths[i].ChannelSize)
+		Endpoints[i].ProcessGraphiteChan = make(chan KafkaMsg, c.WritePaths[i].ChannelSize)
+		Endpoints[i].ProcessSchemaChan = make(chan KafkaMsg, c.WritePaths[i].ChannelSize)
 		Endpoints[i].FilterTagChan = make(chan InfluxMetric, c.WritePaths[i].ChannelSize)
 		Endpoints[i].OutputTSDBChan = make(chan InfluxMetric, c.WritePaths[i].ChannelSize)
-		Endpoints[i].FailedWritesChan = make(chan string, c.WritePaths[i].ChannelSize)
+
+		/*
+			Outputs (sinks)
+
+			A single output writes straight from the pipeline's output queue,
+			several each get their own queue (fed by FanOut)
+		*/
+		outputs := c.WritePaths[i].Outputs
+		urls := make([]string, 0, len(outputs))
+		for j := 0; j < len(outputs); j++ {
+			sink := &Sink{Name: outputs[j].Name, TSDURL: outputs[j].URL(), OutputTSDBChan: Endpoints[i].OutputTSDBChan,
+				FailedWritesChan: make(chan FailedWrite, c.WritePaths[i].ChannelSize)}
+			if len(outputs) > 1 {
+				sink.OutputTSDBChan = make(chan InfluxMetric, c.WritePaths[i].ChannelSize)
+			}
+			log.WithFields(log.Fields{"TSDURL": sink.TSDURL, "name": sink.Name, "type": outputs[j].OutputType, "section": "main"}).Info("Output URL")
+			Endpoints[i].Sinks = append(Endpoints[i].Sinks, sink)
+			urls = append(urls, sink.TSDURL)
+		}
+		Endpoints[i].TSDURL = strings.Join(urls, ",")
 
 		/*
 			Go Routines
 
-			First routine is a single thread for failed writes
+			First routines are a single thread per output for failed writes
 			This shouldn't need more than one thread because
 			it should be low-volume
 		*/
-		Endpoints[i].FailedWG.Add(1)
-		go SendFailedToKafka(Endpoints[i].FailedCTX, Endpoints[i].FailedWritesChan, KafkaProducerMeta{Topic: c.FailedWritesTopic,
-			Brokers: c.BrokerStr, CompressionType: c.FailedWritesCompression,
-			WritePath: Endpoints[i].TSDURL, TSDOrg: c.WritePaths[i].TSDDBOrg,
-			TSDName: c.WritePaths[i].TSDDBName}, &Endpoints[i].FailedWG)
+		for j, sink := range Endpoints[i].Sinks {
+			Endpoints[i].FailedWG.Add(1)
+			go SendFailedToKafka(Endpoints[i].FailedCTX, Endpoints[i].DrainCTX, sink.FailedWritesChan, KafkaProducerMeta{Topic: outputs[j].FailedWritesTopic,
+				Brokers: c.BrokerStr, CompressionType: c.FailedWritesCompression,
+				WritePath: sink.TSDURL, TSDOrg: outputs[j].TSDDBOrg,
+				TSDName: outputs[j].TSDDBName, Sink: sink.Name, Health: &Endpoints[i].Health}, &Endpoints[i].FailedWG)
+		}
+		/*
+			Messages we can't deserialize get their own
+			(optional) topic, as they aren't tied to an output
+		*/
+		if c.ParseFailuresTopic != "" {
+			Endpoints[i].ParseFailedChan = make(chan ParseFailure, c.WritePaths[i].ChannelSize)
+			Endpoints[i].ParseFailedWG.Add(1)
+			go SendParseFailuresToKafka(Endpoints[i].ParseFailedCTX, Endpoints[i].DrainCTX, Endpoints[i].ParseFailedChan, KafkaProducerMeta{Topic: c.ParseFailuresTopic,
+				Brokers: c.BrokerStr, CompressionType: c.FailedWritesCompression,
+				WritePath: Endpoints[i].TSDURL, Health: &Endpoints[i].Health}, &Endpoints[i].ParseFailedWG)
+		}
 		/*
 			Next we add processing threads
 			This is the step that consumes from Kafka
 			and deserializes messages. We'll want *at least*
 			one of these for each topic, and likely many
 		*/
+		var graphite *graphiteParser
+		if len(c.WritePaths[i].GraphiteTopics) > 0 {
+			graphite, err = NewGraphiteParser(c.WritePaths[i].GraphiteTemplates, c.WritePaths[i].GraphiteSeparator, c.WritePaths[i].GraphiteProtocol)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err, "section": "main"}).Fatal("Couldn't parse graphite templates")
+			}
+		}
+		var registry *schemaRegistry
+		if len(c.WritePaths[i].SchemaRegistryTopics) > 0 {
+			registry, err = NewSchemaRegistry(c.WritePaths[i].SchemaRegistryURL, c.WritePaths[i].SchemaRegistryMapping)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err, "section": "main"}).Fatal("Couldn't configure schema registry")
+			}
+		}
+		if len(c.WritePaths[i].StatsdTopics) > 0 || c.WritePaths[i].StatsdListenAddress != "" {
+			Endpoints[i].Statsd, err = NewStatsdAggregator(c.WritePaths[i].StatsdFlushInterval, c.WritePaths[i].StatsdGaugeExpiry, c.WritePaths[i].StatsdPercentiles, c.WritePaths[i].FlipSingleFields)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err, "section": "main"}).Fatal("Couldn't configure statsd aggregation")
+			}
+			Endpoints[i].JSONWG.Add(1)
+			go FlushStatsd(Endpoints[i].JSONCTX, Endpoints[i].Statsd, Endpoints[i].FilterTagChan, &Endpoints[i].JSONWG)
+		}
 		for thread := 1; thread <= c.WritePaths[i].ProcessThreads; thread++ {
 			if len(c.WritePaths[i].InfluxJSONTopics) > 0 {
 				Endpoints[i].JSONWG.Add(1)
-				go ProcessInfluxJSONMsg(Endpoints[i].JSONCTX, thread, Endpoints[i].ProcessInfluxJSONChan, Endpoints[i].FilterTagChan, &Endpoints[i].JSONWG, c.WritePaths[i].FlipSingleFields)
+				go ProcessInfluxJSONMsg(Endpoints[i].JSONCTX, thread, Endpoints[i].ProcessInfluxJSONChan, Endpoints[i].FilterTagChan, Endpoints[i].ParseFailedChan, &Endpoints[i].JSONWG, c.WritePaths[i].FlipSingleFields)
 			}
 			if len(c.WritePaths[i].PromTopics) > 0 {
 				Endpoints[i].JSONWG.Add(1)
-				go ProcessPromMsg(Endpoints[i].JSONCTX, thread, Endpoints[i].ProcessPromJSONChan, Endpoints[i].OutputTSDBChan, c.Normalize, c.WritePaths[i].FlipSingleFields, &Endpoints[i].JSONWG)
+				go ProcessPromMsg(Endpoints[i].JSONCTX, thread, Endpoints[i].ProcessPromJSONChan, Endpoints[i].OutputTSDBChan, Endpoints[i].ParseFailedChan, c.Normalize, c.WritePaths[i].FlipSingleFields, &Endpoints[i].JSONWG)
+			}
+			if len(c.WritePaths[i].PromRemoteWriteTopics) > 0 {
+				Endpoints[i].JSONWG.Add(1)
+				go ProcessPromRemoteWriteMsg(Endpoints[i].JSONCTX, thread, Endpoints[i].ProcessPromRWChan, Endpoints[i].OutputTSDBChan, Endpoints[i].ParseFailedChan, c.MaxDecompressedBytes, c.Normalize, c.WritePaths[i].FlipSingleFields, &Endpoints[i].JSONWG)
+			}
+			if len(c.WritePaths[i].PromTextTopics) > 0 {
+				Endpoints[i].JSONWG.Add(1)
+				go ProcessPromTextMsg(Endpoints[i].JSONCTX, thread, Endpoints[i].ProcessPromTextChan, Endpoints[i].OutputTSDBChan, Endpoints[i].ParseFailedChan, c.Normalize, c.WritePaths[i].FlipSingleFields, &Endpoints[i].JSONWG)
+			}
+			if len(c.WritePaths[i].MixedTopics) > 0 {
+				Endpoints[i].JSONWG.Add(1)
+				go ProcessMixedMsg(Endpoints[i].JSONCTX, thread, Endpoints[i].ProcessMixedChan, Endpoints[i].FilterTagChan, Endpoints[i].OutputTSDBChan, Endpoints[i].ParseFailedChan, c.WritePaths[i].OTLPPromoteAttributes, c.MaxDecompressedBytes, c.Normalize, c.WritePaths[i].FlipSingleFields, &Endpoints[i].JSONWG)
+			}
+			if len(c.WritePaths[i].StatsdTopics) > 0 {
+				Endpoints[i].JSONWG.Add(1)
+				go ProcessStatsdMsg(Endpoints[i].JSONCTX, thread, Endpoints[i].ProcessStatsdChan, Endpoints[i].ParseFailedChan, Endpoints[i].Statsd, &Endpoints[i].JSONWG)
+			}
+			if len(c.WritePaths[i].OpenTSDBTopics) > 0 {
+				Endpoints[i].JSONWG.Add(1)
+				go ProcessOpenTSDBMsg(Endpoints[i].JSONCTX, thread, Endpoints[i].ProcessOpenTSDBChan, Endpoints[i].FilterTagChan, Endpoints[i].ParseFailedChan, &Endpoints[i].JSONWG)
+			}
+			if len(c.WritePaths[i].OTLPTopics) > 0 {
+				Endpoints[i].JSONWG.Add(1)
+				go ProcessOTLPMsg(Endpoints[i].JSONCTX, thread, Endpoints[i].ProcessOTLPChan, Endpoints[i].FilterTagChan, Endpoints[i].ParseFailedChan, c.WritePaths[i].OTLPPromoteAttributes, c.WritePaths[i].FlipSingleFields, &Endpoints[i].JSONWG)
+			}
+			if len(c.WritePaths[i].GraphiteTopics) > 0 {
+				Endpoints[i].JSONWG.Add(1)
+				go ProcessGraphiteMsg(Endpoints[i].JSONCTX, thread, Endpoints[i].ProcessGraphiteChan, Endpoints[i].FilterTagChan, Endpoints[i].ParseFailedChan, graphite, c.WritePaths[i].FlipSingleFields, &Endpoints[i].JSONWG)
+			}
+			if len(c.WritePaths[i].SchemaRegistryTopics) > 0 {
+				Endpoints[i].JSONWG.Add(1)
+				go ProcessSchemaRegistryMsg(Endpoints[i].JSONCTX, thread, Endpoints[i].ProcessSchemaChan, Endpoints[i].FilterTagChan, Endpoints[i].ParseFailedChan, registry, c.WritePaths[i].FlipSingleFields, &Endpoints[i].JSONWG)
 			}
 			if len(c.WritePaths[i].InfluxLineTopics) > 0 {
 				Endpoints[i].JSONWG.Add(1)
-				go ProcessInfluxLineMsg(Endpoints[i].JSONCTX, thread, Endpoints[i].ProcessInfluxLineChan, Endpoints[i].FilterTagChan, &Endpoints[i].JSONWG, c.WritePaths[i].FlipSingleFields)
+				go ProcessInfluxLineMsg(Endpoints[i].JSONCTX, thread, Endpoints[i].ProcessInfluxLineChan, Endpoints[i].FilterTagChan, Endpoints[i].ParseFailedChan, &Endpoints[i].JSONWG, c.WritePaths[i].FlipSingleFields)
 			}
 		}
 		/*
@@ -208,81 +432,145 @@ func main() {
 			go FilterMessages(Endpoints[i].FilterCTX, thread, Endpoints[i].FilterTagChan, Endpoints[i].OutputTSDBChan, &Endpoints[i].FilterWG, c.Normalize)
 		}
 		/*
-			Output threads...
-			As above, we define as many as requested per write path
+			Everything else about an output is per output too
+		*/
+		isolated := len(outputs) > 1
+		for j, sink := range Endpoints[i].Sinks {
+			/*
+				If we're spooling failed writes to disk,
+				open the spool and start replaying anything
+				left over from a previous run
+			*/
+			if outputs[j].SpoolDir != "" {
+				sink.Spool, err = NewSpool(outputs[j].SpoolDir, outputs[j].SpoolMaxMB*1024*1024)
+				if err != nil {
+					log.WithFields(log.Fields{"error": err, "dir": outputs[j].SpoolDir, "section": "main"}).Fatal("Couldn't open spool")
+				}
+				Endpoints[i].SpoolWG.Add(1)
+				cfg := OutputMeta{Thread: 0, WriteTimeout: outputs[j].WriteTimeout,
+					URL: sink.TSDURL, Sink: sink.Name, OutputType: outputs[j].OutputType, TsdOrg: outputs[j].TSDDBOrg,
+					TsdDbName: outputs[j].TSDDBName, Precision: FailedPrecision, Kafka: c.kafkaOutput(outputs[j])}
+				go DrainSpool(Endpoints[i].SpoolCTX, sink.Spool, sink.FailedWritesChan, cfg, outputs[j].SpoolRetryInterval, &Endpoints[i].SpoolWG)
+			}
+			/*
+				Output threads...
+				As above, we define as many as requested per output.
+				All of them share a retry policy and circuit breaker
+			*/
+			retry := RetryPolicy{InitialInterval: time.Duration(outputs[j].RetryInitialInterval * float64(time.Second)),
+				MaxInterval: time.Duration(outputs[j].RetryMaxInterval * float64(time.Second)),
+				MaxElapsed:  time.Duration(outputs[j].RetryMaxElapsed * float64(time.Second)),
+				Multiplier:  outputs[j].RetryMultiplier, Jitter: outputs[j].RetryJitter, MaxRetries: *outputs[j].MaxRetries}
+			if outputs[j].BreakerThreshold > 0 {
+				sink.Breaker = NewCircuitBreaker(sink.TSDURL, outputs[j].BreakerThreshold,
+					time.Duration(outputs[j].BreakerCooldown*float64(time.Second)))
+			}
+			for thread := 1; thread <= outputs[j].WriteThreads; thread++ {
+				Endpoints[i].WriteWG.Add(1)
+				cfg := OutputMeta{Thread: thread, BatchSize: outputs[j].SendBatch, WriteTimeout: outputs[j].WriteTimeout,
+					FlushSegment: outputs[j].TSDFlushSegment, URL: sink.TSDURL,
+					Sink: sink.Name, Isolated: isolated, OutputType: outputs[j].OutputType, TsdOrg: outputs[j].TSDDBOrg,
+					TsdDbName: outputs[j].TSDDBName, Spool: sink.Spool, Retry: retry, Breaker: sink.Breaker,
+					Health: &Endpoints[i].Health, Kafka: c.kafkaOutput(outputs[j])}
+				go SendTSDB(Endpoints[i].OutputCTX, Endpoints[i].DrainCTX, sink.OutputTSDBChan, sink.FailedWritesChan, cfg, &Endpoints[i].WriteWG)
+			}
+			// keep readiness current even when nothing is being written
+			go MonitorOutput(Endpoints[i].OutputCTX, OutputMeta{WriteTimeout: outputs[j].WriteTimeout, URL: sink.TSDURL,
+				Sink: sink.Name, OutputType: outputs[j].OutputType, Kafka: c.kafkaOutput(outputs[j])}, &Endpoints[i].Health)
+		}
+		/*
+			Several outputs either all get every metric,
+			or (when sharding) each get the series hashed to them
 		*/
-		for thread := 1; thread <= c.WritePaths[i].WriteThreads; thread++ {
+		if isolated && c.WritePaths[i].ShardOutputs {
+			ring, err := newShardRing(Endpoints[i].Sinks, c.WritePaths[i].ReplicationFactor)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err, "section": "main"}).Fatal("Couldn't configure sharding")
+			}
+			Endpoints[i].WriteWG.Add(1)
+			go ShardOut(Endpoints[i].OutputTSDBChan, ring, &Endpoints[i].WriteWG)
+		} else if isolated {
 			Endpoints[i].WriteWG.Add(1)
-			cfg := OutputMeta{Thread: thread, BatchSize: c.WritePaths[i].SendBatch, WriteTimeout: c.WritePaths[i].WriteTimeout,
-				MaxRetries: c.WritePaths[i].MaxRetries, FlushSegment: c.WritePaths[i].TSDFlushSegment, URL: Endpoints[i].TSDURL,
-				TsdOrg: c.WritePaths[i].TSDDBOrg, TsdDbName: c.WritePaths[i].TSDDBName}
-			go SendTSDB(Endpoints[i].OutputCTX, Endpoints[i].OutputTSDBChan, Endpoints[i].FailedWritesChan, cfg, &Endpoints[i].WriteWG)
+			go FanOut(Endpoints[i].OutputTSDBChan, Endpoints[i].Sinks, &Endpoints[i].WriteWG)
+		}
+		/*
+			Our readers only pause for a single output's circuit breaker,
+			several outputs deal with a failing one on their own
+		*/
+		var breaker *CircuitBreaker
+		if !isolated {
+			breaker = Endpoints[i].Sinks[0].Breaker
 		}
 		/*
 			Actual kafka threads, connected to the Process threads
 			We initialize these last to have the rest of the pipeline
 			ready before we start actually consuming data
 		*/
+		inputs := []struct {
+			topics  []string
+			channel chan KafkaMsg
+		}{
+			{c.WritePaths[i].InfluxJSONTopics, Endpoints[i].ProcessInfluxJSONChan},
+			{c.WritePaths[i].InfluxLineTopics, Endpoints[i].ProcessInfluxLineChan},
+			{c.WritePaths[i].PromTopics, Endpoints[i].ProcessPromJSONChan},
+			{c.WritePaths[i].PromRemoteWriteTopics, Endpoints[i].ProcessPromRWChan},
+			{c.WritePaths[i].PromTextTopics, Endpoints[i].ProcessPromTextChan},
+			{c.WritePaths[i].MixedTopics, Endpoints[i].ProcessMixedChan},
+			{c.WritePaths[i].StatsdTopics, Endpoints[i].ProcessStatsdChan},
+			{c.WritePaths[i].OpenTSDBTopics, Endpoints[i].ProcessOpenTSDBChan},
+			{c.WritePaths[i].OTLPTopics, Endpoints[i].ProcessOTLPChan},
+			{c.WritePaths[i].GraphiteTopics, Endpoints[i].ProcessGraphiteChan},
+			{c.WritePaths[i].SchemaRegistryTopics, Endpoints[i].ProcessSchemaChan},
+		}
 		for thread := 1; thread <= c.WritePaths[i].ReadThreads; thread++ {
-			if len(c.WritePaths[i].InfluxJSONTopics) > 0 {
+			for _, input := range inputs {
+				if len(input.topics) < 1 {
+					continue
+				}
 				Endpoints[i].ReadWG.Add(1)
-				cfg := KafkaConsumerMeta{ThreadCount: thread, Topics: c.WritePaths[i].InfluxJSONTopics,
+				Endpoints[i].CommitWG.Add(1)
+				cfg := KafkaConsumerMeta{ThreadCount: thread, Topics: input.topics,
 					Brokers: c.BrokerStr, ConsumerGroup: c.ConsumerGroup,
 					ClientID: c.ClientID, SessionTimeout: c.SessionTimeout,
-					OffsetReset: c.Offset}
-				go ReadFromKafka(Endpoints[i].ReadCTX, cfg, Endpoints[i].ProcessInfluxJSONChan, &Endpoints[i].ReadWG)
-			}
-			if len(c.WritePaths[i].InfluxLineTopics) > 0 {
-				Endpoints[i].ReadWG.Add(1)
-				cfg := KafkaConsumerMeta{ThreadCount: thread, Topics: c.WritePaths[i].InfluxLineTopics,
-					Brokers: c.BrokerStr, ConsumerGroup: c.ConsumerGroup,
-					ClientID: c.ClientID, SessionTimeout: c.SessionTimeout,
-					OffsetReset: c.Offset}
-				go ReadFromKafka(Endpoints[i].ReadCTX, cfg, Endpoints[i].ProcessInfluxJSONChan, &Endpoints[i].ReadWG)
-			}
-			if len(c.WritePaths[i].PromTopics) > 0 {
-				Endpoints[i].ReadWG.Add(1)
-				cfg := KafkaConsumerMeta{ThreadCount: thread, Topics: c.WritePaths[i].PromTopics,
-					Brokers: c.BrokerStr, ConsumerGroup: c.ConsumerGroup,
-					ClientID: c.ClientID, SessionTimeout: c.SessionTimeout,
-					OffsetReset: c.Offset}
-				go ReadFromKafka(Endpoints[i].ReadCTX, cfg, Endpoints[i].ProcessPromJSONChan, &Endpoints[i].ReadWG)
+					OffsetReset: c.Offset, AtLeastOnce: c.AtLeastOnce, Breaker: breaker,
+					QueueFill: Endpoints[i].QueueFill, HighWatermark: *c.WritePaths[i].HighWatermark,
+					LowWatermark: *c.WritePaths[i].LowWatermark, Health: &Endpoints[i].Health,
+					MaxDecompressed: c.MaxDecompressedBytes}
+				go ReadFromKafka(Endpoints[i].ReadCTX, Endpoints[i].DrainCTX, Endpoints[i].CommitCTX, cfg, input.channel, &Endpoints[i].ReadWG, &Endpoints[i].CommitWG)
 			}
 		}
+		if c.WritePaths[i].StatsdListenAddress != "" {
+			Endpoints[i].ReadWG.Add(1)
+			go ListenStatsd(Endpoints[i].ReadCTX, c.WritePaths[i].StatsdListenAddress, Endpoints[i].Statsd, &Endpoints[i].ReadWG)
+		}
 	}
+	go StatsListener(c.StatsAddress, c.StatsPort)
 
 	run := true
 	for run == true {
 		select {
 		/*
 			Shut down steps...
-			Because we have wait groups stored for each pipeline object,
-			we can just loop through the WritePaths object and issue
-			cancel/wait commands to the wait groups and move along
+			Every pipeline drains in parallel. Once shutdown_timeout passes,
+			we stop waiting on outputs and spool/dead-letter whatever is left.
 		*/
 		case sig := <-sigchan:
-			log.WithFields(log.Fields{"error": sig, "section": "main"}).Error("Caught signal...terminating")
-			for i := 0; i < len(c.WritePaths); i++ {
-				log.WithFields(log.Fields{"queue": i}).Info("Closing ingest threads for writepath")
-				Endpoints[i].ReadCancel()
-				Endpoints[i].ReadWG.Wait()
-				log.WithFields(log.Fields{"Influx Proccess Queue": len(Endpoints[i].ProcessInfluxJSONChan), "Prometheus Process Queue": len(Endpoints[i].ProcessPromJSONChan), "section": "main"}).Info("Waiting on queues to flush...")
-				close(Endpoints[i].ProcessInfluxJSONChan)
-				close(Endpoints[i].ProcessPromJSONChan)
-				Endpoints[i].JSONCancel()
-				Endpoints[i].JSONWG.Wait()
-				log.WithFields(log.Fields{"Filter Queue": len(Endpoints[i].FilterTagChan), "section": "main"}).Info("Waiting on queues to flush...")
-				close(Endpoints[i].FilterTagChan)
-				Endpoints[i].FilterCancel()
-				Endpoints[i].FilterWG.Wait()
-				log.WithFields(log.Fields{"Output Queue": len(Endpoints[i].OutputTSDBChan), "section": "main"}).Info("Waiting on queues to flush...")
-				close(Endpoints[i].OutputTSDBChan)
-				Endpoints[i].OutputCancel()
-				Endpoints[i].WriteWG.Wait()
-				log.WithFields(log.Fields{"Failed Write Queue": len(Endpoints[i].FailedWritesChan), "section": "main"}).Info("Waiting on queues to flush...")
-				close(Endpoints[i].FailedWritesChan)
-				Endpoints[i].FailedCancel()
-				Endpoints[i].FailedWG.Wait()
+			log.WithFields(log.Fields{"error": sig, "timeout": c.ShutdownTimeout, "section": "main"}).Error("Caught signal...terminating")
+			deadline := time.AfterFunc(time.Duration(c.ShutdownTimeout*float64(time.Second)), func() {
+				log.WithFields(log.Fields{"section": "main"}).Error("Shutdown deadline reached, giving up on outputs")
+				for i := 0; i < len(Endpoints); i++ {
+					Endpoints[i].DrainCancel()
+				}
+			})
+			var shutdownWG sync.WaitGroup
+			for i := 0; i < len(Endpoints); i++ {
+				shutdownWG.Add(1)
+				go Endpoints[i].Shutdown(i, &shutdownWG)
+			}
+			shutdownWG.Wait()
+			if !deadline.Stop() || UndeliveredMsgs.Get() > 0 {
+				log.WithFields(log.Fields{"undelivered": UndeliveredMsgs.Get(), "section": "main"}).Error("Queues flushed, but not cleanly. Exiting.")
+				os.Exit(ExitUncleanShutdown)
 			}
 			log.WithFields(log.Fields{"section": "main"}).Info("Queues flushed. Exiting.")
 			run = false
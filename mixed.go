@@ -0,0 +1,170 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"strings"
+
+	json "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// the Kafka header producers on mixed topics can use to tell us what a message is
+const contentTypeHeader = "content-type"
+
+/*
+mixedDecoder :
+Decodes messages from topics where producers mix formats.
+Prometheus formats go straight to output (like prometheus_topics),
+everything else is sent through filtering.
+*/
+type mixedDecoder struct {
+	promote         map[string]bool
+	maxDecompressed int64
+	normalize       bool
+	flipSingleField bool
+}
+
+/*
+contentTypeFormat maps a content-type header to the format it names.
+Either one of our format names (the same ones we put in parse failure headers)
+or a common MIME type. application/json is ambiguous, so we still have to sniff it.
+*/
+func contentTypeFormat(contentType string, msg []byte) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	switch mediaType {
+	case FormatInfluxLine, FormatInfluxJSON, FormatPromJSON, FormatPromRemoteWrite, FormatPromText, FormatOTLPProto, FormatOTLPJSON:
+		return mediaType, nil
+	case "text/plain":
+		// Prometheus' text exposition is text/plain; version=0.0.4
+		if params["version"] != "" {
+			return FormatPromText, nil
+		}
+		return FormatInfluxLine, nil
+	case "application/openmetrics-text":
+		return FormatPromText, nil
+	case "application/json":
+		return sniffFormat(msg), nil
+	}
+	return "", fmt.Errorf("unsupported content-type %q", contentType)
+}
+
+/*
+sniffFormat guesses a message's format from its contents:
+a JSON object with labels is Prometheus JSON, any other JSON is influx JSON
+(single metrics, batches and arrays), and anything else is line protocol.
+*/
+func sniffFormat(msg []byte) string {
+	trimmed := bytes.TrimSpace(msg)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		// only look at the first object, in case this is newline-delimited JSON
+		var fields map[string]json.RawMessage
+		if err := json.NewDecoder(bytes.NewReader(trimmed)).Decode(&fields); err == nil {
+			if _, ok := fields["labels"]; ok {
+				return FormatPromJSON
+			}
+		}
+		return FormatInfluxJSON
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		return FormatInfluxJSON
+	}
+	return FormatInfluxLine
+}
+
+/*
+deserialize picks a decoder for a single message and runs it.
+Returns the format we picked and whether its metrics need filtering.
+*/
+func (d *mixedDecoder) deserialize(thread int, msg KafkaMsg) (string, bool, []InfluxMetric, error) {
+	format := sniffFormat(msg.Value)
+	if msg.ContentType != "" {
+		var err error
+		if format, err = contentTypeFormat(msg.ContentType, msg.Value); err != nil {
+			log.WithFields(log.Fields{"threadNum": thread, "error": err, "section": "mixed processing"}).Error("Couldn't process message")
+			return FormatMixed, false, nil, err
+		}
+	}
+	mixedMsgs(format).Inc()
+	var metrics []InfluxMetric
+	var err error
+	switch format {
+	case FormatInfluxLine:
+		metrics, err = deserializeInfluxLine(thread, msg.Value, d.flipSingleField)
+	case FormatInfluxJSON:
+		metrics, err = deserializeInfluxJSON(thread, msg.Value, d.flipSingleField)
+	case FormatPromJSON:
+		metrics, err = deserializePromJSON(thread, msg.Value, d.normalize, d.flipSingleField)
+		return format, false, metrics, err
+	case FormatPromRemoteWrite:
+		metrics, err = deserializePromRemoteWrite(thread, msg, d.maxDecompressed, d.normalize, d.flipSingleField)
+		return format, false, metrics, err
+	case FormatPromText:
+		metrics, err = deserializePromText(thread, msg.Value, msg.Source.receivedAt(), d.normalize, d.flipSingleField)
+		return format, false, metrics, err
+	case FormatOTLPProto, FormatOTLPJSON:
+		metrics, err = deserializeOTLP(thread, msg.Value, d.promote, d.flipSingleField)
+	}
+	return format, true, metrics, err
+}
+
+// ProcessMixedMsg : parse and forward messages from topics with more than one format
+func ProcessMixedMsg(ctx context.Context, thread int, inChannel chan KafkaMsg, filterChannel chan InfluxMetric, outChannel chan InfluxMetric, parseFailedChan chan ParseFailure, promoteAttributes []string, maxDecompressed int64, normalize bool, flipSingleField bool, wg *Stage) {
+	log.WithFields(log.Fields{"threadNum": thread, "section": "mixed processing"}).Info("processing thread starting...")
+	defer wg.Done()
+	decoder := &mixedDecoder{promote: make(map[string]bool, len(promoteAttributes)), maxDecompressed: maxDecompressed,
+		normalize: normalize, flipSingleField: flipSingleField}
+	for _, attr := range promoteAttributes {
+		decoder.promote[attr] = true
+	}
+	process := func(msg KafkaMsg) {
+		format, filter, metrics, err := decoder.deserialize(thread, msg)
+		if filter {
+			handleParsed(msg, format, metrics, err, filterChannel, parseFailedChan)
+		} else {
+			handleParsed(msg, format, metrics, err, outChannel, parseFailedChan)
+		}
+	}
+
+processloop:
+	for {
+		select {
+		case msg := <-inChannel:
+			process(msg)
+		case <-ctx.Done():
+			log.WithFields(log.Fields{"threadNum": thread, "section": "mixed processing"}).Info("Closing processing thread...")
+			for msg := range inChannel {
+				process(msg)
+			}
+			break processloop
+		}
+	}
+}
@@ -0,0 +1,73 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"testing"
+)
+
+/*
+Things we should check:
+1. without a content-type, JSON with labels is prometheus, other JSON is influx and anything else is line protocol
+2. content-type headers (our format names or MIME types) pick the decoder
+3. prometheus formats skip filtering, influx-style formats don't
+4. unknown content-types fail to parse
+*/
+func TestMixed(t *testing.T) {
+	influxJSON := `{"fields": {"field": 1}, "tags": {"tag": "value"}, "name": "test_metric", "timestamp": 1637090544}`
+	promJSON := `{"value": "2", "name": "test_metric_field", "timestamp": "2021-11-16T07:20:50.52Z", "labels": {"__name__": "test_metric_field", "tag": "value"}}`
+	line := "test_metric,tag=value field=1 1637090544000000000"
+	promText := "# TYPE test_metric_total counter\ntest_metric_total 3\n"
+	decoder := &mixedDecoder{promote: map[string]bool{}}
+	for _, test := range []struct {
+		msg         string
+		contentType string
+		format      string
+		filter      bool
+	}{
+		{influxJSON, "", FormatInfluxJSON, true},
+		{"[" + influxJSON + "]", "", FormatInfluxJSON, true},
+		{promJSON, "", FormatPromJSON, false},
+		{line, "", FormatInfluxLine, true},
+		{promJSON, "application/json; charset=utf-8", FormatPromJSON, false},
+		{line, "text/plain", FormatInfluxLine, true},
+		{promText, "text/plain; version=0.0.4", FormatPromText, false},
+		{promText, "prometheus_text", FormatPromText, false},
+		{influxJSON, "INFLUX_JSON", FormatInfluxJSON, true},
+	} {
+		format, filter, metrics, err := decoder.deserialize(1, KafkaMsg{Value: []byte(test.msg), ContentType: test.contentType})
+		if err != nil || len(metrics) != 1 {
+			t.Fatalf("Couldn't deserialize %q (%v): %+v (%v)", test.msg, test.contentType, metrics, err)
+		}
+		if format != test.format || filter != test.filter {
+			t.Fatalf("%q (%v) was decoded as %v (filtered: %v) -> should be %v (filtered: %v)", test.msg, test.contentType, format, filter, test.format, test.filter)
+		}
+	}
+	if format, _, _, err := decoder.deserialize(1, KafkaMsg{Value: []byte(line), ContentType: "application/xml"}); err == nil || format != FormatMixed {
+		t.Fatalf("unknown content-type should fail to parse: %v (%v)", format, err)
+	}
+	if _, _, _, err := decoder.deserialize(1, KafkaMsg{Value: []byte(line), ContentType: FormatPromJSON}); err == nil {
+		t.Fatalf("line protocol with a prometheus JSON content-type should fail to parse")
+	}
+}
@@ -0,0 +1,186 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+/*
+MessageSource :
+Where a message came from in Kafka.
+
+Every metric we deserialize from a message carries a pointer back to
+the message's source. The source counts how many of those metrics are still
+in flight so that (in at-least-once mode) we only commit the message's offset
+once every metric has been written or handed to the dead letter queue.
+*/
+type MessageSource struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Timestamp time.Time
+	pending   int32
+}
+
+// KafkaMsg : a raw message from Kafka along with its source
+type KafkaMsg struct {
+	Value  []byte
+	Source *MessageSource
+	// the message's content-type header (if it had one)
+	ContentType string
+	// the value exactly as it was produced (if we decompressed it), for parse failures
+	Raw []byte
+	// the content-encoding the reader already undid (EncodingIdentity or empty if none)
+	Encoding string
+}
+
+// original : the message's value as it was produced
+func (m KafkaMsg) original() []byte {
+	if m.Raw != nil {
+		return m.Raw
+	}
+	return m.Value
+}
+
+/*
+newMessageSource starts the source with a single pending reference.
+That reference belongs to the processing thread and is released (with Done)
+once every metric from the message has been sent along. This keeps us from
+committing a message before all of its metrics have even been created.
+*/
+func newMessageSource(msg *kafka.Message) *MessageSource {
+	src := &MessageSource{Partition: msg.TopicPartition.Partition,
+		Offset: int64(msg.TopicPartition.Offset), Timestamp: msg.Timestamp, pending: 1}
+	if msg.TopicPartition.Topic != nil {
+		src.Topic = *msg.TopicPartition.Topic
+	}
+	return src
+}
+
+// Hold : add references for metrics that still need to be delivered
+func (s *MessageSource) Hold(count int) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt32(&s.pending, int32(count))
+}
+
+// Done : release a reference once a metric has been delivered (or intentionally dropped)
+func (s *MessageSource) Done() {
+	if s == nil {
+		return
+	}
+	atomic.AddInt32(&s.pending, -1)
+}
+
+// receivedAt : when Kafka got a message (or now, if we don't know)
+func (s *MessageSource) receivedAt() time.Time {
+	if s == nil || s.Timestamp.IsZero() {
+		return time.Now()
+	}
+	return s.Timestamp
+}
+
+// Delivered : whether every metric from this message has been handled
+func (s *MessageSource) Delivered() bool {
+	return atomic.LoadInt32(&s.pending) <= 0
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+/*
+offsetTracker :
+Tracks in-flight messages for a single consumer, in the order we received them.
+
+We can only commit a partition up to the first message that is still in flight,
+so each partition is a simple queue we pop delivered messages off of.
+Without at-least-once, a message counts as delivered as soon as it's tracked
+(i.e. handed to the pipeline), but messages we never hand over still aren't committed.
+Only the owning Kafka reader thread touches the tracker, so it needs no locking
+(the per-message counters are atomic).
+*/
+type offsetTracker struct {
+	partitions  map[topicPartition][]*MessageSource
+	atLeastOnce bool
+}
+
+func newOffsetTracker(atLeastOnce bool) *offsetTracker {
+	return &offsetTracker{partitions: make(map[topicPartition][]*MessageSource), atLeastOnce: atLeastOnce}
+}
+
+func (t *offsetTracker) track(src *MessageSource) {
+	key := topicPartition{topic: src.Topic, partition: src.Partition}
+	t.partitions[key] = append(t.partitions[key], src)
+}
+
+/*
+committable returns the offsets we can safely store for each partition
+(the offset of the last contiguous delivered message + 1, per Kafka convention)
+*/
+func (t *offsetTracker) committable() []kafka.TopicPartition {
+	var offsets []kafka.TopicPartition
+	for key, queue := range t.partitions {
+		delivered := 0
+		for delivered < len(queue) && (!t.atLeastOnce || queue[delivered].Delivered()) {
+			delivered++
+		}
+		if delivered == 0 {
+			continue
+		}
+		topic := key.topic
+		offsets = append(offsets, kafka.TopicPartition{Topic: &topic, Partition: key.partition,
+			Offset: kafka.Offset(queue[delivered-1].Offset + 1)})
+		t.partitions[key] = queue[delivered:]
+	}
+	return offsets
+}
+
+// pending counts messages we've received but can't commit yet
+func (t *offsetTracker) pending() int {
+	count := 0
+	for _, queue := range t.partitions {
+		count += len(queue)
+	}
+	return count
+}
+
+/*
+revoke forgets about partitions we no longer own.
+Anything still in flight for them will be re-delivered to whoever picks the partition up.
+*/
+func (t *offsetTracker) revoke(partitions []kafka.TopicPartition) {
+	for _, tp := range partitions {
+		if tp.Topic == nil {
+			continue
+		}
+		delete(t.partitions, topicPartition{topic: *tp.Topic, partition: tp.Partition})
+	}
+}
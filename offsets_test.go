@@ -0,0 +1,85 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+func testSource(topic string, partition int32, offset int64) *MessageSource {
+	return newMessageSource(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic,
+		Partition: partition, Offset: kafka.Offset(offset)}})
+}
+
+/*
+Things we should check:
+1. nothing is committable until the processing thread lets go of a message
+2. a message with in-flight metrics blocks later messages in the same partition
+3. partitions are tracked independently
+4. revoked partitions are forgotten
+*/
+func TestOffsetTracker(t *testing.T) {
+	tracker := newOffsetTracker(true)
+	first := testSource("test", 0, 10)
+	second := testSource("test", 0, 11)
+	other := testSource("test", 1, 5)
+	tracker.track(first)
+	tracker.track(second)
+	tracker.track(other)
+
+	if offsets := tracker.committable(); len(offsets) > 0 {
+		t.Fatalf("Offsets committable before any message was processed: %v", offsets)
+	}
+	// first message produced two metrics, only one of which has been written
+	first.Hold(2)
+	first.Done()
+	first.Done()
+	// second message produced nothing (e.g. everything was filtered)
+	second.Done()
+	if offsets := tracker.committable(); len(offsets) > 0 {
+		t.Fatalf("Offsets committable with a metric still in flight: %v", offsets)
+	}
+	first.Done()
+	offsets := tracker.committable()
+	if len(offsets) != 1 {
+		t.Fatalf("Wrong number of committable partitions: %v -> should be 1", offsets)
+	}
+	if offsets[0].Partition != 0 || offsets[0].Offset != 12 {
+		t.Fatalf("Wrong committable offset: %v -> should be partition 0, offset 12", offsets[0])
+	}
+	if tracker.pending() != 1 {
+		t.Fatalf("Wrong number of pending messages: %v -> should be 1", tracker.pending())
+	}
+	topic := "test"
+	tracker.revoke([]kafka.TopicPartition{{Topic: &topic, Partition: 1}})
+	other.Done()
+	if offsets := tracker.committable(); len(offsets) > 0 {
+		t.Fatalf("Offsets committable for a revoked partition: %v", offsets)
+	}
+	if tracker.pending() != 0 {
+		t.Fatalf("Wrong number of pending messages: %v -> should be 0", tracker.pending())
+	}
+}
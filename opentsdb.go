@@ -0,0 +1,198 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	json "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// openTSDBPoint : a single data point in OpenTSDB's /api/put JSON
+type openTSDBPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp json.Number       `json:"timestamp"`
+	Value     json.Number       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+/*
+openTSDBTimestamp converts an OpenTSDB timestamp to seconds.
+OpenTSDB takes seconds (10 digits) or milliseconds (13 digits).
+*/
+func openTSDBTimestamp(raw string) (int64, error) {
+	ts, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || ts < 0 {
+		return 0, fmt.Errorf("bad timestamp %q", raw)
+	}
+	if ts > 9999999999 {
+		ts /= 1000
+	}
+	return ts, nil
+}
+
+// openTSDBValue keeps integers as integers, like OpenTSDB does
+func openTSDBValue(raw string) (interface{}, error) {
+	if value, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return value, nil
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad value %q", raw)
+	}
+	return value, nil
+}
+
+// openTSDBMetric turns a data point into a metric with a Prometheus-safe name
+func openTSDBMetric(metric string, timestamp string, value string, tags map[string]string) (InfluxMetric, error) {
+	if metric == "" {
+		return InfluxMetric{}, fmt.Errorf("data point has no metric name")
+	}
+	ts, err := openTSDBTimestamp(timestamp)
+	if err != nil {
+		return InfluxMetric{}, err
+	}
+	parsed, err := openTSDBValue(value)
+	if err != nil {
+		return InfluxMetric{}, err
+	}
+	return InfluxMetric{Name: replaceChars.ReplaceAllString(metric, "_"), Tags: copyTags(tags),
+		Fields: map[string]interface{}{"value": parsed}, Timestamp: ts}, nil
+}
+
+// parseOpenTSDBTelnet reads `put <metric> <timestamp> <value> <tagk1=tagv1 ...>` lines
+func parseOpenTSDBTelnet(msg []byte) ([]InfluxMetric, error) {
+	var metrics []InfluxMetric
+	scanner := bufio.NewScanner(bytes.NewReader(msg))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(msg)+1)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) == 0 {
+			continue
+		}
+		if parts[0] != "put" || len(parts) < 4 {
+			return nil, fmt.Errorf("bad put line %q", scanner.Text())
+		}
+		tags := make(map[string]string, len(parts)-4)
+		for _, tag := range parts[4:] {
+			sep := strings.IndexByte(tag, '=')
+			if sep < 1 {
+				return nil, fmt.Errorf("bad tag %q in %q", tag, scanner.Text())
+			}
+			tags[tag[:sep]] = tag[sep+1:]
+		}
+		metric, err := openTSDBMetric(parts[1], parts[2], parts[3], tags)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, scanner.Err()
+}
+
+// parseOpenTSDBJSON reads /api/put JSON: a single data point or an array of them
+func parseOpenTSDBJSON(msg []byte) ([]InfluxMetric, error) {
+	var points []openTSDBPoint
+	trimmed := bytes.TrimSpace(msg)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		if err := json.Unmarshal(trimmed, &points); err != nil {
+			return nil, err
+		}
+	} else {
+		var point openTSDBPoint
+		if err := json.Unmarshal(trimmed, &point); err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+	metrics := make([]InfluxMetric, 0, len(points))
+	for _, point := range points {
+		metric, err := openTSDBMetric(point.Metric, point.Timestamp.String(), point.Value.String(), point.Tags)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, nil
+}
+
+// openTSDBFormat : whether a message is JSON or telnet style
+func openTSDBFormat(msg []byte) string {
+	trimmed := bytes.TrimSpace(msg)
+	if bytes.HasPrefix(trimmed, []byte("{")) || bytes.HasPrefix(trimmed, []byte("[")) {
+		return FormatOpenTSDBJSON
+	}
+	return FormatOpenTSDB
+}
+
+func deserializeOpenTSDB(thread int, msg []byte) ([]InfluxMetric, error) {
+	ProcTimeStart := time.Now()
+	defer func() { ProcessTime.Add(float64(time.Now().Sub(ProcTimeStart)) / TimeSegmentDivisor) }()
+	ReceivedMsgs.Inc()
+	if msg == nil {
+		log.Warning("Empty message received from Kafka")
+		return nil, nil
+	}
+	var metrics []InfluxMetric
+	var err error
+	if openTSDBFormat(msg) == FormatOpenTSDBJSON {
+		metrics, err = parseOpenTSDBJSON(msg)
+	} else {
+		metrics, err = parseOpenTSDBTelnet(msg)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"threadNum": thread, "error": err, "section": "opentsdb processing"}).Error("Couldn't process message")
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// ProcessOpenTSDBMsg : parse and forward an OpenTSDB message
+func ProcessOpenTSDBMsg(ctx context.Context, thread int, inChannel chan KafkaMsg, outChannel chan InfluxMetric, parseFailedChan chan ParseFailure, wg *Stage) {
+	log.WithFields(log.Fields{"threadNum": thread, "section": "opentsdb processing"}).Info("processing thread starting...")
+	defer wg.Done()
+
+processloop:
+	for {
+		select {
+		case msg := <-inChannel:
+			metrics, err := deserializeOpenTSDB(thread, msg.Value)
+			handleParsed(msg, openTSDBFormat(msg.Value), metrics, err, outChannel, parseFailedChan)
+		case <-ctx.Done():
+			log.WithFields(log.Fields{"threadNum": thread, "section": "opentsdb processing"}).Info("Closing processing thread...")
+			for msg := range inChannel {
+				metrics, err := deserializeOpenTSDB(thread, msg.Value)
+				handleParsed(msg, openTSDBFormat(msg.Value), metrics, err, outChannel, parseFailedChan)
+			}
+			break processloop
+		}
+	}
+}
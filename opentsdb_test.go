@@ -0,0 +1,79 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"testing"
+)
+
+/*
+Things we should check:
+1. telnet put lines (second and millisecond timestamps, integer and float values) become metrics
+2. /api/put JSON works for single data points and arrays
+3. dotted metric names are made Prometheus-safe
+4. bad lines/JSON fail to parse
+*/
+func TestOpenTSDB(t *testing.T) {
+	msg := "put sys.cpu.user 1637047250 42 host=web01 cpu=0\n\nput sys.cpu.nice 1637047250500 1.5 host=web01\n"
+	results, err := deserializeOpenTSDB(1, []byte(msg))
+	if err != nil {
+		t.Fatalf("Couldn't deserialize message: %v", err)
+	}
+	if len(results) != 2 || openTSDBFormat([]byte(msg)) != FormatOpenTSDB {
+		t.Fatalf("metric count is wrong: %v -> should be 2", len(results))
+	}
+	if results[0].Name != "sys_cpu_user" || results[0].Fields["value"].(int64) != 42 || results[0].Timestamp != 1637047250 ||
+		results[0].Tags["host"] != "web01" || results[0].Tags["cpu"] != "0" {
+		t.Fatalf("put line is wrong: %+v", results[0])
+	}
+	if results[1].Name != "sys_cpu_nice" || results[1].Fields["value"].(float64) != 1.5 || results[1].Timestamp != 1637047250 {
+		t.Fatalf("millisecond put line is wrong: %+v", results[1])
+	}
+
+	single := `{"metric": "sys.mem.free", "timestamp": 1637047250, "value": 1024, "tags": {"host": "web01"}}`
+	results, err = deserializeOpenTSDB(1, []byte(single))
+	if err != nil || len(results) != 1 || results[0].Name != "sys_mem_free" || results[0].Fields["value"].(int64) != 1024 ||
+		results[0].Tags["host"] != "web01" || openTSDBFormat([]byte(single)) != FormatOpenTSDBJSON {
+		t.Fatalf("single JSON data point is wrong: %+v (%v)", results, err)
+	}
+	results, err = deserializeOpenTSDB(1, []byte("["+single+`, {"metric": "sys.load-1m", "timestamp": 1637047250000, "value": 0.25, "tags": {}}]`))
+	if err != nil || len(results) != 2 || results[1].Name != "sys_load_1m" || results[1].Fields["value"].(float64) != 0.25 ||
+		results[1].Timestamp != 1637047250 {
+		t.Fatalf("JSON array is wrong: %+v (%v)", results, err)
+	}
+
+	for _, bad := range []string{
+		"sys.cpu.user 1637047250 42 host=web01",
+		"put sys.cpu.user 1637047250",
+		"put sys.cpu.user yesterday 42 host=web01",
+		"put sys.cpu.user 1637047250 lots host=web01",
+		"put sys.cpu.user 1637047250 42 host",
+		`{"metric": "", "timestamp": 1637047250, "value": 1}`,
+		`[{"metric": "sys.cpu.user", "timestamp": 1637047250, "value": 1}`,
+	} {
+		if _, err := deserializeOpenTSDB(1, []byte(bad)); err == nil {
+			t.Fatalf("%q should fail to parse", bad)
+		}
+	}
+}
@@ -0,0 +1,924 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	json "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+/*
+OTLP metrics (ExportMetricsServiceRequest), as sent by the OpenTelemetry Collector's Kafka exporter.
+
+Both the protobuf and JSON encodings decode into the same structs.
+The JSON tags follow protobuf's JSON mapping (lowerCamelCase names, 64 bit integers as strings).
+*/
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	// older collectors (before scopes were introduced)
+	LibraryMetrics []otlpScopeMetrics `json:"instrumentationLibraryMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Library otlpScope    `json:"instrumentationLibrary"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name       string         `json:"name"`
+	Version    string         `json:"version"`
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpMetric struct {
+	Name                 string            `json:"name"`
+	Gauge                *otlpGauge        `json:"gauge"`
+	Sum                  *otlpSum          `json:"sum"`
+	Histogram            *otlpHistogram    `json:"histogram"`
+	ExponentialHistogram *otlpExpHistogram `json:"exponentialHistogram"`
+	Summary              *struct{}         `json:"summary"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints  []otlpNumberPoint `json:"dataPoints"`
+	Temporality otlpTemporality   `json:"aggregationTemporality"`
+	IsMonotonic bool              `json:"isMonotonic"`
+}
+
+type otlpHistogram struct {
+	DataPoints  []otlpHistogramPoint `json:"dataPoints"`
+	Temporality otlpTemporality      `json:"aggregationTemporality"`
+}
+
+type otlpExpHistogram struct {
+	DataPoints  []otlpExpHistogramPoint `json:"dataPoints"`
+	Temporality otlpTemporality         `json:"aggregationTemporality"`
+}
+
+type otlpNumberPoint struct {
+	Attributes   []otlpKeyValue `json:"attributes"`
+	TimeUnixNano otlpInt        `json:"timeUnixNano"`
+	AsDouble     *otlpFloat     `json:"asDouble"`
+	AsInt        *otlpInt       `json:"asInt"`
+}
+
+type otlpHistogramPoint struct {
+	Attributes     []otlpKeyValue `json:"attributes"`
+	TimeUnixNano   otlpInt        `json:"timeUnixNano"`
+	Count          otlpInt        `json:"count"`
+	Sum            *otlpFloat     `json:"sum"`
+	BucketCounts   []otlpInt      `json:"bucketCounts"`
+	ExplicitBounds []otlpFloat    `json:"explicitBounds"`
+	Min            *otlpFloat     `json:"min"`
+	Max            *otlpFloat     `json:"max"`
+}
+
+type otlpExpHistogramPoint struct {
+	Attributes    []otlpKeyValue `json:"attributes"`
+	TimeUnixNano  otlpInt        `json:"timeUnixNano"`
+	Count         otlpInt        `json:"count"`
+	Sum           *otlpFloat     `json:"sum"`
+	Scale         int32          `json:"scale"`
+	ZeroCount     otlpInt        `json:"zeroCount"`
+	Positive      otlpBuckets    `json:"positive"`
+	Negative      otlpBuckets    `json:"negative"`
+	Min           *otlpFloat     `json:"min"`
+	Max           *otlpFloat     `json:"max"`
+	ZeroThreshold otlpFloat      `json:"zeroThreshold"`
+}
+
+type otlpBuckets struct {
+	Offset       int32     `json:"offset"`
+	BucketCounts []otlpInt `json:"bucketCounts"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string         `json:"stringValue"`
+	BoolValue   *bool           `json:"boolValue"`
+	IntValue    *otlpInt        `json:"intValue"`
+	DoubleValue *otlpFloat      `json:"doubleValue"`
+	ArrayValue  *otlpArrayValue `json:"arrayValue"`
+	KvlistValue *otlpKvlist     `json:"kvlistValue"`
+	BytesValue  []byte          `json:"bytesValue"`
+}
+
+type otlpArrayValue struct {
+	Values []otlpAnyValue `json:"values"`
+}
+
+type otlpKvlist struct {
+	Values []otlpKeyValue `json:"values"`
+}
+
+// otlpInt : a 64 bit integer, which JSON encodes as a string (but may also be a number)
+type otlpInt int64
+
+// UnmarshalJSON : accept both quoted and bare integers
+func (i *otlpInt) UnmarshalJSON(data []byte) error {
+	v, err := strconv.ParseInt(string(bytes.Trim(data, `"`)), 10, 64)
+	*i = otlpInt(v)
+	return err
+}
+
+// otlpFloat : a double, which JSON encodes as a number (or "NaN"/"Infinity"/"-Infinity")
+type otlpFloat float64
+
+// UnmarshalJSON : accept numbers and the special string values
+func (f *otlpFloat) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case `"NaN"`:
+		*f = otlpFloat(math.NaN())
+	case `"Infinity"`:
+		*f = otlpFloat(math.Inf(1))
+	case `"-Infinity"`:
+		*f = otlpFloat(math.Inf(-1))
+	default:
+		v, err := strconv.ParseFloat(string(bytes.Trim(data, `"`)), 64)
+		*f = otlpFloat(v)
+		return err
+	}
+	return nil
+}
+
+// otlpTemporality : AggregationTemporality, which JSON encodes as a number or the enum's name
+type otlpTemporality int32
+
+const (
+	otlpTemporalityUnspecified otlpTemporality = 0
+	otlpTemporalityDelta       otlpTemporality = 1
+	otlpTemporalityCumulative  otlpTemporality = 2
+)
+
+// UnmarshalJSON : accept both the enum's number and name
+func (t *otlpTemporality) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case `"AGGREGATION_TEMPORALITY_UNSPECIFIED"`:
+		*t = otlpTemporalityUnspecified
+	case `"AGGREGATION_TEMPORALITY_DELTA"`:
+		*t = otlpTemporalityDelta
+	case `"AGGREGATION_TEMPORALITY_CUMULATIVE"`:
+		*t = otlpTemporalityCumulative
+	default:
+		v, err := strconv.ParseInt(string(data), 10, 32)
+		*t = otlpTemporality(v)
+		return err
+	}
+	return nil
+}
+
+func (t otlpTemporality) String() string {
+	switch t {
+	case otlpTemporalityDelta:
+		return "delta"
+	case otlpTemporalityCumulative:
+		return "cumulative"
+	}
+	return "unspecified"
+}
+
+/*
+Decoding the protobuf encoding.
+Field numbers are from opentelemetry-proto's metrics/v1, common/v1 and resource/v1 protos.
+*/
+
+// protoScalar : the value of a varint/fixed field (wire types are checked so bad data can't be misread)
+func protoScalar(num protowire.Number, typ protowire.Type, want protowire.Type, raw []byte) (uint64, error) {
+	if typ != want {
+		return 0, fmt.Errorf("field %v: expected wire type %v, got %v", num, want, typ)
+	}
+	switch typ {
+	case protowire.VarintType:
+		v, _ := protowire.ConsumeVarint(raw)
+		return v, nil
+	case protowire.Fixed32Type:
+		v, _ := protowire.ConsumeFixed32(raw)
+		return uint64(v), nil
+	}
+	v, _ := protowire.ConsumeFixed64(raw)
+	return v, nil
+}
+
+// protoRepeated : the values of a repeated scalar field (packed or not)
+func protoRepeated(num protowire.Number, typ protowire.Type, want protowire.Type, raw []byte) ([]uint64, error) {
+	if typ != protowire.BytesType {
+		v, err := protoScalar(num, typ, want, raw)
+		return []uint64{v}, err
+	}
+	packed, err := protoBytes(num, typ, raw)
+	if err != nil {
+		return nil, err
+	}
+	var values []uint64
+	for len(packed) > 0 {
+		n := protowire.ConsumeFieldValue(num, want, packed)
+		if n < 0 {
+			return nil, fmt.Errorf("field %v: %w", num, protowire.ParseError(n))
+		}
+		v, _ := protoScalar(num, want, want, packed[:n])
+		values = append(values, v)
+		packed = packed[n:]
+	}
+	return values, nil
+}
+
+func protoDouble(num protowire.Number, typ protowire.Type, raw []byte) (*otlpFloat, error) {
+	v, err := protoScalar(num, typ, protowire.Fixed64Type, raw)
+	f := otlpFloat(math.Float64frombits(v))
+	return &f, err
+}
+
+func protoString(num protowire.Number, typ protowire.Type, raw []byte) (string, error) {
+	b, err := protoBytes(num, typ, raw)
+	return string(b), err
+}
+
+// protoMessage : decode a length-delimited field as an embedded message
+func protoMessage(num protowire.Number, typ protowire.Type, raw []byte, decode func([]byte) error) error {
+	b, err := protoBytes(num, typ, raw)
+	if err != nil {
+		return err
+	}
+	return decode(b)
+}
+
+func decodeOTLPAnyValue(msg []byte, value *otlpAnyValue) error {
+	return protoFields(msg, func(num protowire.Number, typ protowire.Type, raw []byte) error {
+		switch num {
+		case 1:
+			s, err := protoString(num, typ, raw)
+			value.StringValue = &s
+			return err
+		case 2:
+			v, err := protoScalar(num, typ, protowire.VarintType, raw)
+			b := v != 0
+			value.BoolValue = &b
+			return err
+		case 3:
+			v, err := protoScalar(num, typ, protowire.VarintType, raw)
+			i := otlpInt(v)
+			value.IntValue = &i
+			return err
+		case 4:
+			f, err := protoDouble(num, typ, raw)
+			value.DoubleValue = f
+			return err
+		case 5:
+			value.ArrayValue = &otlpArrayValue{}
+			return protoMessage(num, typ, raw, func(b []byte) error {
+				return protoFields(b, func(num protowire.Number, typ protowire.Type, raw []byte) error {
+					if num != 1 {
+						return nil
+					}
+					var v otlpAnyValue
+					err := protoMessage(num, typ, raw, func(b []byte) error { return decodeOTLPAnyValue(b, &v) })
+					value.ArrayValue.Values = append(value.ArrayValue.Values, v)
+					return err
+				})
+			})
+		case 6:
+			value.KvlistValue = &otlpKvlist{}
+			return protoMessage(num, typ, raw, func(b []byte) error {
+				return decodeOTLPAttributes(b, 1, &value.KvlistValue.Values)
+			})
+		case 7:
+			b, err := protoBytes(num, typ, raw)
+			value.BytesValue = b
+			return err
+		}
+		return nil
+	})
+}
+
+// decodeOTLPAttributes : collect every KeyValue in field attrField of msg
+func decodeOTLPAttributes(msg []byte, attrField protowire.Number, attrs *[]otlpKeyValue) error {
+	return protoFields(msg, func(num protowire.Number, typ protowire.Type, raw []byte) error {
+		if num != attrField {
+			return nil
+		}
+		var kv otlpKeyValue
+		err := protoMessage(num, typ, raw, func(b []byte) error {
+			return protoFields(b, func(num protowire.Number, typ protowire.Type, raw []byte) error {
+				switch num {
+				case 1:
+					s, err := protoString(num, typ, raw)
+					kv.Key = s
+					return err
+				case 2:
+					return protoMessage(num, typ, raw, func(b []byte) error { return decodeOTLPAnyValue(b, &kv.Value) })
+				}
+				return nil
+			})
+		})
+		*attrs = append(*attrs, kv)
+		return err
+	})
+}
+
+func decodeOTLPNumberPoint(msg []byte) (otlpNumberPoint, error) {
+	var point otlpNumberPoint
+	err := protoFields(msg, func(num protowire.Number, typ protowire.Type, raw []byte) error {
+		switch num {
+		case 3:
+			v, err := protoScalar(num, typ, protowire.Fixed64Type, raw)
+			point.TimeUnixNano = otlpInt(v)
+			return err
+		case 4:
+			f, err := protoDouble(num, typ, raw)
+			point.AsDouble = f
+			return err
+		case 6:
+			v, err := protoScalar(num, typ, protowire.Fixed64Type, raw)
+			i := otlpInt(v)
+			point.AsInt = &i
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return point, err
+	}
+	return point, decodeOTLPAttributes(msg, 7, &point.Attributes)
+}
+
+func decodeOTLPHistogramPoint(msg []byte) (otlpHistogramPoint, error) {
+	var point otlpHistogramPoint
+	err := protoFields(msg, func(num protowire.Number, typ protowire.Type, raw []byte) error {
+		var err error
+		var v uint64
+		var values []uint64
+		switch num {
+		case 3:
+			v, err = protoScalar(num, typ, protowire.Fixed64Type, raw)
+			point.TimeUnixNano = otlpInt(v)
+		case 4:
+			v, err = protoScalar(num, typ, protowire.Fixed64Type, raw)
+			point.Count = otlpInt(v)
+		case 5:
+			point.Sum, err = protoDouble(num, typ, raw)
+		case 6:
+			values, err = protoRepeated(num, typ, protowire.Fixed64Type, raw)
+			for _, v := range values {
+				point.BucketCounts = append(point.BucketCounts, otlpInt(v))
+			}
+		case 7:
+			values, err = protoRepeated(num, typ, protowire.Fixed64Type, raw)
+			for _, v := range values {
+				point.ExplicitBounds = append(point.ExplicitBounds, otlpFloat(math.Float64frombits(v)))
+			}
+		case 11:
+			point.Min, err = protoDouble(num, typ, raw)
+		case 12:
+			point.Max, err = protoDouble(num, typ, raw)
+		}
+		return err
+	})
+	if err != nil {
+		return point, err
+	}
+	return point, decodeOTLPAttributes(msg, 9, &point.Attributes)
+}
+
+func decodeOTLPBuckets(msg []byte, buckets *otlpBuckets) error {
+	return protoFields(msg, func(num protowire.Number, typ protowire.Type, raw []byte) error {
+		switch num {
+		case 1:
+			v, err := protoScalar(num, typ, protowire.VarintType, raw)
+			buckets.Offset = int32(protowire.DecodeZigZag(v))
+			return err
+		case 2:
+			values, err := protoRepeated(num, typ, protowire.VarintType, raw)
+			for _, v := range values {
+				buckets.BucketCounts = append(buckets.BucketCounts, otlpInt(v))
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+func decodeOTLPExpHistogramPoint(msg []byte) (otlpExpHistogramPoint, error) {
+	var point otlpExpHistogramPoint
+	err := protoFields(msg, func(num protowire.Number, typ protowire.Type, raw []byte) error {
+		var err error
+		var v uint64
+		var f *otlpFloat
+		switch num {
+		case 3:
+			v, err = protoScalar(num, typ, protowire.Fixed64Type, raw)
+			point.TimeUnixNano = otlpInt(v)
+		case 4:
+			v, err = protoScalar(num, typ, protowire.Fixed64Type, raw)
+			point.Count = otlpInt(v)
+		case 5:
+			point.Sum, err = protoDouble(num, typ, raw)
+		case 6:
+			v, err = protoScalar(num, typ, protowire.VarintType, raw)
+			point.Scale = int32(protowire.DecodeZigZag(v))
+		case 7:
+			v, err = protoScalar(num, typ, protowire.Fixed64Type, raw)
+			point.ZeroCount = otlpInt(v)
+		case 8:
+			err = protoMessage(num, typ, raw, func(b []byte) error { return decodeOTLPBuckets(b, &point.Positive) })
+		case 9:
+			err = protoMessage(num, typ, raw, func(b []byte) error { return decodeOTLPBuckets(b, &point.Negative) })
+		case 12:
+			point.Min, err = protoDouble(num, typ, raw)
+		case 13:
+			point.Max, err = protoDouble(num, typ, raw)
+		case 14:
+			f, err = protoDouble(num, typ, raw)
+			point.ZeroThreshold = *f
+		}
+		return err
+	})
+	if err != nil {
+		return point, err
+	}
+	return point, decodeOTLPAttributes(msg, 1, &point.Attributes)
+}
+
+/*
+decodeOTLPData decodes the fields shared by every metric type's data message:
+data points (field 1), aggregation temporality (field 2) and monotonicity (field 3)
+*/
+func decodeOTLPData(msg []byte, point func([]byte) error, temporality *otlpTemporality, monotonic *bool) error {
+	return protoFields(msg, func(num protowire.Number, typ protowire.Type, raw []byte) error {
+		switch {
+		case num == 1:
+			return protoMessage(num, typ, raw, point)
+		case num == 2 && temporality != nil:
+			v, err := protoScalar(num, typ, protowire.VarintType, raw)
+			*temporality = otlpTemporality(v)
+			return err
+		case num == 3 && monotonic != nil:
+			v, err := protoScalar(num, typ, protowire.VarintType, raw)
+			*monotonic = v != 0
+			return err
+		}
+		return nil
+	})
+}
+
+func decodeOTLPMetric(msg []byte) (otlpMetric, error) {
+	var metric otlpMetric
+	err := protoFields(msg, func(num protowire.Number, typ protowire.Type, raw []byte) error {
+		switch num {
+		case 1:
+			s, err := protoString(num, typ, raw)
+			metric.Name = s
+			return err
+		case 5:
+			metric.Gauge = &otlpGauge{}
+			return protoMessage(num, typ, raw, func(b []byte) error {
+				return decodeOTLPData(b, func(b []byte) error {
+					point, err := decodeOTLPNumberPoint(b)
+					metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, point)
+					return err
+				}, nil, nil)
+			})
+		case 7:
+			metric.Sum = &otlpSum{}
+			return protoMessage(num, typ, raw, func(b []byte) error {
+				return decodeOTLPData(b, func(b []byte) error {
+					point, err := decodeOTLPNumberPoint(b)
+					metric.Sum.DataPoints = append(metric.Sum.DataPoints, point)
+					return err
+				}, &metric.Sum.Temporality, &metric.Sum.IsMonotonic)
+			})
+		case 9:
+			metric.Histogram = &otlpHistogram{}
+			return protoMessage(num, typ, raw, func(b []byte) error {
+				return decodeOTLPData(b, func(b []byte) error {
+					point, err := decodeOTLPHistogramPoint(b)
+					metric.Histogram.DataPoints = append(metric.Histogram.DataPoints, point)
+					return err
+				}, &metric.Histogram.Temporality, nil)
+			})
+		case 10:
+			metric.ExponentialHistogram = &otlpExpHistogram{}
+			return protoMessage(num, typ, raw, func(b []byte) error {
+				return decodeOTLPData(b, func(b []byte) error {
+					point, err := decodeOTLPExpHistogramPoint(b)
+					metric.ExponentialHistogram.DataPoints = append(metric.ExponentialHistogram.DataPoints, point)
+					return err
+				}, &metric.ExponentialHistogram.Temporality, nil)
+			})
+		case 11:
+			metric.Summary = &struct{}{}
+		}
+		return nil
+	})
+	return metric, err
+}
+
+func decodeOTLPScope(msg []byte, scope *otlpScope) error {
+	err := protoFields(msg, func(num protowire.Number, typ protowire.Type, raw []byte) error {
+		var err error
+		switch num {
+		case 1:
+			scope.Name, err = protoString(num, typ, raw)
+		case 2:
+			scope.Version, err = protoString(num, typ, raw)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return decodeOTLPAttributes(msg, 3, &scope.Attributes)
+}
+
+func decodeOTLPScopeMetrics(msg []byte) (otlpScopeMetrics, error) {
+	var scopeMetrics otlpScopeMetrics
+	err := protoFields(msg, func(num protowire.Number, typ protowire.Type, raw []byte) error {
+		switch num {
+		case 1:
+			return protoMessage(num, typ, raw, func(b []byte) error { return decodeOTLPScope(b, &scopeMetrics.Scope) })
+		case 2:
+			return protoMessage(num, typ, raw, func(b []byte) error {
+				metric, err := decodeOTLPMetric(b)
+				scopeMetrics.Metrics = append(scopeMetrics.Metrics, metric)
+				return err
+			})
+		}
+		return nil
+	})
+	return scopeMetrics, err
+}
+
+// decodeOTLPProto : decode a protobuf encoded ExportMetricsServiceRequest
+func decodeOTLPProto(msg []byte) (otlpRequest, error) {
+	var req otlpRequest
+	err := protoFields(msg, func(num protowire.Number, typ protowire.Type, raw []byte) error {
+		if num != 1 {
+			return nil
+		}
+		var rm otlpResourceMetrics
+		err := protoMessage(num, typ, raw, func(b []byte) error {
+			return protoFields(b, func(num protowire.Number, typ protowire.Type, raw []byte) error {
+				switch num {
+				case 1:
+					return protoMessage(num, typ, raw, func(b []byte) error {
+						return decodeOTLPAttributes(b, 1, &rm.Resource.Attributes)
+					})
+				// scope_metrics, and instrumentation_library_metrics from older collectors (which has the same layout)
+				case 2, 1000:
+					return protoMessage(num, typ, raw, func(b []byte) error {
+						scopeMetrics, err := decodeOTLPScopeMetrics(b)
+						rm.ScopeMetrics = append(rm.ScopeMetrics, scopeMetrics)
+						return err
+					})
+				}
+				return nil
+			})
+		})
+		req.ResourceMetrics = append(req.ResourceMetrics, rm)
+		return err
+	})
+	return req, err
+}
+
+// decodeOTLPJSON : decode a JSON encoded ExportMetricsServiceRequest
+func decodeOTLPJSON(msg []byte) (otlpRequest, error) {
+	var req otlpRequest
+	err := json.Unmarshal(msg, &req)
+	for i := range req.ResourceMetrics {
+		rm := &req.ResourceMetrics[i]
+		for _, lib := range rm.LibraryMetrics {
+			lib.Scope = lib.Library
+			rm.ScopeMetrics = append(rm.ScopeMetrics, lib)
+		}
+	}
+	return req, err
+}
+
+// otlpFormat : which encoding an OTLP message uses (a protobuf request can never start with '{')
+func otlpFormat(msg []byte) string {
+	if bytes.HasPrefix(bytes.TrimSpace(msg), []byte("{")) {
+		return FormatOTLPJSON
+	}
+	return FormatOTLPProto
+}
+
+// String : an attribute's value as a tag value
+func (v otlpAnyValue) String() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return strconv.FormatInt(int64(*v.IntValue), 10)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(float64(*v.DoubleValue), 'g', -1, 64)
+	case v.BytesValue != nil:
+		return base64.StdEncoding.EncodeToString(v.BytesValue)
+	case v.ArrayValue != nil:
+		values := make([]string, 0, len(v.ArrayValue.Values))
+		for _, value := range v.ArrayValue.Values {
+			values = append(values, value.String())
+		}
+		out, _ := json.Marshal(values)
+		return string(out)
+	case v.KvlistValue != nil:
+		values := make(map[string]string, len(v.KvlistValue.Values))
+		for _, kv := range v.KvlistValue.Values {
+			values[kv.Key] = kv.Value.String()
+		}
+		out, _ := json.Marshal(values)
+		return string(out)
+	}
+	return ""
+}
+
+/*
+otlpConverter turns decoded OTLP requests into influx metrics.
+promote limits which resource/scope attributes become tags (all of them if it's empty),
+data point attributes always become tags.
+*/
+type otlpConverter struct {
+	promote         map[string]bool
+	flipSingleField bool
+	metrics         []InfluxMetric
+}
+
+func (c *otlpConverter) addAttributes(tags map[string]string, attrs []otlpKeyValue, promoted bool) {
+	for _, attr := range attrs {
+		if promoted && len(c.promote) > 0 && !c.promote[attr.Key] {
+			continue
+		}
+		tags[attr.Key] = attr.Value.String()
+	}
+}
+
+func otlpTimestamp(timeUnixNano otlpInt) int64 {
+	if timeUnixNano == 0 {
+		return time.Now().Unix()
+	}
+	return int64(timeUnixNano) / int64(time.Second)
+}
+
+func otlpBound(bound float64) string {
+	if math.IsInf(bound, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(bound, 'g', -1, 64)
+}
+
+// add : queue up a metric (flipping its field if it only has one, like influx line protocol)
+func (c *otlpConverter) add(name string, tags map[string]string, fields map[string]interface{}, timestamp int64) {
+	metric := InfluxMetric{Name: name, Tags: tags, Fields: fields, Timestamp: timestamp}
+	if c.flipSingleField && len(fields) == 1 {
+		for field, value := range fields {
+			metric.Name = fmt.Sprintf("%v_%v", name, field)
+			metric.Fields = map[string]interface{}{"value": value}
+		}
+	}
+	c.metrics = append(c.metrics, metric)
+}
+
+func copyTags(tags map[string]string, extra ...string) map[string]string {
+	out := make(map[string]string, len(tags)+len(extra)/2)
+	for key, value := range tags {
+		out[key] = value
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		out[extra[i]] = extra[i+1]
+	}
+	return out
+}
+
+func (c *otlpConverter) numberPoints(name string, field string, points []otlpNumberPoint, tags map[string]string) {
+	for _, point := range points {
+		pointTags := copyTags(tags)
+		c.addAttributes(pointTags, point.Attributes, false)
+		var value interface{}
+		switch {
+		case point.AsDouble != nil:
+			if math.IsNaN(float64(*point.AsDouble)) || math.IsInf(float64(*point.AsDouble), 0) {
+				DroppedMsgs.Inc()
+				continue
+			}
+			value = float64(*point.AsDouble)
+		case point.AsInt != nil:
+			value = int64(*point.AsInt)
+		default:
+			// no recorded value
+			DroppedMsgs.Inc()
+			continue
+		}
+		c.add(name, pointTags, map[string]interface{}{field: value}, otlpTimestamp(point.TimeUnixNano))
+	}
+}
+
+// histogramFields : count/sum/min/max for either kind of histogram
+func histogramFields(count otlpInt, sum *otlpFloat, min *otlpFloat, max *otlpFloat) map[string]interface{} {
+	fields := map[string]interface{}{"count": int64(count)}
+	for field, value := range map[string]*otlpFloat{"sum": sum, "min": min, "max": max} {
+		if value != nil && !math.IsNaN(float64(*value)) && !math.IsInf(float64(*value), 0) {
+			fields[field] = float64(*value)
+		}
+	}
+	return fields
+}
+
+/*
+histogramPoints : a histogram becomes a metric with count/sum (and min/max) fields,
+plus a "bucket" metric for every bucket, tagged with its upper bound (le) and
+holding the cumulative count (like Prometheus histograms)
+*/
+func (c *otlpConverter) histogramPoints(name string, points []otlpHistogramPoint, tags map[string]string) {
+	for _, point := range points {
+		pointTags := copyTags(tags)
+		c.addAttributes(pointTags, point.Attributes, false)
+		timestamp := otlpTimestamp(point.TimeUnixNano)
+		c.add(name, pointTags, histogramFields(point.Count, point.Sum, point.Min, point.Max), timestamp)
+		cumulative := int64(0)
+		for i, count := range point.BucketCounts {
+			cumulative += int64(count)
+			bound := math.Inf(1)
+			if i < len(point.ExplicitBounds) {
+				bound = float64(point.ExplicitBounds[i])
+			}
+			c.add(name, copyTags(pointTags, "le", otlpBound(bound)), map[string]interface{}{"bucket": cumulative}, timestamp)
+		}
+	}
+}
+
+/*
+expHistogramPoints : exponential histograms are turned into explicit buckets, from the most negative bucket
+(each bucket's bound is base^index, where base = 2^(2^-scale)) through the zero bucket to the largest positive bucket
+*/
+func (c *otlpConverter) expHistogramPoints(name string, points []otlpExpHistogramPoint, tags map[string]string) {
+	for _, point := range points {
+		pointTags := copyTags(tags)
+		c.addAttributes(pointTags, point.Attributes, false)
+		timestamp := otlpTimestamp(point.TimeUnixNano)
+		fields := histogramFields(point.Count, point.Sum, point.Min, point.Max)
+		fields["zero_count"] = int64(point.ZeroCount)
+		fields["scale"] = int64(point.Scale)
+		c.add(name, pointTags, fields, timestamp)
+		base := math.Pow(2, math.Pow(2, float64(-point.Scale)))
+		cumulative := int64(0)
+		bucket := func(bound float64, count otlpInt) {
+			cumulative += int64(count)
+			c.add(name, copyTags(pointTags, "le", otlpBound(bound)), map[string]interface{}{"bucket": cumulative}, timestamp)
+		}
+		for i := len(point.Negative.BucketCounts) - 1; i >= 0; i-- {
+			bucket(-math.Pow(base, float64(int(point.Negative.Offset)+i)), point.Negative.BucketCounts[i])
+		}
+		bucket(float64(point.ZeroThreshold), point.ZeroCount)
+		for i, count := range point.Positive.BucketCounts {
+			bucket(math.Pow(base, float64(int(point.Positive.Offset)+i+1)), count)
+		}
+		bucket(math.Inf(1), point.Count-otlpInt(cumulative))
+	}
+}
+
+/*
+convert : every data point becomes a metric named after its OTLP metric
+  - gauges: a "gauge" field
+  - sums: a "counter" field if they're monotonic, "gauge" otherwise, tagged with their temporality
+  - histograms/exponential histograms: see histogramPoints/expHistogramPoints, tagged with their temporality
+
+Summaries (a legacy type) aren't supported and are dropped.
+*/
+func (c *otlpConverter) convert(req otlpRequest) []InfluxMetric {
+	for _, rm := range req.ResourceMetrics {
+		resourceTags := make(map[string]string)
+		c.addAttributes(resourceTags, rm.Resource.Attributes, true)
+		for _, sm := range rm.ScopeMetrics {
+			tags := copyTags(resourceTags)
+			scopeAttrs := sm.Scope.Attributes
+			if sm.Scope.Name != "" {
+				scopeAttrs = append([]otlpKeyValue{{Key: "otel.scope.name", Value: otlpAnyValue{StringValue: &sm.Scope.Name}}}, scopeAttrs...)
+			}
+			if sm.Scope.Version != "" {
+				scopeAttrs = append([]otlpKeyValue{{Key: "otel.scope.version", Value: otlpAnyValue{StringValue: &sm.Scope.Version}}}, scopeAttrs...)
+			}
+			c.addAttributes(tags, scopeAttrs, true)
+			for _, metric := range sm.Metrics {
+				switch {
+				case metric.Gauge != nil:
+					c.numberPoints(metric.Name, "gauge", metric.Gauge.DataPoints, tags)
+				case metric.Sum != nil:
+					field := "gauge"
+					if metric.Sum.IsMonotonic {
+						field = "counter"
+					}
+					c.numberPoints(metric.Name, field, metric.Sum.DataPoints, copyTags(tags, "temporality", metric.Sum.Temporality.String()))
+				case metric.Histogram != nil:
+					c.histogramPoints(metric.Name, metric.Histogram.DataPoints, copyTags(tags, "temporality", metric.Histogram.Temporality.String()))
+				case metric.ExponentialHistogram != nil:
+					c.expHistogramPoints(metric.Name, metric.ExponentialHistogram.DataPoints, copyTags(tags, "temporality", metric.ExponentialHistogram.Temporality.String()))
+				default:
+					log.WithFields(log.Fields{"name": metric.Name, "section": "otlp processing"}).Debug("Dropped unsupported metric type")
+					DroppedMsgs.Inc()
+				}
+			}
+		}
+	}
+	return c.metrics
+}
+
+/*
+deserializeOTLP : turn an OTLP ExportMetricsServiceRequest (protobuf or JSON) into influx metrics
+These still need filtering (OTLP names use '.', which isn't valid in the prometheus data model)
+*/
+func deserializeOTLP(thread int, msg []byte, promote map[string]bool, flipSingleField bool) ([]InfluxMetric, error) {
+	ProcTimeStart := time.Now()
+	defer func() { ProcessTime.Add(float64(time.Now().Sub(ProcTimeStart)) / TimeSegmentDivisor) }()
+	ReceivedMsgs.Inc()
+	if msg == nil {
+		log.Warning("Empty message received from Kafka")
+		return nil, nil
+	}
+	var req otlpRequest
+	var err error
+	if otlpFormat(msg) == FormatOTLPJSON {
+		req, err = decodeOTLPJSON(msg)
+	} else {
+		req, err = decodeOTLPProto(msg)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"threadNum": thread, "error": err, "section": "otlp processing"}).Error("Couldn't process message")
+		return nil, err
+	}
+	converter := otlpConverter{promote: promote, flipSingleField: flipSingleField}
+	return converter.convert(req), nil
+}
+
+// ProcessOTLPMsg : parse and forward an OTLP metrics message
+func ProcessOTLPMsg(ctx context.Context, thread int, inChannel chan KafkaMsg, outChannel chan InfluxMetric, parseFailedChan chan ParseFailure, promoteAttributes []string, flipSingleField bool, wg *Stage) {
+	log.WithFields(log.Fields{"threadNum": thread, "section": "otlp processing"}).Info("processing thread starting...")
+	defer wg.Done()
+	promote := make(map[string]bool, len(promoteAttributes))
+	for _, attr := range promoteAttributes {
+		promote[attr] = true
+	}
+
+processloop:
+	for {
+		select {
+		case msg := <-inChannel:
+			metrics, err := deserializeOTLP(thread, msg.Value, promote, flipSingleField)
+			handleParsed(msg, otlpFormat(msg.Value), metrics, err, outChannel, parseFailedChan)
+		case <-ctx.Done():
+			log.WithFields(log.Fields{"threadNum": thread, "section": "otlp processing"}).Info("Closing processing thread...")
+			for msg := range inChannel {
+				metrics, err := deserializeOTLP(thread, msg.Value, promote, flipSingleField)
+				handleParsed(msg, otlpFormat(msg.Value), metrics, err, outChannel, parseFailedChan)
+			}
+			break processloop
+		}
+	}
+}
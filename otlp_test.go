@@ -0,0 +1,189 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"math"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoMsg appends a length-delimited (embedded message/string) field
+func protoMsg(b []byte, num protowire.Number, value []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, value)
+}
+
+func protoFixed(b []byte, num protowire.Number, value uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, value)
+}
+
+func protoVarint(b []byte, num protowire.Number, value uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, value)
+}
+
+func testAttribute(key string, value string) []byte {
+	return protoMsg(protoMsg(nil, 1, []byte(key)), 2, protoMsg(nil, 1, []byte(value)))
+}
+
+// testOTLPRequest builds a protobuf ExportMetricsServiceRequest with one of each metric type we support
+func testOTLPRequest() []byte {
+	ts := uint64(1637047250 * 1e9)
+	var gauge, sum, histogram, expHistogram, summary []byte
+	// gauge: 1.5, with a data point attribute
+	point := protoMsg(nil, 7, testAttribute("cpu", "0"))
+	point = protoFixed(protoFixed(point, 3, ts), 4, math.Float64bits(1.5))
+	gauge = protoMsg(protoMsg(nil, 1, []byte("system.cpu.utilization")), 5, protoMsg(nil, 1, point))
+	// monotonic cumulative sum: 10 (as an int)
+	point = protoFixed(protoFixed(nil, 3, ts), 6, 10)
+	sum = protoMsg(nil, 1, []byte("http.requests"))
+	sum = protoMsg(sum, 7, protoVarint(protoVarint(protoMsg(nil, 1, point), 2, 2), 3, 1))
+	// histogram: buckets (,1] (1,5] (5,) with 1, 2 and 3 observations (packed)
+	var counts, bounds []byte
+	for _, c := range []uint64{1, 2, 3} {
+		counts = protowire.AppendFixed64(counts, c)
+	}
+	for _, b := range []float64{1, 5} {
+		bounds = protowire.AppendFixed64(bounds, math.Float64bits(b))
+	}
+	point = protoFixed(protoFixed(protoFixed(nil, 3, ts), 4, 6), 5, math.Float64bits(20))
+	point = protoMsg(protoMsg(point, 6, counts), 7, bounds)
+	histogram = protoMsg(nil, 1, []byte("http.duration"))
+	histogram = protoMsg(histogram, 9, protoVarint(protoMsg(nil, 1, point), 2, 1))
+	// exponential histogram: scale 0 (base 2), 1 zero, buckets (1,2] (2,4] with 2 and 3 observations
+	positive := protoMsg(protoVarint(nil, 1, protowire.EncodeZigZag(0)), 2, protowire.AppendVarint(protowire.AppendVarint(nil, 2), 3))
+	point = protoFixed(protoFixed(protoFixed(nil, 3, ts), 4, 6), 7, 1)
+	point = protoMsg(protoVarint(point, 6, protowire.EncodeZigZag(0)), 8, positive)
+	expHistogram = protoMsg(nil, 1, []byte("queue.size"))
+	expHistogram = protoMsg(expHistogram, 10, protoVarint(protoMsg(nil, 1, point), 2, 2))
+	summary = protoMsg(protoMsg(nil, 1, []byte("legacy")), 11, nil)
+
+	scope := protoMsg(protoMsg(nil, 1, []byte("test-scope")), 3, testAttribute("scope.attr", "x"))
+	scopeMetrics := protoMsg(nil, 1, scope)
+	for _, metric := range [][]byte{gauge, sum, histogram, expHistogram, summary} {
+		scopeMetrics = protoMsg(scopeMetrics, 2, metric)
+	}
+	resource := protoMsg(protoMsg(nil, 1, testAttribute("service.name", "api")), 1, testAttribute("process.pid", "1234"))
+	return protoMsg(nil, 1, protoMsg(protoMsg(nil, 1, resource), 2, scopeMetrics))
+}
+
+// otlpMetrics indexes converted metrics by name, field and le tag (if any)
+func otlpMetrics(results []InfluxMetric) map[string]InfluxMetric {
+	indexed := make(map[string]InfluxMetric)
+	for _, metric := range results {
+		for field := range metric.Fields {
+			indexed[metric.Name+"/"+field+"/"+metric.Tags["le"]] = metric
+		}
+	}
+	return indexed
+}
+
+/*
+Things we should check:
+1. every supported metric type is decoded from protobuf
+2. histograms become cumulative buckets (exponential ones included)
+3. resource/scope attributes become tags, limited to promoted attributes if configured
+4. JSON requests are decoded the same way (including stringified integers and enum names)
+*/
+func TestOTLP(t *testing.T) {
+	msg := testOTLPRequest()
+	if otlpFormat(msg) != FormatOTLPProto {
+		t.Fatalf("Protobuf request detected as %v", otlpFormat(msg))
+	}
+	results, err := deserializeOTLP(1, msg, nil, false)
+	if err != nil {
+		t.Fatalf("Couldn't deserialize message: %v", err)
+	}
+	metrics := otlpMetrics(results)
+	gauge, ok := metrics["system.cpu.utilization/gauge/"]
+	if !ok || gauge.Fields["gauge"].(float64) != 1.5 || gauge.Timestamp != 1637047250 {
+		t.Fatalf("gauge is wrong: %+v", gauge)
+	}
+	if gauge.Tags["cpu"] != "0" || gauge.Tags["service.name"] != "api" || gauge.Tags["process.pid"] != "1234" ||
+		gauge.Tags["otel.scope.name"] != "test-scope" || gauge.Tags["scope.attr"] != "x" {
+		t.Fatalf("gauge tags are wrong: %v", gauge.Tags)
+	}
+	sum, ok := metrics["http.requests/counter/"]
+	if !ok || sum.Fields["counter"].(int64) != 10 || sum.Tags["temporality"] != "cumulative" {
+		t.Fatalf("sum is wrong: %+v", sum)
+	}
+	histogram := metrics["http.duration/count/"]
+	if histogram.Fields["count"].(int64) != 6 || histogram.Fields["sum"].(float64) != 20 || histogram.Tags["temporality"] != "delta" {
+		t.Fatalf("histogram is wrong: %+v", histogram)
+	}
+	for le, count := range map[string]int64{"1": 1, "5": 3, "+Inf": 6} {
+		if bucket := metrics["http.duration/bucket/"+le]; bucket.Fields["bucket"] != count {
+			t.Fatalf("histogram bucket le=%v is wrong: %+v -> should be %v", le, bucket, count)
+		}
+	}
+	for le, count := range map[string]int64{"0": 1, "2": 3, "4": 6, "+Inf": 6} {
+		if bucket := metrics["queue.size/bucket/"+le]; bucket.Fields["bucket"] != count {
+			t.Fatalf("exponential histogram bucket le=%v is wrong: %+v -> should be %v", le, bucket, count)
+		}
+	}
+	if _, ok := metrics["legacy/value/"]; ok {
+		t.Fatalf("Summary wasn't dropped")
+	}
+
+	results, err = deserializeOTLP(1, msg, map[string]bool{"service.name": true}, true)
+	if err != nil {
+		t.Fatalf("Couldn't deserialize message: %v", err)
+	}
+	gauge = otlpMetrics(results)["system.cpu.utilization_gauge/value/"]
+	if len(gauge.Tags) != 2 || gauge.Tags["service.name"] != "api" || gauge.Tags["cpu"] != "0" {
+		t.Fatalf("promoted/flipped gauge is wrong: %+v", gauge)
+	}
+
+	json := []byte(`{"resourceMetrics": [{"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "api"}}]},
+		"scopeMetrics": [{"scope": {"name": "test-scope"}, "metrics": [
+			{"name": "http.requests", "sum": {"aggregationTemporality": "AGGREGATION_TEMPORALITY_DELTA", "isMonotonic": true,
+				"dataPoints": [{"timeUnixNano": "1637047250000000000", "asInt": "10", "attributes": [{"key": "code", "value": {"intValue": "200"}}]}]}},
+			{"name": "http.duration", "histogram": {"aggregationTemporality": 2,
+				"dataPoints": [{"timeUnixNano": "1637047250000000000", "count": "6", "sum": 20, "bucketCounts": ["1", "2", "3"], "explicitBounds": [1, 5]}]}}
+		]}]}]}`)
+	if otlpFormat(json) != FormatOTLPJSON {
+		t.Fatalf("JSON request detected as %v", otlpFormat(json))
+	}
+	results, err = deserializeOTLP(1, json, nil, false)
+	if err != nil {
+		t.Fatalf("Couldn't deserialize message: %v", err)
+	}
+	metrics = otlpMetrics(results)
+	sum = metrics["http.requests/counter/"]
+	if sum.Fields["counter"] != int64(10) || sum.Tags["temporality"] != "delta" || sum.Tags["code"] != "200" || sum.Timestamp != 1637047250 {
+		t.Fatalf("JSON sum is wrong: %+v", sum)
+	}
+	if bucket := metrics["http.duration/bucket/5"]; bucket.Fields["bucket"] != int64(3) || bucket.Tags["temporality"] != "cumulative" {
+		t.Fatalf("JSON histogram bucket is wrong: %+v", bucket)
+	}
+
+	for _, bad := range [][]byte{[]byte("{\"resourceMetrics\": [}"), {0x0a, 0xff}} {
+		if _, err = deserializeOTLP(1, bad, nil, false); err == nil {
+			t.Fatalf("Garbage message %q was deserialized", bad)
+		}
+	}
+}
@@ -24,12 +24,19 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
-	"sync"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/influxdata/influxdb-client-go/v2"
 	influxapi "github.com/influxdata/influxdb-client-go/v2/api"
+	influxhttp "github.com/influxdata/influxdb-client-go/v2/api/http"
 	influxapiwrite "github.com/influxdata/influxdb-client-go/v2/api/write"
 	log "github.com/sirupsen/logrus"
 )
@@ -39,11 +46,19 @@ type OutputMeta struct {
 	Thread       int
 	BatchSize    uint
 	WriteTimeout uint
-	MaxRetries   uint
 	FlushSegment float64
 	URL          string
+	Sink         string
+	Isolated     bool
+	OutputType   string
 	TsdOrg       string
 	TsdDbName    string
+	Precision    time.Duration
+	Spool        *Spool
+	Retry        RetryPolicy
+	Breaker      *CircuitBreaker
+	Health       *Health
+	Kafka        KafkaOutputMeta
 }
 
 //BatchMeta : meta data about the batches we write to our outputs
@@ -52,43 +67,411 @@ type BatchMeta struct {
 	BatchCount    uint
 	FlushSegment  float64
 	Batch         []*influxapiwrite.Point
+	Sources       []*MessageSource
 	BatchSize     uint
+	WritePath     string
+	Sink          string
+	Isolated      bool
 	LastFlushTime time.Time
 	WriteAPI      influxapi.WriteAPIBlocking
+	Spool         *Spool
+	Retry         RetryPolicy
+	Breaker       *CircuitBreaker
+	Health        *Health
 }
 
+const (
+	// FailedPrecision is the timestamp precision of line protocol we write to the spool and dead letter queue
+	FailedPrecision = time.Microsecond
+)
+
+// Error classes for failed writes (sent along with dead letter messages)
+const (
+	// ErrorClassClient : the output rejected the data (HTTP 4xx)
+	ErrorClassClient = "client_error"
+	// ErrorClassServer : the output failed to handle the data (HTTP 5xx)
+	ErrorClassServer = "server_error"
+	// ErrorClassTimeout : the write timed out
+	ErrorClassTimeout = "timeout"
+	// ErrorClassConnection : we couldn't talk to the output at all
+	ErrorClassConnection = "connection_error"
+	// ErrorClassShutdown : we ran out of time to write the data while shutting down
+	ErrorClassShutdown = "shutdown"
+	// ErrorClassSpoolEvicted : the data was spooled, but evicted before it could be replayed
+	ErrorClassSpoolEvicted = "spool_evicted"
+	// ErrorClassQueueFull : the output (one of several for its write path) couldn't keep up
+	ErrorClassQueueFull = "queue_full"
+	// ErrorClassCircuitOpen : the output (one of several for its write path) is failing, so we didn't try it
+	ErrorClassCircuitOpen = "circuit_open"
+	// ErrorClassUnknown : anything else
+	ErrorClassUnknown = "unknown"
+)
+
 var (
 	duration time.Duration
+	// errShutdown : we gave up on a batch because we ran out of time to write it while shutting down
+	errShutdown = errors.New("shutdown deadline reached before write succeeded")
+	// errQueueFull : we gave up on a metric because its output's queue was full
+	errQueueFull = errors.New("output queue full")
+	// errCircuitOpen : we gave up on a batch because its output's circuit breaker was open
+	errCircuitOpen = errors.New("circuit breaker open")
 )
 
-func writeBatch(thread int, batch []*influxapiwrite.Point, batchCount uint, writeAPI influxapi.WriteAPIBlocking, failedChan chan string) {
-	err := writeAPI.WritePoint(context.Background(), batch...)
+/*
+InfluxWriter :
+Blocking writes to an influx v2-compatible endpoint.
+
+The influx client's own blocking writer throws away the HTTP status (and Retry-After)
+of a failed write, and we need those to decide what to do with the failed data.
+Errors returned are always *influxhttp.Error.
+*/
+type InfluxWriter struct {
+	service   influxhttp.Service
+	url       string
+	gzip      bool
+	precision time.Duration
+}
+
+// newInfluxWriter : a writer for a single org/bucket, using an existing client's connection/settings
+func newInfluxWriter(client influxdb2.Client, org string, bucket string) *InfluxWriter {
+	options := client.Options()
+	precision := "ns"
+	switch options.Precision() {
+	case time.Microsecond:
+		precision = "us"
+	case time.Millisecond:
+		precision = "ms"
+	case time.Second:
+		precision = "s"
+	}
+	u, _ := url.Parse(client.HTTPService().ServerAPIURL())
+	u, _ = u.Parse("write")
+	params := u.Query()
+	params.Set("org", org)
+	params.Set("bucket", bucket)
+	params.Set("precision", precision)
+	u.RawQuery = params.Encode()
+	return &InfluxWriter{service: client.HTTPService(), url: u.String(), gzip: options.UseGZip(), precision: options.Precision()}
+}
+
+// WriteRecord : write raw line protocol
+func (w *InfluxWriter) WriteRecord(ctx context.Context, line ...string) error {
+	if len(line) < 1 {
+		return nil
+	}
+	var sb strings.Builder
+	for _, l := range line {
+		sb.WriteString(l)
+		sb.WriteString("\n")
+	}
+	return w.write(ctx, sb.String())
+}
+
+// WritePoint : write influx points
+func (w *InfluxWriter) WritePoint(ctx context.Context, point ...*influxapiwrite.Point) error {
+	if len(point) < 1 {
+		return nil
+	}
+	var sb strings.Builder
+	for _, p := range point {
+		influxapiwrite.PointToLineProtocolBuffer(p, &sb, w.precision)
+	}
+	return w.write(ctx, sb.String())
+}
+
+func (w *InfluxWriter) write(ctx context.Context, data string) error {
+	var body io.Reader = strings.NewReader(data)
+	if w.gzip {
+		var buf strings.Builder
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write([]byte(data))
+		if err == nil {
+			err = zw.Close()
+		}
+		if err != nil {
+			return influxhttp.NewError(err)
+		}
+		body = strings.NewReader(buf.String())
+	}
+	perr := w.service.DoPostRequest(ctx, w.url, body, func(req *http.Request) {
+		if w.gzip {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+	}, nil)
+	if perr != nil {
+		return perr
+	}
+	return nil
+}
+
+/*
+classifyWriteError works out why a write failed,
+returning one of our error classes and the HTTP status (if there was one)
+*/
+func classifyWriteError(err error) (string, int) {
+	var netErr net.Error
+	var httpErr *influxhttp.Error
+	if errors.As(err, &httpErr) {
+		switch {
+		case httpErr.StatusCode >= 500:
+			return ErrorClassServer, httpErr.StatusCode
+		case httpErr.StatusCode >= 400:
+			return ErrorClassClient, httpErr.StatusCode
+		case httpErr.StatusCode > 0:
+			return ErrorClassUnknown, httpErr.StatusCode
+		}
+		// no response at all, look at what actually went wrong
+		if httpErr.Err == nil {
+			return ErrorClassUnknown, 0
+		}
+		err = httpErr.Err
+	}
+	if class, ok := classifyKafkaError(err); ok {
+		return class, 0
+	}
+	if errors.Is(err, errQueueFull) {
+		return ErrorClassQueueFull, 0
+	}
+	if errors.Is(err, errCircuitOpen) {
+		return ErrorClassCircuitOpen, 0
+	}
+	if errors.Is(err, errShutdown) || errors.Is(err, context.Canceled) {
+		return ErrorClassShutdown, 0
+	}
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrorClassTimeout, 0
+	}
+	if netErr != nil {
+		return ErrorClassConnection, 0
+	}
+	return ErrorClassUnknown, 0
+}
+
+// newFailedWrite : everything the dead letter queue should know about a metric we couldn't write
+func newFailedWrite(line string, source *MessageSource, err error, retries int) FailedWrite {
+	failed := FailedWrite{Message: line, Source: source, Retries: retries, FailedAt: time.Now()}
 	if err != nil {
-		log.WithFields(log.Fields{"threadNum": thread, "section": "output", "error": err}).Error("Failed Write")
-		for _, badpoint := range batch {
-			if len(badpoint.TagList()) < 1 {
-				/*
-					if the metric has no tags, skip it.
-					This is largely to avoid writing empty messages to the dead letter queue
-				*/
-				continue
-			}
+		failed.ErrorClass, failed.HTTPStatus = classifyWriteError(err)
+		failed.Error = err.Error()
+	}
+	return failed
+}
+
+// pointsToLines converts points to line protocol
+func pointsToLines(batch []*influxapiwrite.Point) []string {
+	lines := make([]string, 0, len(batch))
+	for _, point := range batch {
+		/*
+			the metric conversion function requires a time.Duration set, so we'll just use a default ("1us")
+		*/
+		lines = append(lines, strings.TrimSuffix(influxapiwrite.PointToLineProtocol(point, duration), "\n"))
+	}
+	return lines
+}
+
+/*
+spoolBatch writes failed points to the write path's on-disk spool.
+Once they're on disk, the points count as delivered. Anything the spool
+evicted to make room goes to the dead letter queue instead.
+*/
+func spoolBatch(meta *BatchMeta, points []*influxapiwrite.Point, sources []*MessageSource, failedChan chan FailedWrite) error {
+	evicted, err := meta.Spool.Write(pointsToLines(points))
+	if err != nil {
+		return err
+	}
+	SpooledMsgs.Add(len(points))
+	for _, source := range sources {
+		source.Done()
+	}
+	evictFromSpool(meta.Thread, evicted, failedChan)
+	return nil
+}
+
+// evictFromSpool sends data evicted from a full spool to the dead letter queue
+func evictFromSpool(thread int, evicted []SpoolEviction, failedChan chan FailedWrite) {
+	for _, eviction := range evicted {
+		log.WithFields(log.Fields{"threadNum": thread, "section": "output", "evicted": len(eviction.Lines)}).Warning("Spool full, evicting oldest data to dead letter queue")
+		EvictedMsgs.Add(len(eviction.Lines))
+		for _, line := range eviction.Lines {
+			failed := newFailedWrite(line, nil, nil, eviction.Attempts)
+			failed.ErrorClass = ErrorClassSpoolEvicted
+			failed.Error = "spool full"
+			failedChan <- failed
+		}
+	}
+}
+
+/*
+bisectable decides whether a failed write was caused by the data itself.
+Only then can splitting the batch find the bad points, anything else
+(auth, routing, rate limiting, server errors) fails every point equally.
+*/
+func bisectable(err error) bool {
+	class, status := classifyWriteError(err)
+	if class != ErrorClassClient {
+		return false
+	}
+	switch status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// sentPoints marks points as successfully written to our output
+func sentPoints(meta *BatchMeta, points []*influxapiwrite.Point, sources []*MessageSource) {
+	SentMsgs.Add(len(points))
+	outputSentMsgs(meta.WritePath).Add(len(points))
+	for _, source := range sources {
+		source.Done()
+	}
+}
+
+// deadLetterPoints sends points to the dead letter queue
+func deadLetterPoints(points []*influxapiwrite.Point, sources []*MessageSource, err error, retries int, failedChan chan FailedWrite) {
+	for i, badpoint := range points {
+		if len(badpoint.TagList()) < 1 {
 			/*
-				the metric conversion function requires a time.Duration set, so we'll just use a default ("1us")
+				if the metric has no tags, skip it.
+				This is largely to avoid writing empty messages to the dead letter queue
 			*/
-			badstr := influxapiwrite.PointToLineProtocol(badpoint, duration)
-			failedChan <- badstr
+			sources[i].Done()
+			continue
+		}
+		/*
+			the metric conversion function requires a time.Duration set, so we'll just use a default ("1us")
+		*/
+		badstr := strings.TrimSuffix(influxapiwrite.PointToLineProtocol(badpoint, duration), "\n")
+		failedChan <- newFailedWrite(badstr, sources[i], err, retries)
+	}
+}
+
+// failPoints hands points we couldn't write to the spool (if we have one) or the dead letter queue
+func failPoints(meta *BatchMeta, points []*influxapiwrite.Point, sources []*MessageSource, err error, retries int, failedChan chan FailedWrite) {
+	outputFailedMsgs(meta.WritePath).Add(len(points))
+	if meta.Spool != nil {
+		spoolErr := spoolBatch(meta, points, sources, failedChan)
+		if spoolErr == nil {
+			return
+		}
+		log.WithFields(log.Fields{"threadNum": meta.Thread, "section": "output", "error": spoolErr}).Error("Couldn't spool failed batch, sending to dead letter queue")
+	}
+	deadLetterPoints(points, sources, err, retries, failedChan)
+}
+
+// writePoints writes points to our output, retrying transient failures
+func writePoints(drainCtx context.Context, meta *BatchMeta, points []*influxapiwrite.Point) (int, error) {
+	retries, err := meta.Retry.Do(drainCtx, func(ctx context.Context) error {
+		return meta.WriteAPI.WritePoint(ctx, points...)
+	})
+	meta.Health.OutputResult(meta.Sink, err)
+	retriedWrites(meta.WritePath).Add(retries)
+	return retries, err
+}
+
+/*
+bisectBatch splits a rejected batch in half and writes each half,
+recursing into any half the output also rejects until we're down to
+the individual bad points (which go to the dead letter queue).
+If the output starts failing for any other reason while we're splitting,
+the remaining points are handled like any other failed write.
+*/
+func bisectBatch(drainCtx context.Context, meta *BatchMeta, points []*influxapiwrite.Point, sources []*MessageSource, failedChan chan FailedWrite) (written int, rejected int) {
+	half := len(points) / 2
+	for _, part := range [][2]int{{0, half}, {half, len(points)}} {
+		subPoints, subSources := points[part[0]:part[1]], sources[part[0]:part[1]]
+		retries, err := writePoints(drainCtx, meta, subPoints)
+		switch {
+		case err == nil:
+			sentPoints(meta, subPoints, subSources)
+			written += len(subPoints)
+		case !bisectable(err):
+			failPoints(meta, subPoints, subSources, err, retries, failedChan)
+		case len(subPoints) == 1:
+			log.WithFields(log.Fields{"threadNum": meta.Thread, "section": "output", "error": err}).Debug("Isolated rejected point")
+			outputFailedMsgs(meta.WritePath).Add(len(subPoints))
+			deadLetterPoints(subPoints, subSources, err, retries, failedChan)
+			rejected++
+		default:
+			subWritten, subRejected := bisectBatch(drainCtx, meta, subPoints, subSources, failedChan)
+			written += subWritten
+			rejected += subRejected
+		}
+	}
+	return written, rejected
+}
+
+/*
+writeBatch sends the current batch to our output.
+meta.Sources lines up with meta.Batch, so each point can tell the message it came from
+that it's been delivered (to the output, the spool, or the dead letter queue)
+
+Transient failures are retried (per meta.Retry). If they keep failing, the
+write path's circuit breaker opens and we hold on to the batch until the output
+recovers, rather than dead-lettering everything. If the output rejects the batch
+because of bad data, we bisect the batch so only the bad points are dead-lettered.
+
+Once drainCtx is done (we're shutting down and out of time) we stop waiting on the output
+and hand the batch straight to the spool or dead letter queue.
+
+An isolated output (one of several for a write path) never holds batches, as that would
+hold up every other output: while its breaker is open, batches go straight to the spool or dead letter queue.
+*/
+func writeBatch(drainCtx context.Context, meta *BatchMeta, failedChan chan FailedWrite) {
+	if len(meta.Batch) < 1 {
+		return
+	}
+	var err error
+	retries := 0
+	for {
+		if meta.Isolated && !meta.Breaker.TryAllow() {
+			failPoints(meta, meta.Batch, meta.Sources, errCircuitOpen, retries, failedChan)
+			return
+		}
+		if (!meta.Isolated && !meta.Breaker.Allow(drainCtx)) || drainCtx.Err() != nil {
+			log.WithFields(log.Fields{"threadNum": meta.Thread, "section": "output", "error": err}).Error("Out of time to write batch at shutdown, giving up on it")
+			failPoints(meta, meta.Batch, meta.Sources, errShutdown, retries, failedChan)
+			return
+		}
+		var attemptRetries int
+		attemptRetries, err = writePoints(drainCtx, meta, meta.Batch)
+		retries += attemptRetries
+		if err == nil {
+			meta.Breaker.Success()
+			sentPoints(meta, meta.Batch, meta.Sources)
+			return
+		}
+		log.WithFields(log.Fields{"threadNum": meta.Thread, "section": "output", "error": err}).Error("Failed Write")
+		if drainCtx.Err() != nil {
+			continue
+		}
+		if !retryable(err) {
+			// the output is up, it just didn't like what we sent
+			meta.Breaker.Success()
+			break
 		}
-	} else {
-		SentMsgs.Add(int(batchCount))
+		if !meta.Breaker.Failure() || meta.Isolated {
+			failPoints(meta, meta.Batch, meta.Sources, err, retries, failedChan)
+			return
+		}
+		log.WithFields(log.Fields{"threadNum": meta.Thread, "section": "output"}).Warning("Circuit breaker open, holding batch until output recovers")
+	}
+	if len(meta.Batch) < 2 || !bisectable(err) {
+		failPoints(meta, meta.Batch, meta.Sources, err, retries, failedChan)
+		return
 	}
+	written, rejected := bisectBatch(drainCtx, meta, meta.Batch, meta.Sources, failedChan)
+	recoveredMsgs(meta.WritePath).Add(written)
+	rejectedMsgs(meta.WritePath).Add(rejected)
+	log.WithFields(log.Fields{"threadNum": meta.Thread, "section": "output", "recovered": written, "rejected": rejected}).Warning("Split rejected batch to isolate bad points")
 }
 
-func processOutput(msg InfluxMetric, meta *BatchMeta, failedChan chan string) {
+func processOutput(drainCtx context.Context, msg InfluxMetric, meta *BatchMeta, failedChan chan FailedWrite) {
 	outputTimeStart := time.Now()
 	p := influxdb2.NewPoint(msg.Name, msg.Tags, msg.Fields, time.Unix(msg.Timestamp, 0))
 
 	meta.Batch = append(meta.Batch, p)
+	meta.Sources = append(meta.Sources, msg.Source)
 	meta.BatchCount++
 	/*
 		We have two reasons to flush the output buffer:
@@ -99,30 +482,90 @@ func processOutput(msg InfluxMetric, meta *BatchMeta, failedChan chan string) {
 		Both of these options are predicated on there _being_ data to flush (because there's no reason to flush an empty buffer)
 	*/
 	if meta.BatchCount > 0 && (meta.BatchCount >= meta.BatchSize || float64(outputTimeStart.Sub(meta.LastFlushTime))/TimeSegmentDivisor > meta.FlushSegment) {
-		writeBatch(meta.Thread, meta.Batch, meta.BatchCount, meta.WriteAPI, failedChan)
+		writeBatch(drainCtx, meta, failedChan)
 		meta.BatchCount = 0
 		meta.Batch = meta.Batch[:0]
+		meta.Sources = meta.Sources[:0]
 		meta.LastFlushTime = time.Now()
 	}
 	OutputTime.Add(float64(time.Now().Sub(outputTimeStart)) / TimeSegmentDivisor)
 }
 
+// Output types a write path can send to
+const (
+	// OutputTypeInflux : an influx-compatible /api/v2/write endpoint
+	OutputTypeInflux = "influx"
+	// OutputTypeRemoteWrite : a Prometheus remote write endpoint
+	OutputTypeRemoteWrite = "prometheus_remote_write"
+	// OutputTypeVMImport : a VictoriaMetrics /api/v1/import (JSON line) endpoint
+	OutputTypeVMImport = "victoriametrics_import"
+	// OutputTypeKafka : a Kafka topic
+	OutputTypeKafka = "kafka"
+)
+
+// OutputWriter : a blocking writer for a single output that can also check the output's health
+type OutputWriter interface {
+	influxapi.WriteAPIBlocking
+	Ping(ctx context.Context) (bool, error)
+	Close()
+}
+
+// influxOutput : an influx-compatible output (the client handles pings, the writer handles writes)
+type influxOutput struct {
+	*InfluxWriter
+	client influxdb2.Client
+}
+
+// Ping : check the output's /ping endpoint
+func (o influxOutput) Ping(ctx context.Context) (bool, error) {
+	return o.client.Ping(ctx)
+}
+
+// Close : close the underlying client
+func (o influxOutput) Close() {
+	o.client.Close()
+}
+
+// newOutputWriter : a writer for whatever type of output cfg points at
+func newOutputWriter(cfg OutputMeta) OutputWriter {
+	switch cfg.OutputType {
+	case OutputTypeRemoteWrite:
+		return newRemoteWriteWriter(cfg.URL, cfg.WriteTimeout)
+	case OutputTypeVMImport:
+		return newVMImportWriter(cfg.URL, cfg.WriteTimeout)
+	case OutputTypeKafka:
+		return newKafkaWriter(cfg.Kafka)
+	}
+	client := newOutputClient(cfg)
+	return influxOutput{InfluxWriter: newInfluxWriter(client, cfg.TsdOrg, cfg.TsdDbName), client: client}
+}
+
+/*
+newOutputClient builds a client for our influx-compatible output
+(cfg.Precision only matters when writing raw line protocol)
+*/
+func newOutputClient(cfg OutputMeta) influxdb2.Client {
+	options := influxdb2.DefaultOptions().
+		SetUseGZip(true).
+		SetHTTPRequestTimeout(cfg.WriteTimeout)
+	if cfg.Precision != 0 {
+		options = options.SetPrecision(cfg.Precision)
+	}
+	return influxdb2.NewClientWithOptions(cfg.URL, "", options)
+}
+
 /*
 SendTSDB : wrapper to actually send messages to our configured outputs
 All incoming messages should be formatted as influx metrics
+
+ctx tells us to write what's left and finish, drainCtx tells us we're out of time to do so
 */
-func SendTSDB(ctx context.Context, inChannel chan InfluxMetric, failedChan chan string, cfg OutputMeta, wg *sync.WaitGroup) {
+func SendTSDB(ctx context.Context, drainCtx context.Context, inChannel chan InfluxMetric, failedChan chan FailedWrite, cfg OutputMeta, wg *Stage) {
 	var err error
 	log.WithFields(log.Fields{"threadNum": cfg.Thread, "section": "output"}).Info("Output thread starting...")
 	defer wg.Done()
-	client := influxdb2.NewClientWithOptions(
-		cfg.URL, "",
-		influxdb2.DefaultOptions().
-			SetUseGZip(true).
-			SetHTTPRequestTimeout(cfg.WriteTimeout).
-			SetMaxRetries(cfg.MaxRetries),
-	)
-	defer client.Close()
+	writer := newOutputWriter(cfg)
+	defer writer.Close()
 	duration, err = time.ParseDuration("1us")
 	if err != nil {
 		log.WithFields(log.Fields{"threadNum": cfg.Thread, "section": "output", "error": err}).Fatal("Couln't parse static time.Duration?!")
@@ -130,22 +573,24 @@ func SendTSDB(ctx context.Context, inChannel chan InfluxMetric, failedChan chan
 
 	// properly scoped variables so multiple threads don't stomp on things
 	meta := BatchMeta{Thread: cfg.Thread, BatchCount: 0, FlushSegment: cfg.FlushSegment,
-		Batch: make([]*influxapiwrite.Point, 0, cfg.BatchSize*2), BatchSize: cfg.BatchSize,
-		LastFlushTime: time.Now(), WriteAPI: client.WriteAPIBlocking(cfg.TsdOrg, cfg.TsdDbName)}
+		Batch: make([]*influxapiwrite.Point, 0, cfg.BatchSize*2), Sources: make([]*MessageSource, 0, cfg.BatchSize*2),
+		BatchSize: cfg.BatchSize, WritePath: cfg.URL, Sink: cfg.Sink, Isolated: cfg.Isolated,
+		LastFlushTime: time.Now(), WriteAPI: writer, Spool: cfg.Spool,
+		Retry: cfg.Retry, Breaker: cfg.Breaker, Health: cfg.Health}
 
 outputloop:
 	for {
 		select {
 		case msg := <-inChannel:
-			processOutput(msg, &meta, failedChan)
+			processOutput(drainCtx, msg, &meta, failedChan)
 		case <-ctx.Done():
 			log.WithFields(log.Fields{"threadNum": cfg.Thread, "section": "output"}).Info("Closing output thread...")
 			// make sure to flush anything in the channel before exiting
 			for msg := range inChannel {
-				processOutput(msg, &meta, failedChan)
+				processOutput(drainCtx, msg, &meta, failedChan)
 			}
 			// one last write after finishing to ensure we don't drop data on the floor
-			writeBatch(meta.Thread, meta.Batch, meta.BatchCount, meta.WriteAPI, failedChan)
+			writeBatch(drainCtx, &meta, failedChan)
 			break outputloop
 		}
 	}
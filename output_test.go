@@ -0,0 +1,134 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	influxhttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+	influxapiwrite "github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+/*
+testWriter rejects (with a 400) any write containing a point named "bad",
+or fails every write with status if it's set
+*/
+type testWriter struct {
+	status  int
+	writes  int
+	written []*influxapiwrite.Point
+}
+
+func (w *testWriter) WriteRecord(ctx context.Context, line ...string) error {
+	return nil
+}
+
+func (w *testWriter) WritePoint(ctx context.Context, point ...*influxapiwrite.Point) error {
+	w.writes++
+	if w.status != 0 {
+		return &influxhttp.Error{StatusCode: w.status}
+	}
+	for _, p := range point {
+		if p.Name() == "bad" {
+			return &influxhttp.Error{StatusCode: 400, Message: "partial write"}
+		}
+	}
+	w.written = append(w.written, point...)
+	return nil
+}
+
+func testBatch(writer *testWriter, names ...string) *BatchMeta {
+	meta := &BatchMeta{WriteAPI: writer, WritePath: "http://test"}
+	for _, name := range names {
+		meta.Batch = append(meta.Batch, influxdb2.NewPoint(name, map[string]string{"tag": "value"},
+			map[string]interface{}{"value": 1}, time.Unix(1637090544, 0)))
+		meta.Sources = append(meta.Sources, testSource("test", 0, int64(len(meta.Sources))))
+	}
+	return meta
+}
+
+/*
+Things we should check:
+1. a batch rejected for bad data only dead-letters the bad points
+2. every point's source is delivered either way
+3. batches that fail for other reasons aren't split
+*/
+func TestWriteBatchBisect(t *testing.T) {
+	writer := &testWriter{}
+	meta := testBatch(writer, "good", "good", "bad", "good", "good", "good", "bad")
+	failedChan := make(chan FailedWrite, len(meta.Batch))
+	recovered := recoveredMsgs(meta.WritePath).Get()
+	writeBatch(context.Background(), meta, failedChan)
+	if len(writer.written) != 5 {
+		t.Fatalf("Wrong number of points written after bisecting: %v -> should be 5", len(writer.written))
+	}
+	if len(failedChan) != 2 {
+		t.Fatalf("Wrong number of points dead-lettered after bisecting: %v -> should be 2", len(failedChan))
+	}
+	failed := <-failedChan
+	if failed.ErrorClass != ErrorClassClient || failed.HTTPStatus != 400 || failed.Source != meta.Sources[2] {
+		t.Fatalf("Dead-lettered point doesn't describe the rejection: %v", failed)
+	}
+	if recoveredMsgs(meta.WritePath).Get()-recovered != 5 {
+		t.Fatalf("Wrong number of recovered points counted: %v -> should be 5", recoveredMsgs(meta.WritePath).Get()-recovered)
+	}
+	for _, source := range meta.Sources {
+		// the dead letter queue's delivery reports release sources we've dead-lettered
+		if !source.Delivered() && source != meta.Sources[2] && source != meta.Sources[6] {
+			t.Fatalf("Source for a written point wasn't delivered: %v", source)
+		}
+	}
+
+	writer = &testWriter{status: 503}
+	meta = testBatch(writer, "good", "bad", "good", "good")
+	failedChan = make(chan FailedWrite, len(meta.Batch))
+	writeBatch(context.Background(), meta, failedChan)
+	if writer.writes != 1 {
+		t.Fatalf("Unavailable output was written to %v times -> should be 1", writer.writes)
+	}
+	if len(failedChan) != 4 {
+		t.Fatalf("Wrong number of points dead-lettered from unavailable output: %v -> should be 4", len(failedChan))
+	}
+}
+
+func TestWriteBatchShutdown(t *testing.T) {
+	writer := &testWriter{status: 503}
+	meta := testBatch(writer, "good", "good")
+	meta.Retry = RetryPolicy{InitialInterval: time.Hour, MaxInterval: time.Hour, MaxElapsed: 2 * time.Hour, Multiplier: 2}
+	meta.Breaker = &CircuitBreaker{Threshold: 1, Cooldown: time.Hour}
+	drainCtx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	failedChan := make(chan FailedWrite, len(meta.Batch))
+	// a dead output (and an open breaker) would otherwise hold this batch forever
+	writeBatch(drainCtx, meta, failedChan)
+	if len(failedChan) != 2 {
+		t.Fatalf("Wrong number of points dead-lettered at shutdown: %v -> should be 2", len(failedChan))
+	}
+	if failed := <-failedChan; failed.ErrorClass != ErrorClassShutdown {
+		t.Fatalf("Point dead-lettered at shutdown has the wrong error class: %v -> should be %v", failed.ErrorClass, ErrorClassShutdown)
+	}
+}
@@ -0,0 +1,364 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+/*
+A (very) small unpickler: just enough of Python's pickle protocols (0 through 4)
+to read the lists of tuples of strings and numbers that carbon's pickle protocol sends.
+Anything else (objects, dicts, etc.) is refused.
+*/
+
+// pickleList : lists are appended to after they're created (and may be memoized), so we need a pointer
+type pickleList struct {
+	items []interface{}
+}
+
+type pickleMark struct{}
+
+var errPickleTruncated = errors.New("pickle is truncated")
+
+type unpickler struct {
+	data  []byte
+	pos   int
+	stack []interface{}
+	memo  map[int]interface{}
+}
+
+func (u *unpickler) read(n int) ([]byte, error) {
+	if n < 0 || n > len(u.data)-u.pos {
+		return nil, errPickleTruncated
+	}
+	b := u.data[u.pos : u.pos+n]
+	u.pos += n
+	return b, nil
+}
+
+func (u *unpickler) readLine() (string, error) {
+	end := bytes.IndexByte(u.data[u.pos:], '\n')
+	if end < 0 {
+		return "", errPickleTruncated
+	}
+	line := string(u.data[u.pos : u.pos+end])
+	u.pos += end + 1
+	return line, nil
+}
+
+// readUint : read a little-endian unsigned integer of n bytes
+func (u *unpickler) readUint(n int) (int, error) {
+	b, err := u.read(n)
+	if err != nil {
+		return 0, err
+	}
+	v := 0
+	for i := n - 1; i >= 0; i-- {
+		v = v<<8 | int(b[i])
+	}
+	return v, nil
+}
+
+func (u *unpickler) push(v interface{}) {
+	u.stack = append(u.stack, v)
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) < 1 {
+		return nil, errors.New("pickle stack underflow")
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	return v, nil
+}
+
+// popMark : everything pushed since the last mark
+func (u *unpickler) popMark() ([]interface{}, error) {
+	for i := len(u.stack) - 1; i >= 0; i-- {
+		if _, ok := u.stack[i].(pickleMark); ok {
+			items := append([]interface{}{}, u.stack[i+1:]...)
+			u.stack = u.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, errors.New("pickle has no mark")
+}
+
+// appendTo : append items to the list on top of the stack
+func (u *unpickler) appendTo(items ...interface{}) error {
+	if len(u.stack) < 1 {
+		return errors.New("pickle stack underflow")
+	}
+	list, ok := u.stack[len(u.stack)-1].(*pickleList)
+	if !ok {
+		return errors.New("pickle appends to something that isn't a list")
+	}
+	list.items = append(list.items, items...)
+	return nil
+}
+
+func (u *unpickler) tuple(n int) error {
+	if len(u.stack) < n {
+		return errors.New("pickle stack underflow")
+	}
+	items := append([]interface{}{}, u.stack[len(u.stack)-n:]...)
+	u.stack = u.stack[:len(u.stack)-n]
+	u.push(items)
+	return nil
+}
+
+func (u *unpickler) put(index int) error {
+	if len(u.stack) < 1 {
+		return errors.New("pickle stack underflow")
+	}
+	u.memo[index] = u.stack[len(u.stack)-1]
+	return nil
+}
+
+func (u *unpickler) get(index int) error {
+	v, ok := u.memo[index]
+	if !ok {
+		return fmt.Errorf("pickle memo %v is missing", index)
+	}
+	u.push(v)
+	return nil
+}
+
+// pickleInt : a little-endian two's complement integer (LONG1/LONG4)
+func pickleInt(b []byte) (int64, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	reversed := make([]byte, len(b))
+	for i := range b {
+		reversed[len(b)-1-i] = b[i]
+	}
+	n := new(big.Int).SetBytes(reversed)
+	if b[len(b)-1]&0x80 != 0 {
+		n.Sub(n, new(big.Int).Lsh(big.NewInt(1), uint(len(b)*8)))
+	}
+	if !n.IsInt64() {
+		return 0, errors.New("pickle integer overflows int64")
+	}
+	return n.Int64(), nil
+}
+
+// pickleString : a protocol 0 quoted string ('...' or "...")
+func pickleString(line string) (string, error) {
+	if len(line) < 2 || (line[0] != '\'' && line[0] != '"') || line[len(line)-1] != line[0] {
+		return "", fmt.Errorf("invalid pickle string %q", line)
+	}
+	if line[0] == '\'' {
+		// python's repr uses single quotes, which Go can't unquote
+		line = `"` + line[1:len(line)-1] + `"`
+	}
+	return strconv.Unquote(line)
+}
+
+// step : run a single opcode, returning true once we've reached STOP
+func (u *unpickler) step() (bool, error) {
+	op, err := u.read(1)
+	if err != nil {
+		return false, err
+	}
+	var n int
+	var b []byte
+	var line string
+	switch op[0] {
+	case 0x80: // PROTO
+		_, err = u.read(1)
+	case 0x95: // FRAME
+		_, err = u.read(8)
+	case '.': // STOP
+		return true, nil
+	case '(': // MARK
+		u.push(pickleMark{})
+	case ']': // EMPTY_LIST
+		u.push(&pickleList{})
+	case ')': // EMPTY_TUPLE
+		u.push([]interface{}{})
+	case 'l': // LIST
+		var items []interface{}
+		if items, err = u.popMark(); err == nil {
+			u.push(&pickleList{items: items})
+		}
+	case 't': // TUPLE
+		var items []interface{}
+		if items, err = u.popMark(); err == nil {
+			u.push(items)
+		}
+	case 0x85, 0x86, 0x87: // TUPLE1, TUPLE2, TUPLE3
+		err = u.tuple(int(op[0]-0x85) + 1)
+	case 'a': // APPEND
+		var item interface{}
+		if item, err = u.pop(); err == nil {
+			err = u.appendTo(item)
+		}
+	case 'e': // APPENDS
+		var items []interface{}
+		if items, err = u.popMark(); err == nil {
+			err = u.appendTo(items...)
+		}
+	case 'N': // NONE
+		u.push(nil)
+	case 0x88: // NEWTRUE
+		u.push(true)
+	case 0x89: // NEWFALSE
+		u.push(false)
+	case 'K': // BININT1
+		if n, err = u.readUint(1); err == nil {
+			u.push(int64(n))
+		}
+	case 'M': // BININT2
+		if n, err = u.readUint(2); err == nil {
+			u.push(int64(n))
+		}
+	case 'J': // BININT
+		if n, err = u.readUint(4); err == nil {
+			u.push(int64(int32(uint32(n))))
+		}
+	case 0x8a, 0x8b: // LONG1, LONG4
+		size := 1
+		if op[0] == 0x8b {
+			size = 4
+		}
+		if n, err = u.readUint(size); err == nil {
+			if b, err = u.read(n); err == nil {
+				var v int64
+				if v, err = pickleInt(b); err == nil {
+					u.push(v)
+				}
+			}
+		}
+	case 'I', 'L': // INT, LONG
+		if line, err = u.readLine(); err == nil {
+			switch line {
+			case "01":
+				u.push(true)
+			case "00":
+				u.push(false)
+			default:
+				var v int64
+				if v, err = strconv.ParseInt(strings.TrimSuffix(line, "L"), 10, 64); err == nil {
+					u.push(v)
+				}
+			}
+		}
+	case 'G': // BINFLOAT
+		if b, err = u.read(8); err == nil {
+			u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+		}
+	case 'F': // FLOAT
+		if line, err = u.readLine(); err == nil {
+			var v float64
+			if v, err = strconv.ParseFloat(line, 64); err == nil {
+				u.push(v)
+			}
+		}
+	case 'U', 'C', 0x8c: // SHORT_BINSTRING, SHORT_BINBYTES, SHORT_BINUNICODE
+		if n, err = u.readUint(1); err == nil {
+			if b, err = u.read(n); err == nil {
+				u.push(string(b))
+			}
+		}
+	case 'T', 'B', 'X': // BINSTRING, BINBYTES, BINUNICODE
+		if n, err = u.readUint(4); err == nil {
+			if b, err = u.read(n); err == nil {
+				u.push(string(b))
+			}
+		}
+	case 0x8d, 0x8e: // BINUNICODE8, BINBYTES8
+		if n, err = u.readUint(8); err == nil {
+			if b, err = u.read(n); err == nil {
+				u.push(string(b))
+			}
+		}
+	case 'S': // STRING
+		if line, err = u.readLine(); err == nil {
+			var s string
+			if s, err = pickleString(line); err == nil {
+				u.push(s)
+			}
+		}
+	case 'V': // UNICODE (raw-unicode-escape, which metric paths never need)
+		if line, err = u.readLine(); err == nil {
+			u.push(line)
+		}
+	case 'p': // PUT
+		if line, err = u.readLine(); err == nil {
+			if n, err = strconv.Atoi(line); err == nil {
+				err = u.put(n)
+			}
+		}
+	case 'q': // BINPUT
+		if n, err = u.readUint(1); err == nil {
+			err = u.put(n)
+		}
+	case 'r': // LONG_BINPUT
+		if n, err = u.readUint(4); err == nil {
+			err = u.put(n)
+		}
+	case 0x94: // MEMOIZE
+		err = u.put(len(u.memo))
+	case 'g': // GET
+		if line, err = u.readLine(); err == nil {
+			if n, err = strconv.Atoi(line); err == nil {
+				err = u.get(n)
+			}
+		}
+	case 'h': // BINGET
+		if n, err = u.readUint(1); err == nil {
+			err = u.get(n)
+		}
+	case 'j': // LONG_BINGET
+		if n, err = u.readUint(4); err == nil {
+			err = u.get(n)
+		}
+	default:
+		return false, fmt.Errorf("unsupported pickle opcode 0x%02x at %v", op[0], u.pos-1)
+	}
+	return false, err
+}
+
+// unpickle : decode a pickle, returning the object it built
+func unpickle(data []byte) (interface{}, error) {
+	u := unpickler{data: data, memo: make(map[int]interface{})}
+	for {
+		done, err := u.step()
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return u.pop()
+		}
+	}
+}
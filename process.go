@@ -27,8 +27,8 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/influxdata/influxdb/models"
@@ -36,6 +36,24 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// Formats we deserialize (used to label parse failures)
+const (
+	FormatInfluxLine      = "influx_line"
+	FormatInfluxJSON      = "influx_json"
+	FormatPromJSON        = "prometheus_json"
+	FormatPromRemoteWrite = "prometheus_remote_write"
+	FormatPromText        = "prometheus_text"
+	FormatOTLPProto       = "otlp_proto"
+	FormatOTLPJSON        = "otlp_json"
+	FormatGraphite        = "graphite"
+	FormatGraphitePickle  = "graphite_pickle"
+	FormatSchemaRegistry  = "schema_registry"
+	FormatMixed           = "mixed"
+	FormatStatsd          = "statsd"
+	FormatOpenTSDB        = "opentsdb"
+	FormatOpenTSDBJSON    = "opentsdb_json"
+)
+
 /*
 Handle incoming data in Influx's Line protocol
 e.g.
@@ -50,9 +68,10 @@ Becomes:
 
 The other potential change is whether or not we're "flipping" single fields for a VictoriaMetrics output
 */
-func deserializeInfluxLine(thread int, msg []byte, flipSingleField bool) []InfluxMetric {
+func deserializeInfluxLine(thread int, msg []byte, flipSingleField bool) ([]InfluxMetric, error) {
 	var outputStats []InfluxMetric
 	ProcTimeStart := time.Now()
+	defer func() { ProcessTime.Add(float64(time.Now().Sub(ProcTimeStart)) / TimeSegmentDivisor) }()
 	// logFields := {"threadNum": thread, "section": "processing"}
 	ReceivedMsgs.Inc()
 	if msg == nil {
@@ -61,6 +80,7 @@ func deserializeInfluxLine(thread int, msg []byte, flipSingleField bool) []Influ
 		points, err := models.ParsePoints(msg)
 		if err != nil {
 			log.WithFields(log.Fields{"threadnum": thread, "error": err, "incoming_msg": msg, "section": "influx Line processing"}).Error("Couldn't process message")
+			return nil, err
 		} else {
 			for _, point := range points {
 				jsonMsg := InfluxMetric{
@@ -73,6 +93,7 @@ func deserializeInfluxLine(thread int, msg []byte, flipSingleField bool) []Influ
 				fields, err := point.Fields()
 				if err != nil {
 					log.WithFields(log.Fields{"threadnum": thread, "error": err, "incoming_msg": msg, "section": "influx Line processing"}).Error("No fields in incoming message?")
+					return nil, err
 				}
 				if flipSingleField && len(fields) < 2 {
 					fieldName := ""
@@ -91,8 +112,7 @@ func deserializeInfluxLine(thread int, msg []byte, flipSingleField bool) []Influ
 			}
 		}
 	}
-	ProcessTime.Add(float64(time.Now().Sub(ProcTimeStart)) / TimeSegmentDivisor)
-	return outputStats
+	return outputStats, nil
 }
 
 /*
@@ -112,51 +132,183 @@ e.g.
     "timestamp": 1458229140
 }
 
+A single message may also hold many metrics:
+  - Telegraf's json_batch format ({"metrics": [{...}, {...}]})
+  - a JSON array ([{...}, {...}])
+  - newline-delimited JSON ({...}\n{...})
+An element of a batch that can't be decoded is dropped (and counted) on its own,
+the message only fails if nothing in it could be decoded.
+
 The only potential change is whether or not we're "flipping" single fields for a VictoriaMetrics output
 */
-func deserializeInfluxJSON(thread int, msg []byte, flipSingleField bool) []InfluxMetric {
+func deserializeInfluxJSON(thread int, msg []byte, flipSingleField bool) ([]InfluxMetric, error) {
 	var outputStats []InfluxMetric
 	ProcTimeStart := time.Now()
+	defer func() { ProcessTime.Add(float64(time.Now().Sub(ProcTimeStart)) / TimeSegmentDivisor) }()
 	// logFields := {"threadNum": thread, "section": "processing"}
 	ReceivedMsgs.Inc()
 	if msg == nil {
 		log.Warning("Empty message received from Kafka")
-	} else {
+		return outputStats, nil
+	}
+	elements, err := influxJSONElements(msg)
+	if err != nil {
+		log.WithFields(log.Fields{"threadNum": thread, "error": err, "incoming_msg": msg, "section": "influx JSON processing"}).Error("Couldn't process message")
+		return nil, err
+	}
+	var lastErr error
+	failed := 0
+	for _, element := range elements {
 		var jsonMsg InfluxMetric
-		err := json.Unmarshal(msg, &jsonMsg)
+		err := json.Unmarshal(element, &jsonMsg)
 		if err != nil {
-			log.WithFields(log.Fields{"threadNum": thread, "error": err, "incoming_msg": msg, "section": "influx JSON processing"}).Error("Couldn't process message")
-		} else {
-			if flipSingleField && len(jsonMsg.Fields) < 2 {
-				// log.WithFields(log.Fields{"Message": jsonMsg, "threadNum": thread, "section": "processing"}).Info("Processing Message")
-				/*
-					Address single field messages
+			lastErr = err
+			failed++
+			continue
+		}
+		outputStats = append(outputStats, flipInfluxJSON(jsonMsg, flipSingleField))
+	}
+	if failed > 0 && len(outputStats) < 1 {
+		log.WithFields(log.Fields{"threadNum": thread, "error": lastErr, "incoming_msg": msg, "section": "influx JSON processing"}).Error("Couldn't process message")
+		return nil, lastErr
+	}
+	if failed > 0 {
+		ParseFailedElements.Add(failed)
+		log.WithFields(log.Fields{"threadNum": thread, "error": lastErr, "failed": failed, "decoded": len(outputStats), "section": "influx JSON processing"}).Warning("Dropped undecodable metrics from batch")
+	}
+	return outputStats, nil
+}
 
-					We'll add the field name to the metric name and make the field `value`.
-					This will make -influxSkipSingleField
-				*/
-				tmpMetric := InfluxMetric{
-					Name: "", Fields: make(map[string]interface{}),
-					Tags: make(map[string]string), Timestamp: jsonMsg.Timestamp,
-				}
-				fieldName := ""
-				for key, value := range jsonMsg.Fields {
-					fieldName = key
-					tmpMetric.Fields["value"] = value
-				}
-				tmpMetric.Name = fmt.Sprintf("%v_%v", jsonMsg.Name, fieldName)
-				for k, v := range jsonMsg.Tags {
-					tmpMetric.Tags[k] = v
-				}
-				// log.WithFields(log.Fields{"Message": tmpMetric, "threadNum": thread, "section": "influx JSON processing"}).Info("Finished Message")
-				outputStats = append(outputStats, tmpMetric)
-			} else {
-				outputStats = append(outputStats, jsonMsg)
+// influxJSONBatch : Telegraf's json_batch format
+type influxJSONBatch struct {
+	Metrics []json.RawMessage `json:"metrics"`
+}
+
+/*
+influxJSONElements splits a message into individual (still encoded) metrics.
+If the message isn't a clean sequence of JSON values, we fall back to treating each line as
+its own metric, so one broken line of newline-delimited JSON doesn't take the rest down with it.
+*/
+func influxJSONElements(msg []byte) ([]json.RawMessage, error) {
+	var elements []json.RawMessage
+	decoder := json.NewDecoder(bytes.NewReader(msg))
+	for {
+		var value json.RawMessage
+		err := decoder.Decode(&value)
+		if err == io.EOF {
+			return elements, nil
+		}
+		if err != nil {
+			if bytes.Count(bytes.TrimSpace(msg), []byte("\n")) < 1 {
+				return nil, err
 			}
+			break
+		}
+		elements = append(elements, expandInfluxJSON(value)...)
+	}
+	elements = elements[:0]
+	for _, line := range bytes.Split(msg, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) > 0 {
+			elements = append(elements, expandInfluxJSON(line)...)
+		}
+	}
+	return elements, nil
+}
+
+// expandInfluxJSON : the metrics in a single JSON value (an array, a json_batch object, or a single metric)
+func expandInfluxJSON(value json.RawMessage) []json.RawMessage {
+	trimmed := bytes.TrimSpace(value)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		var elements []json.RawMessage
+		if json.Unmarshal(trimmed, &elements) == nil {
+			return elements
+		}
+	}
+	if bytes.HasPrefix(trimmed, []byte("{")) && bytes.Contains(trimmed, []byte(`"metrics"`)) {
+		var batch influxJSONBatch
+		if json.Unmarshal(trimmed, &batch) == nil && batch.Metrics != nil {
+			return batch.Metrics
+		}
+	}
+	return []json.RawMessage{trimmed}
+}
+
+/*
+flipInfluxJSON addresses single field messages
+
+We'll add the field name to the metric name and make the field `value`.
+This will make -influxSkipSingleField
+*/
+func flipInfluxJSON(jsonMsg InfluxMetric, flipSingleField bool) InfluxMetric {
+	if !flipSingleField || len(jsonMsg.Fields) >= 2 {
+		return jsonMsg
+	}
+	tmpMetric := InfluxMetric{
+		Name: "", Fields: make(map[string]interface{}),
+		Tags: make(map[string]string), Timestamp: jsonMsg.Timestamp,
+	}
+	fieldName := ""
+	for key, value := range jsonMsg.Fields {
+		fieldName = key
+		tmpMetric.Fields["value"] = value
+	}
+	tmpMetric.Name = fmt.Sprintf("%v_%v", jsonMsg.Name, fieldName)
+	for k, v := range jsonMsg.Tags {
+		tmpMetric.Tags[k] = v
+	}
+	return tmpMetric
+}
+
+/*
+promToInflux turns a single Prometheus sample into an influx metric
+(shared by every Prometheus format we read)
+*/
+func promToInflux(name string, labels map[string]string, value interface{}, timestamp int64, flipSingleField bool) InfluxMetric {
+	/*
+		For prometheus metrics, tags/labels don't
+		need special processing.
+	*/
+	finalMsg := InfluxMetric{
+		Name: "", Fields: make(map[string]interface{}),
+		Tags: make(map[string]string), Timestamp: timestamp,
+	}
+	for key, value := range labels {
+		// don't add the __name__ tag, it's the name of the metric already
+		if key == "__name__" {
+			continue
 		}
+		finalMsg.Tags[key] = value
 	}
-	ProcessTime.Add(float64(time.Now().Sub(ProcTimeStart)) / TimeSegmentDivisor)
-	return outputStats
+	if flipSingleField {
+		/*
+			all prometheus metrics have a single "field" value
+			so handling single field issues is simpler:
+			We simply make the single field key `value`.
+		*/
+		finalMsg.Name = name
+		finalMsg.Fields["value"] = value
+	} else {
+		/*
+			The dance around turning a regular prometheus object
+			into an influx object is a bit weirder...
+			If we have multiple pieces to our name based on a consistent
+			splittable token (_ in our case), we can make the
+			field value be the final section of the metric "name".
+
+			If there's only one object after splitting on our token,
+			we simply add "value" as the field name.
+		*/
+		tmpSlice := strings.Split(name, "_")
+		tmpSliceLen := len(tmpSlice)
+		if tmpSliceLen > 1 {
+			finalMsg.Fields[tmpSlice[tmpSliceLen-1]] = value
+			finalMsg.Name = strings.Join(tmpSlice[0:tmpSliceLen-1], "_")
+		} else {
+			finalMsg.Fields["value"] = value
+			finalMsg.Name = name
+		}
+	}
+	return finalMsg
 }
 
 /*
@@ -178,9 +330,10 @@ Because Prometheus metrics should already meet the prometheus data model require
 through filtering. This means we _do_ have to handle normalization here, as well as addressing the "single field"
 issue for VictoriaMetrics outputs.
 */
-func deserializePromJSON(thread int, msg []byte, normalize bool, flipSingleField bool) []InfluxMetric {
+func deserializePromJSON(thread int, msg []byte, normalize bool, flipSingleField bool) ([]InfluxMetric, error) {
 	var outputStats []InfluxMetric
 	ProcTimeStart := time.Now()
+	defer func() { ProcessTime.Add(float64(time.Now().Sub(ProcTimeStart)) / TimeSegmentDivisor) }()
 	ReceivedMsgs.Inc()
 	if msg == nil {
 		log.Warning("Empty message received from Kafka")
@@ -193,6 +346,7 @@ func deserializePromJSON(thread int, msg []byte, normalize bool, flipSingleField
 		err := json.Unmarshal(msg, &jsonMsg)
 		if err != nil {
 			log.WithFields(log.Fields{"threadNum": thread, "error": err, "incoming_msg": msg, "section": "prometheus processing"}).Error("Couldn't process message")
+			return nil, err
 		} else {
 			/*
 				normalizing the bytes before we serialize means the timestamp field gets slightly munged.
@@ -207,62 +361,51 @@ func deserializePromJSON(thread int, msg []byte, normalize bool, flipSingleField
 			*/
 			ts, err := time.Parse(time.RFC3339, jsonMsg.Timestamp)
 			if err != nil {
-				log.WithFields(log.Fields{"threadNum": thread, "error": err, "incoming_msg": msg, "section": "prometheus processing", "timestamp": jsonMsg.Timestamp}).Fatal("Invalid timestamp in message")
+				log.WithFields(log.Fields{"threadNum": thread, "error": err, "incoming_msg": msg, "section": "prometheus processing", "timestamp": jsonMsg.Timestamp}).Error("Invalid timestamp in message")
+				return nil, err
 			} else {
-				/*
-					For prometheus metrics, tags/labels don't
-					need special processing.
-				*/
-				finalMsg := InfluxMetric{
-					Name: "", Fields: make(map[string]interface{}),
-					Tags: make(map[string]string), Timestamp: ts.Unix(),
-				}
-				for key, value := range jsonMsg.Labels {
-					// don't add the __name__ tag, it's the name of the metric already
-					if key == "__name__" {
-						continue
-					}
-					finalMsg.Tags[key] = value
-				}
-				if flipSingleField {
-					/*
-						all prometheus metrics have a single "field" value
-						so handling single field issues is simpler:
-						We simply make the single field key `value`.
-					*/
-					finalMsg.Name = jsonMsg.Name
-					finalMsg.Fields["value"] = jsonMsg.Value
-				} else {
-					/*
-						The dance around turning a regular prometheus object
-						into an influx object is a bit weirder...
-						If we have multiple pieces to our name based on a consistent
-						splittable token (_ in our case), we can make the
-						field value be the final section of the metric "name".
-
-						If there's only one object after splitting on our token,
-						we simply add "value" as the field name.
-					*/
-					tmpSlice := strings.Split(jsonMsg.Name, "_")
-					tmpSliceLen := len(tmpSlice)
-					if tmpSliceLen > 1 {
-						finalMsg.Fields[tmpSlice[tmpSliceLen-1]] = jsonMsg.Value
-						finalMsg.Name = strings.Join(tmpSlice[0:tmpSliceLen-1], "_")
-					} else {
-						finalMsg.Fields["value"] = jsonMsg.Value
-						finalMsg.Name = jsonMsg.Name
-					}
-				}
-				outputStats = append(outputStats, finalMsg)
+				outputStats = append(outputStats, promToInflux(jsonMsg.Name, jsonMsg.Labels, jsonMsg.Value, ts.Unix(), flipSingleField))
 			}
 		}
 	}
-	ProcessTime.Add(float64(time.Now().Sub(ProcTimeStart)) / TimeSegmentDivisor)
-	return outputStats
+	return outputStats, nil
+}
+
+/*
+forwardMetrics sends deserialized metrics along to the next stage.
+Each metric holds a reference to the message it came from, and we release
+the processing thread's own reference once everything has been sent.
+*/
+func forwardMetrics(source *MessageSource, metrics []InfluxMetric, outChannel chan InfluxMetric) {
+	source.Hold(len(metrics))
+	for _, metric := range metrics {
+		metric.Source = source
+		outChannel <- metric
+	}
+	source.Done()
+}
+
+/*
+handleParsed forwards a message's metrics, or (if we couldn't deserialize it)
+hands the original message (as it was produced, before we decompressed it) to the parse failures topic.
+Without a parse failures topic (parseFailedChan is nil) bad messages are only logged.
+*/
+func handleParsed(msg KafkaMsg, format string, metrics []InfluxMetric, err error, outChannel chan InfluxMetric, parseFailedChan chan ParseFailure) {
+	if err == nil {
+		forwardMetrics(msg.Source, metrics, outChannel)
+		return
+	}
+	ParseFailures.Inc()
+	if parseFailedChan != nil {
+		msg.Source.Hold(1)
+		parseFailedChan <- ParseFailure{Value: msg.original(), Source: msg.Source, Format: format,
+			Error: err.Error(), FailedAt: time.Now()}
+	}
+	msg.Source.Done()
 }
 
 //ProcessInfluxLineMsg : parse and forward an influx line protocol message
-func ProcessInfluxLineMsg(ctx context.Context, thread int, inChannel chan []byte, outChannel chan InfluxMetric, wg *sync.WaitGroup, flipSingleField bool) {
+func ProcessInfluxLineMsg(ctx context.Context, thread int, inChannel chan KafkaMsg, outChannel chan InfluxMetric, parseFailedChan chan ParseFailure, wg *Stage, flipSingleField bool) {
 	log.WithFields(log.Fields{"threadNum": thread, "section": "influx Line processing"}).Info("processing thread starting...")
 	defer wg.Done()
 
@@ -270,15 +413,13 @@ processloop:
 	for {
 		select {
 		case msg := <-inChannel:
-			for _, metric := range deserializeInfluxLine(thread, msg, flipSingleField) {
-				outChannel <- metric
-			}
+			metrics, err := deserializeInfluxLine(thread, msg.Value, flipSingleField)
+			handleParsed(msg, FormatInfluxLine, metrics, err, outChannel, parseFailedChan)
 		case <-ctx.Done():
 			log.WithFields(log.Fields{"threadNum": thread, "section": "influx Line processing"}).Info("Closing processing thread...")
 			for msg := range inChannel {
-				for _, metric := range deserializeInfluxLine(thread, msg, flipSingleField) {
-					outChannel <- metric
-				}
+				metrics, err := deserializeInfluxLine(thread, msg.Value, flipSingleField)
+				handleParsed(msg, FormatInfluxLine, metrics, err, outChannel, parseFailedChan)
 			}
 			break processloop
 		}
@@ -286,7 +427,7 @@ processloop:
 }
 
 //ProcessInfluxJSONMsg : parse and forward an influx JSON protocol message
-func ProcessInfluxJSONMsg(ctx context.Context, thread int, inChannel chan []byte, outChannel chan InfluxMetric, wg *sync.WaitGroup, flipSingleField bool) {
+func ProcessInfluxJSONMsg(ctx context.Context, thread int, inChannel chan KafkaMsg, outChannel chan InfluxMetric, parseFailedChan chan ParseFailure, wg *Stage, flipSingleField bool) {
 	log.WithFields(log.Fields{"threadNum": thread, "section": "influx JSON processing"}).Info("processing thread starting...")
 	defer wg.Done()
 
@@ -294,15 +435,13 @@ processloop:
 	for {
 		select {
 		case msg := <-inChannel:
-			for _, metric := range deserializeInfluxJSON(thread, msg, flipSingleField) {
-				outChannel <- metric
-			}
+			metrics, err := deserializeInfluxJSON(thread, msg.Value, flipSingleField)
+			handleParsed(msg, FormatInfluxJSON, metrics, err, outChannel, parseFailedChan)
 		case <-ctx.Done():
 			log.WithFields(log.Fields{"threadNum": thread, "section": "influx JSON processing"}).Info("Closing processing thread...")
 			for msg := range inChannel {
-				for _, metric := range deserializeInfluxJSON(thread, msg, flipSingleField) {
-					outChannel <- metric
-				}
+				metrics, err := deserializeInfluxJSON(thread, msg.Value, flipSingleField)
+				handleParsed(msg, FormatInfluxJSON, metrics, err, outChannel, parseFailedChan)
 			}
 			break processloop
 		}
@@ -310,7 +449,7 @@ processloop:
 }
 
 //ProcessPromMsg : parse and forward a Prometheus JSON protocol message
-func ProcessPromMsg(ctx context.Context, thread int, inChannel chan []byte, outChannel chan InfluxMetric, normalize bool, flipSingleField bool, wg *sync.WaitGroup) {
+func ProcessPromMsg(ctx context.Context, thread int, inChannel chan KafkaMsg, outChannel chan InfluxMetric, parseFailedChan chan ParseFailure, normalize bool, flipSingleField bool, wg *Stage) {
 	log.WithFields(log.Fields{"threadNum": thread, "section": "prometheus processing"}).Info("processing thread starting...")
 	defer wg.Done()
 
@@ -318,15 +457,13 @@ processloop:
 	for {
 		select {
 		case msg := <-inChannel:
-			for _, metric := range deserializePromJSON(thread, msg, normalize, flipSingleField) {
-				outChannel <- metric
-			}
+			metrics, err := deserializePromJSON(thread, msg.Value, normalize, flipSingleField)
+			handleParsed(msg, FormatPromJSON, metrics, err, outChannel, parseFailedChan)
 		case <-ctx.Done():
 			log.WithFields(log.Fields{"threadNum": thread, "section": "prometheus processing"}).Info("Closing processing thread...")
 			for msg := range inChannel {
-				for _, metric := range deserializePromJSON(thread, msg, normalize, flipSingleField) {
-					outChannel <- metric
-				}
+				metrics, err := deserializePromJSON(thread, msg.Value, normalize, flipSingleField)
+				handleParsed(msg, FormatPromJSON, metrics, err, outChannel, parseFailedChan)
 			}
 			break processloop
 		}
@@ -24,13 +24,18 @@
 package main
 
 import (
+	"fmt"
 	"testing"
 )
 
 func TestInfluxLine(t *testing.T) {
 	var results []InfluxMetric
+	var err error
 	msg := "test_metric,tag=Value field=1 1637090544726635243"
-	results = deserializeInfluxLine(1, []byte(msg), false)
+	results, err = deserializeInfluxLine(1, []byte(msg), false)
+	if err != nil {
+		t.Fatalf("Couldn't deserialize message: %v", err)
+	}
 	if results[0].Timestamp != 1637090544726635243 {
 		t.Fatalf("Timestamp is invalid: %v -> should be '1637090544726635243'", results[0].Timestamp)
 	}
@@ -49,7 +54,10 @@ func TestInfluxLine(t *testing.T) {
 	if results[0].Tags["tag"] != "Value" {
 		t.Fatalf("tag value is wrong: %v -> should be 'Value'", results[0].Tags["tag"])
 	}
-	results = deserializeInfluxLine(1, []byte(msg), true)
+	results, err = deserializeInfluxLine(1, []byte(msg), true)
+	if err != nil {
+		t.Fatalf("Couldn't deserialize message: %v", err)
+	}
 	if results[0].Timestamp != 1637090544726635243 {
 		t.Fatalf("Timestamp is invalid: %v -> should be '1637090544726635243'", results[0].Timestamp)
 	}
@@ -70,16 +78,23 @@ func TestInfluxLine(t *testing.T) {
 	}
 	// space after comma and before tags
 	msg = "test_metric, tag=value field=1 1637090544726635243"
-	results = deserializeInfluxLine(1, []byte(msg), false)
+	results, err = deserializeInfluxLine(1, []byte(msg), false)
 	if len(results) > 0 {
 		t.Fatalf("Improperly formatted line protocol emitted data? %v", results)
 	}
+	if err == nil {
+		t.Fatalf("Improperly formatted message didn't return an error")
+	}
 }
 
 func TestInfluxJSON(t *testing.T) {
 	var results []InfluxMetric
+	var err error
 	msg := "{\"fields\": {\"field\": 1}, \"tags\": {\"tag\": \"Value\"}, \"name\": \"test_metric\", \"timestamp\": 1637090544726635243}"
-	results = deserializeInfluxJSON(1, []byte(msg), false)
+	results, err = deserializeInfluxJSON(1, []byte(msg), false)
+	if err != nil {
+		t.Fatalf("Couldn't deserialize message: %v", err)
+	}
 	if results[0].Timestamp != 1637090544726635243 {
 		t.Fatalf("Timestamp is invalid: %v -> should be '1637090544726635243'", results[0].Timestamp)
 	}
@@ -98,7 +113,10 @@ func TestInfluxJSON(t *testing.T) {
 	if results[0].Tags["tag"] != "Value" {
 		t.Fatalf("tag value is wrong: %v -> should be 'Value'", results[0].Tags["tag"])
 	}
-	results = deserializeInfluxJSON(1, []byte(msg), true)
+	results, err = deserializeInfluxJSON(1, []byte(msg), true)
+	if err != nil {
+		t.Fatalf("Couldn't deserialize message: %v", err)
+	}
 	if results[0].Timestamp != 1637090544726635243 {
 		t.Fatalf("Timestamp is invalid: %v -> should be '1637090544726635243'", results[0].Timestamp)
 	}
@@ -119,16 +137,65 @@ func TestInfluxJSON(t *testing.T) {
 	}
 	// missing comma after `fields` object
 	msg = "{\"fields\": {\"field\": 1} \"tags\": {\"tag\": \"value\"}, \"name\": \"test_metric\", \"timestamp\": 1637090544726635243}"
-	results = deserializeInfluxJSON(1, []byte(msg), false)
+	results, err = deserializeInfluxJSON(1, []byte(msg), false)
 	if len(results) > 0 {
 		t.Fatalf("Improperly formatted influx JSON emitted data? %v", results)
 	}
+	if err == nil {
+		t.Fatalf("Improperly formatted message didn't return an error")
+	}
+}
+
+/*
+Things we should check:
+1. json_batch documents, arrays and newline-delimited JSON are all expanded
+2. a bad element only drops itself (and is counted)
+3. a message where nothing decodes still fails
+*/
+func TestInfluxJSONBatch(t *testing.T) {
+	metric := "{\"fields\": {\"field\": %v}, \"tags\": {\"tag\": \"value\"}, \"name\": \"test_metric\", \"timestamp\": 1637090544}"
+	one, two := fmt.Sprintf(metric, 1), fmt.Sprintf(metric, 2)
+	for _, msg := range []string{
+		fmt.Sprintf("{\"metrics\": [%v, %v]}", one, two),
+		fmt.Sprintf("[%v, %v]", one, two),
+		fmt.Sprintf("%v\n%v\n", one, two),
+		fmt.Sprintf("{\"metrics\": [%v]}\n%v", one, two),
+	} {
+		results, err := deserializeInfluxJSON(1, []byte(msg), true)
+		if err != nil {
+			t.Fatalf("Couldn't deserialize message %v: %v", msg, err)
+		}
+		if len(results) != 2 || results[0].Fields["value"].(float64) != 1 || results[1].Fields["value"].(float64) != 2 || results[1].Name != "test_metric_field" {
+			t.Fatalf("Batch %v decoded wrong: %+v", msg, results)
+		}
+	}
+	failed := ParseFailedElements.Get()
+	for _, msg := range []string{
+		fmt.Sprintf("{\"metrics\": [%v, 5, %v]}", one, two),
+		fmt.Sprintf("%v\n{\"fields\": {\"field\": 1} \"name\": \"broken\"}\n%v", one, two),
+	} {
+		results, err := deserializeInfluxJSON(1, []byte(msg), false)
+		if err != nil || len(results) != 2 {
+			t.Fatalf("Batch with a bad element %v decoded wrong: %+v (%v)", msg, results, err)
+		}
+	}
+	if ParseFailedElements.Get() != failed+2 {
+		t.Fatalf("Failed elements weren't counted: %v -> should be %v", ParseFailedElements.Get(), failed+2)
+	}
+	results, err := deserializeInfluxJSON(1, []byte("[5, \"test\"]"), false)
+	if err == nil || len(results) > 0 {
+		t.Fatalf("Batch with no good elements didn't fail: %+v", results)
+	}
 }
 
 func TestPrometheusJSON(t *testing.T) {
 	var results []InfluxMetric
+	var err error
 	msg := "{\"value\": \"2\", \"name\": \"test_metric_field\", \"timestamp\": \"2021-11-16T07:20:50.52Z\", \"labels\": {\"__name__\": \"test_metric_field\", \"tag\": \"Value\"}}"
-	results = deserializePromJSON(1, []byte(msg), false, false)
+	results, err = deserializePromJSON(1, []byte(msg), false, false)
+	if err != nil {
+		t.Fatalf("Couldn't deserialize message: %v", err)
+	}
 	// timestamp gets smooshed down to seconds in parsing
 	if results[0].Timestamp != 1637047250 {
 		t.Fatalf("Timestamp is invalid: %v -> should be '1637047250'", results[0].Timestamp)
@@ -148,7 +215,10 @@ func TestPrometheusJSON(t *testing.T) {
 	if results[0].Tags["tag"] != "Value" {
 		t.Fatalf("tag value is wrong: %v -> should be 'Value'", results[0].Tags["tag"])
 	}
-	results = deserializePromJSON(1, []byte(msg), false, true)
+	results, err = deserializePromJSON(1, []byte(msg), false, true)
+	if err != nil {
+		t.Fatalf("Couldn't deserialize message: %v", err)
+	}
 	if results[0].Timestamp != 1637047250 {
 		t.Fatalf("Timestamp is invalid: %v -> should be '1637047250'", results[0].Timestamp)
 	}
@@ -168,7 +238,10 @@ func TestPrometheusJSON(t *testing.T) {
 		t.Fatalf("tag value is wrong: %v -> should be 'Value'", results[0].Tags["tag"])
 	}
 	msg = "{\"value\": \"2\", \"name\": \"test_metric_field\", \"timestamp\": \"2021-11-16T07:20:50.52Z\", \"labels\": {\"__name__\": \"test_metric_field\", \"tag\": \"Value\"}}"
-	results = deserializePromJSON(1, []byte(msg), true, false)
+	results, err = deserializePromJSON(1, []byte(msg), true, false)
+	if err != nil {
+		t.Fatalf("Couldn't deserialize message: %v", err)
+	}
 	if results[0].Timestamp != 1637047250 {
 		t.Fatalf("Timestamp is invalid: %v -> should be '1637047250'", results[0].Timestamp)
 	}
@@ -187,7 +260,10 @@ func TestPrometheusJSON(t *testing.T) {
 	if results[0].Tags["tag"] != "value" {
 		t.Fatalf("tag value is wrong: %v -> should be 'value'", results[0].Tags["tag"])
 	}
-	results = deserializePromJSON(1, []byte(msg), true, true)
+	results, err = deserializePromJSON(1, []byte(msg), true, true)
+	if err != nil {
+		t.Fatalf("Couldn't deserialize message: %v", err)
+	}
 	if results[0].Timestamp != 1637047250 {
 		t.Fatalf("Timestamp is invalid: %v -> should be '1637047250'", results[0].Timestamp)
 	}
@@ -208,8 +284,65 @@ func TestPrometheusJSON(t *testing.T) {
 	}
 	// no comma after value
 	msg = "{\"value\": \"2\" \"timestamp\": 1637090544726635243, \"labels\": {\"__name__\": \"test_metric\", \"tag\": \"value\"}}"
-	results = deserializePromJSON(1, []byte(msg), false, false)
+	results, err = deserializePromJSON(1, []byte(msg), false, false)
 	if len(results) > 0 {
 		t.Fatalf("Improperly formatted Prometheus JSON emitted data? %v", results)
 	}
+	if err == nil {
+		t.Fatalf("Improperly formatted message didn't return an error")
+	}
+	// a bad timestamp shouldn't take the whole process down
+	msg = "{\"value\": \"2\", \"name\": \"test_metric_field\", \"timestamp\": \"yesterday\", \"labels\": {\"__name__\": \"test_metric_field\", \"tag\": \"Value\"}}"
+	results, err = deserializePromJSON(1, []byte(msg), false, false)
+	if len(results) > 0 {
+		t.Fatalf("Prometheus JSON with an invalid timestamp emitted data? %v", results)
+	}
+	if err == nil {
+		t.Fatalf("Invalid timestamp didn't return an error")
+	}
+}
+
+func TestParseFailures(t *testing.T) {
+	msg := KafkaMsg{Value: []byte("test_metric, tag=value field=1"), Source: testSource("test", 1, 5)}
+	metrics, err := deserializeInfluxLine(1, msg.Value, false)
+	parseFailedChan := make(chan ParseFailure, 1)
+	handleParsed(msg, FormatInfluxLine, metrics, err, nil, parseFailedChan)
+	if len(parseFailedChan) != 1 {
+		t.Fatalf("Unparseable message wasn't sent to the parse failures topic")
+	}
+	failure := <-parseFailedChan
+	if string(failure.Value) != string(msg.Value) || failure.Format != FormatInfluxLine || failure.Error == "" {
+		t.Fatalf("Parse failure doesn't describe the original message: %v", failure)
+	}
+	if msg.Source.Delivered() {
+		t.Fatalf("Message considered delivered before its parse failure was")
+	}
+	headers := parseFailureHeaders(failure, KafkaProducerMeta{WritePath: "http://localhost"})
+	found := false
+	for _, header := range headers {
+		if header.Key == "sisyphus-source-offset" {
+			found = string(header.Value) == "5"
+		}
+	}
+	if !found {
+		t.Fatalf("Parse failure headers are missing the source offset: %v", headers)
+	}
+	failure.Source.Done()
+	if !msg.Source.Delivered() {
+		t.Fatalf("Message not delivered after its parse failure was")
+	}
+
+	// a message the reader decompressed is published as it was produced
+	msg = KafkaMsg{Value: []byte("test_metric, tag=value field=1"), Raw: []byte("compressed"), Encoding: EncodingGzip, Source: testSource("test", 1, 7)}
+	handleParsed(msg, FormatInfluxLine, nil, errNoMetricName, nil, parseFailedChan)
+	if failure := <-parseFailedChan; string(failure.Value) != "compressed" {
+		t.Fatalf("Parse failure of a decompressed message isn't the original message: %q", failure.Value)
+	}
+
+	// without a parse failures topic, bad messages are simply dropped
+	msg.Source = testSource("test", 1, 6)
+	handleParsed(msg, FormatInfluxLine, metrics, err, nil, nil)
+	if !msg.Source.Delivered() {
+		t.Fatalf("Dropped message wasn't considered delivered")
+	}
 }
@@ -0,0 +1,272 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// suffixes a sample name can have on top of its metric family's name
+var promFamilySuffixes = []string{"_bucket", "_count", "_sum", "_total", "_created", "_info", "_gcount", "_gsum"}
+
+// promTextSample : a single sample line from a text exposition
+type promTextSample struct {
+	name      string
+	labels    map[string]string
+	value     float64
+	timestamp int64
+	hasTime   bool
+}
+
+/*
+parsePromLabels reads a label set (`{a="b",c="d"}`, starting after the `{`)
+and returns whatever is left of the line after the closing `}`.
+*/
+func parsePromLabels(line string) (map[string]string, string, error) {
+	labels := make(map[string]string)
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if strings.HasPrefix(line, "}") {
+			return labels, line[1:], nil
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 1 {
+			return nil, "", fmt.Errorf("bad label in %q", line)
+		}
+		key := strings.TrimSpace(line[:eq])
+		line = strings.TrimLeft(line[eq+1:], " \t")
+		if !strings.HasPrefix(line, "\"") {
+			return nil, "", fmt.Errorf("label %v value isn't quoted", key)
+		}
+		var value strings.Builder
+		closed := false
+		i := 1
+		for ; i < len(line); i++ {
+			if line[i] == '"' {
+				closed = true
+				break
+			}
+			if line[i] == '\\' && i+1 < len(line) {
+				i++
+				switch line[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(line[i])
+				}
+				continue
+			}
+			value.WriteByte(line[i])
+		}
+		if !closed {
+			return nil, "", fmt.Errorf("label %v value isn't terminated", key)
+		}
+		labels[key] = value.String()
+		line = strings.TrimLeft(line[i+1:], " \t")
+		if strings.HasPrefix(line, ",") {
+			line = line[1:]
+		} else if !strings.HasPrefix(line, "}") {
+			return nil, "", fmt.Errorf("expected , or } after label %v", key)
+		}
+	}
+}
+
+/*
+parsePromSample reads a single sample line: `name{labels} value [timestamp]`.
+Prometheus' text format has millisecond timestamps, OpenMetrics has (possibly fractional) seconds
+and may add an exemplar (` # {labels} value`) that we ignore.
+*/
+func parsePromSample(line string, openMetrics bool) (promTextSample, error) {
+	sample := promTextSample{labels: make(map[string]string)}
+	end := strings.IndexAny(line, "{ \t")
+	if end < 0 {
+		return sample, fmt.Errorf("sample %q has no value", line)
+	}
+	sample.name = line[:end]
+	line = line[end:]
+	if strings.HasPrefix(line, "{") {
+		var err error
+		if sample.labels, line, err = parsePromLabels(line[1:]); err != nil {
+			return sample, err
+		}
+	}
+	if exemplar := strings.Index(line, " # "); openMetrics && exemplar >= 0 {
+		line = line[:exemplar]
+	}
+	parts := strings.Fields(line)
+	if len(parts) < 1 || len(parts) > 2 {
+		return sample, fmt.Errorf("sample %v should have a value and an optional timestamp", sample.name)
+	}
+	value, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return sample, fmt.Errorf("sample %v has a bad value: %v", sample.name, err)
+	}
+	sample.value = value
+	if len(parts) == 2 {
+		sample.hasTime = true
+		if openMetrics {
+			ts, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil {
+				return sample, fmt.Errorf("sample %v has a bad timestamp: %v", sample.name, err)
+			}
+			sample.timestamp = int64(ts)
+		} else {
+			ts, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				return sample, fmt.Errorf("sample %v has a bad timestamp: %v", sample.name, err)
+			}
+			sample.timestamp = ts / 1000
+		}
+	}
+	return sample, nil
+}
+
+// promFamily finds the metric family (and so the declared type) a sample belongs to
+func promFamily(name string, types map[string]string) (string, string) {
+	if typ, ok := types[name]; ok {
+		return name, typ
+	}
+	for _, suffix := range promFamilySuffixes {
+		family := strings.TrimSuffix(name, suffix)
+		if typ, ok := types[family]; ok && family != name {
+			return family, typ
+		}
+	}
+	return name, "untyped"
+}
+
+/*
+parsePromText reads a whole exposition (a /metrics scrape body), in either
+Prometheus' text format or OpenMetrics (which always ends with `# EOF`).
+HELP/UNIT lines and other comments are skipped, TYPE lines are used to check
+that histogram buckets have an `le` label and summary quantiles a `quantile` label.
+*/
+func parsePromText(msg []byte) ([]promTextSample, error) {
+	var samples []promTextSample
+	openMetrics := bytes.HasSuffix(bytes.TrimSpace(msg), []byte("# EOF"))
+	types := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(msg))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(msg)+1)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			parts := strings.Fields(line)
+			if len(parts) >= 4 && parts[1] == "TYPE" {
+				types[parts[2]] = strings.ToLower(parts[3])
+			}
+			continue
+		}
+		sample, err := parsePromSample(line, openMetrics)
+		if err != nil {
+			return nil, err
+		}
+		family, typ := promFamily(sample.name, types)
+		switch {
+		case (typ == "histogram" || typ == "gaugehistogram") && sample.name == family+"_bucket":
+			if _, ok := sample.labels["le"]; !ok {
+				return nil, fmt.Errorf("histogram bucket %v has no le label", sample.name)
+			}
+		case typ == "summary" && sample.name == family:
+			if _, ok := sample.labels["quantile"]; !ok {
+				return nil, fmt.Errorf("summary quantile %v has no quantile label", sample.name)
+			}
+		}
+		samples = append(samples, sample)
+	}
+	return samples, scanner.Err()
+}
+
+/*
+deserializePromText turns an exposition into metrics, with the same naming rules as
+our other Prometheus formats. Samples without timestamps get received (the Kafka timestamp).
+*/
+func deserializePromText(thread int, msg []byte, received time.Time, normalize bool, flipSingleField bool) ([]InfluxMetric, error) {
+	var outputStats []InfluxMetric
+	ProcTimeStart := time.Now()
+	defer func() { ProcessTime.Add(float64(time.Now().Sub(ProcTimeStart)) / TimeSegmentDivisor) }()
+	ReceivedMsgs.Inc()
+	if msg == nil {
+		log.Warning("Empty message received from Kafka")
+		return nil, nil
+	}
+	samples, err := parsePromText(msg)
+	if err != nil {
+		log.WithFields(log.Fields{"threadNum": thread, "error": err, "section": "prometheus text processing"}).Error("Couldn't process message")
+		return nil, err
+	}
+	for _, sample := range samples {
+		if math.IsNaN(sample.value) || math.IsInf(sample.value, 0) {
+			DroppedMsgs.Inc()
+			continue
+		}
+		name, labels := sample.name, sample.labels
+		if normalize {
+			name = strings.ToLower(name)
+			labels = make(map[string]string, len(sample.labels))
+			for key, value := range sample.labels {
+				labels[strings.ToLower(key)] = strings.ToLower(value)
+			}
+		}
+		timestamp := received.Unix()
+		if sample.hasTime {
+			timestamp = sample.timestamp
+		}
+		outputStats = append(outputStats, promToInflux(name, labels, sample.value, timestamp, flipSingleField))
+	}
+	return outputStats, nil
+}
+
+// ProcessPromTextMsg : parse and forward a Prometheus text exposition message
+func ProcessPromTextMsg(ctx context.Context, thread int, inChannel chan KafkaMsg, outChannel chan InfluxMetric, parseFailedChan chan ParseFailure, normalize bool, flipSingleField bool, wg *Stage) {
+	log.WithFields(log.Fields{"threadNum": thread, "section": "prometheus text processing"}).Info("processing thread starting...")
+	defer wg.Done()
+
+processloop:
+	for {
+		select {
+		case msg := <-inChannel:
+			metrics, err := deserializePromText(thread, msg.Value, msg.Source.receivedAt(), normalize, flipSingleField)
+			handleParsed(msg, FormatPromText, metrics, err, outChannel, parseFailedChan)
+		case <-ctx.Done():
+			log.WithFields(log.Fields{"threadNum": thread, "section": "prometheus text processing"}).Info("Closing processing thread...")
+			for msg := range inChannel {
+				metrics, err := deserializePromText(thread, msg.Value, msg.Source.receivedAt(), normalize, flipSingleField)
+				handleParsed(msg, FormatPromText, metrics, err, outChannel, parseFailedChan)
+			}
+			break processloop
+		}
+	}
+}
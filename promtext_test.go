@@ -0,0 +1,105 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+Things we should check:
+1. counters, gauges, histograms and summaries are named like other prometheus formats
+2. label escapes, sample timestamps (ms) and the fallback to the Kafka timestamp work
+3. OpenMetrics has timestamps in seconds and exemplars are ignored
+4. NaN/Inf samples are dropped
+5. buckets without le, summaries without quantile, and bad lines fail to parse
+*/
+func TestPromText(t *testing.T) {
+	received := time.Unix(1637000000, 0)
+	msg := `# HELP http_requests_total The total number of HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027 1637047250000
+http_requests_total{method="post",path="/a\"b\\c\n"} 3
+
+# TYPE temperature gauge
+temperature 21.5
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0.5"} 24054
+request_duration_seconds_bucket{le="+Inf"} 33444
+request_duration_seconds_sum 53423
+request_duration_seconds_count 33444
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.99"} NaN
+rpc_duration_seconds{quantile="0.5",} 4773
+rpc_duration_seconds_count 2693
+`
+	results, err := deserializePromText(1, []byte(msg), received, false, false)
+	if err != nil {
+		t.Fatalf("Couldn't deserialize message: %v", err)
+	}
+	if len(results) != 9 {
+		t.Fatalf("metric count is wrong: %v -> should be 9 (%+v)", len(results), results)
+	}
+	if results[0].Name != "http_requests" || results[0].Fields["total"].(float64) != 1027 || results[0].Timestamp != 1637047250 ||
+		results[0].Tags["method"] != "post" || results[0].Tags["code"] != "200" {
+		t.Fatalf("counter is wrong: %+v", results[0])
+	}
+	if results[1].Tags["path"] != "/a\"b\\c\n" || results[1].Timestamp != 1637000000 {
+		t.Fatalf("escaped labels or kafka timestamp are wrong: %+v", results[1])
+	}
+	if results[2].Name != "temperature" || results[2].Fields["value"].(float64) != 21.5 {
+		t.Fatalf("gauge is wrong: %+v", results[2])
+	}
+	if results[4].Name != "request_duration_seconds" || results[4].Fields["bucket"].(float64) != 33444 || results[4].Tags["le"] != "+Inf" {
+		t.Fatalf("histogram bucket is wrong: %+v", results[4])
+	}
+	if results[7].Name != "rpc_duration" || results[7].Fields["seconds"].(float64) != 4773 || results[7].Tags["quantile"] != "0.5" {
+		t.Fatalf("summary quantile is wrong: %+v", results[7])
+	}
+
+	openMetrics := "# TYPE jobs counter\n# UNIT jobs seconds\njobs_total{job=\"Backup\"} 17 1637047250.5 # {trace_id=\"abc\"} 1 1637047250\n# EOF\n"
+	results, err = deserializePromText(1, []byte(openMetrics), received, true, true)
+	if err != nil || len(results) != 1 {
+		t.Fatalf("Couldn't deserialize openmetrics: %+v (%v)", results, err)
+	}
+	if results[0].Name != "jobs_total" || results[0].Fields["value"].(float64) != 17 || results[0].Timestamp != 1637047250 ||
+		results[0].Tags["job"] != "backup" || len(results[0].Tags) != 1 {
+		t.Fatalf("openmetrics sample is wrong: %+v", results[0])
+	}
+
+	for _, bad := range []string{
+		"# TYPE h histogram\nh_bucket 1\n",
+		"# TYPE s summary\ns 1\n",
+		"metric{label=\"value} 1\n",
+		"metric{label=value} 1\n",
+		"metric one\n",
+		"metric\n",
+		"metric 1 2 3\n",
+	} {
+		if _, err := deserializePromText(1, []byte(bad), received, false, false); err == nil {
+			t.Fatalf("%q should fail to parse", bad)
+		}
+	}
+}
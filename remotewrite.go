@@ -0,0 +1,280 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+/*
+Field numbers from Prometheus' remote write protobuf (prompb):
+
+	message WriteRequest { repeated TimeSeries timeseries = 1; ... }
+	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; ... }
+	message Label { string name = 1; string value = 2; }
+	message Sample { double value = 1; int64 timestamp = 2; }
+
+Anything else (metadata, exemplars, native histograms) is skipped.
+*/
+const (
+	writeRequestTimeSeries = 1
+	timeSeriesLabels       = 1
+	timeSeriesSamples      = 2
+	labelName              = 1
+	labelValue             = 2
+	sampleValue            = 1
+	sampleTimestamp        = 2
+)
+
+var errNoMetricName = errors.New("time series has no __name__ label")
+
+// promSample : a single value from a remote write time series
+type promSample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// promTimeSeries : a single series (and all its samples) from a remote write request
+type promTimeSeries struct {
+	Labels  map[string]string
+	Samples []promSample
+}
+
+/*
+protoFields walks the fields of an encoded protobuf message,
+handing each one (and its raw value) to handle
+*/
+func protoFields(msg []byte, handle func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		n = protowire.ConsumeFieldValue(num, typ, msg)
+		if n < 0 {
+			return fmt.Errorf("field %v: %w", num, protowire.ParseError(n))
+		}
+		if err := handle(num, typ, msg[:n]); err != nil {
+			return err
+		}
+		msg = msg[n:]
+	}
+	return nil
+}
+
+// protoBytes : the contents of a length-delimited field
+func protoBytes(num protowire.Number, typ protowire.Type, value []byte) ([]byte, error) {
+	if typ != protowire.BytesType {
+		return nil, fmt.Errorf("field %v: expected length-delimited value, got wire type %v", num, typ)
+	}
+	b, n := protowire.ConsumeBytes(value)
+	if n < 0 {
+		return nil, protowire.ParseError(n)
+	}
+	return b, nil
+}
+
+func decodeLabel(msg []byte) (string, string, error) {
+	var name, value string
+	err := protoFields(msg, func(num protowire.Number, typ protowire.Type, raw []byte) error {
+		if num != labelName && num != labelValue {
+			return nil
+		}
+		b, err := protoBytes(num, typ, raw)
+		if num == labelName {
+			name = string(b)
+		} else {
+			value = string(b)
+		}
+		return err
+	})
+	return name, value, err
+}
+
+func decodeSample(msg []byte) (promSample, error) {
+	var sample promSample
+	err := protoFields(msg, func(num protowire.Number, typ protowire.Type, raw []byte) error {
+		switch {
+		case num == sampleValue && typ == protowire.Fixed64Type:
+			v, _ := protowire.ConsumeFixed64(raw)
+			sample.Value = math.Float64frombits(v)
+		case num == sampleTimestamp && typ == protowire.VarintType:
+			v, _ := protowire.ConsumeVarint(raw)
+			sample.Timestamp = int64(v)
+		case num == sampleValue || num == sampleTimestamp:
+			return fmt.Errorf("sample field %v has unexpected wire type %v", num, typ)
+		}
+		return nil
+	})
+	return sample, err
+}
+
+func decodeTimeSeries(msg []byte) (promTimeSeries, error) {
+	series := promTimeSeries{Labels: make(map[string]string)}
+	err := protoFields(msg, func(num protowire.Number, typ protowire.Type, raw []byte) error {
+		if num != timeSeriesLabels && num != timeSeriesSamples {
+			return nil
+		}
+		b, err := protoBytes(num, typ, raw)
+		if err != nil {
+			return err
+		}
+		if num == timeSeriesLabels {
+			name, value, err := decodeLabel(b)
+			series.Labels[name] = value
+			return err
+		}
+		sample, err := decodeSample(b)
+		series.Samples = append(series.Samples, sample)
+		return err
+	})
+	return series, err
+}
+
+/*
+decodeWriteRequest : unpack a (snappy compressed) remote write request,
+refusing any that'd decompress to more than limit bytes.
+Remote write is always compressed, so when decompression is turned off
+(a negative limit) we still keep to the default limit.
+If the Kafka reader already undid the snappy compression (the message had
+a content-encoding header), decompressed is set and msg is used as-is.
+*/
+func decodeWriteRequest(msg []byte, decompressed bool, limit int64) ([]promTimeSeries, error) {
+	raw := msg
+	if !decompressed {
+		if limit < 0 {
+			limit = DefaultMaxDecompressedBytes
+		}
+		// snappy allocates whatever the header claims, so check it before decoding
+		size, err := snappy.DecodedLen(msg)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decompress write request: %w", err)
+		}
+		if int64(size) > limit {
+			return nil, fmt.Errorf("couldn't decompress write request: %w", errTooLarge)
+		}
+		raw, err = snappy.Decode(nil, msg)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decompress write request: %w", err)
+		}
+	}
+	var series []promTimeSeries
+	err := protoFields(raw, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num != writeRequestTimeSeries {
+			return nil
+		}
+		b, err := protoBytes(num, typ, value)
+		if err != nil {
+			return err
+		}
+		ts, err := decodeTimeSeries(b)
+		series = append(series, ts)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode write request: %w", err)
+	}
+	return series, nil
+}
+
+/*
+deserializePromRemoteWrite : turn a remote write request into influx metrics
+
+Every sample of every series becomes its own metric, named the same way
+as Prometheus JSON metrics (see promToInflux).
+Samples with values influx can't store (NaN, like Prometheus' staleness markers, or +/-Inf) are dropped.
+*/
+func deserializePromRemoteWrite(thread int, msg KafkaMsg, maxDecompressed int64, normalize bool, flipSingleField bool) ([]InfluxMetric, error) {
+	var outputStats []InfluxMetric
+	ProcTimeStart := time.Now()
+	defer func() { ProcessTime.Add(float64(time.Now().Sub(ProcTimeStart)) / TimeSegmentDivisor) }()
+	ReceivedMsgs.Inc()
+	if msg.Value == nil {
+		log.Warning("Empty message received from Kafka")
+		return nil, nil
+	}
+	series, err := decodeWriteRequest(msg.Value, msg.Encoding == EncodingSnappy, maxDecompressed)
+	if err != nil {
+		log.WithFields(log.Fields{"threadNum": thread, "error": err, "section": "prometheus remote write processing"}).Error("Couldn't process message")
+		return nil, err
+	}
+	for _, ts := range series {
+		name, ok := ts.Labels["__name__"]
+		if !ok {
+			log.WithFields(log.Fields{"threadNum": thread, "labels": ts.Labels, "section": "prometheus remote write processing"}).Error("Couldn't process message")
+			return nil, errNoMetricName
+		}
+		labels := make(map[string]string, len(ts.Labels))
+		for key, value := range ts.Labels {
+			if normalize {
+				key, value = strings.ToLower(key), strings.ToLower(value)
+			}
+			labels[key] = value
+		}
+		if normalize {
+			name = strings.ToLower(name)
+		}
+		for _, sample := range ts.Samples {
+			if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+				DroppedMsgs.Inc()
+				continue
+			}
+			// remote write timestamps are in milliseconds
+			outputStats = append(outputStats, promToInflux(name, labels, sample.Value, sample.Timestamp/1000, flipSingleField))
+		}
+	}
+	return outputStats, nil
+}
+
+// ProcessPromRemoteWriteMsg : parse and forward a Prometheus remote write protobuf message
+func ProcessPromRemoteWriteMsg(ctx context.Context, thread int, inChannel chan KafkaMsg, outChannel chan InfluxMetric, parseFailedChan chan ParseFailure, maxDecompressed int64, normalize bool, flipSingleField bool, wg *Stage) {
+	log.WithFields(log.Fields{"threadNum": thread, "section": "prometheus remote write processing"}).Info("processing thread starting...")
+	defer wg.Done()
+
+processloop:
+	for {
+		select {
+		case msg := <-inChannel:
+			metrics, err := deserializePromRemoteWrite(thread, msg, maxDecompressed, normalize, flipSingleField)
+			handleParsed(msg, FormatPromRemoteWrite, metrics, err, outChannel, parseFailedChan)
+		case <-ctx.Done():
+			log.WithFields(log.Fields{"threadNum": thread, "section": "prometheus remote write processing"}).Info("Closing processing thread...")
+			for msg := range inChannel {
+				metrics, err := deserializePromRemoteWrite(thread, msg, maxDecompressed, normalize, flipSingleField)
+				handleParsed(msg, FormatPromRemoteWrite, metrics, err, outChannel, parseFailedChan)
+			}
+			break processloop
+		}
+	}
+}
@@ -0,0 +1,127 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// testWriteRequest builds a snappy compressed remote write request
+func testWriteRequest(series ...promTimeSeries) []byte {
+	var req []byte
+	for _, ts := range series {
+		var tsMsg []byte
+		for name, value := range ts.Labels {
+			var label []byte
+			label = protowire.AppendTag(label, labelName, protowire.BytesType)
+			label = protowire.AppendString(label, name)
+			label = protowire.AppendTag(label, labelValue, protowire.BytesType)
+			label = protowire.AppendString(label, value)
+			tsMsg = protowire.AppendTag(tsMsg, timeSeriesLabels, protowire.BytesType)
+			tsMsg = protowire.AppendBytes(tsMsg, label)
+		}
+		for _, s := range ts.Samples {
+			var sample []byte
+			sample = protowire.AppendTag(sample, sampleValue, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(s.Value))
+			sample = protowire.AppendTag(sample, sampleTimestamp, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(s.Timestamp))
+			tsMsg = protowire.AppendTag(tsMsg, timeSeriesSamples, protowire.BytesType)
+			tsMsg = protowire.AppendBytes(tsMsg, sample)
+		}
+		// exemplars (which we don't read)
+		tsMsg = protowire.AppendTag(tsMsg, 3, protowire.BytesType)
+		tsMsg = protowire.AppendBytes(tsMsg, []byte{})
+		req = protowire.AppendTag(req, writeRequestTimeSeries, protowire.BytesType)
+		req = protowire.AppendBytes(req, tsMsg)
+	}
+	return snappy.Encode(nil, req)
+}
+
+/*
+Things we should check:
+1. every sample of every series becomes a metric
+2. names/fields are mapped the same way as Prometheus JSON
+3. NaN samples (staleness markers) are dropped
+4. garbage (or series without names) fails to parse
+5. requests that'd decompress to more than max_decompressed_bytes fail to parse (without decompressing them)
+6. requests the reader already decompressed (content-encoding: snappy) aren't decompressed again
+*/
+func TestPrometheusRemoteWrite(t *testing.T) {
+	msg := testWriteRequest(
+		promTimeSeries{Labels: map[string]string{"__name__": "test_metric_field", "tag": "Value"},
+			Samples: []promSample{{Value: 2, Timestamp: 1637047250520}, {Value: 3, Timestamp: 1637047260520}, {Value: math.NaN(), Timestamp: 1637047270520}}},
+		promTimeSeries{Labels: map[string]string{"__name__": "up", "job": "Node"},
+			Samples: []promSample{{Value: 1, Timestamp: 1637047250520}}})
+	results, err := deserializePromRemoteWrite(1, KafkaMsg{Value: msg}, DefaultMaxDecompressedBytes, false, false)
+	if err != nil {
+		t.Fatalf("Couldn't deserialize message: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("metric count is wrong: %v -> should be 3", len(results))
+	}
+	if results[0].Name != "test_metric" || results[0].Fields["field"].(float64) != 2 || results[0].Tags["tag"] != "Value" || len(results[0].Tags) != 1 {
+		t.Fatalf("first sample is wrong: %+v", results[0])
+	}
+	// timestamp gets smooshed down to seconds in parsing
+	if results[1].Timestamp != 1637047260 || results[1].Fields["field"].(float64) != 3 {
+		t.Fatalf("second sample is wrong: %+v", results[1])
+	}
+	if results[2].Name != "up" || results[2].Fields["value"].(float64) != 1 {
+		t.Fatalf("single part name is wrong: %+v", results[2])
+	}
+	kafkaMsg := &kafka.Message{Value: msg, Headers: []kafka.Header{{Key: contentEncodingHeader, Value: []byte(EncodingSnappy)}}}
+	decompressed := KafkaMsg{Raw: msg}
+	decompressed.Value, decompressed.Encoding = decompressMsg(1, kafkaMsg, DefaultMaxDecompressedBytes)
+	if decoded, err := deserializePromRemoteWrite(1, decompressed, DefaultMaxDecompressedBytes, false, false); err != nil || len(decoded) != 3 {
+		t.Fatalf("Write request decompressed by the reader wasn't deserialized: %v (%v)", decoded, err)
+	}
+	results, err = deserializePromRemoteWrite(1, KafkaMsg{Value: msg}, DefaultMaxDecompressedBytes, true, true)
+	if err != nil {
+		t.Fatalf("Couldn't deserialize message: %v", err)
+	}
+	if results[0].Name != "test_metric_field" || results[0].Fields["value"].(float64) != 2 || results[0].Tags["tag"] != "value" {
+		t.Fatalf("normalized/flipped sample is wrong: %+v", results[0])
+	}
+	if _, err = deserializePromRemoteWrite(1, KafkaMsg{Value: []byte("test_metric field=1")}, DefaultMaxDecompressedBytes, false, false); err == nil {
+		t.Fatalf("Garbage message was deserialized")
+	}
+	msg = testWriteRequest(promTimeSeries{Labels: map[string]string{"tag": "value"}, Samples: []promSample{{Value: 1}}})
+	if _, err = deserializePromRemoteWrite(1, KafkaMsg{Value: msg}, DefaultMaxDecompressedBytes, false, false); err != errNoMetricName {
+		t.Fatalf("Series without a name returned %v -> should be %v", err, errNoMetricName)
+	}
+	// a few bytes claiming to decompress to ~4GiB, which we mustn't allocate
+	if _, err = deserializePromRemoteWrite(1, KafkaMsg{Value: []byte{0xff, 0xff, 0xff, 0xff, 0x0f, 0x00}}, DefaultMaxDecompressedBytes, false, false); !errors.Is(err, errTooLarge) {
+		t.Fatalf("Oversized write request returned %v -> should be %v", err, errTooLarge)
+	}
+	if _, err = deserializePromRemoteWrite(1, KafkaMsg{Value: msg}, 8, false, false); !errors.Is(err, errTooLarge) {
+		t.Fatalf("Write request over max_decompressed_bytes returned %v -> should be %v", err, errTooLarge)
+	}
+}
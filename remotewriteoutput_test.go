@@ -0,0 +1,157 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	influxhttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+	influxapiwrite "github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// testRemoteWriteServer decodes every write request it gets, answering with status (if set)
+func testRemoteWriteServer(t *testing.T, status int) (*httptest.Server, func() []promTimeSeries) {
+	var lock sync.Mutex
+	var received []promTimeSeries
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Encoding") != "snappy" || req.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("Wrong headers on remote write request: %v", req.Header)
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		series, err := decodeWriteRequest(body, false, DefaultMaxDecompressedBytes)
+		if err != nil {
+			t.Errorf("Couldn't decode remote write request: %v", err)
+		}
+		lock.Lock()
+		received = append(received, series...)
+		lock.Unlock()
+		if status != 0 {
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(status)
+			w.Write([]byte("out of order sample"))
+		}
+	}))
+	return server, func() []promTimeSeries {
+		lock.Lock()
+		defer lock.Unlock()
+		return received
+	}
+}
+
+/*
+Things we should check:
+1. every numeric field becomes a <name>_<field> series (and `value` fields keep the name)
+2. tags become labels, timestamps are in milliseconds
+3. samples for the same series are grouped (in time order), string fields are skipped
+4. spooled line protocol is written the same way
+*/
+func TestRemoteWriteWriter(t *testing.T) {
+	server, received := testRemoteWriteServer(t, 0)
+	defer server.Close()
+	writer := newRemoteWriteWriter(server.URL, 5)
+	defer writer.Close()
+	ts := time.Unix(1637090544, 123000000)
+	err := writer.WritePoint(context.Background(),
+		influxdb2.NewPoint("cpu", map[string]string{"host": "a"}, map[string]interface{}{"usage_idle": 91.5}, ts.Add(time.Second)),
+		influxdb2.NewPoint("cpu", map[string]string{"host": "a"}, map[string]interface{}{"usage_idle": 90.5, "cores": 4, "state": "ok"}, ts),
+		influxdb2.NewPoint("up", map[string]string{"host": "a"}, map[string]interface{}{"value": true}, ts))
+	if err != nil {
+		t.Fatalf("Couldn't write points: %v", err)
+	}
+	series := map[string]promTimeSeries{}
+	for _, s := range received() {
+		series[s.Labels["__name__"]] = s
+	}
+	if len(series) != 3 {
+		t.Fatalf("Wrong series written: %v -> should be cpu_usage_idle, cpu_cores and up", series)
+	}
+	idle := series["cpu_usage_idle"]
+	if idle.Labels["host"] != "a" || len(idle.Samples) != 2 {
+		t.Fatalf("Wrong cpu_usage_idle series: %+v", idle)
+	}
+	if idle.Samples[0].Value != 90.5 || idle.Samples[0].Timestamp != 1637090544123 || idle.Samples[1].Timestamp != 1637090545123 {
+		t.Fatalf("Wrong cpu_usage_idle samples: %+v", idle.Samples)
+	}
+	if series["cpu_cores"].Samples[0].Value != 4 || series["up"].Samples[0].Value != 1 {
+		t.Fatalf("Wrong cpu_cores/up samples: %+v %+v", series["cpu_cores"], series["up"])
+	}
+
+	err = writer.WriteRecord(context.Background(), "mem,host=b used=12i 1637090544000000")
+	if err != nil {
+		t.Fatalf("Couldn't write line protocol: %v", err)
+	}
+	all := received()
+	last := all[len(all)-1]
+	if last.Labels["__name__"] != "mem_used" || last.Labels["host"] != "b" || last.Samples[0].Timestamp != 1637090544000 || last.Samples[0].Value != 12 {
+		t.Fatalf("Wrong series from line protocol: %+v", last)
+	}
+}
+
+/*
+Things we should check:
+1. rejected writes come back as HTTP errors, so they're retried/dead-lettered like influx writes
+2. Retry-After and the response body are kept
+3. pings treat a client error as a live endpoint, but not a server error
+*/
+func TestRemoteWriteErrors(t *testing.T) {
+	server, _ := testRemoteWriteServer(t, http.StatusBadRequest)
+	defer server.Close()
+	writer := newRemoteWriteWriter(server.URL, 5)
+	point := influxdb2.NewPoint("cpu", nil, map[string]interface{}{"value": 1.0}, time.Now())
+	err := writer.WritePoint(context.Background(), []*influxapiwrite.Point{point}...)
+	class, status := classifyWriteError(err)
+	if class != ErrorClassClient || status != http.StatusBadRequest {
+		t.Fatalf("Wrong error class for a rejected write: %v/%v -> should be %v/400", class, status, ErrorClassClient)
+	}
+	var httpErr *influxhttp.Error
+	if !errors.As(err, &httpErr) || httpErr.RetryAfter != 7 || httpErr.Message != "out of order sample" {
+		t.Fatalf("Rejected write lost Retry-After/the response body: %v", err)
+	}
+	failed := newFailedWrite("cpu value=1", nil, err, 0)
+	if failed.Error == "" || failed.HTTPStatus != http.StatusBadRequest {
+		t.Fatalf("Wrong dead letter for a rejected write: %+v", failed)
+	}
+	if ok, err := writer.Ping(context.Background()); !ok || err != nil {
+		t.Fatalf("Endpoint answering with a client error should be up: %v/%v", ok, err)
+	}
+
+	broken, _ := testRemoteWriteServer(t, http.StatusServiceUnavailable)
+	defer broken.Close()
+	writer = newRemoteWriteWriter(broken.URL, 5)
+	err = writer.WritePoint(context.Background(), point)
+	if class, _ := classifyWriteError(err); class != ErrorClassServer {
+		t.Fatalf("Wrong error class for a failed write: %v -> should be %v", class, ErrorClassServer)
+	}
+	if ok, _ := writer.Ping(context.Background()); ok {
+		t.Fatalf("Endpoint answering with a server error shouldn't be up")
+	}
+}
@@ -0,0 +1,415 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	json "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReplayMeta : settings for replaying the dead letter queue
+type ReplayMeta struct {
+	Brokers      string
+	Topic        string
+	Group        string
+	BatchSize    int
+	Rate         float64
+	StartTime    time.Time
+	EndTime      time.Time
+	StartOffset  int64
+	EndOffset    int64
+	DryRun       bool
+	Normalize    bool
+	WritePaths   *regexp.Regexp
+	IdleTimeout  time.Duration
+	WriteTimeout uint
+	// how to write to the outputs we know about (by URL), anything else is assumed to be influx
+	Outputs map[string]OutputMeta
+}
+
+/*
+replayDestination :
+Dead letter messages may be for different tenants,
+so we batch by everything that makes up a write destination
+*/
+type replayDestination struct {
+	WritePath string
+	TSDOrg    string
+	TSDName   string
+}
+
+type replayBatch struct {
+	Lines   []string
+	Sources []*MessageSource
+}
+
+/*
+replayer :
+Everything we need to keep track of while replaying.
+Messages are grouped into per-destination batches. Each message's
+source is only marked delivered once its batch has been written, so
+the offsetTracker tells us what we can safely commit.
+*/
+type replayer struct {
+	cfg      ReplayMeta
+	batches  map[replayDestination]*replayBatch
+	clients  map[replayDestination]OutputWriter
+	tracker  *offsetTracker
+	started  time.Time
+	written  int
+	skipped  int
+	failures int
+}
+
+func newReplayer(cfg ReplayMeta) *replayer {
+	return &replayer{cfg: cfg, batches: make(map[replayDestination]*replayBatch),
+		clients: make(map[replayDestination]OutputWriter), tracker: newOffsetTracker(true),
+		started: time.Now()}
+}
+
+/*
+add queues a single dead letter message for replay.
+Messages we can't (or shouldn't) replay are released immediately
+so they don't hold up offset commits.
+*/
+func (r *replayer) add(value []byte, source *MessageSource) {
+	var msg DeadLetterMsg
+	err := json.Unmarshal(value, &msg)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "incoming_msg": string(value), "section": "replay"}).Warning("Couldn't deserialize dead letter message")
+		r.skipped++
+		source.Done()
+		return
+	}
+	line := strings.TrimSpace(msg.Message)
+	if msg.WritePath == "" || line == "" || strings.HasPrefix(line, ",") {
+		log.WithFields(log.Fields{"msg": msg, "section": "replay"}).Warning("Dead letter message doesn't have a proper destination or metric")
+		r.skipped++
+		source.Done()
+		return
+	}
+	if r.cfg.WritePaths != nil && !r.cfg.WritePaths.MatchString(msg.WritePath) {
+		r.skipped++
+		source.Done()
+		return
+	}
+	if r.cfg.Normalize {
+		line = strings.ToLower(line)
+	}
+	dest := replayDestination{WritePath: msg.WritePath, TSDOrg: msg.TSDOrg, TSDName: msg.TSDName}
+	batch, ok := r.batches[dest]
+	if !ok {
+		batch = &replayBatch{}
+		r.batches[dest] = batch
+	}
+	batch.Lines = append(batch.Lines, line)
+	batch.Sources = append(batch.Sources, source)
+	if len(batch.Lines) >= r.cfg.BatchSize {
+		r.flush(dest, batch)
+	}
+}
+
+// throttle sleeps long enough to keep us under our configured points/second
+func (r *replayer) throttle() {
+	if r.cfg.Rate <= 0 {
+		return
+	}
+	expected := time.Duration(float64(r.written) / r.cfg.Rate * float64(time.Second))
+	if elapsed := time.Since(r.started); elapsed < expected {
+		time.Sleep(expected - elapsed)
+	}
+}
+
+/*
+flush writes a destination's batch using the same client setup as our regular outputs.
+A failed batch is dropped from memory but *not* marked delivered,
+so its offsets are never committed and a later run will pick it up again.
+*/
+func (r *replayer) flush(dest replayDestination, batch *replayBatch) {
+	if len(batch.Lines) < 1 {
+		return
+	}
+	r.throttle()
+	logFields := log.Fields{"writepath": dest.WritePath, "org": dest.TSDOrg, "bucket": dest.TSDName, "count": len(batch.Lines), "section": "replay"}
+	if r.cfg.DryRun {
+		log.WithFields(logFields).Info("Dry run, would have written batch")
+		log.WithFields(logFields).Debug(strings.Join(batch.Lines, "\n"))
+	} else {
+		writer, ok := r.clients[dest]
+		if !ok {
+			output := r.cfg.Outputs[dest.WritePath]
+			writer = newOutputWriter(OutputMeta{URL: dest.WritePath, OutputType: output.OutputType, Kafka: output.Kafka,
+				WriteTimeout: r.cfg.WriteTimeout, TsdOrg: dest.TSDOrg, TsdDbName: dest.TSDName, Precision: FailedPrecision})
+			r.clients[dest] = writer
+		}
+		err := writer.WriteRecord(context.Background(), batch.Lines...)
+		if err != nil {
+			logFields["error"] = err
+			log.WithFields(logFields).Error("Failed to replay batch")
+			r.failures++
+			batch.Lines = batch.Lines[:0]
+			batch.Sources = batch.Sources[:0]
+			return
+		}
+		log.WithFields(logFields).Debug("Replayed batch")
+		for _, source := range batch.Sources {
+			source.Done()
+		}
+	}
+	r.written += len(batch.Lines)
+	batch.Lines = batch.Lines[:0]
+	batch.Sources = batch.Sources[:0]
+}
+
+func (r *replayer) flushAll() {
+	for dest, batch := range r.batches {
+		r.flush(dest, batch)
+	}
+}
+
+// commit commits offsets for every message that's been replayed (never during a dry run)
+func (r *replayer) commit(consumer *kafka.Consumer) {
+	offsets := r.tracker.committable()
+	if r.cfg.DryRun || len(offsets) < 1 {
+		return
+	}
+	_, err := consumer.CommitOffsets(offsets)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "offsets": offsets, "section": "replay"}).Error("Couldn't commit offsets")
+	}
+}
+
+func (r *replayer) close() {
+	for _, client := range r.clients {
+		client.Close()
+	}
+}
+
+/*
+replayAssignment works out where each partition of the dead letter topic should start.
+An explicit offset wins, then a start time, and otherwise we pick up
+wherever our consumer group left off.
+*/
+func replayAssignment(consumer *kafka.Consumer, cfg ReplayMeta) ([]kafka.TopicPartition, error) {
+	metadata, err := consumer.GetMetadata(&cfg.Topic, false, 10*1000)
+	if err != nil {
+		return nil, err
+	}
+	topicMeta, ok := metadata.Topics[cfg.Topic]
+	if !ok || len(topicMeta.Partitions) < 1 {
+		return nil, fmt.Errorf("topic %v has no partitions", cfg.Topic)
+	}
+	var partitions []kafka.TopicPartition
+	for _, partition := range topicMeta.Partitions {
+		tp := kafka.TopicPartition{Topic: &cfg.Topic, Partition: partition.ID, Offset: kafka.OffsetStored}
+		if cfg.StartOffset >= 0 {
+			tp.Offset = kafka.Offset(cfg.StartOffset)
+		} else if !cfg.StartTime.IsZero() {
+			// OffsetsForTimes expects the timestamp (in ms) in the offset field
+			tp.Offset = kafka.Offset(cfg.StartTime.UnixNano() / int64(time.Millisecond))
+		}
+		partitions = append(partitions, tp)
+	}
+	if cfg.StartOffset < 0 && !cfg.StartTime.IsZero() {
+		partitions, err = consumer.OffsetsForTimes(partitions, 10*1000)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return partitions, nil
+}
+
+// pastWindow : whether a message is past the end of our time/offset window
+func pastWindow(msg *kafka.Message, cfg ReplayMeta) bool {
+	if cfg.EndOffset >= 0 && int64(msg.TopicPartition.Offset) > cfg.EndOffset {
+		return true
+	}
+	if !cfg.EndTime.IsZero() && msg.Timestamp.After(cfg.EndTime) {
+		return true
+	}
+	return false
+}
+
+/*
+ReplayFromKafka : read our dead letter queue and re-write everything in it
+
+We stop once every partition is caught up (or past the end of our window),
+or once we haven't seen a message in cfg.IdleTimeout.
+Returns the number of batches that failed to write.
+*/
+func ReplayFromKafka(cfg ReplayMeta) int {
+	log.WithFields(log.Fields{"topic": cfg.Topic, "group": cfg.Group, "dryrun": cfg.DryRun, "section": "replay"}).Info("Starting dead letter replay...")
+	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers":    cfg.Brokers,
+		"group.id":             cfg.Group,
+		"enable.partition.eof": true,
+		"enable.auto.commit":   false,
+		"auto.offset.reset":    "earliest"})
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "section": "replay"}).Fatal("Couldn't build consumer")
+	}
+	defer consumer.Close()
+	partitions, err := replayAssignment(consumer, cfg)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "topic": cfg.Topic, "section": "replay"}).Fatal("Couldn't work out partition assignment")
+	}
+	err = consumer.Assign(partitions)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "section": "replay"}).Fatal("Couldn't assign partitions")
+	}
+	r := newReplayer(cfg)
+	defer r.close()
+	finished := make(map[int32]bool)
+	lastMsg := time.Now()
+	lastCommit := time.Now()
+
+replayloop:
+	for len(finished) < len(partitions) {
+		ev := consumer.Poll(1000)
+		switch e := ev.(type) {
+		case *kafka.Message:
+			lastMsg = time.Now()
+			if finished[e.TopicPartition.Partition] {
+				continue
+			}
+			if pastWindow(e, cfg) {
+				finished[e.TopicPartition.Partition] = true
+				continue
+			}
+			source := newMessageSource(e)
+			r.tracker.track(source)
+			r.add(e.Value, source)
+		case kafka.PartitionEOF:
+			finished[e.Partition] = true
+		case kafka.Error:
+			log.WithFields(log.Fields{"error": e, "section": "replay"}).Error("Kafka Error, recovering...")
+		case nil:
+			if time.Since(lastMsg) > cfg.IdleTimeout {
+				log.WithFields(log.Fields{"timeout": cfg.IdleTimeout, "section": "replay"}).Info("No new messages, stopping")
+				break replayloop
+			}
+		}
+		if time.Since(lastCommit) > offsetStoreInterval {
+			r.commit(consumer)
+			lastCommit = time.Now()
+		}
+	}
+	r.flushAll()
+	r.commit(consumer)
+	log.WithFields(log.Fields{"written": r.written, "skipped": r.skipped, "failed_batches": r.failures, "dryrun": cfg.DryRun, "section": "replay"}).Info("Dead letter replay finished")
+	return r.failures
+}
+
+/*
+ReplayDLQ : the `replay-dlq` subcommand
+
+Defaults come from the same config file the forwarder uses.
+*/
+func ReplayDLQ(args []string) int {
+	flags := flag.NewFlagSet("replay-dlq", flag.ExitOnError)
+	var cfgfile = flags.String("config", "config.yml", "Full path to config file")
+	var brokers = flags.String("brokers", "", "Comma-separated broker list (defaults to the config's brokers)")
+	var topic = flags.String("topic", "", "Dead letter topic to replay (defaults to the config's failed_writes_topic)")
+	var group = flags.String("group", "", "Consumer group for tracking replay progress (defaults to <consumer_group>-replay-dlq)")
+	var batchSize = flags.Int("batch-size", 250, "Number of metrics to write in each batch")
+	var rate = flags.Float64("rate", 0, "Maximum metrics per second to write (0 for no limit)")
+	var startTime = flags.String("start-time", "", "Only replay messages produced at or after this time (RFC3339)")
+	var endTime = flags.String("end-time", "", "Only replay messages produced at or before this time (RFC3339)")
+	var startOffset = flags.Int64("start-offset", -1, "Start every partition at this offset")
+	var endOffset = flags.Int64("end-offset", -1, "Stop every partition after this offset")
+	var writePaths = flags.String("writepath", "", "Only replay messages whose write path matches this regular expression")
+	var dryRun = flags.Bool("dry-run", false, "Log what would be written without writing or committing anything")
+	var normalize = flags.Bool("normalize", false, "Normalize (lowercase) metrics when re-writing")
+	var timeout = flags.Int("timeout", 30, "Stop after this many seconds without a new message")
+	var writeTimeout = flags.Uint("write-timeout", ResponseTimeout, "HTTP timeout for writes")
+	var debug = flags.Bool("debug", false, "Debug logging")
+	err := flags.Parse(args)
+	if err != nil {
+		return 1
+	}
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+	}
+	var c Config
+	c.LoadConfig(*cfgfile)
+
+	cfg := ReplayMeta{Brokers: c.BrokerStr, Topic: c.FailedWritesTopic, Group: fmt.Sprintf("%v-replay-dlq", c.ConsumerGroup),
+		BatchSize: *batchSize, Rate: *rate, StartOffset: *startOffset, EndOffset: *endOffset,
+		DryRun: *dryRun, Normalize: *normalize, IdleTimeout: time.Duration(*timeout) * time.Second,
+		WriteTimeout: *writeTimeout, Outputs: make(map[string]OutputMeta)}
+	for _, writePath := range c.WritePaths {
+		for _, output := range writePath.Outputs {
+			cfg.Outputs[output.URL()] = OutputMeta{OutputType: output.OutputType, Kafka: c.kafkaOutput(output)}
+		}
+	}
+	if *brokers != "" {
+		cfg.Brokers = *brokers
+	}
+	if *topic != "" {
+		cfg.Topic = *topic
+	}
+	if *group != "" {
+		cfg.Group = *group
+	}
+	if cfg.Topic == "" {
+		log.WithFields(log.Fields{"section": "replay"}).Error("No dead letter topic configured")
+		return 1
+	}
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 1
+	}
+	if *startTime != "" {
+		cfg.StartTime, err = time.Parse(time.RFC3339, *startTime)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "section": "replay"}).Error("Invalid start time")
+			return 1
+		}
+	}
+	if *endTime != "" {
+		cfg.EndTime, err = time.Parse(time.RFC3339, *endTime)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "section": "replay"}).Error("Invalid end time")
+			return 1
+		}
+	}
+	if *writePaths != "" {
+		cfg.WritePaths, err = regexp.Compile(*writePaths)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "section": "replay"}).Error("Invalid write path filter")
+			return 1
+		}
+	}
+	if ReplayFromKafka(cfg) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,74 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+/*
+Things we should check:
+1. messages are grouped by write path, org, and bucket (and org/bucket aren't swapped)
+2. messages for filtered write paths and broken messages are skipped
+3. a dry run never marks anything delivered
+*/
+func TestReplayGrouping(t *testing.T) {
+	r := newReplayer(ReplayMeta{BatchSize: 100, DryRun: true, WritePaths: regexp.MustCompile("^http://vm")})
+	msgs := []string{
+		"{\"WritePath\": \"http://vm:8480\", \"TSDOrg\": \"org\", \"TSDName\": \"bucket\", \"Message\": \"test,tag=a value=1 1\"}",
+		"{\"WritePath\": \"http://vm:8480\", \"TSDOrg\": \"org\", \"TSDName\": \"other\", \"Message\": \"test,tag=b value=1 1\"}",
+		"{\"WritePath\": \"http://vm:8480\", \"TSDOrg\": \"org\", \"TSDName\": \"bucket\", \"Message\": \"test,tag=c value=1 1\"}",
+		"{\"WritePath\": \"http://influx:8086\", \"TSDOrg\": \"org\", \"TSDName\": \"bucket\", \"Message\": \"test,tag=d value=1 1\"}",
+		"{\"WritePath\": \"http://vm:8480\", \"TSDOrg\": \"org\", \"TSDName\": \"bucket\", \"Message\": \",tag=e value=1 1\"}",
+		"{\"WritePath\": \"http://vm:8480\" \"Message\": \"test value=1 1\"}",
+	}
+	var sources []*MessageSource
+	for i, msg := range msgs {
+		source := testSource("failed", 0, int64(i))
+		r.tracker.track(source)
+		sources = append(sources, source)
+		r.add([]byte(msg), source)
+	}
+	if r.skipped != 3 {
+		t.Fatalf("Wrong number of skipped messages: %v -> should be 3", r.skipped)
+	}
+	if len(r.batches) != 2 {
+		t.Fatalf("Wrong number of destinations: %v -> should be 2", r.batches)
+	}
+	batch, ok := r.batches[replayDestination{WritePath: "http://vm:8480", TSDOrg: "org", TSDName: "bucket"}]
+	if !ok {
+		t.Fatalf("Missing destination for org 'org', bucket 'bucket': %v", r.batches)
+	}
+	if len(batch.Lines) != 2 || batch.Lines[0] != "test,tag=a value=1 1" || batch.Lines[1] != "test,tag=c value=1 1" {
+		t.Fatalf("Wrong lines in batch: %v", batch.Lines)
+	}
+	r.flushAll()
+	if r.written != 3 {
+		t.Fatalf("Wrong number of (dry run) written messages: %v -> should be 3", r.written)
+	}
+	if offsets := r.tracker.committable(); len(offsets) > 0 {
+		t.Fatalf("Dry run marked offsets as committable: %v", offsets)
+	}
+}
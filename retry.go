@@ -0,0 +1,270 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	influxhttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+RetryPolicy :
+How we retry writes that failed for transient reasons (the output being unavailable/overloaded).
+Each retry waits exponentially longer (with some random jitter so write threads don't retry in lockstep),
+unless the output tells us how long to wait with a Retry-After header.
+We give up after MaxRetries retries (so 0 means we never retry), or once another retry would take us past MaxElapsed.
+*/
+type RetryPolicy struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	MaxElapsed      time.Duration
+	Multiplier      float64
+	Jitter          float64
+	MaxRetries      uint
+}
+
+// circuit breaker states (also the values of our state metric)
+const (
+	breakerClosed   = 0
+	breakerHalfOpen = 1
+	breakerOpen     = 2
+)
+
+const (
+	// how frequently blocked writers check whether the circuit breaker will let them through
+	breakerPollInterval = 100 * time.Millisecond
+)
+
+// backoff : how long to wait before a given retry (starting at 1)
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	interval := float64(p.InitialInterval) * math.Pow(p.Multiplier, float64(retry-1))
+	if interval > float64(p.MaxInterval) {
+		interval = float64(p.MaxInterval)
+	}
+	// spread retries across [interval * (1 - jitter), interval * (1 + jitter)]
+	interval += interval * p.Jitter * (2*rand.Float64() - 1)
+	return time.Duration(interval)
+}
+
+/*
+retryable decides whether a failed write is worth retrying.
+Only failures caused by the output's state (rather than our data or config) are.
+*/
+func retryable(err error) bool {
+	class, status := classifyWriteError(err)
+	switch class {
+	case ErrorClassServer, ErrorClassTimeout, ErrorClassConnection:
+		return true
+	}
+	return status == http.StatusTooManyRequests
+}
+
+// retryAfter : how long the output asked us to wait (if it did)
+func retryAfter(err error) time.Duration {
+	var httpErr *influxhttp.Error
+	if errors.As(err, &httpErr) {
+		return time.Duration(httpErr.RetryAfter) * time.Second
+	}
+	return 0
+}
+
+/*
+Do calls write until it succeeds, fails with an error we shouldn't retry, we run out of retries,
+or ctx is done (we're shutting down and out of time). Returns how many times we retried and the last error.
+*/
+func (p RetryPolicy) Do(ctx context.Context, write func(ctx context.Context) error) (int, error) {
+	start := time.Now()
+	retries := 0
+	for {
+		err := write(ctx)
+		if err == nil || !retryable(err) || ctx.Err() != nil {
+			return retries, err
+		}
+		if uint(retries) >= p.MaxRetries {
+			return retries, err
+		}
+		wait := retryAfter(err)
+		if wait == 0 {
+			wait = p.backoff(retries + 1)
+		}
+		if time.Since(start)+wait > p.MaxElapsed {
+			return retries, err
+		}
+		select {
+		case <-ctx.Done():
+			return retries, err
+		case <-time.After(wait):
+		}
+		retries++
+	}
+}
+
+/*
+CircuitBreaker :
+Tracks the health of a single write path's output across all of its write threads.
+
+After Threshold consecutive failed writes (each having already been retried) the breaker opens.
+While it's open, writers hold on to their batches instead of dead-lettering them,
+and our Kafka readers pause their partitions so we stop pulling in data we can't write.
+(Outputs sharing a write path with others can't do either without holding the others up,
+so their writers spool or dead-letter batches while the breaker is open instead.)
+After Cooldown, a single write is let through to probe the output (half-open):
+if it works the breaker closes, otherwise it opens again.
+*/
+type CircuitBreaker struct {
+	WritePath string
+	Threshold int
+	Cooldown  time.Duration
+	lock      sync.Mutex
+	state     int
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+// NewCircuitBreaker : a breaker for a write path (exposed as circuit_breaker_state{writepath="..."})
+func NewCircuitBreaker(writePath string, threshold int, cooldown time.Duration) *CircuitBreaker {
+	b := &CircuitBreaker{WritePath: writePath, Threshold: threshold, Cooldown: cooldown}
+	metrics.GetOrCreateGauge(fmt.Sprintf(`circuit_breaker_state{writepath=%q}`, writePath), func() float64 {
+		return float64(b.State())
+	})
+	return b
+}
+
+// State : closed (0), half-open (1), or open (2)
+func (b *CircuitBreaker) State() int {
+	if b == nil {
+		return breakerClosed
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+// Open : whether the breaker is keeping (most) writes from the output
+func (b *CircuitBreaker) Open() bool {
+	return b.State() != breakerClosed
+}
+
+/*
+Available : whether a write sent to the output now would be let through
+(the breaker is closed, or its cooldown is over and nobody is probing yet),
+without claiming the probe the way TryAllow does
+*/
+func (b *CircuitBreaker) Available() bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case breakerOpen:
+		return time.Since(b.openedAt) >= b.Cooldown
+	case breakerHalfOpen:
+		return !b.probing
+	}
+	return true
+}
+
+// TryAllow : whether the breaker lets a write through right now
+func (b *CircuitBreaker) TryAllow() bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.Cooldown {
+		b.state = breakerHalfOpen
+	}
+	if b.state == breakerClosed || (b.state == breakerHalfOpen && !b.probing) {
+		b.probing = b.state == breakerHalfOpen
+		return true
+	}
+	return false
+}
+
+/*
+Allow blocks until the breaker lets a write through.
+It returns false if ctx finishes first (e.g. we're shutting down),
+in which case the caller should give up on the output.
+*/
+func (b *CircuitBreaker) Allow(ctx context.Context) bool {
+	if b == nil {
+		return true
+	}
+	for {
+		if b.TryAllow() {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(breakerPollInterval):
+		}
+	}
+}
+
+// Success : the output took a write
+func (b *CircuitBreaker) Success() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state != breakerClosed {
+		log.WithFields(log.Fields{"writepath": b.WritePath, "section": "output"}).Info("Output recovered, closing circuit breaker")
+	}
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure : the output failed a write, returns whether the breaker is (now) open
+func (b *CircuitBreaker) Failure() bool {
+	if b == nil {
+		return false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures++
+	b.probing = false
+	if b.state == breakerHalfOpen || b.failures >= b.Threshold {
+		if b.state == breakerClosed {
+			log.WithFields(log.Fields{"writepath": b.WritePath, "failures": b.failures, "section": "output"}).Error("Output failing, opening circuit breaker")
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+	return b.state == breakerOpen
+}
@@ -0,0 +1,113 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	influxhttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{InitialInterval: time.Millisecond, MaxInterval: 4 * time.Millisecond,
+		MaxElapsed: time.Second, Multiplier: 2, Jitter: 0.5, MaxRetries: 3}
+	for retry := 1; retry < 10; retry++ {
+		if wait := policy.backoff(retry); wait < 500*time.Microsecond || wait > 6*time.Millisecond {
+			t.Fatalf("Backoff for retry %v is out of bounds: %v", retry, wait)
+		}
+	}
+	writes := 0
+	retries, err := policy.Do(context.Background(), func(ctx context.Context) error {
+		writes++
+		return &influxhttp.Error{StatusCode: 503}
+	})
+	if err == nil || retries != 3 || writes != 4 {
+		t.Fatalf("Server errors were retried %v times (%v writes) -> should be 3 (4 writes)", retries, writes)
+	}
+	writes = 0
+	retries, err = policy.Do(context.Background(), func(ctx context.Context) error {
+		writes++
+		return &influxhttp.Error{StatusCode: 400}
+	})
+	if err == nil || retries != 0 || writes != 1 {
+		t.Fatalf("Client errors were retried %v times -> should be 0", retries)
+	}
+	// max_retries: 0 means no retries at all
+	writes = 0
+	noRetries := policy
+	noRetries.MaxRetries = 0
+	retries, err = noRetries.Do(context.Background(), func(ctx context.Context) error {
+		writes++
+		return &influxhttp.Error{StatusCode: 503}
+	})
+	if err == nil || retries != 0 || writes != 1 {
+		t.Fatalf("Server errors were retried %v times without max_retries -> should be 0", retries)
+	}
+	// the output asking us to wait longer than we're willing to
+	retries, _ = policy.Do(context.Background(), func(ctx context.Context) error {
+		return &influxhttp.Error{StatusCode: 429, RetryAfter: 5}
+	})
+	if retries != 0 {
+		t.Fatalf("Retried past our maximum elapsed time %v times -> should be 0", retries)
+	}
+}
+
+/*
+Things we should check:
+1. the breaker only opens after enough consecutive failures
+2. an open breaker blocks writers (until their context finishes)
+3. after cooldown, only a single probe is let through
+4. a successful probe closes the breaker
+*/
+func TestCircuitBreaker(t *testing.T) {
+	breaker := &CircuitBreaker{WritePath: "http://test", Threshold: 2, Cooldown: 50 * time.Millisecond}
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+	if breaker.Failure() || breaker.Open() {
+		t.Fatalf("Breaker opened before reaching its threshold")
+	}
+	if !breaker.Failure() || breaker.State() != breakerOpen {
+		t.Fatalf("Breaker didn't open at its threshold")
+	}
+	if breaker.Allow(done) {
+		t.Fatalf("Open breaker let a write through")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !breaker.Allow(context.Background()) || breaker.State() != breakerHalfOpen {
+		t.Fatalf("Breaker didn't let a probe through after cooldown")
+	}
+	if breaker.Allow(done) {
+		t.Fatalf("Half-open breaker let a second write through")
+	}
+	breaker.Success()
+	if breaker.Open() || !breaker.Allow(done) {
+		t.Fatalf("Breaker didn't close after a successful probe")
+	}
+	var disabled *CircuitBreaker
+	if disabled.Failure() || !disabled.Allow(done) {
+		t.Fatalf("Disabled breaker blocked a write")
+	}
+}
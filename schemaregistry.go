@@ -0,0 +1,782 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	json "github.com/json-iterator/go"
+	"github.com/linkedin/goavro/v2"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Schema types a registry can hand us
+const (
+	SchemaTypeAvro     = "AVRO"
+	SchemaTypeProtobuf = "PROTOBUF"
+	// DefaultSchemaTimestampUnit : what unit numeric timestamp fields are in
+	DefaultSchemaTimestampUnit = "ms"
+	// how long we wait on a single request to the schema registry
+	schemaRegistryTimeout = 10 * time.Second
+	// how long we remember a schema we couldn't use (it may just not have replicated to our registry yet)
+	schemaFailureTTL = time.Minute
+	// the file name we give the top-level protobuf schema (references use their own names)
+	protoSchemaFile = "schema.proto"
+)
+
+var (
+	errNotRegistryFramed = errors.New("message isn't in schema registry wire format (missing magic byte)")
+	// how we back off while the schema registry is unavailable
+	schemaRegistryRetry  = RetryPolicy{InitialInterval: time.Second, MaxInterval: 30 * time.Second, Multiplier: 2, Jitter: 0.2}
+	schemaTimestampUnits = map[string]float64{"s": 1, "ms": 1e3, "us": 1e6, "ns": 1e9}
+)
+
+/*
+schemaRegistryError :
+A failed request to the schema registry.
+Transient failures (connection problems, 5xx, 429) mean we should try again later
+rather than sending the message to parse failures.
+*/
+type schemaRegistryError struct {
+	status    int
+	transient bool
+	err       error
+}
+
+func (e *schemaRegistryError) Error() string {
+	if e.status != 0 {
+		return fmt.Sprintf("schema registry returned %v: %v", e.status, e.err)
+	}
+	return fmt.Sprintf("schema registry request failed: %v", e.err)
+}
+
+func (e *schemaRegistryError) Unwrap() error {
+	return e.err
+}
+
+// transientSchemaError : whether a failed decode is worth retrying
+func transientSchemaError(err error) bool {
+	var regErr *schemaRegistryError
+	return errors.As(err, &regErr) && regErr.transient
+}
+
+// registrySchema : a schema as the registry returns it
+type registrySchema struct {
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType"`
+	References []struct {
+		Name    string `json:"name"`
+		Subject string `json:"subject"`
+		Version int    `json:"version"`
+	} `json:"references"`
+}
+
+// schemaDecoder turns a message body (after the wire format header) into a record
+type schemaDecoder interface {
+	decode(payload []byte) (map[string]interface{}, error)
+}
+
+/*
+cachedSchema : a decoder (or the reason we couldn't build one) for a single schema ID.
+ready is closed once we've heard back from the registry, until then
+decoder and err aren't set (and anyone else after the schema waits on ready).
+*/
+type cachedSchema struct {
+	decoder schemaDecoder
+	err     error
+	ready   chan struct{}
+	// when we should ask about a schema we couldn't use again (zero for decoders, which we keep forever)
+	expires time.Time
+}
+
+/*
+schemaRegistry :
+Resolves schema IDs against a Confluent-compatible schema registry.
+Schemas never change once registered, so decoders are cached forever
+and shared by every processing thread on a write path.
+*/
+type schemaRegistry struct {
+	url     string
+	client  *http.Client
+	mapping SchemaMapping
+	lock    sync.Mutex
+	schemas map[uint32]*cachedSchema
+}
+
+// NewSchemaRegistry : validate the registry URL and mapping for a write path
+func NewSchemaRegistry(registryURL string, mapping SchemaMapping) (*schemaRegistry, error) {
+	parsed, err := url.Parse(registryURL)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid schema_registry_url %q", registryURL)
+	}
+	if mapping.Measurement == "" && mapping.MeasurementField == "" {
+		return nil, fmt.Errorf("schema_registry_mapping needs either measurement or measurement_field")
+	}
+	if mapping.TimestampUnit == "" {
+		mapping.TimestampUnit = DefaultSchemaTimestampUnit
+	}
+	if _, ok := schemaTimestampUnits[mapping.TimestampUnit]; !ok {
+		return nil, fmt.Errorf("unknown schema_registry_mapping timestamp_unit %q (expected s, ms, us or ns)", mapping.TimestampUnit)
+	}
+	return &schemaRegistry{url: strings.TrimSuffix(registryURL, "/"), client: &http.Client{Timeout: schemaRegistryTimeout},
+		mapping: mapping, schemas: make(map[uint32]*cachedSchema)}, nil
+}
+
+// get : fetch a single registry resource (credentials in the URL are sent as basic auth)
+func (r *schemaRegistry) get(path string) (registrySchema, error) {
+	var schema registrySchema
+	req, err := http.NewRequest(http.MethodGet, r.url+path, nil)
+	if err != nil {
+		return schema, &schemaRegistryError{err: err}
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return schema, &schemaRegistryError{err: err, transient: true}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return schema, &schemaRegistryError{err: err, transient: true}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return schema, &schemaRegistryError{status: resp.StatusCode, err: fmt.Errorf("%s", strings.TrimSpace(string(body))),
+			transient: resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests}
+	}
+	if err := json.Unmarshal(body, &schema); err != nil {
+		return schema, &schemaRegistryError{err: err}
+	}
+	if schema.SchemaType == "" {
+		schema.SchemaType = SchemaTypeAvro
+	}
+	return schema, nil
+}
+
+/*
+decoder returns the (cached) decoder for a schema ID.
+Only one thread asks the registry about a given schema at a time (the rest wait for its answer),
+and we never hold the lock while we do, so a slow registry doesn't hold up schemas we already have.
+Schemas we can't use are cached for schemaFailureTTL, so a bad producer doesn't hammer the registry,
+but transient failures aren't: we'll ask again next time.
+*/
+func (r *schemaRegistry) decoder(id uint32) (schemaDecoder, error) {
+	r.lock.Lock()
+	cached, ok := r.schemas[id]
+	if ok && (cached.expires.IsZero() || time.Now().Before(cached.expires)) {
+		r.lock.Unlock()
+		<-cached.ready
+		return cached.decoder, cached.err
+	}
+	cached = &cachedSchema{ready: make(chan struct{})}
+	r.schemas[id] = cached
+	r.lock.Unlock()
+
+	cached.decoder, cached.err = r.load(id)
+	r.lock.Lock()
+	if transientSchemaError(cached.err) {
+		delete(r.schemas, id)
+	} else if cached.err != nil {
+		cached.expires = time.Now().Add(schemaFailureTTL)
+	}
+	r.lock.Unlock()
+	close(cached.ready)
+	return cached.decoder, cached.err
+}
+
+// load : fetch a schema (and anything it references) from the registry and build its decoder
+func (r *schemaRegistry) load(id uint32) (schemaDecoder, error) {
+	schema, err := r.get(fmt.Sprintf("/schemas/ids/%d", id))
+	var decoder schemaDecoder
+	if err == nil {
+		switch schema.SchemaType {
+		case SchemaTypeAvro:
+			decoder, err = newAvroDecoder(schema.Schema)
+		case SchemaTypeProtobuf:
+			decoder, err = r.newProtoDecoder(schema)
+		default:
+			err = fmt.Errorf("unsupported schema type %v", schema.SchemaType)
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("schema %d: %w", id, err)
+		if transientSchemaError(err) {
+			return nil, err
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"schema": id, "error": err, "section": "schema registry"}).Error("Couldn't load schema")
+	} else {
+		log.WithFields(log.Fields{"schema": id, "type": schema.SchemaType, "section": "schema registry"}).Info("Loaded schema")
+	}
+	return decoder, err
+}
+
+// avroDecoder : decodes Avro binary with a single writer schema
+type avroDecoder struct {
+	codec  *goavro.Codec
+	schema interface{}
+	names  map[string]interface{}
+}
+
+func newAvroDecoder(schema string) (*avroDecoder, error) {
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		return nil, err
+	}
+	d := &avroDecoder{codec: codec, names: make(map[string]interface{})}
+	if err := json.Unmarshal([]byte(schema), &d.schema); err != nil {
+		return nil, err
+	}
+	d.collectNames(d.schema, "")
+	return d, nil
+}
+
+// collectNames finds every named type so later references to them by name resolve
+func (d *avroDecoder) collectNames(schema interface{}, namespace string) {
+	switch s := schema.(type) {
+	case []interface{}:
+		for _, branch := range s {
+			d.collectNames(branch, namespace)
+		}
+	case map[string]interface{}:
+		if name, ok := s["name"].(string); ok {
+			if ns, ok := s["namespace"].(string); ok {
+				namespace = ns
+			}
+			fullName := name
+			if !strings.Contains(name, ".") && namespace != "" {
+				fullName = namespace + "." + name
+			}
+			if dot := strings.LastIndex(fullName, "."); dot >= 0 {
+				namespace = fullName[:dot]
+			}
+			d.names[fullName] = s
+			d.names[fullName[strings.LastIndex(fullName, ".")+1:]] = s
+		}
+		if fields, ok := s["fields"].([]interface{}); ok {
+			for _, field := range fields {
+				if f, ok := field.(map[string]interface{}); ok {
+					d.collectNames(f["type"], namespace)
+				}
+			}
+		}
+		d.collectNames(s["items"], namespace)
+		d.collectNames(s["values"], namespace)
+		if typ, ok := s["type"]; ok {
+			if _, primitive := typ.(string); !primitive {
+				d.collectNames(typ, namespace)
+			}
+		}
+	}
+}
+
+// avroBranchMatches : whether a union branch is the one goavro labelled name
+func avroBranchMatches(branch interface{}, name string) bool {
+	var branchName string
+	switch b := branch.(type) {
+	case string:
+		branchName = b
+	case map[string]interface{}:
+		if n, ok := b["name"].(string); ok {
+			branchName = n
+		} else if t, ok := b["type"].(string); ok {
+			branchName = t
+		}
+	}
+	return branchName == name || strings.HasSuffix(name, "."+branchName)
+}
+
+/*
+unwrap walks a decoded value alongside its schema and strips goavro's union wrappers
+({"string": "foo"} becomes "foo"), so mapping paths look the same whether or not a field is nullable.
+*/
+func (d *avroDecoder) unwrap(schema interface{}, value interface{}) interface{} {
+	switch s := schema.(type) {
+	case string:
+		if named, ok := d.names[s]; ok {
+			return d.unwrap(named, value)
+		}
+	case []interface{}:
+		wrapped, ok := value.(map[string]interface{})
+		if !ok || len(wrapped) != 1 {
+			return value
+		}
+		for name, inner := range wrapped {
+			for _, branch := range s {
+				if avroBranchMatches(branch, name) {
+					return d.unwrap(branch, inner)
+				}
+			}
+			return inner
+		}
+	case map[string]interface{}:
+		switch s["type"] {
+		case "record", "error":
+			record, ok := value.(map[string]interface{})
+			fields, _ := s["fields"].([]interface{})
+			if !ok {
+				return value
+			}
+			for _, field := range fields {
+				if f, ok := field.(map[string]interface{}); ok {
+					if name, ok := f["name"].(string); ok {
+						record[name] = d.unwrap(f["type"], record[name])
+					}
+				}
+			}
+			return record
+		case "map":
+			if entries, ok := value.(map[string]interface{}); ok {
+				for key, entry := range entries {
+					entries[key] = d.unwrap(s["values"], entry)
+				}
+			}
+		case "array":
+			if items, ok := value.([]interface{}); ok {
+				for i, item := range items {
+					items[i] = d.unwrap(s["items"], item)
+				}
+			}
+		case "enum", "fixed":
+		default:
+			return d.unwrap(s["type"], value)
+		}
+	}
+	return value
+}
+
+func (d *avroDecoder) decode(payload []byte) (map[string]interface{}, error) {
+	native, remaining, err := d.codec.NativeFromBinary(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(remaining) > 0 {
+		return nil, fmt.Errorf("%d trailing bytes after avro record", len(remaining))
+	}
+	record, ok := d.unwrap(d.schema, native).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("avro schema isn't a record")
+	}
+	return record, nil
+}
+
+// protoDecoder : decodes protobuf messages from any message type in a single schema file
+type protoDecoder struct {
+	file protoreflect.FileDescriptor
+}
+
+/*
+newProtoDecoder compiles a protobuf schema (and anything it references)
+Referenced schemas are fetched from the registry by subject and version.
+*/
+func (r *schemaRegistry) newProtoDecoder(schema registrySchema) (*protoDecoder, error) {
+	sources := map[string]string{protoSchemaFile: schema.Schema}
+	pending := []registrySchema{schema}
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+		for _, ref := range current.References {
+			if _, ok := sources[ref.Name]; ok {
+				continue
+			}
+			referenced, err := r.get(fmt.Sprintf("/subjects/%v/versions/%d", url.PathEscape(ref.Subject), ref.Version))
+			if err != nil {
+				return nil, err
+			}
+			sources[ref.Name] = referenced.Schema
+			pending = append(pending, referenced)
+		}
+	}
+	parser := protoparse.Parser{Accessor: protoparse.FileContentsFromMap(sources)}
+	parsed, err := parser.ParseFiles(protoSchemaFile)
+	if err != nil {
+		return nil, err
+	}
+	file, err := registerProtoFile(parsed[0], new(protoregistry.Files))
+	if err != nil {
+		return nil, err
+	}
+	return &protoDecoder{file: file}, nil
+}
+
+// registerProtoFile converts a parsed file (dependencies first) to a protoreflect descriptor
+func registerProtoFile(fd *desc.FileDescriptor, files *protoregistry.Files) (protoreflect.FileDescriptor, error) {
+	if found, err := files.FindFileByPath(fd.GetName()); err == nil {
+		return found, nil
+	}
+	for _, dep := range fd.GetDependencies() {
+		if _, err := registerProtoFile(dep, files); err != nil {
+			return nil, err
+		}
+	}
+	file, err := protodesc.NewFile(fd.AsFileDescriptorProto(), files)
+	if err != nil {
+		return nil, err
+	}
+	return file, files.RegisterFile(file)
+}
+
+/*
+messageIndexes reads the list of (nested) message indexes that follows the schema ID
+in protobuf messages, which tells us which message type in the schema we're looking at.
+A single 0 is shorthand for the first message in the file.
+*/
+func messageIndexes(payload []byte) ([]int, []byte, error) {
+	count, n := binary.Varint(payload)
+	if n <= 0 || count < 0 {
+		return nil, nil, fmt.Errorf("bad protobuf message index header")
+	}
+	payload = payload[n:]
+	if count == 0 {
+		return []int{0}, payload, nil
+	}
+	// every index takes at least a byte, so a bigger count can't be real (and we mustn't allocate for it)
+	if count > int64(len(payload)) {
+		return nil, nil, fmt.Errorf("bad protobuf message index header: %v indexes in %v bytes", count, len(payload))
+	}
+	indexes := make([]int, count)
+	for i := range indexes {
+		index, n := binary.Varint(payload)
+		if n <= 0 || index < 0 {
+			return nil, nil, fmt.Errorf("bad protobuf message index header")
+		}
+		indexes[i] = int(index)
+		payload = payload[n:]
+	}
+	return indexes, payload, nil
+}
+
+func (d *protoDecoder) decode(payload []byte) (map[string]interface{}, error) {
+	indexes, payload, err := messageIndexes(payload)
+	if err != nil {
+		return nil, err
+	}
+	messages := d.file.Messages()
+	var descriptor protoreflect.MessageDescriptor
+	for _, index := range indexes {
+		if index >= messages.Len() {
+			return nil, fmt.Errorf("message index %v doesn't exist in schema", indexes)
+		}
+		descriptor = messages.Get(index)
+		messages = descriptor.Messages()
+	}
+	msg := dynamicpb.NewMessage(descriptor)
+	if err := proto.Unmarshal(payload, msg); err != nil {
+		return nil, err
+	}
+	return protoRecord(msg), nil
+}
+
+/*
+protoRecord turns a decoded message into the same shape as a decoded Avro record.
+Unset fields without a default (sub-messages, oneofs, optionals) are left out,
+enums become their names and google.protobuf.Timestamps become times.
+*/
+func protoRecord(msg protoreflect.Message) map[string]interface{} {
+	record := make(map[string]interface{})
+	fields := msg.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if fd.HasPresence() && !msg.Has(fd) {
+			continue
+		}
+		value := msg.Get(fd)
+		switch {
+		case fd.IsMap():
+			entries := make(map[string]interface{})
+			value.Map().Range(func(key protoreflect.MapKey, entry protoreflect.Value) bool {
+				entries[key.String()] = protoValue(fd.MapValue(), entry)
+				return true
+			})
+			record[string(fd.Name())] = entries
+		case fd.IsList():
+			list := value.List()
+			items := make([]interface{}, list.Len())
+			for j := range items {
+				items[j] = protoValue(fd, list.Get(j))
+			}
+			record[string(fd.Name())] = items
+		default:
+			record[string(fd.Name())] = protoValue(fd, value)
+		}
+	}
+	return record
+}
+
+func protoValue(fd protoreflect.FieldDescriptor, value protoreflect.Value) interface{} {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		msg := value.Message()
+		if msg.Descriptor().FullName() == "google.protobuf.Timestamp" {
+			fields := msg.Descriptor().Fields()
+			return time.Unix(msg.Get(fields.ByName("seconds")).Int(), msg.Get(fields.ByName("nanos")).Int()).UTC()
+		}
+		return protoRecord(msg)
+	case protoreflect.EnumKind:
+		if enum := fd.Enum().Values().ByNumber(value.Enum()); enum != nil {
+			return string(enum.Name())
+		}
+		return int64(value.Enum())
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return value.Int()
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return value.Uint()
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return value.Float()
+	}
+	return value.Interface()
+}
+
+// lookupPath finds a (dotted) path in a record, descending into nested records and maps
+func lookupPath(record map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = record
+	for _, part := range strings.Split(path, ".") {
+		nested, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = nested[part]; !ok {
+			return nil, false
+		}
+	}
+	return value, value != nil
+}
+
+// fieldValue : normalize a decoded scalar into something we can write as a field
+func fieldValue(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case int32:
+		return int64(v), true
+	case uint32:
+		return uint64(v), true
+	case float32:
+		return float64(v), true
+	case int64, uint64, float64, bool, string:
+		return v, true
+	}
+	return nil, false
+}
+
+// tagValue : format a decoded scalar as a tag value
+func tagValue(value interface{}) (string, bool) {
+	if v, ok := fieldValue(value); ok {
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+// lastPart : the name a dotted path's value is stored under
+func lastPart(path string) string {
+	return path[strings.LastIndex(path, ".")+1:]
+}
+
+// timestamp converts a decoded timestamp (a time or a number in the mapping's unit) to seconds
+func (m SchemaMapping) timestamp(value interface{}) (int64, bool) {
+	if t, ok := value.(time.Time); ok {
+		return t.Unix(), true
+	}
+	v, ok := fieldValue(value)
+	if !ok {
+		return 0, false
+	}
+	divisor := schemaTimestampUnits[m.TimestampUnit]
+	switch n := v.(type) {
+	case int64:
+		return int64(float64(n) / divisor), true
+	case uint64:
+		return int64(float64(n) / divisor), true
+	case float64:
+		return int64(n / divisor), true
+	}
+	return 0, false
+}
+
+/*
+metric applies the mapping to a decoded record.
+Tags and fields named by a path that resolves to a map take every entry of that map.
+Without value_fields, every top-level scalar that isn't otherwise used becomes a field.
+*/
+func (m SchemaMapping) metric(record map[string]interface{}, received time.Time) (InfluxMetric, error) {
+	metric := InfluxMetric{Name: m.Measurement, Tags: make(map[string]string),
+		Fields: make(map[string]interface{}), Timestamp: received.Unix()}
+	used := make(map[string]bool)
+	if m.MeasurementField != "" {
+		value, _ := lookupPath(record, m.MeasurementField)
+		name, ok := tagValue(value)
+		if !ok || name == "" {
+			return InfluxMetric{}, fmt.Errorf("record has no usable measurement field %v", m.MeasurementField)
+		}
+		metric.Name = name
+		used[m.MeasurementField] = true
+	}
+	for _, path := range m.TagFields {
+		used[path] = true
+		value, ok := lookupPath(record, path)
+		if !ok {
+			continue
+		}
+		if entries, isMap := value.(map[string]interface{}); isMap {
+			for key, entry := range entries {
+				if tag, ok := tagValue(entry); ok {
+					metric.Tags[key] = tag
+				}
+			}
+		} else if tag, ok := tagValue(value); ok {
+			metric.Tags[lastPart(path)] = tag
+		}
+	}
+	if m.TimestampField != "" {
+		used[m.TimestampField] = true
+		if value, ok := lookupPath(record, m.TimestampField); ok {
+			ts, ok := m.timestamp(value)
+			if !ok {
+				return InfluxMetric{}, fmt.Errorf("record has an unusable timestamp field %v (%T)", m.TimestampField, value)
+			}
+			metric.Timestamp = ts
+		}
+	}
+	valueFields := m.ValueFields
+	if len(valueFields) == 0 {
+		for key := range record {
+			if !used[key] {
+				valueFields = append(valueFields, key)
+			}
+		}
+	}
+	for _, path := range valueFields {
+		value, ok := lookupPath(record, path)
+		if !ok {
+			continue
+		}
+		if entries, isMap := value.(map[string]interface{}); isMap && len(m.ValueFields) > 0 {
+			for key, entry := range entries {
+				if field, ok := fieldValue(entry); ok {
+					metric.Fields[key] = field
+				}
+			}
+		} else if field, ok := fieldValue(value); ok {
+			metric.Fields[lastPart(path)] = field
+		}
+	}
+	if len(metric.Fields) < 1 {
+		return InfluxMetric{}, fmt.Errorf("record has no usable value fields")
+	}
+	return metric, nil
+}
+
+/*
+deserializeSchemaRegistry decodes a single schema registry framed message:
+a 0 magic byte, a 4 byte (big endian) schema ID and the Avro/protobuf body.
+*/
+func deserializeSchemaRegistry(thread int, msg KafkaMsg, registry *schemaRegistry, flipSingleField bool) ([]InfluxMetric, error) {
+	ProcTimeStart := time.Now()
+	defer func() { ProcessTime.Add(float64(time.Now().Sub(ProcTimeStart)) / TimeSegmentDivisor) }()
+	if msg.Value == nil {
+		log.Warning("Empty message received from Kafka")
+		return nil, nil
+	}
+	if len(msg.Value) < 5 || msg.Value[0] != 0 {
+		return nil, errNotRegistryFramed
+	}
+	decoder, err := registry.decoder(binary.BigEndian.Uint32(msg.Value[1:5]))
+	if err != nil {
+		return nil, err
+	}
+	record, err := decoder.decode(msg.Value[5:])
+	if err != nil {
+		return nil, err
+	}
+	metric, err := registry.mapping.metric(record, msg.Source.receivedAt())
+	if err != nil {
+		return nil, err
+	}
+	return []InfluxMetric{flipInfluxJSON(metric, flipSingleField)}, nil
+}
+
+/*
+processSchemaRegistryMsg handles a single message.
+While the registry is unavailable we keep retrying (holding up the pipeline behind us)
+instead of calling the message unparseable. If we're shutting down, the message is left
+uncommitted so it'll be read again once we're back.
+*/
+func processSchemaRegistryMsg(ctx context.Context, thread int, msg KafkaMsg, outChannel chan InfluxMetric, parseFailedChan chan ParseFailure, registry *schemaRegistry, flipSingleField bool) {
+	ReceivedMsgs.Inc()
+	for retry := 1; ; retry++ {
+		metrics, err := deserializeSchemaRegistry(thread, msg, registry, flipSingleField)
+		if !transientSchemaError(err) {
+			if err != nil {
+				log.WithFields(log.Fields{"threadNum": thread, "error": err, "section": "schema registry processing"}).Error("Couldn't process message")
+			}
+			handleParsed(msg, FormatSchemaRegistry, metrics, err, outChannel, parseFailedChan)
+			return
+		}
+		if ctx.Err() != nil {
+			log.WithFields(log.Fields{"threadNum": thread, "error": err, "section": "schema registry processing"}).Warning("Schema registry unavailable while shutting down, leaving message uncommitted")
+			return
+		}
+		wait := schemaRegistryRetry.backoff(retry)
+		log.WithFields(log.Fields{"threadNum": thread, "error": err, "wait": wait, "section": "schema registry processing"}).Warning("Schema registry unavailable, retrying")
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+	}
+}
+
+// ProcessSchemaRegistryMsg : parse and forward schema registry encoded (Avro/protobuf) messages
+func ProcessSchemaRegistryMsg(ctx context.Context, thread int, inChannel chan KafkaMsg, outChannel chan InfluxMetric, parseFailedChan chan ParseFailure, registry *schemaRegistry, flipSingleField bool, wg *Stage) {
+	log.WithFields(log.Fields{"threadNum": thread, "section": "schema registry processing"}).Info("processing thread starting...")
+	defer wg.Done()
+
+processloop:
+	for {
+		select {
+		case msg := <-inChannel:
+			processSchemaRegistryMsg(ctx, thread, msg, outChannel, parseFailedChan, registry, flipSingleField)
+		case <-ctx.Done():
+			log.WithFields(log.Fields{"threadNum": thread, "section": "schema registry processing"}).Info("Closing processing thread...")
+			for msg := range inChannel {
+				processSchemaRegistryMsg(ctx, thread, msg, outChannel, parseFailedChan, registry, flipSingleField)
+			}
+			break processloop
+		}
+	}
+}
@@ -0,0 +1,219 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	json "github.com/json-iterator/go"
+	"github.com/linkedin/goavro/v2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	testAvroSchema = `{"type": "record", "name": "cpu", "namespace": "test", "fields": [
+		{"name": "host", "type": "string"},
+		{"name": "region", "type": ["null", "string"]},
+		{"name": "usage", "type": "double"},
+		{"name": "idle", "type": ["null", "double"]},
+		{"name": "labels", "type": {"type": "map", "values": "string"}},
+		{"name": "meta", "type": ["null", {"type": "record", "name": "meta", "fields": [{"name": "rack", "type": "string"}]}]},
+		{"name": "ts", "type": {"type": "long", "logicalType": "timestamp-millis"}}]}`
+	testProtoSchema = `syntax = "proto3";
+package test;
+import "common.proto";
+import "google/protobuf/timestamp.proto";
+message Other {}
+message Reading {
+	enum Status { UNKNOWN = 0; OK = 1; }
+	string name = 1;
+	common.Host host = 2;
+	double value = 3;
+	int64 count = 4;
+	google.protobuf.Timestamp time = 5;
+	Status status = 6;
+}`
+	testProtoReference = `syntax = "proto3";
+package common;
+message Host { string name = 1; string dc = 2; }`
+)
+
+// fakeRegistry serves our test schemas, failing the first request for schema 3
+func fakeRegistry(t *testing.T, hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := atomic.AddInt32(hits, 1)
+		var schema map[string]interface{}
+		switch r.URL.Path {
+		case "/schemas/ids/1":
+			schema = map[string]interface{}{"schema": testAvroSchema}
+		case "/schemas/ids/2":
+			schema = map[string]interface{}{"schema": testProtoSchema, "schemaType": "PROTOBUF",
+				"references": []map[string]interface{}{{"name": "common.proto", "subject": "common", "version": 1}}}
+		case "/subjects/common/versions/1":
+			schema = map[string]interface{}{"schema": testProtoReference, "schemaType": "PROTOBUF"}
+		case "/schemas/ids/3":
+			if count == 1 {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			schema = map[string]interface{}{"schema": testAvroSchema}
+		default:
+			http.Error(w, `{"error_code": 40403, "message": "Schema not found"}`, http.StatusNotFound)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(schema); err != nil {
+			t.Errorf("Couldn't encode schema: %v", err)
+		}
+	}))
+}
+
+// framed adds the schema registry wire format header to a message
+func framed(id uint32, body []byte) []byte {
+	msg := []byte{0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], id)
+	return append(msg, body...)
+}
+
+/*
+Things we should check:
+1. Avro records (with nullable fields, maps and nested records) become metrics per the mapping
+2. protobuf messages (nested message indexes, references, enums, timestamps, zero values) do too
+3. missing timestamps fall back to the Kafka timestamp
+4. registry outages are transient (and retried), unknown schemas are parse failures, cached until they expire (and fetched once)
+5. messages that aren't in the wire format (or claim more message indexes than they hold) fail to parse
+*/
+func TestSchemaRegistry(t *testing.T) {
+	var hits int32
+	server := fakeRegistry(t, &hits)
+	defer server.Close()
+	registry, err := NewSchemaRegistry(server.URL, SchemaMapping{Measurement: "cpu",
+		TagFields: []string{"host", "region", "labels", "meta.rack"}, TimestampField: "ts"})
+	if err != nil {
+		t.Fatalf("Couldn't create registry: %v", err)
+	}
+	codec, err := goavro.NewCodec(testAvroSchema)
+	if err != nil {
+		t.Fatalf("Couldn't create codec: %v", err)
+	}
+	body, err := codec.BinaryFromNative(nil, map[string]interface{}{"host": "h1", "region": goavro.Union("string", "eu"),
+		"usage": 0.5, "idle": nil, "labels": map[string]interface{}{"env": "prod"},
+		"meta": goavro.Union("test.meta", map[string]interface{}{"rack": "r1"}), "ts": time.Unix(1637047250, 0)})
+	if err != nil {
+		t.Fatalf("Couldn't encode avro: %v", err)
+	}
+	results, err := deserializeSchemaRegistry(1, KafkaMsg{Value: framed(1, body)}, registry, false)
+	if err != nil {
+		t.Fatalf("Couldn't deserialize avro: %v", err)
+	}
+	if len(results) != 1 || results[0].Name != "cpu" || results[0].Timestamp != 1637047250 || len(results[0].Fields) != 1 ||
+		results[0].Fields["usage"].(float64) != 0.5 || results[0].Tags["host"] != "h1" || results[0].Tags["region"] != "eu" ||
+		results[0].Tags["env"] != "prod" || results[0].Tags["rack"] != "r1" {
+		t.Fatalf("avro metric is wrong: %+v", results)
+	}
+
+	registry, err = NewSchemaRegistry(server.URL, SchemaMapping{MeasurementField: "name", TagFields: []string{"host.dc", "status"},
+		ValueFields: []string{"value", "count"}, TimestampField: "time"})
+	if err != nil {
+		t.Fatalf("Couldn't create registry: %v", err)
+	}
+	var host, ts, msg []byte
+	host = protowire.AppendTag(host, 2, protowire.BytesType)
+	host = protowire.AppendString(host, "east")
+	ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+	ts = protowire.AppendVarint(ts, 1637047250)
+	// message indexes [1] (the second message in the file)
+	msg = []byte{2, 2}
+	msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+	msg = protowire.AppendString(msg, "temperature")
+	msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+	msg = protowire.AppendBytes(msg, host)
+	msg = protowire.AppendTag(msg, 3, protowire.Fixed64Type)
+	msg = protowire.AppendFixed64(msg, 0x4037000000000000)
+	msg = protowire.AppendTag(msg, 6, protowire.VarintType)
+	msg = protowire.AppendVarint(msg, 1)
+	withTime := protowire.AppendBytes(protowire.AppendTag(append([]byte{}, msg...), 5, protowire.BytesType), ts)
+	results, err = deserializeSchemaRegistry(1, KafkaMsg{Value: framed(2, withTime)}, registry, false)
+	if err != nil {
+		t.Fatalf("Couldn't deserialize protobuf: %v", err)
+	}
+	if len(results) != 1 || results[0].Name != "temperature" || results[0].Timestamp != 1637047250 || len(results[0].Fields) != 2 ||
+		results[0].Fields["value"].(float64) != 23 || results[0].Fields["count"].(int64) != 0 ||
+		results[0].Tags["dc"] != "east" || results[0].Tags["status"] != "OK" {
+		t.Fatalf("protobuf metric is wrong: %+v", results)
+	}
+	source := &MessageSource{Timestamp: time.Unix(1637000000, 0)}
+	results, err = deserializeSchemaRegistry(1, KafkaMsg{Value: framed(2, msg), Source: source}, registry, true)
+	if err != nil || results[0].Timestamp != 1637000000 || results[0].Name != "temperature" {
+		t.Fatalf("kafka timestamp wasn't used: %+v (%v)", results, err)
+	}
+
+	atomic.StoreInt32(&hits, 0)
+	_, err = deserializeSchemaRegistry(1, KafkaMsg{Value: framed(3, body)}, registry, false)
+	if !transientSchemaError(err) {
+		t.Fatalf("registry outage should be transient: %v", err)
+	}
+	results, err = deserializeSchemaRegistry(1, KafkaMsg{Value: framed(3, body)}, registry, false)
+	if err == nil || transientSchemaError(err) {
+		// schema 3 is avro, but this mapping wants protobuf fields
+		t.Fatalf("retried schema wasn't loaded: %+v (%v)", results, err)
+	}
+	atomic.StoreInt32(&hits, 0)
+	for i := 0; i < 2; i++ {
+		_, err = deserializeSchemaRegistry(1, KafkaMsg{Value: framed(9, body)}, registry, false)
+		if err == nil || transientSchemaError(err) {
+			t.Fatalf("unknown schema should fail to parse: %v", err)
+		}
+	}
+	if count := atomic.LoadInt32(&hits); count != 1 {
+		t.Fatalf("unknown schema wasn't cached: %v requests", count)
+	}
+	// once the failure expires, we ask again (but only once, however many threads want it)
+	registry.schemas[9].expires = time.Now().Add(-time.Second)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deserializeSchemaRegistry(1, KafkaMsg{Value: framed(9, body)}, registry, false)
+		}()
+	}
+	wg.Wait()
+	if count := atomic.LoadInt32(&hits); count != 2 {
+		t.Fatalf("expired unknown schema wasn't fetched once: %v requests", count)
+	}
+	if _, err = deserializeSchemaRegistry(1, KafkaMsg{Value: []byte("cpu value=1")}, registry, false); err != errNotRegistryFramed {
+		t.Fatalf("unframed message should fail to parse: %v", err)
+	}
+	huge := make([]byte, binary.MaxVarintLen64)
+	huge = huge[:binary.PutVarint(huge, 1<<62)]
+	if _, err = deserializeSchemaRegistry(1, KafkaMsg{Value: framed(2, huge)}, registry, false); err == nil || transientSchemaError(err) {
+		t.Fatalf("bogus message index count should fail to parse: %v", err)
+	}
+}
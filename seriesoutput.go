@@ -0,0 +1,241 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	influxhttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+	influxapiwrite "github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/influxdata/influxdb/models"
+)
+
+const (
+	// how much of an error response we keep for logs/the dead letter queue
+	maxErrorBody = 1024
+)
+
+// outputSeries : samples for a single series (labels sorted by name)
+type outputSeries struct {
+	labels  [][2]string
+	samples []promSample
+}
+
+/*
+seriesBatch groups metrics into Prometheus-style series.
+Each field becomes its own series named <name>_<field>, except `value`
+fields (from flipped or single value metrics), which keep the metric's name.
+*/
+type seriesBatch struct {
+	series map[string]*outputSeries
+	order  []string
+}
+
+func newSeriesBatch() *seriesBatch {
+	return &seriesBatch{series: make(map[string]*outputSeries)}
+}
+
+// seriesValue : a field value as a sample value (strings, NaN and +/-Inf can't be samples)
+func seriesValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, !math.IsNaN(v) && !math.IsInf(v, 0)
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func (b *seriesBatch) add(name string, tags map[string]string, fields map[string]interface{}, ts time.Time) {
+	for field, raw := range fields {
+		value, ok := seriesValue(raw)
+		if !ok {
+			DroppedMsgs.Inc()
+			continue
+		}
+		seriesName := name
+		if field != "value" {
+			seriesName = fmt.Sprintf("%v_%v", name, field)
+		}
+		labels := [][2]string{{"__name__", replaceChars.ReplaceAllString(seriesName, "_")}}
+		for key, tagValue := range tags {
+			labels = append(labels, [2]string{key, tagValue})
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+		var key strings.Builder
+		for _, label := range labels {
+			key.WriteString(label[0])
+			key.WriteByte(0)
+			key.WriteString(label[1])
+			key.WriteByte(0)
+		}
+		series, ok := b.series[key.String()]
+		if !ok {
+			series = &outputSeries{labels: labels}
+			b.series[key.String()] = series
+			b.order = append(b.order, key.String())
+		}
+		series.samples = append(series.samples, promSample{Value: value, Timestamp: ts.UnixNano() / int64(time.Millisecond)})
+	}
+}
+
+/*
+each : every series in the batch, in the order we first saw them.
+Metrics don't reach us in time order, but Prometheus-style receivers reject
+out of order samples within a series, so each series' samples are sorted first.
+*/
+func (b *seriesBatch) each(handle func(series *outputSeries)) {
+	for _, key := range b.order {
+		series := b.series[key]
+		sort.SliceStable(series.samples, func(i, j int) bool { return series.samples[i].Timestamp < series.samples[j].Timestamp })
+		handle(series)
+	}
+}
+
+/*
+SeriesWriter :
+Blocking writes of Prometheus-style series to an HTTP endpoint, with
+encode turning each batch into a request body (sent with headers).
+Implements the same interface as our influx writer, so batching, retries, bisecting,
+spooling and dead lettering work exactly the same for every output type.
+Errors returned are always *influxhttp.Error, so they're classified the same way too.
+*/
+type SeriesWriter struct {
+	client  *http.Client
+	url     string
+	headers map[string]string
+	encode  func(b *seriesBatch) ([]byte, error)
+}
+
+// newSeriesWriter : a writer for a series endpoint (timeout is in seconds, like the influx client's)
+func newSeriesWriter(url string, timeout uint, headers map[string]string, encode func(b *seriesBatch) ([]byte, error)) *SeriesWriter {
+	return &SeriesWriter{client: &http.Client{Timeout: time.Duration(timeout) * time.Second}, url: url,
+		headers: headers, encode: encode}
+}
+
+// WritePoint : write influx points as series
+func (w *SeriesWriter) WritePoint(ctx context.Context, point ...*influxapiwrite.Point) error {
+	if len(point) < 1 {
+		return nil
+	}
+	batch := newSeriesBatch()
+	for _, p := range point {
+		tags := make(map[string]string, len(p.TagList()))
+		for _, tag := range p.TagList() {
+			tags[tag.Key] = tag.Value
+		}
+		fields := make(map[string]interface{}, len(p.FieldList()))
+		for _, field := range p.FieldList() {
+			fields[field.Key] = field.Value
+		}
+		batch.add(p.Name(), tags, fields, p.Time())
+	}
+	return w.write(ctx, batch)
+}
+
+// WriteRecord : write line protocol (from our spool, at FailedPrecision) as series
+func (w *SeriesWriter) WriteRecord(ctx context.Context, line ...string) error {
+	if len(line) < 1 {
+		return nil
+	}
+	points, err := models.ParsePointsWithPrecision([]byte(strings.Join(line, "\n")), time.Now(), "u")
+	if err != nil {
+		return &influxhttp.Error{StatusCode: http.StatusBadRequest, Code: "invalid", Message: err.Error(), Err: err}
+	}
+	batch := newSeriesBatch()
+	for _, p := range points {
+		fields, err := p.Fields()
+		if err != nil {
+			return &influxhttp.Error{StatusCode: http.StatusBadRequest, Code: "invalid", Message: err.Error(), Err: err}
+		}
+		batch.add(string(p.Name()), p.Tags().Map(), fields, p.Time())
+	}
+	return w.write(ctx, batch)
+}
+
+func (w *SeriesWriter) write(ctx context.Context, batch *seriesBatch) error {
+	body, err := w.encode(batch)
+	if err != nil {
+		return influxhttp.NewError(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return influxhttp.NewError(err)
+	}
+	for key, value := range w.headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("User-Agent", "sisyphus")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return influxhttp.NewError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	httpErr := &influxhttp.Error{StatusCode: resp.StatusCode, Code: http.StatusText(resp.StatusCode), Message: strings.TrimSpace(string(msg))}
+	if retryAfter, err := strconv.ParseUint(resp.Header.Get("Retry-After"), 10, 32); err == nil {
+		httpErr.RetryAfter = uint(retryAfter)
+	}
+	return httpErr
+}
+
+/*
+Ping : series endpoints don't share a health endpoint, so we send an empty write.
+Any answer that isn't a server error means the endpoint is up.
+*/
+func (w *SeriesWriter) Ping(ctx context.Context) (bool, error) {
+	err := w.write(ctx, newSeriesBatch())
+	if err == nil {
+		return true, nil
+	}
+	if class, _ := classifyWriteError(err); class == ErrorClassClient {
+		return true, nil
+	}
+	return false, err
+}
+
+// Close : drop any idle connections to the endpoint
+func (w *SeriesWriter) Close() {
+	w.client.CloseIdleConnections()
+}
@@ -0,0 +1,178 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultReplicationFactor defines how many outputs each series is written to when sharding
+	DefaultReplicationFactor = 1
+	// how many points each output gets on the hash ring (more spreads series more evenly)
+	shardVirtualNodes = 128
+)
+
+/*
+shardRing :
+A consistent hash ring over a write path's sinks.
+Each sink owns shardVirtualNodes points on the ring (placed by its name),
+and a series belongs to the first sinks found walking clockwise from its own hash.
+Adding or removing a sink only moves the series it owns (or will own).
+*/
+type shardRing struct {
+	sinks       []*Sink
+	replication int
+	hashes      []uint64
+	owners      []int
+}
+
+/*
+shardHash places a key on the ring.
+FNV alone barely changes the high bits between similar keys (like our virtual node names),
+so we finish it with murmur3's mixer to spread them across the ring.
+*/
+func shardHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// newShardRing : a ring over sinks, writing every series to replication of them
+func newShardRing(sinks []*Sink, replication int) (*shardRing, error) {
+	if replication < 1 || replication > len(sinks) {
+		return nil, fmt.Errorf("replication_factor %v must be between 1 and the number of outputs (%v)", replication, len(sinks))
+	}
+	ring := &shardRing{sinks: sinks, replication: replication}
+	type node struct {
+		hash  uint64
+		owner int
+	}
+	nodes := make([]node, 0, len(sinks)*shardVirtualNodes)
+	for i, sink := range sinks {
+		for v := 0; v < shardVirtualNodes; v++ {
+			nodes = append(nodes, node{hash: shardHash(fmt.Sprintf("%v-%v", sink.Name, v)), owner: i})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].hash < nodes[j].hash })
+	for _, n := range nodes {
+		ring.hashes = append(ring.hashes, n.hash)
+		ring.owners = append(ring.owners, n.owner)
+	}
+	return ring, nil
+}
+
+// shardKey : what identifies a series for sharding (its name and sorted tags)
+func shardKey(msg InfluxMetric) string {
+	keys := make([]string, 0, len(msg.Tags))
+	for key := range msg.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(msg.Name)
+	for _, key := range keys {
+		b.WriteByte(',')
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(msg.Tags[key])
+	}
+	return b.String()
+}
+
+/*
+pick : the sinks a series should be written to
+
+Normally that's the first `replication` distinct sinks clockwise from the series' hash.
+Sinks whose circuit breaker is open are skipped in favour of the next sink on the ring,
+unless too few sinks are left, in which case the failing owners still get the data (to spool or dead-letter).
+Once a breaker's cooldown is over, its sink gets its series back, so the next write can probe it.
+*/
+func (r *shardRing) pick(msg InfluxMetric) []*Sink {
+	hash := shardHash(shardKey(msg))
+	start := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= hash })
+	seen := make(map[int]bool, len(r.sinks))
+	healthy := make([]*Sink, 0, r.replication)
+	var owners, failing []*Sink
+	for i := 0; i < len(r.hashes) && len(seen) < len(r.sinks); i++ {
+		owner := r.owners[(start+i)%len(r.hashes)]
+		if seen[owner] {
+			continue
+		}
+		seen[owner] = true
+		sink := r.sinks[owner]
+		if len(owners) < r.replication {
+			owners = append(owners, sink)
+		}
+		if !sink.Breaker.Available() {
+			failing = append(failing, sink)
+			continue
+		}
+		healthy = append(healthy, sink)
+		if len(healthy) == r.replication {
+			break
+		}
+	}
+	for _, sink := range failing {
+		if len(healthy) == r.replication {
+			break
+		}
+		healthy = append(healthy, sink)
+	}
+	for _, sink := range healthy {
+		shardedMsgs(sink.TSDURL).Inc()
+		if !containsSink(owners, sink) {
+			shardFailoverMsgs(sink.TSDURL).Inc()
+		}
+	}
+	return healthy
+}
+
+func containsSink(sinks []*Sink, sink *Sink) bool {
+	for _, s := range sinks {
+		if s == sink {
+			return true
+		}
+	}
+	return false
+}
+
+// ShardOut : send every metric a pipeline produces to the sinks its series is pinned to
+func ShardOut(inChannel chan InfluxMetric, ring *shardRing, wg *Stage) {
+	log.WithFields(log.Fields{"sinks": len(ring.sinks), "replication": ring.replication, "section": "sharding"}).Info("Sharding thread starting...")
+	defer wg.Done()
+	distribute(inChannel, ring.sinks, ring.pick)
+	log.WithFields(log.Fields{"section": "sharding"}).Info("Closing sharding thread...")
+}
@@ -0,0 +1,150 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testShardSinks(names ...string) []*Sink {
+	sinks := make([]*Sink, 0, len(names))
+	for _, name := range names {
+		sinks = append(sinks, &Sink{Name: name, TSDURL: fmt.Sprintf("http://%v", name)})
+	}
+	return sinks
+}
+
+func testSeries(i int) InfluxMetric {
+	return InfluxMetric{Name: "cpu", Tags: map[string]string{"host": fmt.Sprintf("host%v", i), "dc": "dc1"},
+		Fields: map[string]interface{}{"value": 1.0}}
+}
+
+/*
+Things we should check:
+1. a series always lands on the same sink, and series are spread across every sink
+2. adding a sink only moves series to the new sink
+3. replication writes a series to distinct sinks
+4. a replication factor larger than the ring is refused
+*/
+func TestShardRing(t *testing.T) {
+	sinks := testShardSinks("a", "b", "c")
+	ring, err := newShardRing(sinks, 1)
+	if err != nil {
+		t.Fatalf("Couldn't build ring: %v", err)
+	}
+	counts := map[string]int{}
+	placement := map[int]string{}
+	for i := 0; i < 3000; i++ {
+		picked := ring.pick(testSeries(i))
+		if len(picked) != 1 {
+			t.Fatalf("Wrong number of sinks for series %v: %v -> should be 1", i, len(picked))
+		}
+		if again := ring.pick(testSeries(i)); again[0] != picked[0] {
+			t.Fatalf("Series %v moved from %v to %v", i, picked[0].Name, again[0].Name)
+		}
+		counts[picked[0].Name]++
+		placement[i] = picked[0].Name
+	}
+	for _, sink := range sinks {
+		if counts[sink.Name] < 600 {
+			t.Fatalf("Series spread unevenly across sinks: %v", counts)
+		}
+	}
+
+	grown, _ := newShardRing(testShardSinks("a", "b", "c", "d"), 1)
+	for i := 0; i < 3000; i++ {
+		if moved := grown.pick(testSeries(i))[0].Name; moved != placement[i] && moved != "d" {
+			t.Fatalf("Series %v moved between existing sinks (%v -> %v) when adding a sink", i, placement[i], moved)
+		}
+	}
+
+	replicated, _ := newShardRing(sinks, 2)
+	for i := 0; i < 100; i++ {
+		picked := replicated.pick(testSeries(i))
+		if len(picked) != 2 || picked[0] == picked[1] {
+			t.Fatalf("Wrong replicas for series %v: %v", i, picked)
+		}
+	}
+
+	if _, err := newShardRing(sinks, 4); err == nil {
+		t.Fatalf("Replication factor larger than the ring was accepted")
+	}
+}
+
+/*
+Things we should check:
+1. series owned by a sink with an open breaker fail over to the next sink on the ring
+2. failover is counted
+3. once the breaker's cooldown is over, the series goes back to its sink to probe it (and stays once it recovers)
+4. with every sink failing, series still go to their own sinks (to be spooled/dead-lettered)
+*/
+func TestShardFailover(t *testing.T) {
+	sinks := testShardSinks("a", "b", "c")
+	ring, _ := newShardRing(sinks, 1)
+	series := testSeries(1)
+	owner := ring.pick(series)[0]
+	owner.Breaker = &CircuitBreaker{Threshold: 1, Cooldown: time.Hour}
+	owner.Breaker.Failure()
+
+	failovers := shardFailoverMsgs("http://a").Get() + shardFailoverMsgs("http://b").Get() + shardFailoverMsgs("http://c").Get()
+	picked := ring.pick(series)
+	if len(picked) != 1 || picked[0] == owner {
+		t.Fatalf("Series wasn't failed over from %v: %v", owner.Name, picked)
+	}
+	after := shardFailoverMsgs("http://a").Get() + shardFailoverMsgs("http://b").Get() + shardFailoverMsgs("http://c").Get()
+	if after != failovers+1 {
+		t.Fatalf("Failover wasn't counted: %v -> should be %v", after, failovers+1)
+	}
+	// the next sink on the ring is the same one every time
+	if again := ring.pick(series); again[0] != picked[0] {
+		t.Fatalf("Series failed over to %v, then %v", picked[0].Name, again[0].Name)
+	}
+
+	// once the cooldown's over, the owner gets the series back to probe with, and keeps it once it recovers
+	owner.Breaker.Cooldown = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	if probe := ring.pick(series); probe[0] != owner {
+		t.Fatalf("Series wasn't sent back to %v to probe it: %v", owner.Name, probe[0].Name)
+	}
+	if !owner.Breaker.TryAllow() {
+		t.Fatalf("Probe write wasn't allowed")
+	}
+	if probing := ring.pick(series); probing[0] == owner {
+		t.Fatalf("Series should fail over while %v is being probed", owner.Name)
+	}
+	owner.Breaker.Success()
+	if recovered := ring.pick(series); recovered[0] != owner {
+		t.Fatalf("Series didn't go back to %v once it recovered: %v", owner.Name, recovered[0].Name)
+	}
+
+	for _, sink := range sinks {
+		sink.Breaker = &CircuitBreaker{Threshold: 1, Cooldown: time.Hour}
+		sink.Breaker.Failure()
+	}
+	if picked := ring.pick(series); len(picked) != 1 || picked[0] != owner {
+		t.Fatalf("Series should stay with its own sink when every sink is failing: %v", picked)
+	}
+}
@@ -0,0 +1,150 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	influxapiwrite "github.com/influxdata/influxdb-client-go/v2/api/write"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// how long we wait on a full (but healthy) sink before dead-lettering a metric for it
+	sinkSendTimeout = time.Second
+)
+
+/*
+Sink :
+A single output of a pipeline. Every sink has its own queue, writers,
+circuit breaker, spool and dead letter producer, so when a write path
+has several sinks, one of them failing (or falling behind) doesn't hold up the rest.
+*/
+type Sink struct {
+	Name             string
+	TSDURL           string
+	OutputTSDBChan   chan InfluxMetric
+	FailedWritesChan chan FailedWrite
+	Spool            *Spool
+	Breaker          *CircuitBreaker
+	// we gave up waiting on the sink's queue, and haven't managed to send it anything since
+	lagging bool
+}
+
+// sinkComponent : a health component's name, qualified by its sink's name (if it has one)
+func sinkComponent(component string, sink string) string {
+	if sink == "" {
+		return component
+	}
+	return fmt.Sprintf("%v %v", component, sink)
+}
+
+/*
+send queues a metric for the sink.
+A burst can fill a healthy sink's queue, so we wait (up to sinkSendTimeout) for room.
+A sink whose breaker is open, or that we already gave up waiting on,
+doesn't get to hold up the other sinks: it overflows straight away
+until its queue has room again.
+*/
+func (s *Sink) send(msg InfluxMetric) {
+	select {
+	case s.OutputTSDBChan <- msg:
+		s.lagging = false
+		return
+	default:
+	}
+	if s.lagging || s.Breaker.Open() {
+		s.overflow(msg)
+		return
+	}
+	timer := time.NewTimer(sinkSendTimeout)
+	defer timer.Stop()
+	select {
+	case s.OutputTSDBChan <- msg:
+	case <-timer.C:
+		log.WithFields(log.Fields{"sink": s.TSDURL, "section": "fanout"}).Warning("Output queue full, dead-lettering its metrics until it catches up")
+		s.lagging = true
+		s.overflow(msg)
+	}
+}
+
+/*
+overflow dead-letters a metric its sink has no room for.
+We skip the spool here: it stores whole batches, and a sink
+that can't keep up would fill it one metric at a time.
+We never wait on the dead letter queue either, if it's full too, the metric is dropped (and counted),
+but its message is never released: it was neither written nor dead-lettered, so (with at-least-once)
+its offset (and every later one in its partition) isn't committed, and it's re-delivered after a restart.
+*/
+func (s *Sink) overflow(msg InfluxMetric) {
+	outputOverflowMsgs(s.TSDURL).Inc()
+	outputFailedMsgs(s.TSDURL).Inc()
+	point := influxdb2.NewPoint(msg.Name, msg.Tags, msg.Fields, time.Unix(msg.Timestamp, 0))
+	// like deadLetterPoints, metrics without tags aren't worth dead-lettering
+	if len(point.TagList()) < 1 {
+		msg.Source.Done()
+		return
+	}
+	line := strings.TrimSuffix(influxapiwrite.PointToLineProtocol(point, duration), "\n")
+	select {
+	case s.FailedWritesChan <- newFailedWrite(line, msg.Source, errQueueFull, 0):
+	default:
+		outputDroppedMsgs(s.TSDURL).Inc()
+	}
+}
+
+/*
+distribute sends every metric a pipeline produces to the sinks pick chooses for it
+
+Each message's source is held once more for every extra sink, so its offset
+is only committed once every sink has written (or spooled/dead-lettered) it.
+A full sink only holds up the others briefly (see send), after that anything
+it can't take is dead-lettered for that sink alone.
+Once inChannel is closed and drained, we close every sink's queue so their writers can finish.
+*/
+func distribute(inChannel chan InfluxMetric, sinks []*Sink, pick func(msg InfluxMetric) []*Sink) {
+	for msg := range inChannel {
+		targets := pick(msg)
+		msg.Source.Hold(len(targets) - 1)
+		for _, sink := range targets {
+			sink.send(msg)
+		}
+	}
+	for _, sink := range sinks {
+		close(sink.OutputTSDBChan)
+	}
+}
+
+// FanOut : copy every metric a pipeline produces to each of its sinks
+func FanOut(inChannel chan InfluxMetric, sinks []*Sink, wg *Stage) {
+	log.WithFields(log.Fields{"sinks": len(sinks), "section": "fanout"}).Info("Fan out thread starting...")
+	defer wg.Done()
+	distribute(inChannel, sinks, func(msg InfluxMetric) []*Sink {
+		return sinks
+	})
+	log.WithFields(log.Fields{"section": "fanout"}).Info("Closing fan out thread...")
+}
@@ -0,0 +1,148 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+/*
+Things we should check:
+1. every sink gets every metric, and a message is only delivered once every sink is done with it
+2. a full sink with an open breaker dead-letters what it can't take, without holding up the others
+3. sink queues are closed once the pipeline's output queue is drained
+*/
+func TestFanOut(t *testing.T) {
+	in := make(chan InfluxMetric, 10)
+	fast := &Sink{TSDURL: "http://fast", OutputTSDBChan: make(chan InfluxMetric, 10), FailedWritesChan: make(chan FailedWrite, 10)}
+	slow := &Sink{TSDURL: "http://slow", OutputTSDBChan: make(chan InfluxMetric, 1), FailedWritesChan: make(chan FailedWrite, 10),
+		Breaker: &CircuitBreaker{Threshold: 1, Cooldown: time.Hour}}
+	slow.Breaker.Failure()
+	sources := []*MessageSource{testSource("test", 0, 0), testSource("test", 0, 1)}
+	// each source's single pending reference stands in for its one metric
+	for _, source := range sources {
+		in <- InfluxMetric{Name: "cpu", Tags: map[string]string{"host": "a"}, Fields: map[string]interface{}{"value": 1.0}, Timestamp: 1637090544, Source: source}
+	}
+	close(in)
+	var wg Stage
+	wg.Add(1)
+	FanOut(in, []*Sink{fast, slow}, &wg)
+	wg.Wait()
+
+	var fastMsgs, slowMsgs []InfluxMetric
+	for msg := range fast.OutputTSDBChan {
+		fastMsgs = append(fastMsgs, msg)
+	}
+	for msg := range slow.OutputTSDBChan {
+		slowMsgs = append(slowMsgs, msg)
+	}
+	if len(fastMsgs) != 2 || len(slowMsgs) != 1 {
+		t.Fatalf("Wrong metrics fanned out: %v/%v -> should be 2/1", len(fastMsgs), len(slowMsgs))
+	}
+	if len(fast.FailedWritesChan) != 0 || len(slow.FailedWritesChan) != 1 {
+		t.Fatalf("Wrong metrics dead-lettered: %v/%v -> should be 0/1", len(fast.FailedWritesChan), len(slow.FailedWritesChan))
+	}
+	if failed := <-slow.FailedWritesChan; failed.ErrorClass != ErrorClassQueueFull || failed.Source != sources[1] {
+		t.Fatalf("Overflowing metric was dead-lettered wrong: %+v", failed)
+	}
+	// fast sink writes both, slow sink writes the first (its overflow was released by the dead letter producer)
+	for _, msg := range fastMsgs {
+		msg.Source.Done()
+	}
+	slowMsgs[0].Source.Done()
+	if !sources[0].Delivered() {
+		t.Fatalf("Message written to every sink isn't delivered")
+	}
+	if sources[1].Delivered() {
+		t.Fatalf("Message still waiting on the dead letter queue is delivered")
+	}
+}
+
+/*
+Things we should check:
+1. a burst that fills a healthy sink waits for room instead of dead-lettering
+2. a sink we gave up waiting on overflows straight away until it has room again
+3. with the dead letter queue full too, overflowing metrics are dropped instead of blocking, but never released
+*/
+func TestSinkSend(t *testing.T) {
+	sink := &Sink{TSDURL: "http://burst", OutputTSDBChan: make(chan InfluxMetric, 1), FailedWritesChan: make(chan FailedWrite, 1)}
+	metric := func(offset int64) InfluxMetric {
+		return InfluxMetric{Name: "cpu", Tags: map[string]string{"host": "a"}, Fields: map[string]interface{}{"value": 1.0},
+			Timestamp: 1637090544, Source: testSource("test", 0, offset)}
+	}
+	sink.send(metric(0))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		<-sink.OutputTSDBChan
+	}()
+	sink.send(metric(1))
+	if len(sink.OutputTSDBChan) != 1 || len(sink.FailedWritesChan) != 0 {
+		t.Fatalf("Burst on a healthy sink was dead-lettered: %v queued, %v dead-lettered", len(sink.OutputTSDBChan), len(sink.FailedWritesChan))
+	}
+
+	sink.lagging = true
+	sink.send(metric(2))
+	if len(sink.FailedWritesChan) != 1 {
+		t.Fatalf("Lagging sink didn't overflow straight away")
+	}
+	dropped := outputDroppedMsgs(sink.TSDURL).Get()
+	overflowing := metric(3)
+	sink.send(overflowing)
+	if outputDroppedMsgs(sink.TSDURL).Get() != dropped+1 || overflowing.Source.Delivered() {
+		t.Fatalf("Metric overflowing into a full dead letter queue should be dropped, but its message kept pending")
+	}
+	<-sink.OutputTSDBChan
+	sink.send(metric(4))
+	if sink.lagging || len(sink.OutputTSDBChan) != 1 {
+		t.Fatalf("Sink with room again should stop overflowing")
+	}
+}
+
+/*
+Things we should check:
+1. an isolated output with an open breaker dead-letters batches instead of holding them
+2. those points say why
+*/
+func TestWriteBatchIsolated(t *testing.T) {
+	writer := &testWriter{status: 503}
+	meta := testBatch(writer, "good", "good")
+	meta.Isolated = true
+	meta.Breaker = &CircuitBreaker{Threshold: 1, Cooldown: time.Hour}
+	failedChan := make(chan FailedWrite, 2*len(meta.Batch))
+	writeBatch(context.Background(), meta, failedChan)
+	writeBatch(context.Background(), meta, failedChan)
+	if writer.writes != 1 {
+		t.Fatalf("Output behind an open breaker was written to %v times -> should be 1", writer.writes)
+	}
+	if len(failedChan) != 4 {
+		t.Fatalf("Wrong number of points dead-lettered from isolated output: %v -> should be 4", len(failedChan))
+	}
+	<-failedChan
+	<-failedChan
+	if failed := <-failedChan; failed.ErrorClass != ErrorClassCircuitOpen {
+		t.Fatalf("Point dead-lettered behind an open breaker has the wrong error class: %v -> should be %v", failed.ErrorClass, ErrorClassCircuitOpen)
+	}
+}
@@ -0,0 +1,334 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// spoolSuffix marks a complete segment file in a spool directory
+	spoolSuffix = ".lp"
+	// spoolTmpSuffix marks a segment that is still being written (and should be ignored/cleaned up on start)
+	spoolTmpSuffix = ".tmp"
+)
+
+type spoolSegment struct {
+	seq      uint64
+	size     int64
+	attempts int
+}
+
+// SpoolEviction : a batch evicted from a full spool, and how many times we tried to replay it
+type SpoolEviction struct {
+	Lines    []string
+	Attempts int
+}
+
+/*
+Spool :
+An on-disk, FIFO write-ahead buffer for a single write path.
+
+Each failed batch becomes one segment file (in line protocol) named by
+an increasing sequence number, so replaying the directory in name order
+replays failed batches in the order they failed.
+When the spool grows past its size cap, the oldest segments are evicted
+and handed back to the caller (to go to the dead letter queue).
+*/
+type Spool struct {
+	Dir      string
+	MaxBytes int64
+	lock     sync.Mutex
+	segments []spoolSegment
+	size     int64
+	nextSeq  uint64
+}
+
+// NewSpool : open (or create) a spool directory, picking up any segments left over from a previous run
+func NewSpool(dir string, maxBytes int64) (*Spool, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &Spool{Dir: dir, MaxBytes: maxBytes}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasSuffix(name, spoolTmpSuffix) {
+			// a partial write from a crash, the batch it held was never acknowledged
+			err = os.Remove(filepath.Join(dir, name))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !strings.HasSuffix(name, spoolSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, spoolSegment{seq: seq, size: file.Size()})
+		s.size += file.Size()
+		if seq >= s.nextSeq {
+			s.nextSeq = seq + 1
+		}
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+	return s, nil
+}
+
+func (s *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.Dir, fmt.Sprintf("%020d%v", seq, spoolSuffix))
+}
+
+func (s *Spool) readSegment(seq uint64) ([]string, error) {
+	var lines []string
+	f, err := os.Open(s.segmentPath(seq))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+/*
+Write : durably add a batch of line protocol to the spool
+
+Once Write returns without an error, the batch is on disk (fsync'd) and
+can be considered delivered. Any lines returned were evicted to make room
+and are no longer in the spool.
+*/
+func (s *Spool) Write(lines []string) ([]SpoolEviction, error) {
+	var evicted []SpoolEviction
+	if len(lines) < 1 {
+		return evicted, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	seq := s.nextSeq
+	s.nextSeq++
+	tmpPath := s.segmentPath(seq) + spoolTmpSuffix
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return evicted, err
+	}
+	data := strings.Join(lines, "\n") + "\n"
+	_, err = f.WriteString(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.segmentPath(seq))
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return evicted, err
+	}
+	s.segments = append(s.segments, spoolSegment{seq: seq, size: int64(len(data))})
+	s.size += int64(len(data))
+
+	// make room by dropping the oldest data first
+	for s.size > s.MaxBytes && len(s.segments) > 0 {
+		oldest := s.segments[0]
+		oldLines, err := s.readSegment(oldest.seq)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "segment": s.segmentPath(oldest.seq), "section": "spool"}).Error("Couldn't read evicted spool segment")
+		}
+		evicted = append(evicted, SpoolEviction{Lines: oldLines, Attempts: oldest.attempts})
+		s.removeLocked(oldest.seq)
+	}
+	return evicted, nil
+}
+
+// Oldest : the oldest batch in the spool (ok is false if the spool is empty)
+func (s *Spool) Oldest() (seq uint64, lines []string, ok bool, err error) {
+	s.lock.Lock()
+	if len(s.segments) < 1 {
+		s.lock.Unlock()
+		return 0, nil, false, nil
+	}
+	seq = s.segments[0].seq
+	s.lock.Unlock()
+	lines, err = s.readSegment(seq)
+	if os.IsNotExist(err) {
+		// evicted out from under us, try whatever is next
+		s.Remove(seq)
+		return s.Oldest()
+	}
+	return seq, lines, true, err
+}
+
+// Attempt : note a failed replay of a batch, returning how many times we've tried it
+func (s *Spool) Attempt(seq uint64) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := range s.segments {
+		if s.segments[i].seq == seq {
+			s.segments[i].attempts++
+			return s.segments[i].attempts
+		}
+	}
+	return 0
+}
+
+// Remove : drop a batch from the spool once it has been replayed
+func (s *Spool) Remove(seq uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.removeLocked(seq)
+}
+
+func (s *Spool) removeLocked(seq uint64) {
+	for i, segment := range s.segments {
+		if segment.seq != seq {
+			continue
+		}
+		err := os.Remove(s.segmentPath(seq))
+		if err != nil && !os.IsNotExist(err) {
+			log.WithFields(log.Fields{"error": err, "segment": s.segmentPath(seq), "section": "spool"}).Error("Couldn't remove spool segment")
+		}
+		s.size -= segment.size
+		s.segments = append(s.segments[:i], s.segments[i+1:]...)
+		return
+	}
+}
+
+// Size : bytes currently held in the spool
+func (s *Spool) Size() int64 {
+	if s == nil {
+		return 0
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.size
+}
+
+// Len : batches currently held in the spool
+func (s *Spool) Len() int {
+	if s == nil {
+		return 0
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.segments)
+}
+
+/*
+replaySpool writes spooled batches (oldest first) until the spool is empty or the endpoint fails.
+If the endpoint answers pings but still refuses a batch, the batch itself is bad,
+so it goes to the dead letter queue rather than blocking everything behind it.
+If ctx finishes mid-write, the batch stays spooled for our next start.
+*/
+func replaySpool(ctx context.Context, spool *Spool, meta *BatchMeta, ping func() bool, failedChan chan FailedWrite) {
+	for {
+		seq, lines, ok, err := spool.Oldest()
+		if !ok {
+			return
+		}
+		attempts := 0
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "segment": spool.segmentPath(seq), "section": "spool"}).Error("Couldn't read spool segment, dead-lettering what we could")
+		} else {
+			err = meta.WriteAPI.WriteRecord(ctx, lines...)
+			if err == nil {
+				spool.Remove(seq)
+				SentMsgs.Add(len(lines))
+				ReplayedMsgs.Add(len(lines))
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			attempts = spool.Attempt(seq)
+			if !ping() {
+				log.WithFields(log.Fields{"error": err, "attempts": attempts, "section": "spool"}).Debug("Output still unavailable, leaving spool for later")
+				return
+			}
+			log.WithFields(log.Fields{"error": err, "segment": spool.segmentPath(seq), "section": "spool"}).Error("Output rejected spooled batch, dead-lettering it")
+		}
+		for _, line := range lines {
+			failedChan <- newFailedWrite(line, nil, err, attempts)
+		}
+		spool.Remove(seq)
+	}
+}
+
+/*
+DrainSpool : background replay of a write path's spool
+
+Every retryInterval seconds we try to empty the spool into our output.
+Anything left when we shut down stays on disk for our next start.
+*/
+func DrainSpool(ctx context.Context, spool *Spool, failedChan chan FailedWrite, cfg OutputMeta, retryInterval float64, wg *Stage) {
+	log.WithFields(log.Fields{"dir": spool.Dir, "segments": spool.Len(), "section": "spool"}).Info("Spool drainer starting...")
+	defer wg.Done()
+	writer := newOutputWriter(cfg)
+	defer writer.Close()
+	meta := BatchMeta{Thread: cfg.Thread, WriteAPI: writer}
+	ping := func() bool {
+		ok, err := writer.Ping(context.Background())
+		return err == nil && ok
+	}
+	ticker := time.NewTicker(time.Duration(retryInterval * float64(time.Second)))
+	defer ticker.Stop()
+
+drainloop:
+	for {
+		select {
+		case <-ticker.C:
+			replaySpool(ctx, spool, &meta, ping, failedChan)
+		case <-ctx.Done():
+			log.WithFields(log.Fields{"dir": spool.Dir, "segments": spool.Len(), "section": "spool"}).Info("Closing spool drainer...")
+			break drainloop
+		}
+	}
+}
@@ -0,0 +1,91 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"testing"
+)
+
+/*
+Things we should check:
+1. batches come back out in the order they went in
+2. a full spool evicts its oldest data
+3. a re-opened spool picks up where the last one left off
+*/
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	// each batch below is 12 bytes on disk
+	spool, err := NewSpool(dir, 30)
+	if err != nil {
+		t.Fatalf("Couldn't create spool: %v", err)
+	}
+	for _, line := range []string{"first v=1 1", "secnd v=1 1"} {
+		evicted, err := spool.Write([]string{line})
+		if err != nil {
+			t.Fatalf("Couldn't write to spool: %v", err)
+		}
+		if len(evicted) > 0 {
+			t.Fatalf("Evicted data from a spool with room left: %v", evicted)
+		}
+	}
+	evicted, err := spool.Write([]string{"third v=1 1"})
+	if err != nil {
+		t.Fatalf("Couldn't write to spool: %v", err)
+	}
+	if len(evicted) != 1 || len(evicted[0].Lines) != 1 || evicted[0].Lines[0] != "first v=1 1" {
+		t.Fatalf("Wrong data evicted from full spool: %v -> should be 'first v=1 1'", evicted)
+	}
+	if spool.Len() != 2 || spool.Size() != 24 {
+		t.Fatalf("Wrong spool size: %v batches, %v bytes -> should be 2 batches, 24 bytes", spool.Len(), spool.Size())
+	}
+
+	reopened, err := NewSpool(dir, 30)
+	if err != nil {
+		t.Fatalf("Couldn't re-open spool: %v", err)
+	}
+	if reopened.Len() != 2 {
+		t.Fatalf("Re-opened spool has the wrong number of batches: %v -> should be 2", reopened.Len())
+	}
+	for _, expected := range []string{"secnd v=1 1", "third v=1 1"} {
+		seq, lines, ok, err := reopened.Oldest()
+		if !ok || err != nil {
+			t.Fatalf("Couldn't read from spool: %v", err)
+		}
+		if len(lines) != 1 || lines[0] != expected {
+			t.Fatalf("Spool replayed out of order: %v -> should be '%v'", lines, expected)
+		}
+		reopened.Remove(seq)
+	}
+	if _, _, ok, _ := reopened.Oldest(); ok {
+		t.Fatalf("Spool still has data after everything was removed")
+	}
+	// writes after a re-open shouldn't clobber old segment names
+	_, err = reopened.Write([]string{"fourt v=1 1"})
+	if err != nil {
+		t.Fatalf("Couldn't write to spool: %v", err)
+	}
+	if _, lines, _, _ := reopened.Oldest(); len(lines) != 1 || lines[0] != "fourt v=1 1" {
+		t.Fatalf("Wrong data in spool: %v -> should be 'fourt v=1 1'", lines)
+	}
+}
@@ -26,6 +26,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/VictoriaMetrics/metrics"
@@ -48,6 +49,31 @@ var (
 	ReceivedMsgs = metrics.NewCounter("received_msg_total")
 	//SentMsgs : Messages sent to Influx/VictoriaMetrics endpoint
 	SentMsgs = metrics.NewCounter("sent_msg_total")
+	//ParseFailures : Messages from Kafka we couldn't deserialize
+	ParseFailures = metrics.NewCounter("parse_failure_msg_total")
+	//ParseFailedElements : Metrics dropped from otherwise decodable batches (e.g. Telegraf's json_batch)
+	ParseFailedElements = metrics.NewCounter("parse_failure_element_total")
+	//DecompressFailures : Messages from Kafka that looked compressed but we couldn't decompress
+	DecompressFailures = metrics.NewCounter("decompress_failure_msg_total")
+	//SpooledMsgs : Messages written to an on-disk spool after a failed write
+	SpooledMsgs = metrics.NewCounter("spooled_msg_total")
+	//ReplayedMsgs : Messages replayed from an on-disk spool to our output
+	ReplayedMsgs = metrics.NewCounter("spool_replayed_msg_total")
+	//EvictedMsgs : Messages evicted from a full spool (and sent to the dead letter queue)
+	EvictedMsgs = metrics.NewCounter("spool_evicted_msg_total")
+	// Kafka reader threads currently paused (because of a full pipeline or an unavailable output)
+	pausedReaders int64
+	//PausedReaders : exposes pausedReaders
+	PausedReaders = metrics.NewGauge("paused_kafka_readers",
+		func() float64 {
+			return float64(atomic.LoadInt64(&pausedReaders))
+		})
+	//UndeliveredMsgs : dead letter/parse failure messages we couldn't deliver to Kafka before shutting down
+	UndeliveredMsgs = metrics.NewCounter("shutdown_undelivered_msg_total")
+	//LostMsgs : dead letter/parse failure messages we gave up trying to deliver to Kafka
+	LostMsgs = metrics.NewCounter("undelivered_failure_msg_total")
+	//AbandonedMsgs : messages held by a paused reader that we never got to queue before our shutdown deadline (re-delivered after a restart)
+	AbandonedMsgs = metrics.NewCounter("shutdown_abandoned_msg_total")
 	//FailedWriteTime : Time spent writing data to dead letter queue
 	FailedWriteTime = metrics.NewFloatCounter("failed_write_time_secs_total")
 	//FilterTime : Time spent filtering data
@@ -69,7 +95,9 @@ var (
 		func() float64 {
 			failedWrites := 0
 			for i := 0; i < len(Endpoints); i++ {
-				failedWrites += len(Endpoints[i].FailedWritesChan)
+				for _, sink := range Endpoints[i].Sinks {
+					failedWrites += len(sink.FailedWritesChan)
+				}
 			}
 			return float64(failedWrites)
 		})
@@ -88,9 +116,35 @@ var (
 			output := 0
 			for i := 0; i < len(Endpoints); i++ {
 				output += len(Endpoints[i].OutputTSDBChan)
+				for _, sink := range Endpoints[i].Sinks {
+					// a single sink shares the pipeline's queue
+					if sink.OutputTSDBChan != Endpoints[i].OutputTSDBChan {
+						output += len(sink.OutputTSDBChan)
+					}
+				}
 			}
 			return float64(output)
 		})
+	// Current parse failures queue length
+	parseFailureQueueLen = metrics.NewGauge("parse_failure_queue_len",
+		func() float64 {
+			parseFailures := 0
+			for i := 0; i < len(Endpoints); i++ {
+				parseFailures += len(Endpoints[i].ParseFailedChan)
+			}
+			return float64(parseFailures)
+		})
+	// Current size of all on-disk spools
+	spoolSize = metrics.NewGauge("spool_size_bytes",
+		func() float64 {
+			var size int64
+			for i := 0; i < len(Endpoints); i++ {
+				for _, sink := range Endpoints[i].Sinks {
+					size += sink.Spool.Size()
+				}
+			}
+			return float64(size)
+		})
 	// Current cached influx-style metrics queue length
 	influxIngestQueueLen = metrics.NewGauge("influx_ingest_queue_len",
 		func() float64 {
@@ -111,11 +165,68 @@ var (
 		})
 )
 
+// recoveredMsgs : points written after splitting a batch the output rejected (per write path)
+func recoveredMsgs(writePath string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`bisect_recovered_msg_total{writepath=%q}`, writePath))
+}
+
+// rejectedMsgs : points isolated (and dead-lettered) after splitting a batch the output rejected (per write path)
+func rejectedMsgs(writePath string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`bisect_rejected_msg_total{writepath=%q}`, writePath))
+}
+
+// retriedWrites : writes retried after a transient failure (per write path)
+func retriedWrites(writePath string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`retried_write_total{writepath=%q}`, writePath))
+}
+
+// outputSentMsgs : metrics written to an output (per output URL)
+func outputSentMsgs(writePath string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`output_sent_msg_total{writepath=%q}`, writePath))
+}
+
+// outputFailedMsgs : metrics we couldn't write to an output, and spooled or dead-lettered instead (per output URL)
+func outputFailedMsgs(writePath string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`output_failed_msg_total{writepath=%q}`, writePath))
+}
+
+// outputOverflowMsgs : metrics dead-lettered because an output's queue was full (per output URL)
+func outputOverflowMsgs(writePath string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`output_overflow_msg_total{writepath=%q}`, writePath))
+}
+
+// outputDroppedMsgs : metrics dropped because both an output's queue and its dead letter queue were full (per output URL)
+func outputDroppedMsgs(writePath string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`output_dropped_msg_total{writepath=%q}`, writePath))
+}
+
+// shardedMsgs : metrics routed to an output by consistent hashing (per output URL)
+func shardedMsgs(writePath string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`shard_routed_msg_total{writepath=%q}`, writePath))
+}
+
+// shardFailoverMsgs : metrics routed to an output because one of their series' own outputs was failing (per output URL)
+func shardFailoverMsgs(writePath string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`shard_failover_msg_total{writepath=%q}`, writePath))
+}
+
+// decompressedMsgs : messages from Kafka we decompressed (per encoding)
+func decompressedMsgs(encoding string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`decompressed_msg_total{encoding=%q}`, encoding))
+}
+
+// mixedMsgs : messages from mixed topics (per detected format)
+func mixedMsgs(format string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`mixed_format_msg_total{format=%q}`, format))
+}
+
 //StatsListener : Actually expose an endpoint for stats to be scraped
 func StatsListener(address string, port string) {
 	http.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
 		metrics.WritePrometheus(w, true)
 	})
+	http.HandleFunc("/healthz", healthHandler((*Pipeline).Liveness))
+	http.HandleFunc("/readyz", healthHandler((*Pipeline).Readiness))
 	err := http.ListenAndServe(fmt.Sprintf("%v:%v", address, port), nil)
 	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Fatal("Couldn't start stats listener")
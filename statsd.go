@@ -0,0 +1,427 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StatsD metric types (and the metric_type tags we give their aggregates)
+const (
+	statsdCounter = "counter"
+	statsdTimer   = "timing"
+	statsdGauge   = "gauge"
+	statsdSet     = "set"
+	// DefaultStatsdFlushInterval defines how frequently (in seconds) we emit StatsD aggregates
+	DefaultStatsdFlushInterval = 10
+	// DefaultStatsdGaugeExpiry defines how many flushes a gauge can go without an update before we forget it
+	DefaultStatsdGaugeExpiry = 60
+	// largest UDP packet we'll read from StatsD clients
+	statsdMaxPacket = 64 * 1024
+	// how frequently the UDP listener checks whether it should stop
+	statsdReadTimeout = time.Second
+)
+
+var (
+	// DefaultStatsdPercentiles defines which percentiles we calculate for timers
+	DefaultStatsdPercentiles = []float64{90}
+	statsdTypes              = map[string]string{"c": statsdCounter, "ms": statsdTimer, "h": statsdTimer, "d": statsdTimer, "g": statsdGauge, "s": statsdSet}
+	errNoStatsdMetrics       = errors.New("message has no usable statsd metrics")
+)
+
+// statsdSample : a single value from a StatsD line
+type statsdSample struct {
+	name     string
+	kind     string
+	value    float64
+	member   string
+	rate     float64
+	relative bool
+	tags     map[string]string
+}
+
+/*
+parseStatsdLine reads a single (Dog)StatsD line: `name:value|type[|@rate][|#tag:value,tag]`.
+DogStatsD lets a line carry several values (`name:1:2:3|ms`), which become separate samples.
+Other DogStatsD extensions (container IDs, timestamps) are ignored.
+*/
+func parseStatsdLine(line string) ([]statsdSample, error) {
+	colon := strings.IndexByte(line, ':')
+	pipe := strings.IndexByte(line, '|')
+	if colon < 1 || pipe < colon {
+		return nil, fmt.Errorf("bad statsd line %q", line)
+	}
+	name := line[:colon]
+	parts := strings.Split(line[colon+1:], "|")
+	kind, ok := statsdTypes[parts[1]]
+	if !ok {
+		return nil, fmt.Errorf("unknown statsd type %q in %q", parts[1], line)
+	}
+	rate := 1.0
+	tags := map[string]string{"metric_type": kind}
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			parsed, err := strconv.ParseFloat(part[1:], 64)
+			if err != nil || parsed <= 0 || parsed > 1 {
+				return nil, fmt.Errorf("bad sample rate %q in %q", part, line)
+			}
+			rate = parsed
+		case strings.HasPrefix(part, "#"):
+			for _, tag := range strings.Split(part[1:], ",") {
+				if tag == "" {
+					continue
+				}
+				if sep := strings.IndexByte(tag, ':'); sep > 0 {
+					tags[tag[:sep]] = tag[sep+1:]
+				} else {
+					tags[tag] = "true"
+				}
+			}
+		}
+	}
+	var samples []statsdSample
+	for _, raw := range strings.Split(parts[0], ":") {
+		sample := statsdSample{name: name, kind: kind, rate: rate, tags: tags}
+		if kind == statsdSet {
+			sample.member = raw
+		} else {
+			value, err := strconv.ParseFloat(raw, 64)
+			if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+				return nil, fmt.Errorf("bad value %q in %q", raw, line)
+			}
+			sample.value = value
+			// gauges with a sign are adjustments to the current value
+			sample.relative = kind == statsdGauge && (strings.HasPrefix(raw, "+") || strings.HasPrefix(raw, "-"))
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// statsdSeries : everything we've aggregated for a single metric (name, type and tags) since the last flush
+type statsdSeries struct {
+	name    string
+	kind    string
+	tags    map[string]string
+	updated bool
+	// flushes since a gauge was last updated
+	idle    int
+	sum     float64
+	count   float64
+	values  []float64
+	members map[string]bool
+	gauge   float64
+}
+
+/*
+statsdAggregator :
+Aggregates StatsD samples the way the statsd daemon does, for every processing
+thread (and UDP listener) on a write path. Each flush emits one metric per series
+updated since the last flush, then starts over. Gauges remember their last value,
+so relative updates keep working, but are only emitted when they're updated
+(and forgotten once they go gaugeExpiry flushes without one).
+*/
+type statsdAggregator struct {
+	lock            sync.Mutex
+	interval        time.Duration
+	gaugeExpiry     int
+	percentiles     []float64
+	flipSingleField bool
+	series          map[string]*statsdSeries
+}
+
+// NewStatsdAggregator : build an aggregator that flushes every interval seconds (and forgets gauges after gaugeExpiry idle flushes)
+func NewStatsdAggregator(interval float64, gaugeExpiry int, percentiles []float64, flipSingleField bool) (*statsdAggregator, error) {
+	if interval <= 0 {
+		interval = DefaultStatsdFlushInterval
+	}
+	if gaugeExpiry <= 0 {
+		gaugeExpiry = DefaultStatsdGaugeExpiry
+	}
+	if len(percentiles) == 0 {
+		percentiles = DefaultStatsdPercentiles
+	}
+	for _, p := range percentiles {
+		if p <= 0 || p > 100 {
+			return nil, fmt.Errorf("statsd percentile %v isn't between 0 and 100", p)
+		}
+	}
+	return &statsdAggregator{interval: time.Duration(interval * float64(time.Second)), gaugeExpiry: gaugeExpiry, percentiles: percentiles,
+		flipSingleField: flipSingleField, series: make(map[string]*statsdSeries)}, nil
+}
+
+// seriesKey : a series' name, type and (sorted) tags
+func seriesKey(sample statsdSample) string {
+	keys := make([]string, 0, len(sample.tags))
+	for key := range sample.tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var key strings.Builder
+	key.WriteString(sample.name)
+	for _, tag := range keys {
+		fmt.Fprintf(&key, ",%v=%v", tag, sample.tags[tag])
+	}
+	return key.String()
+}
+
+// Add : aggregate samples until the next flush
+func (a *statsdAggregator) Add(samples []statsdSample) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, sample := range samples {
+		key := seriesKey(sample)
+		series, ok := a.series[key]
+		if !ok {
+			series = &statsdSeries{name: sample.name, kind: sample.kind, tags: sample.tags, members: make(map[string]bool)}
+			a.series[key] = series
+		}
+		series.updated = true
+		series.idle = 0
+		switch sample.kind {
+		case statsdCounter:
+			series.sum += sample.value / sample.rate
+		case statsdTimer:
+			series.values = append(series.values, sample.value)
+			series.sum += sample.value
+			series.count += 1 / sample.rate
+		case statsdGauge:
+			if sample.relative {
+				series.gauge += sample.value
+			} else {
+				series.gauge = sample.value
+			}
+		case statsdSet:
+			series.members[sample.member] = true
+		}
+	}
+}
+
+// percentileField : the field name for a percentile (90 -> 90_percentile, 99.9 -> 99_9_percentile)
+func percentileField(p float64) string {
+	return strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", 1) + "_percentile"
+}
+
+// timerFields : summary statistics for the timings in a flush interval
+func (a *statsdAggregator) timerFields(series *statsdSeries) map[string]interface{} {
+	values := series.values
+	sort.Float64s(values)
+	n := float64(len(values))
+	mean := series.sum / n
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	median := values[len(values)/2]
+	if len(values)%2 == 0 {
+		median = (values[len(values)/2-1] + values[len(values)/2]) / 2
+	}
+	fields := map[string]interface{}{"count": series.count, "lower": values[0], "upper": values[len(values)-1],
+		"mean": mean, "median": median, "stddev": math.Sqrt(variance / n), "sum": series.sum}
+	for _, p := range a.percentiles {
+		// nearest rank
+		rank := int(math.Ceil(p/100*n)) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		fields[percentileField(p)] = values[rank]
+	}
+	return fields
+}
+
+/*
+Flush emits (and resets) everything aggregated since the last flush.
+Counters have the total (adjusted for sample rates) and a per second rate,
+timers their count/lower/upper/mean/median/stddev/sum and percentiles,
+gauges their current value and sets how many unique values they saw.
+Gauges that have gone gaugeExpiry flushes without an update are forgotten,
+so short-lived tag values don't pile up forever.
+*/
+func (a *statsdAggregator) Flush(now time.Time) []InfluxMetric {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var metrics []InfluxMetric
+	for key, series := range a.series {
+		if !series.updated {
+			series.idle++
+			if series.idle >= a.gaugeExpiry {
+				delete(a.series, key)
+			}
+			continue
+		}
+		metric := InfluxMetric{Name: series.name, Tags: copyTags(series.tags), Timestamp: now.Unix()}
+		switch series.kind {
+		case statsdCounter:
+			metric.Fields = map[string]interface{}{"value": series.sum, "rate": series.sum / a.interval.Seconds()}
+		case statsdTimer:
+			metric.Fields = a.timerFields(series)
+		case statsdGauge:
+			metric.Fields = map[string]interface{}{"value": series.gauge}
+		case statsdSet:
+			metric.Fields = map[string]interface{}{"value": int64(len(series.members))}
+		}
+		metrics = append(metrics, flipInfluxJSON(metric, a.flipSingleField))
+		if series.kind == statsdGauge {
+			series.updated = false
+		} else {
+			delete(a.series, key)
+		}
+	}
+	return metrics
+}
+
+/*
+FlushStatsd emits aggregates every flush interval until we're told to stop.
+The final flush happens during shutdown, once every processing thread is done.
+*/
+func FlushStatsd(ctx context.Context, aggregator *statsdAggregator, outChannel chan InfluxMetric, wg *Stage) {
+	log.WithFields(log.Fields{"interval": aggregator.interval, "section": "statsd"}).Info("Starting statsd flush thread...")
+	defer wg.Done()
+	ticker := time.NewTicker(aggregator.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, metric := range aggregator.Flush(now) {
+				outChannel <- metric
+			}
+		case <-ctx.Done():
+			log.WithFields(log.Fields{"section": "statsd"}).Info("Closing statsd flush thread...")
+			return
+		}
+	}
+}
+
+/*
+addStatsdLines aggregates every line of a message (or UDP packet).
+Bad lines are dropped on their own, like bad metrics in an influx JSON batch.
+The message only fails to parse if none of it could be used.
+*/
+func addStatsdLines(thread int, msg []byte, aggregator *statsdAggregator) error {
+	var samples []statsdSample
+	bad := 0
+	scanner := bufio.NewScanner(bytes.NewReader(msg))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(msg)+1)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		// DogStatsD events and service checks aren't metrics
+		if strings.HasPrefix(line, "_e{") || strings.HasPrefix(line, "_sc|") {
+			DroppedMsgs.Inc()
+			continue
+		}
+		parsed, err := parseStatsdLine(line)
+		if err != nil {
+			ParseFailedElements.Inc()
+			bad++
+			log.WithFields(log.Fields{"threadNum": thread, "error": err, "section": "statsd processing"}).Warning("Dropped bad statsd line")
+			continue
+		}
+		samples = append(samples, parsed...)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(samples) == 0 && bad > 0 {
+		return errNoStatsdMetrics
+	}
+	aggregator.Add(samples)
+	return nil
+}
+
+/*
+ProcessStatsdMsg : aggregate StatsD messages
+Aggregated messages count as delivered right away (their metrics only exist once we flush),
+so a crash loses at most a flush interval's worth of StatsD data, just like the statsd daemon.
+*/
+func ProcessStatsdMsg(ctx context.Context, thread int, inChannel chan KafkaMsg, parseFailedChan chan ParseFailure, aggregator *statsdAggregator, wg *Stage) {
+	log.WithFields(log.Fields{"threadNum": thread, "section": "statsd processing"}).Info("processing thread starting...")
+	defer wg.Done()
+	process := func(msg KafkaMsg) {
+		ProcTimeStart := time.Now()
+		ReceivedMsgs.Inc()
+		err := addStatsdLines(thread, msg.Value, aggregator)
+		ProcessTime.Add(float64(time.Now().Sub(ProcTimeStart)) / TimeSegmentDivisor)
+		handleParsed(msg, FormatStatsd, nil, err, nil, parseFailedChan)
+	}
+
+processloop:
+	for {
+		select {
+		case msg := <-inChannel:
+			process(msg)
+		case <-ctx.Done():
+			log.WithFields(log.Fields{"threadNum": thread, "section": "statsd processing"}).Info("Closing processing thread...")
+			for msg := range inChannel {
+				process(msg)
+			}
+			break processloop
+		}
+	}
+}
+
+// ListenStatsd : aggregate StatsD packets sent straight to us over UDP
+func ListenStatsd(ctx context.Context, address string, aggregator *statsdAggregator, wg *Stage) {
+	defer wg.Done()
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		log.WithFields(log.Fields{"address": address, "error": err, "section": "statsd listener"}).Fatal("Couldn't listen for statsd packets")
+	}
+	defer conn.Close()
+	log.WithFields(log.Fields{"address": conn.LocalAddr(), "section": "statsd listener"}).Info("Listening for statsd packets...")
+	buf := make([]byte, statsdMaxPacket)
+	for ctx.Err() == nil {
+		conn.SetReadDeadline(time.Now().Add(statsdReadTimeout))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				log.WithFields(log.Fields{"error": err, "section": "statsd listener"}).Error("Couldn't read statsd packet")
+			}
+			continue
+		}
+		IngestMsgs.Inc()
+		ReceivedMsgs.Inc()
+		if err := addStatsdLines(0, buf[:n], aggregator); err != nil {
+			ParseFailures.Inc()
+		}
+	}
+	log.WithFields(log.Fields{"section": "statsd listener"}).Info("Closing statsd listener...")
+}
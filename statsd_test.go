@@ -0,0 +1,109 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+Things we should check:
+1. counters are summed (scaled by sample rates) with a per second rate
+2. timers get count/lower/upper/mean/median/stddev/sum and percentiles
+3. gauges keep their last value (and relative updates work across flushes) until they expire, sets count unique values
+4. DogStatsD tags become tags, and each tag set is its own series
+5. bad lines are dropped on their own, messages with nothing usable fail to parse
+*/
+func TestStatsd(t *testing.T) {
+	aggregator, err := NewStatsdAggregator(10, 3, []float64{90, 99.9}, false)
+	if err != nil {
+		t.Fatalf("Couldn't create aggregator: %v", err)
+	}
+	msgs := []string{
+		"requests:1|c|#env:prod,canary\nrequests:2|c|@0.5|#canary,env:prod\nrequests:5|c|#env:dev\n",
+		"latency:10:20:30|ms\nlatency:40|h\nbroken line\nqueue:5|g\nqueue:+3|g\nusers:alice|s\nusers:bob|s\nusers:alice|s\n",
+		"_e{5,4}:title|text\n",
+	}
+	for _, msg := range msgs {
+		if err := addStatsdLines(1, []byte(msg), aggregator); err != nil {
+			t.Fatalf("Couldn't aggregate %q: %v", msg, err)
+		}
+	}
+	now := time.Unix(1637047250, 0)
+	results := make(map[string]InfluxMetric)
+	for _, metric := range aggregator.Flush(now) {
+		results[metric.Name+","+metric.Tags["env"]] = metric
+	}
+	if len(results) != 5 {
+		t.Fatalf("series count is wrong: %v -> should be 5 (%+v)", len(results), results)
+	}
+	prod := results["requests,prod"]
+	if prod.Fields["value"].(float64) != 5 || prod.Fields["rate"].(float64) != 0.5 || prod.Tags["canary"] != "true" ||
+		prod.Tags["metric_type"] != "counter" || prod.Timestamp != now.Unix() {
+		t.Fatalf("counter is wrong: %+v", prod)
+	}
+	if results["requests,dev"].Fields["value"].(float64) != 5 {
+		t.Fatalf("tagged counter is wrong: %+v", results["requests,dev"])
+	}
+	latency := results["latency,"]
+	if latency.Fields["count"].(float64) != 4 || latency.Fields["lower"].(float64) != 10 || latency.Fields["upper"].(float64) != 40 ||
+		latency.Fields["mean"].(float64) != 25 || latency.Fields["median"].(float64) != 25 || latency.Fields["sum"].(float64) != 100 ||
+		latency.Fields["90_percentile"].(float64) != 40 || latency.Fields["99_9_percentile"].(float64) != 40 {
+		t.Fatalf("timer is wrong: %+v", latency)
+	}
+	if results["queue,"].Fields["value"].(float64) != 8 || results["users,"].Fields["value"].(int64) != 2 {
+		t.Fatalf("gauge or set is wrong: %+v %+v", results["queue,"], results["users,"])
+	}
+	if flushed := aggregator.Flush(now); len(flushed) != 0 {
+		t.Fatalf("nothing was updated, but we flushed %+v", flushed)
+	}
+	if err := addStatsdLines(1, []byte("queue:-2|g"), aggregator); err != nil {
+		t.Fatalf("Couldn't aggregate gauge: %v", err)
+	}
+	if flushed := aggregator.Flush(now); len(flushed) != 1 || flushed[0].Fields["value"].(float64) != 6 {
+		t.Fatalf("relative gauge is wrong: %+v", flushed)
+	}
+	for i := 0; i < 3; i++ {
+		aggregator.Flush(now)
+	}
+	if len(aggregator.series) != 0 {
+		t.Fatalf("idle gauge didn't expire: %+v", aggregator.series)
+	}
+	if err := addStatsdLines(1, []byte("queue:+1|g"), aggregator); err != nil {
+		t.Fatalf("Couldn't aggregate gauge: %v", err)
+	}
+	if flushed := aggregator.Flush(now); len(flushed) != 1 || flushed[0].Fields["value"].(float64) != 1 {
+		t.Fatalf("expired gauge should start over: %+v", flushed)
+	}
+
+	for _, bad := range []string{"requests:1|x\n", "requests|c\n", "requests:one|c\n", "requests:1|c|@2\n"} {
+		if err := addStatsdLines(1, []byte(bad), aggregator); err == nil {
+			t.Fatalf("%q should fail to parse", bad)
+		}
+	}
+	if _, err := NewStatsdAggregator(10, 0, []float64{101}, false); err == nil {
+		t.Fatalf("percentiles over 100 should be refused")
+	}
+}
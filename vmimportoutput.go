@@ -0,0 +1,74 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+
+	json "github.com/json-iterator/go"
+)
+
+// vmImportLine : a single series in VictoriaMetrics' JSON line import format
+type vmImportLine struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []float64         `json:"values"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+// newVMImportWriter : a writer for a VictoriaMetrics /api/v1/import endpoint
+func newVMImportWriter(url string, timeout uint) *SeriesWriter {
+	return newSeriesWriter(url, timeout, map[string]string{
+		"Content-Encoding": "gzip",
+		"Content-Type":     "application/stream+json",
+	}, encodeVMImport)
+}
+
+// encodeVMImport : a gzipped JSON line (one line per series) import request for the batch
+func encodeVMImport(b *seriesBatch) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(gz)
+	var err error
+	b.each(func(series *outputSeries) {
+		if err != nil {
+			return
+		}
+		line := vmImportLine{Metric: make(map[string]string, len(series.labels)),
+			Values: make([]float64, 0, len(series.samples)), Timestamps: make([]int64, 0, len(series.samples))}
+		for _, label := range series.labels {
+			line.Metric[label[0]] = label[1]
+		}
+		for _, sample := range series.samples {
+			line.Values = append(line.Values, sample.Value)
+			line.Timestamps = append(line.Timestamps, sample.Timestamp)
+		}
+		err = enc.Encode(line)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = gz.Close()
+	return buf.Bytes(), err
+}
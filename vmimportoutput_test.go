@@ -0,0 +1,91 @@
+/*This file is part of sisyphus.
+ *
+ * Copyright Datto, Inc.
+ * Author: John Seekins <jseekins@datto.com>
+ *
+ * Licensed under the GNU General Public License Version 3
+ * Fedora-License-Identifier: GPLv3+
+ * SPDX-2.0-License-Identifier: GPL-3.0+
+ * SPDX-3.0-License-Identifier: GPL-3.0-or-later
+ *
+ * sisyphus is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * sisyphus is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with sisyphus.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	json "github.com/json-iterator/go"
+)
+
+/*
+Things we should check:
+1. every series is a single JSON line, with all of its samples grouped
+2. names are <name>_<field> (or just the name for `value` fields) without flip_single_fields
+3. tags become labels, timestamps are in milliseconds
+*/
+func TestVMImportWriter(t *testing.T) {
+	var lines []vmImportLine
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("Import request isn't gzipped: %v", req.Header)
+		}
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			t.Errorf("Couldn't decompress import request: %v", err)
+			return
+		}
+		scanner := bufio.NewScanner(gz)
+		for scanner.Scan() {
+			var line vmImportLine
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				t.Errorf("Bad import line %q: %v", scanner.Text(), err)
+			}
+			lines = append(lines, line)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	writer := newVMImportWriter(server.URL, 5)
+	defer writer.Close()
+	ts := time.Unix(1637090544, 0)
+	err := writer.WritePoint(context.Background(),
+		influxdb2.NewPoint("disk", map[string]string{"path": "/"}, map[string]interface{}{"used": 10}, ts),
+		influxdb2.NewPoint("disk", map[string]string{"path": "/"}, map[string]interface{}{"used": 11}, ts.Add(time.Second)),
+		influxdb2.NewPoint("disk", map[string]string{"path": "/var"}, map[string]interface{}{"used": 12}, ts),
+		influxdb2.NewPoint("load", nil, map[string]interface{}{"value": 0.5}, ts))
+	if err != nil {
+		t.Fatalf("Couldn't write points: %v", err)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("Wrong number of series imported: %v -> should be 3", lines)
+	}
+	root := lines[0]
+	if root.Metric["__name__"] != "disk_used" || root.Metric["path"] != "/" {
+		t.Fatalf("Wrong series labels: %v -> should be disk_used{path=\"/\"}", root.Metric)
+	}
+	if len(root.Values) != 2 || root.Values[1] != 11 || root.Timestamps[0] != 1637090544000 || root.Timestamps[1] != 1637090545000 {
+		t.Fatalf("Wrong samples for disk_used{path=\"/\"}: %v %v", root.Values, root.Timestamps)
+	}
+	if lines[2].Metric["__name__"] != "load" || len(lines[2].Metric) != 1 {
+		t.Fatalf("Wrong series for a value field: %v -> should be load", lines[2].Metric)
+	}
+}